@@ -6,63 +6,51 @@ import (
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"lib"
 	"log"
 	"net/http"
 )
 
+var deps *lib.Deps
+
 type (
 	ACKMessage struct {
 		Action  string `json:"action"`
+		Channel string `json:"channel"`
 		OrderID string `json:"order_id"`
 	}
 )
 
 func handler(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Load AWS config
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: 500, Body: fmt.Sprintf(`{"message":"%v"}`, err)}, nil
-	}
-
-	// Initialize DynamoDB client
-	dynamoClient := dynamodb.NewFromConfig(cfg)
-	endpoint := fmt.Sprintf("https://%s/%s", event.RequestContext.DomainName, event.RequestContext.Stage)
-
-	log.Printf("Complete URL: %s", endpoint)
+	ctx, logger := deps.RequestLogger(ctx, event)
+	metrics := deps.RequestMetrics(event)
+	defer metrics.Flush()
 
 	var msg ACKMessage
-	err = json.Unmarshal([]byte(event.Body), &msg)
+	err := json.Unmarshal([]byte(event.Body), &msg)
 	if err != nil {
-		log.Printf("Error parsing WebSocket message: %v", err)
+		logger.Warn("failed to parse WebSocket message", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
 	}
 
-	log.Printf("Received body: %s", msg)
+	logger.Debug("received message", "message", msg)
 
-	if msg.OrderID == "" {
-		log.Printf("empty order id")
+	channel, err := lib.ResolveChannel(msg.Channel, msg.OrderID)
+	if err != nil {
+		logger.Warn("invalid channel", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
 	}
 
-	_, err = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-		Key: map[string]types.AttributeValue{
-			"eventId": &types.AttributeValueMemberS{Value: msg.OrderID},
-		},
-		TableName: aws.String("WebSocketMessages"),
-	})
-
+	err = deps.Store.DeleteMessage(ctx, channel.Key())
 	if err != nil {
-		log.Printf("DynamoDB error: %v", err)
+		logger.Error("failed to delete message", "error", err)
+		metrics.Count("AckErrors", 1)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 400,
 			Body:       fmt.Sprintf("cannot delete item"),
 		}, nil
 	}
+	metrics.Count("Acks", 1)
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 		Body:       `{"message": "Message sent successfully"}`,
@@ -70,5 +58,10 @@ func handler(ctx context.Context, event events.APIGatewayWebsocketProxyRequest)
 }
 
 func main() {
-	lambda.Start(handler)
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       any
+		storeErr   error
+		wantStatus int
+		wantLeft   bool
+	}{
+		{name: "deletes the status", body: lib.Request{Action: "ack", OrderID: "42"}, wantStatus: 200},
+		{name: "deletes the status of the order channel", body: lib.Request{Action: "ack", Channel: "order:42"}, wantStatus: 200},
+		{name: "other channel", body: lib.Request{Action: "ack", Channel: "shipment:42"}, wantStatus: 200, wantLeft: true},
+		{name: "invalid channel", body: lib.Request{Action: "ack", Channel: "refund:42"}, wantStatus: 400, wantLeft: true},
+		{name: "invalid body", body: "{", wantStatus: 400, wantLeft: true},
+		{name: "missing order", body: lib.Request{Action: "ack"}, wantStatus: 400, wantLeft: true},
+		{name: "store failure", body: lib.Request{Action: "ack", OrderID: "42"}, storeErr: errors.New("throttled"), wantStatus: 400, wantLeft: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Deps.Publish(ctx, lib.StoredMessage{MessageData: lib.MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED"}})
+			h.Store.Fail("DeleteMessage", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message("c1", "ack", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			_, err = h.Store.GetMessage(ctx, "42")
+			if left := err == nil; left != tt.wantLeft {
+				t.Fatalf("status left = %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
@@ -5,75 +5,120 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"lib"
 )
 
 type RequestBody struct {
+	Channel string `json:"channel"`
 	OrderID string `json:"order_id"`
+	// Filter selects the statuses the connection gets, see lib.ParseFilter.
+	Filter string `json:"filter"`
 }
 
 type Response struct {
 	Message      string `json:"message"`
 	ConnectionID string `json:"connectionId"`
-	OrderID      string `json:"orderId"`
+	Channel      string `json:"channel"`
+	OrderID      string `json:"orderId,omitempty"`
 }
 
-var dynamoClient *dynamodb.Client
+var deps *lib.Deps
 
 func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Extract orderId from query string or body
-	orderID := request.QueryStringParameters["order_id"]
-	if orderID == "" {
-		var body RequestBody
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+
+	// Extract the channel, or the order of older clients, from query string or body
+	body := RequestBody{
+		Channel: request.QueryStringParameters["channel"],
+		OrderID: request.QueryStringParameters["order_id"],
+		Filter:  request.QueryStringParameters["filter"],
+	}
+	if body.Channel == "" && body.OrderID == "" {
 		err := json.Unmarshal([]byte(request.Body), &body)
 		if err != nil {
-			log.Printf("Failed to parse request body: %v", err)
+			logger.Warn("failed to parse request body", "error", err)
 			return events.APIGatewayProxyResponse{
 				StatusCode: 400,
 				Body:       fmt.Sprintf(`{"message":"Invalid request body"}`),
 			}, nil
 		}
-		orderID = body.OrderID
+	}
+	channel, err := lib.ResolveChannel(body.Channel, body.OrderID)
+	if err != nil {
+		logger.Warn("invalid channel", "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf(`{"message":%q}`, err.Error()),
+		}, nil
+	}
+
+	filter, err := lib.ParseFilter(body.Filter)
+	if err != nil {
+		logger.Warn("invalid filter", "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf(`{"message":%q}`, err.Error()),
+		}, nil
 	}
 
-	// Prepare the item to store in DynamoDB
-	item := map[string]types.AttributeValue{
-		"connectionId": &types.AttributeValueMemberS{Value: request.RequestContext.ConnectionID},
-		"orderId":      &types.AttributeValueMemberS{Value: orderID},
+	// Frames pushed to the connection are encoded for the subprotocol
+	subprotocol, err := lib.NegotiateSubprotocol(request)
+	if err != nil {
+		logger.Warn("unsupported subprotocol", "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf(`{"message":%q}`, err.Error()),
+		}, nil
 	}
 
-	// Insert into DynamoDB
-	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String("WebSocketConnections"),
-		Item:      item,
-	})
+	conn := lib.NewConnection(request, channel, time.Now())
+	conn.Filter = filter.String()
+	conn.Subprotocol = subprotocol
+	err = deps.Join(ctx, conn)
 	if err != nil {
-		log.Printf("DynamoDB error: %v", err)
+		logger.Error("failed to save connection", "error", err)
+		metrics.Count("ConnectErrors", 1)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Body:       fmt.Sprintf(`{"message":"Error saving connection","error":"%v"}`, err),
 		}, nil
 	}
 
+	metrics.Count("Connects", 1)
+
 	// Return success response
 	response := Response{
 		Message:      "Connection saved",
 		ConnectionID: request.RequestContext.ConnectionID,
-		OrderID:      orderID,
+		Channel:      channel.String(),
+	}
+	if channel.Type == lib.ChannelOrder {
+		response.OrderID = channel.ID
 	}
 	responseBody, _ := json.Marshal(response)
 
-	return events.APIGatewayProxyResponse{
+	resp := events.APIGatewayProxyResponse{
 		StatusCode: 200,
 		Body:       string(responseBody),
-	}, nil
+	}
+	if subprotocol != "" {
+		// API Gateway fails the handshake unless the choice is echoed
+		resp.Headers = map[string]string{lib.HeaderSubprotocol: subprotocol}
+	}
+	return resp, nil
 }
 
 func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	lambda.Start(handler)
 }
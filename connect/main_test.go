@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      events.APIGatewayWebsocketProxyRequest
+		storeErr   error
+		wantStatus int
+		wantOrder  string // key of the channel
+		wantMetric string
+	}{
+		{
+			name:       "order from the query string",
+			event:      wstest.Connect("c1").Query("order_id", "42").Request(),
+			wantStatus: 200,
+			wantOrder:  "42",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "order from the body",
+			event:      wstest.Connect("c1").Body(RequestBody{OrderID: "7"}).Request(),
+			wantStatus: 200,
+			wantOrder:  "7",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "channel from the query string",
+			event:      wstest.Connect("c1").Query("channel", "shipment:S1").Request(),
+			wantStatus: 200,
+			wantOrder:  "shipment:S1",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "customer channel",
+			event:      wstest.Connect("c1").Query("channel", "customer:C1").Request(),
+			wantStatus: 200,
+			wantOrder:  "customer:C1",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "order channel from the body",
+			event:      wstest.Connect("c1").Body(RequestBody{Channel: "order:7"}).Request(),
+			wantStatus: 200,
+			wantOrder:  "7",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "unknown channel type",
+			event:      wstest.Connect("c1").Query("channel", "invoice:1").Request(),
+			wantStatus: 400,
+		},
+		{
+			name:       "invalid filter",
+			event:      wstest.Connect("c1").Query("order_id", "42").Query("filter", "status in (SHIPPED").Request(),
+			wantStatus: 400,
+		},
+		{
+			name:       "empty body",
+			event:      wstest.Connect("c1").Body(RequestBody{}).Request(),
+			wantStatus: 400,
+		},
+		{
+			name:       "neither query nor body",
+			event:      wstest.Connect("c1").Request(),
+			wantStatus: 400,
+		},
+		{
+			name:       "subprotocol",
+			event:      wstest.Connect("c1").Query("order_id", "42").Header("Sec-WebSocket-Protocol", "orders.v1.msgpack, orders.v1.json").Request(),
+			wantStatus: 200,
+			wantOrder:  "42",
+			wantMetric: "Connects",
+		},
+		{
+			name:       "unsupported subprotocol",
+			event:      wstest.Connect("c1").Query("order_id", "42").Header("Sec-WebSocket-Protocol", "graphql-ws").Request(),
+			wantStatus: 400,
+		},
+		{
+			name:       "store failure",
+			event:      wstest.Connect("c1").Query("order_id", "42").Request(),
+			storeErr:   errors.New("throttled"),
+			wantStatus: 500,
+			wantMetric: "ConnectErrors",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Store.Fail("PutConnection", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if tt.wantMetric != "" && h.Metric(tt.wantMetric) != 1 {
+				t.Errorf("expected %s to be counted", tt.wantMetric)
+			}
+			if offered := tt.event.Headers[lib.HeaderSubprotocol]; offered != "" && resp.StatusCode == 200 &&
+				resp.Headers[lib.HeaderSubprotocol] != lib.SubprotocolMsgpack {
+				t.Errorf("got headers %v, want the first subprotocol offered", resp.Headers)
+			}
+			if tt.wantOrder == "" {
+				return
+			}
+			conns, _ := h.Store.ConnectionsForChannel(ctx, tt.wantOrder)
+			if len(conns) != 1 || conns[0].ConnectionID != "c1" || conns[0].Channel != tt.wantOrder || conns[0].LastSeen.IsZero() {
+				t.Fatalf("got connections %+v", conns)
+			}
+			if want, _ := lib.NegotiateSubprotocol(tt.event); conns[0].Subprotocol != want {
+				t.Errorf("got subprotocol %q, want %q", conns[0].Subprotocol, want)
+			}
+		})
+	}
+}
+
+func TestHandlerRecordsCaller(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	deps = h.Deps
+
+	event := wstest.Connect("c1").
+		Query("order_id", "42").
+		Query("client_version", "web/1.4.0").
+		Query("filter", "DELIVERED,CANCELLED").
+		Header("X-Protocol-Version", lib.ProtocolVersion).
+		SourceIP("203.0.113.7").
+		UserAgent("Mozilla/5.0").
+		Authorizer("user123", nil).
+		Request()
+	before := time.Now()
+	if resp, err := handler(ctx, event); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+
+	conns, _ := h.Store.ConnectionsForChannel(ctx, "42")
+	if len(conns) != 1 {
+		t.Fatalf("got connections %+v", conns)
+	}
+	conn := conns[0]
+	if conn.SourceIP != "203.0.113.7" || conn.UserAgent != "Mozilla/5.0" || conn.Principal != "user123" ||
+		conn.ClientVersion != "web/1.4.0" || conn.ProtocolVersion != lib.ProtocolVersion || conn.Filter != "DELIVERED,CANCELLED" {
+		t.Errorf("got %+v", conn)
+	}
+	if conn.ConnectedAt.Before(before.Truncate(time.Second)) || !conn.ExpiresAt.Equal(conn.ConnectedAt.Add(lib.MaxConnectionDuration)) {
+		t.Errorf("got connected at %s, expiring at %s", conn.ConnectedAt, conn.ExpiresAt)
+	}
+}
+
+func TestHandlerLeavesJoinToTheStream(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "merchant", Channel: "42"})
+	deps = h.Deps
+
+	if resp, err := handler(ctx, wstest.Connect("c1").Query("order_id", "42").Request()); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+	// The watchers Lambda announces the join once the count includes it
+	if posts := h.API.Posts(); len(posts) != 0 {
+		t.Fatalf("got posts %+v", posts)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"lib"
+	"log"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type (
+	// Command is the event the function is invoked with, e.g.
+	// {"action":"replay","ids":["..."]}. Without ids, replay and purge act on
+	// every dead letter, purge only when all is set.
+	Command struct {
+		Action string   `json:"action"`
+		IDs    []string `json:"ids,omitempty"`
+		Limit  int      `json:"limit,omitempty"`
+		All    bool     `json:"all,omitempty"`
+	}
+	Result struct {
+		DeadLetters []lib.DeadLetter `json:"dead_letters,omitempty"`
+		Replayed    int              `json:"replayed,omitempty"`
+		Failed      int              `json:"failed,omitempty"`
+		Purged      int              `json:"purged,omitempty"`
+	}
+)
+
+var deps *lib.Deps
+
+func handler(ctx context.Context, cmd Command) (Result, error) {
+	store := deps.DeadLetters
+	logger := deps.Logger.With("action", cmd.Action)
+
+	switch cmd.Action {
+	case "list":
+		dls, err := store.List(ctx, cmd.Limit)
+		return Result{DeadLetters: dls}, err
+
+	case "replay":
+		dls, err := selectDeadLetters(ctx, store, cmd)
+		if err != nil {
+			return Result{}, err
+		}
+		var result Result
+		for _, dl := range dls {
+			if err := deps.Replay(ctx, store, dl); err != nil {
+				logger.Warn("replay failed", "id", dl.ID, "target", dl.ConnectionID, "webhook", dl.WebhookID, "error", err)
+				result.Failed++
+				continue
+			}
+			result.Replayed++
+		}
+		return result, nil
+
+	case "purge":
+		if len(cmd.IDs) == 0 && !cmd.All {
+			return Result{}, errors.New("purge needs ids or all")
+		}
+		dls, err := selectDeadLetters(ctx, store, cmd)
+		if err != nil {
+			return Result{}, err
+		}
+		var result Result
+		for _, dl := range dls {
+			if err := store.Delete(ctx, dl.ID); err != nil {
+				return result, err
+			}
+			result.Purged++
+		}
+		logger.Info("purged dead letters", "count", result.Purged)
+		return result, nil
+	}
+	return Result{}, fmt.Errorf("unknown action %q", cmd.Action)
+}
+
+func selectDeadLetters(ctx context.Context, store lib.DeadLetterStore, cmd Command) ([]lib.DeadLetter, error) {
+	if len(cmd.IDs) == 0 {
+		return store.List(ctx, cmd.Limit)
+	}
+	dls := make([]lib.DeadLetter, 0, len(cmd.IDs))
+	for _, id := range cmd.IDs {
+		dl, err := store.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", id, err)
+		}
+		dls = append(dls, *dl)
+	}
+	return dls, nil
+}
+
+// runCLI runs a single command from the command line:
+//
+//	deadletter list [-limit n]
+//	deadletter replay [id...]
+//	deadletter purge (-all | id...)
+func runCLI(args []string) error {
+	flags := flag.NewFlagSet("deadletter", flag.ContinueOnError)
+	limit := flags.Int("limit", 0, "maximum number of dead letters to list or replay, 0 for all")
+	all := flags.Bool("all", false, "purge every dead letter")
+	if len(args) == 0 {
+		return errors.New("usage: deadletter list|replay|purge [-limit n] [-all] [id...]")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	result, err := handler(context.Background(), Command{
+		Action: args[0],
+		IDs:    flags.Args(),
+		Limit:  *limit,
+		All:    *all,
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(os.Args) > 1 {
+		if err := runCLI(os.Args[1:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      Command
+		wantErr  bool
+		want     Result
+		wantList int
+		wantLeft []string
+	}{
+		{name: "list", cmd: Command{Action: "list"}, wantList: 2, wantLeft: []string{"ok", "broken"}},
+		{name: "list with a limit", cmd: Command{Action: "list", Limit: 1}, wantList: 1, wantLeft: []string{"ok", "broken"}},
+		{name: "replay all", cmd: Command{Action: "replay"}, want: Result{Replayed: 1, Failed: 1}, wantLeft: []string{"broken"}},
+		{name: "replay by id", cmd: Command{Action: "replay", IDs: []string{"ok"}}, want: Result{Replayed: 1}, wantLeft: []string{"broken"}},
+		{name: "replay unknown id", cmd: Command{Action: "replay", IDs: []string{"nope"}}, wantErr: true, wantLeft: []string{"ok", "broken"}},
+		{name: "purge needs ids or all", cmd: Command{Action: "purge"}, wantErr: true, wantLeft: []string{"ok", "broken"}},
+		{name: "purge by id", cmd: Command{Action: "purge", IDs: []string{"broken"}}, want: Result{Purged: 1}, wantLeft: []string{"ok"}},
+		{name: "purge all", cmd: Command{Action: "purge", All: true}, want: Result{Purged: 2}},
+		{name: "unknown action", cmd: Command{Action: "explode"}, wantErr: true, wantLeft: []string{"ok", "broken"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.API.Fail("c-broken", errors.New("throttled"))
+			for i, id := range []string{"ok", "broken"} {
+				dl := lib.NewDeadLetter(wstest.Endpoint, "c-"+id, lib.MessageData{ID: "m1", OrderID: "42"}, errors.New("throttled"))
+				dl.ID = id
+				dl.FailedAt = time.Date(2024, 5, 1, 10, i, 0, 0, time.UTC)
+				h.DeadLetters.Put(ctx, dl)
+			}
+			deps = h.Deps
+
+			result, err := handler(ctx, tt.cmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if len(result.DeadLetters) != tt.wantList {
+				t.Fatalf("listed %+v, want %d", result.DeadLetters, tt.wantList)
+			}
+			if result.Replayed != tt.want.Replayed || result.Failed != tt.want.Failed || result.Purged != tt.want.Purged {
+				t.Fatalf("got %+v, want %+v", result, tt.want)
+			}
+			left, _ := h.DeadLetters.List(ctx, 0)
+			if len(left) != len(tt.wantLeft) {
+				t.Fatalf("left %+v, want %v", left, tt.wantLeft)
+			}
+			for i, dl := range left {
+				if dl.ID != tt.wantLeft[i] {
+					t.Fatalf("left %+v, want %v", left, tt.wantLeft)
+				}
+			}
+		})
+	}
+}
@@ -5,39 +5,29 @@ import (
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"lib"
 	"log"
 )
 
-func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Initialize DynamoDB client
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-	dynamoClient := dynamodb.NewFromConfig(cfg)
+var deps *lib.Deps
 
-	// Prepare the key for deletion
-	key := map[string]types.AttributeValue{
-		"connectionId": &types.AttributeValueMemberS{Value: request.RequestContext.ConnectionID},
-	}
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
 
-	// Delete the item from DynamoDB
-	_, err = dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-		TableName: aws.String("WebSocketConnections"),
-		Key:       key,
-	})
+	err := deps.Leave(ctx, request.RequestContext.ConnectionID)
 	if err != nil {
-		log.Printf("DynamoDB error: %v", err)
+		logger.Error("failed to delete connection", "error", err)
+		metrics.Count("DisconnectErrors", 1)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Body:       fmt.Sprintf(`{"message":"Error deleting connection","error":"%v"}`, err),
 		}, nil
 	}
 
+	metrics.Count("Disconnects", 1)
+
 	// Return success response
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
@@ -46,5 +36,10 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 }
 
 func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	lambda.Start(handler)
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		connectionID string
+		storeErr     error
+		wantStatus   int
+		wantLeft     int
+		wantMetric   string
+	}{
+		{name: "deletes the connection", wantStatus: 200, wantLeft: 0, wantMetric: "Disconnects"},
+		{name: "store failure", storeErr: errors.New("throttled"), wantStatus: 500, wantLeft: 1, wantMetric: "DisconnectErrors"},
+		{name: "already removed", connectionID: "c2", wantStatus: 200, wantLeft: 1, wantMetric: "Disconnects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42"})
+			h.Store.Fail("DeleteConnection", tt.storeErr)
+			deps = h.Deps
+
+			if tt.connectionID == "" {
+				tt.connectionID = "c1"
+			}
+			resp, err := handler(ctx, wstest.Disconnect(tt.connectionID).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if conns, _ := h.Store.ConnectionsForChannel(ctx, "42"); len(conns) != tt.wantLeft {
+				t.Fatalf("got connections %+v", conns)
+			}
+			if h.Metric(tt.wantMetric) != 1 {
+				t.Errorf("expected %s to be counted", tt.wantMetric)
+			}
+			if n, _ := h.Store.Watchers(ctx, "42"); n != tt.wantLeft {
+				t.Errorf("got %d watchers, want %d", n, tt.wantLeft)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lib"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+const localEndpoint = "local"
+
+type (
+	// localCommand is one line of input for the local driver. Connect lines
+	// register a watcher, sendmessage lines are publishes in the WebSocket
+	// format:
+	//
+	//	{"action":"connect","connection_id":"c1","order_id":"42"}
+	//	{"action":"sendmessage","order_id":"42","message":{"id":"m1","status":"SHIPPED"}}
+	localCommand struct {
+		lib.Message
+		ConnectionID string `json:"connection_id"`
+	}
+
+	// printingAPI stands in for the management API and prints the frames and
+	// closed connections.
+	printingAPI struct {
+		mu sync.Mutex
+		w  io.Writer
+	}
+)
+
+func (p *printingAPI) PostToConnection(_ context.Context, in *apigatewaymanagementapi.PostToConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s <- %s\n", aws.ToString(in.ConnectionId), in.Data)
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, err
+}
+
+// GetConnection reports every connection as open.
+func (p *printingAPI) GetConnection(context.Context, *apigatewaymanagementapi.GetConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	return &apigatewaymanagementapi.GetConnectionOutput{}, nil
+}
+
+func (p *printingAPI) DeleteConnection(_ context.Context, in *apigatewaymanagementapi.DeleteConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := fmt.Fprintf(p.w, "%s closed\n", aws.ToString(in.ConnectionId))
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, err
+}
+
+// runLocal drives the handler from an in-memory store: every change the
+// store makes to a message is handed to the handler as a one record stream
+// batch, the same way the messages table stream feeds it in AWS.
+func runLocal(in io.Reader, out io.Writer) error {
+	ctx := context.Background()
+	conf := lib.DefaultConfig()
+	conf.ConnectionsEndpoint = localEndpoint
+	store := lib.NewMemoryStore()
+	api := &printingAPI{w: out}
+
+	deps = lib.NewDepsFromConfig(&conf, aws.Config{Region: conf.Region})
+	deps.Store = store
+	deps.DeadLetters = lib.NewMemoryDeadLetterStore()
+	deps.Webhooks = lib.NewMemoryWebhookStore()
+	deps.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	deps.Metrics = lib.NewMetrics(io.Discard, conf.MetricsNamespace)
+	deps.NewManagementAPI = func(string) lib.ManagementAPI { return api }
+
+	store.OnMessageChange(func(record events.DynamoDBEventRecord) {
+		response, _ := handler(ctx, events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record}})
+		for _, failure := range response.BatchItemFailures {
+			fmt.Fprintf(out, "record %s failed\n", failure.ItemIdentifier)
+		}
+	})
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var cmd localCommand
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return fmt.Errorf("invalid input %q: %w", scanner.Text(), err)
+		}
+		switch cmd.Action {
+		case "connect":
+			err := store.PutConnection(ctx, lib.Connection{ConnectionID: cmd.ConnectionID, Channel: cmd.OrderID})
+			if err != nil {
+				return err
+			}
+		case "sendmessage":
+			cmd.Message.Message.OrderID = cmd.OrderID
+			err := deps.Publish(ctx, lib.StoredMessage{
+				MessageData:        cmd.Message.Message,
+				Endpoint:           localEndpoint,
+				SourceConnectionID: cmd.ConnectionID,
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown action %q", cmd.Action)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"lib"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var deps *lib.Deps
+
+// handler consumes the messages table stream and delivers every new or
+// updated status to the watchers of its channel.
+//
+// Processing stops at the first record that could not be fanned out and only
+// that record is reported, so Lambda retries the shard from there without
+// delivering the records before it twice.
+func handler(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	defer deps.FlushTraces(ctx)
+	metrics := deps.Metrics.Recorder("Route", "fanout", "Stage", deps.Config.Stage)
+	defer metrics.Flush()
+
+	var response events.DynamoDBEventResponse
+	for _, record := range event.Records {
+		if err := process(ctx, record, metrics); err != nil {
+			metrics.Count("FanoutErrors", 1)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
+	return response, nil
+}
+
+func process(ctx context.Context, record events.DynamoDBEventRecord, metrics *lib.Recorder) error {
+	logger := deps.Logger.With("eventId", record.EventID, "eventName", record.EventName)
+	if record.EventName != "INSERT" && record.EventName != "MODIFY" {
+		return nil
+	}
+
+	msg := lib.MessageFromStreamImage(record.Change.NewImage)
+	channel := msg.ChannelKey()
+	if channel == "" {
+		logger.Warn("skipping record without channel")
+		return nil
+	}
+	if record.EventName == "MODIFY" && lib.MessageFromStreamImage(record.Change.OldImage).ID == msg.ID {
+		// Same publish rewritten, e.g. a TTL refresh, nothing new to deliver
+		return nil
+	}
+
+	logger = logger.With("channel", channel)
+	ctx = lib.WithLogger(ctx, logger)
+	ctx, span := deps.Tracer().Start(lib.ExtractTrace(ctx, msg.Trace), "fanout record",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("channel", channel)))
+
+	result, err := deps.Fanout(ctx, *msg)
+	lib.EndSpan(span, err)
+
+	metrics.Count("FanoutSize", result.Connections)
+	metrics.Count("FanoutFiltered", result.Filtered)
+	metrics.Count("FanoutWebhooks", result.Webhooks)
+	metrics.Count("Deliveries", result.Delivered)
+	metrics.Count("DeliveryFailures", result.Failed)
+	metrics.Count("GoneConnections", result.Gone)
+	metrics.Count("DeadLetters", result.DeadLettered)
+	if created := record.Change.ApproximateCreationDateTime; !created.IsZero() {
+		metrics.Duration("FanoutLag", time.Since(created.Time))
+	}
+	if err != nil {
+		logger.Error("fan-out failed", "error", err)
+	}
+	return err
+}
+
+func main() {
+	local := flag.Bool("local", false, "read publishes from stdin into an in-memory store and fan them out locally")
+	flag.Parse()
+	if *local {
+		if err := runLocal(os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
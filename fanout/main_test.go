@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	shipped := lib.StoredMessage{
+		MessageData:        lib.MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED"},
+		Endpoint:           wstest.Endpoint,
+		SourceConnectionID: "publisher",
+	}
+	delivered := shipped
+	delivered.ID, delivered.Status = "m2", "DELIVERED"
+
+	tests := []struct {
+		name string
+		// changes are applied to the store, each becoming a stream record
+		changes      func(ctx context.Context, h *wstest.Harness)
+		gone         string
+		storeErr     error
+		wantFrames   map[string]int
+		wantFailures []string
+		wantLeft     int
+	}{
+		{
+			name:       "insert reaches every watcher but the publisher",
+			changes:    func(ctx context.Context, h *wstest.Harness) { h.Deps.Publish(ctx, shipped) },
+			wantFrames: map[string]int{"w1": 1, "w2": 1},
+			wantLeft:   3,
+		},
+		{
+			name: "modify with a new publish is delivered",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Deps.Publish(ctx, shipped)
+				h.Deps.Publish(ctx, delivered)
+			},
+			wantFrames: map[string]int{"w1": 2, "w2": 2},
+			wantLeft:   3,
+		},
+		{
+			name: "owners' watchers get the order",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "customer", Channel: "customer:C1"})
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "merchant", Channel: "merchant:M1"})
+				owned := shipped
+				owned.CustomerID, owned.MerchantID = "C1", "M1"
+				h.Deps.Publish(ctx, owned)
+			},
+			wantFrames: map[string]int{"w1": 1, "w2": 1, "customer": 1, "merchant": 1},
+			wantLeft:   3,
+		},
+		{
+			name: "non-order channels reach their watchers",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "shipment", Channel: "shipment:S1"})
+				h.Deps.Publish(ctx, lib.StoredMessage{
+					MessageData: lib.MessageData{ID: "s1", Channel: "shipment:S1", Status: "IN_TRANSIT"},
+					Endpoint:    wstest.Endpoint,
+				})
+			},
+			wantFrames: map[string]int{"shipment": 1},
+			wantLeft:   3,
+		},
+		{
+			name: "filtered watchers are skipped",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "w1", Channel: "42", Filter: "DELIVERED"})
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "w2", Channel: "42", Filter: "status != CREATED"})
+				h.Deps.Publish(ctx, shipped)
+				h.Deps.Publish(ctx, delivered)
+			},
+			wantFrames: map[string]int{"w1": 1, "w2": 2},
+			wantLeft:   3,
+		},
+		{
+			name: "rewrite of the same publish is skipped",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Deps.Publish(ctx, shipped)
+				h.Store.PutMessage(ctx, shipped)
+			},
+			wantFrames: map[string]int{"w1": 1, "w2": 1},
+			wantLeft:   3,
+		},
+		{
+			name: "remove is ignored",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Deps.Publish(ctx, shipped)
+				h.Store.DeleteMessage(ctx, "42")
+			},
+			wantFrames: map[string]int{"w1": 1, "w2": 1},
+			wantLeft:   3,
+		},
+		{
+			name:       "gone connections are left to the sweeper",
+			changes:    func(ctx context.Context, h *wstest.Harness) { h.Deps.Publish(ctx, shipped) },
+			gone:       "w2",
+			wantFrames: map[string]int{"w1": 1},
+			wantLeft:   3,
+		},
+		{
+			name: "a failure stops the batch at its record",
+			changes: func(ctx context.Context, h *wstest.Harness) {
+				h.Deps.Publish(ctx, shipped)
+				h.Deps.Publish(ctx, delivered)
+			},
+			storeErr:     errors.New("throttled"),
+			wantFailures: []string{"1"},
+			wantLeft:     3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			for _, id := range []string{"publisher", "w1", "w2"} {
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: id, Channel: "42"})
+			}
+			var batch events.DynamoDBEvent
+			h.Store.OnMessageChange(func(r events.DynamoDBEventRecord) { batch.Records = append(batch.Records, r) })
+			tt.changes(ctx, h)
+			if tt.gone != "" {
+				h.API.Gone(tt.gone)
+			}
+			h.Store.Fail("ConnectionsForChannel", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var failures []string
+			for _, f := range resp.BatchItemFailures {
+				failures = append(failures, f.ItemIdentifier)
+			}
+			if len(failures) != len(tt.wantFailures) || (len(failures) > 0 && failures[0] != tt.wantFailures[0]) {
+				t.Fatalf("got failures %v, want %v", failures, tt.wantFailures)
+			}
+			frames := map[string]int{}
+			for _, post := range h.API.Posts() {
+				frames[post.ConnectionID]++
+			}
+			if len(frames) != len(tt.wantFrames) {
+				t.Fatalf("got frames %v, want %v", frames, tt.wantFrames)
+			}
+			for id, n := range tt.wantFrames {
+				if frames[id] != n {
+					t.Fatalf("got frames %v, want %v", frames, tt.wantFrames)
+				}
+			}
+			h.Store.Fail("ConnectionsForChannel", nil)
+			if conns, _ := h.Store.ConnectionsForChannel(ctx, "42"); len(conns) != tt.wantLeft {
+				t.Fatalf("got connections %+v", conns)
+			}
+		})
+	}
+}
+
+func TestRunLocal(t *testing.T) {
+	in := strings.NewReader(`{"action":"connect","connection_id":"c1","order_id":"42"}
+{"action":"connect","connection_id":"c2","order_id":"42"}
+{"action":"sendmessage","connection_id":"c1","order_id":"42","message":{"id":"m1","status":"SHIPPED"}}
+`)
+	var out bytes.Buffer
+	if err := runLocal(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	frame, ok := strings.CutPrefix(strings.TrimSpace(out.String()), "c2 <- ")
+	if !ok || strings.Contains(frame, "\n") {
+		t.Fatalf("got %q, want one frame to c2", out.String())
+	}
+	var msg lib.MessageData
+	if err := json.Unmarshal([]byte(frame), &msg); err != nil || msg.ID != "m1" || msg.Status != "SHIPPED" {
+		t.Fatalf("got frame %s: %v", frame, err)
+	}
+}
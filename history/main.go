@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
+}
+
+// Delivery modes of a history request.
+const (
+	DeliveryPage   = "page"
+	DeliveryFrames = "frames"
+)
+
+type (
+	// RequestBody is the history action. From and To are RFC 3339 times.
+	RequestBody struct {
+		Action   string   `json:"action"`
+		Channel  string   `json:"channel,omitempty"`
+		OrderID  string   `json:"order_id,omitempty"`
+		Limit    int      `json:"limit,omitempty"`
+		Cursor   string   `json:"cursor,omitempty"`
+		Status   []string `json:"status,omitempty"`
+		From     string   `json:"from,omitempty"`
+		To       string   `json:"to,omitempty"`
+		Delivery string   `json:"delivery,omitempty"`
+	}
+	// PageFrame carries a whole page in page delivery. It names the channel
+	// the way the request did.
+	PageFrame struct {
+		Type    string             `json:"type"`
+		Channel string             `json:"channel,omitempty"`
+		OrderID string             `json:"order_id,omitempty"`
+		Events  []lib.HistoryEvent `json:"events"`
+		Cursor  string             `json:"cursor,omitempty"`
+	}
+	// EventFrame carries one event in frames delivery.
+	EventFrame struct {
+		Type string `json:"type"`
+		lib.HistoryEvent
+	}
+	// EndFrame closes a page in frames delivery.
+	EndFrame struct {
+		Type    string `json:"type"`
+		Channel string `json:"channel,omitempty"`
+		OrderID string `json:"order_id,omitempty"`
+		Count   int    `json:"count"`
+		Cursor  string `json:"cursor,omitempty"`
+	}
+)
+
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+	endpoint := lib.Endpoint(request.RequestContext)
+	connectionID := request.RequestContext.ConnectionID
+
+	var body RequestBody
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		logger.Warn("failed to parse WebSocket message", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+	query, err := body.query()
+	if err != nil {
+		logger.Warn("invalid history request", "error", err)
+		metrics.Count("HistoryErrors", 1)
+		return createErrorResponse(http.StatusBadRequest, err.Error()), nil
+	}
+
+	defer deps.FlushTraces(ctx)
+	ctx, span := deps.Tracer().Start(ctx, "history",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("channel", query.Channel)))
+	defer span.End()
+
+	start := time.Now()
+	page, err := deps.Store.History(ctx, query)
+	metrics.Duration("HistoryLatency", time.Since(start))
+	if errors.Is(err, lib.ErrInvalidCursor) {
+		logger.Warn("invalid history cursor", "error", err)
+		metrics.Count("HistoryErrors", 1)
+		return createErrorResponse(http.StatusBadRequest, "Invalid cursor"), nil
+	}
+	if err != nil {
+		logger.Error("failed to query history", "error", err)
+		metrics.Count("HistoryErrors", 1)
+		return createErrorResponse(http.StatusInternalServerError, "cannot query history"), nil
+	}
+	metrics.Count("HistoryEvents", len(page.Events))
+
+	if err := deliver(ctx, endpoint, connectionID, body, page); err != nil {
+		logger.Error("failed to send history", "error", err)
+		metrics.Count("DeliveryFailures", 1)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to send WebSocket response"), nil
+	}
+	metrics.Count("Deliveries", 1)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+}
+
+// query validates the request and turns it into a store query.
+func (b RequestBody) query() (lib.HistoryQuery, error) {
+	q := lib.HistoryQuery{
+		Limit:    b.Limit,
+		Cursor:   b.Cursor,
+		Statuses: b.Status,
+	}
+	if b.Channel != "" || b.OrderID != "" {
+		channel, err := lib.ResolveChannel(b.Channel, b.OrderID)
+		if err != nil {
+			return q, err
+		}
+		q.Channel = channel.Key()
+	}
+	switch b.Delivery {
+	case "", DeliveryPage, DeliveryFrames:
+	default:
+		return q, fmt.Errorf("delivery must be %s or %s", DeliveryPage, DeliveryFrames)
+	}
+	var err error
+	if b.From != "" {
+		if q.From, err = time.Parse(time.RFC3339, b.From); err != nil {
+			return q, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if b.To != "" {
+		if q.To, err = time.Parse(time.RFC3339, b.To); err != nil {
+			return q, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	return q, q.Normalize()
+}
+
+func deliver(ctx context.Context, endpoint, connectionID string, body RequestBody, page lib.HistoryPage) error {
+	if body.Delivery != DeliveryFrames {
+		return deps.PostFrame(ctx, endpoint, connectionID, PageFrame{
+			Type:    "history",
+			Channel: body.Channel,
+			OrderID: body.OrderID,
+			Events:  append([]lib.HistoryEvent{}, page.Events...),
+			Cursor:  page.Cursor,
+		})
+	}
+	for _, event := range page.Events {
+		if err := deps.PostFrame(ctx, endpoint, connectionID, EventFrame{Type: "history_event", HistoryEvent: event}); err != nil {
+			return err
+		}
+	}
+	return deps.PostFrame(ctx, endpoint, connectionID, EndFrame{
+		Type:    "history_end",
+		Channel: body.Channel,
+		OrderID: body.OrderID,
+		Count:   len(page.Events),
+		Cursor:  page.Cursor,
+	})
+}
+
+// errorBody is the body of refused history requests. Messages may quote the
+// request, so the body is marshaled rather than formatted.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return lib.BuildResponse(statusCode, errorBody{Error: message})
+}
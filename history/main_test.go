@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		body       RequestBody
+		storeErr   error
+		wantStatus int
+		wantTypes  []string
+		wantIDs    []string
+	}{
+		{
+			name:       "page",
+			body:       RequestBody{Action: "history", OrderID: "42", Limit: 2},
+			wantStatus: 200,
+			wantTypes:  []string{"history"},
+			wantIDs:    []string{"m1", "m2"},
+		},
+		{
+			name:       "frames filtered by status",
+			body:       RequestBody{Action: "history", OrderID: "42", Status: []string{"PACKED"}, Delivery: DeliveryFrames},
+			wantStatus: 200,
+			wantTypes:  []string{"history_event", "history_end"},
+			wantIDs:    []string{"m2"},
+		},
+		{
+			name:       "time window",
+			body:       RequestBody{Action: "history", OrderID: "42", From: base.Add(30 * time.Second).Format(time.RFC3339), To: base.Add(90 * time.Second).Format(time.RFC3339)},
+			wantStatus: 200,
+			wantTypes:  []string{"history"},
+			wantIDs:    []string{"m2"},
+		},
+		{
+			name:       "order channel",
+			body:       RequestBody{Action: "history", Channel: "order:42", Limit: 2},
+			wantStatus: 200,
+			wantTypes:  []string{"history"},
+			wantIDs:    []string{"m1", "m2"},
+		},
+		{
+			name:       "shipment channel",
+			body:       RequestBody{Action: "history", Channel: "shipment:S1"},
+			wantStatus: 200,
+			wantTypes:  []string{"history"},
+			wantIDs:    []string{"s1"},
+		},
+		{name: "invalid channel", body: RequestBody{Action: "history", Channel: "shipment:"}, wantStatus: 400},
+		{name: "unknown channel type", body: RequestBody{Action: "history", Channel: "parcel:P1"}, wantStatus: 400},
+		{name: "missing order", body: RequestBody{Action: "history"}, wantStatus: 400},
+		{name: "unknown delivery", body: RequestBody{Action: "history", OrderID: "42", Delivery: "email"}, wantStatus: 400},
+		{name: "invalid time", body: RequestBody{Action: "history", OrderID: "42", From: "yesterday"}, wantStatus: 400},
+		{name: "invalid cursor", body: RequestBody{Action: "history", OrderID: "42", Cursor: "nope"}, wantStatus: 400},
+		{
+			name:       "store failure",
+			body:       RequestBody{Action: "history", OrderID: "42"},
+			storeErr:   errors.New("throttled"),
+			wantStatus: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			for i, status := range []string{"CREATED", "PACKED", "SHIPPED"} {
+				h.Store.AppendHistory(ctx, lib.HistoryEvent{
+					MessageData: lib.MessageData{ID: "m" + string(rune('1'+i)), OrderID: "42", Status: status},
+					PublishedAt: base.Add(time.Duration(i) * time.Minute),
+				})
+			}
+			h.Store.AppendHistory(ctx, lib.HistoryEvent{
+				MessageData: lib.MessageData{ID: "s1", Channel: "shipment:S1", OrderID: "42", Status: "IN TRANSIT"},
+				PublishedAt: base,
+			})
+			h.Store.Fail("History", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message("c1", "history", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if resp.StatusCode != http.StatusOK {
+				var body errorBody
+				if err := json.Unmarshal([]byte(resp.Body), &body); err != nil || body.Error == "" {
+					t.Fatalf("got error body %s: %v", resp.Body, err)
+				}
+			}
+
+			var types, ids []string
+			for _, post := range h.API.Posts() {
+				var frame struct {
+					PageFrame
+					ID string `json:"id"`
+				}
+				if err := post.Decode(&frame); err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, frame.Type)
+				for _, event := range frame.Events {
+					ids = append(ids, event.ID)
+				}
+				if frame.Type == "history_event" {
+					ids = append(ids, frame.ID)
+				}
+			}
+			if !slices.Equal(types, tt.wantTypes) || !slices.Equal(ids, tt.wantIDs) {
+				t.Fatalf("got frames %v with events %v, want %v with %v", types, ids, tt.wantTypes, tt.wantIDs)
+			}
+		})
+	}
+}
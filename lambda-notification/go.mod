@@ -3,8 +3,9 @@ module lambda-notification
 go 1.23.0
 
 require (
-	github.com/google/uuid v1.6.0
-	github.com/gorilla/websocket v1.5.3
+	go.opentelemetry.io/otel v1.35.0
+	go.opentelemetry.io/otel/trace v1.35.0
+	lib v0.0.0-00010101000000-000000000000
 )
 
 require (
@@ -15,8 +16,12 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.29.0 // indirect
 	github.com/aws/aws-sdk-go-v2/service/dynamodbstreams v1.19.1 // indirect
 	github.com/aws/smithy-go v1.20.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/awslabs/aws-lambda-go-api-proxy v0.16.2 // indirect
 	github.com/tidwall/gjson v1.17.1 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
 )
+
+replace lib => ../lib
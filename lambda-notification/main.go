@@ -2,75 +2,75 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/Bancar/lambda-go"
-	"github.com/google/uuid"
+	"lib"
+	"lib/client"
 	"log"
-	"net/url"
-	"time"
+	"log/slog"
+	"os"
 
-	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type (
-	Message struct {
-		Action  string      `json:"action"`
-		Message MessageData `json:"message"`
-		OrderID string      `json:"order_id"`
-	}
+type MessageData = lib.MessageData
 
-	MessageData struct {
-		ID      string `json:"id"`
-		Status  string `json:"status"`
-		Date    string `json:"date"`
-		OrderID string `json:"order_id"`
-	}
+var (
+	conf   *lib.Config
+	logger *slog.Logger
+	tracer trace.Tracer
 )
 
 func main() {
+	var err error
+	conf, err = lib.LoadConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	logger = lib.NewLogger(os.Stdout, conf.LogLevel)
+	tp, err := lib.NewTracerProvider(context.Background(), conf)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if tp != nil {
+		otel.SetTracerProvider(tp)
+	}
+	tracer = otel.Tracer("lambda-notification")
 	lambda.EnableLocalHTTP("8080")
 	lambda.AsyncStart(Do, false)
 }
 
-func Do(_ context.Context, input *MessageData) error {
-	u := url.URL{Scheme: "wss", Host: "o2hn4hxw55.execute-api.us-east-1.amazonaws.com", Path: "/dev", RawQuery: "order_id=default"}
-	log.Printf("Connecting to %s", u.String())
+func Do(ctx context.Context, input *MessageData) error {
+	ctx, span := tracer.Start(ctx, "publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("order_id", input.OrderID)))
+	defer flushTraces(ctx)
+	defer span.End()
 
-	// Establish a connection to the WebSocket
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		return err
-	}
-	// Close connection when finished
-	defer conn.Close()
-
-	// Create the message in the required format
-	msg := Message{
-		Action:  "sendmessage",
-		OrderID: input.OrderID,
-		Message: MessageData{
-			OrderID: input.OrderID,
-			ID: func() string {
-				u, _ := uuid.NewUUID()
-				return u.String()
-			}(),
-			Status: input.Status,
-			Date:   time.Now().Format("2006-01-02 15:04:05"),
-		},
-	}
+	logger := logger.With("order_id", input.OrderID)
+	logger.Info("connecting", "url", conf.WebSocketURL)
 
-	// Convert the message to JSON
-	msgJSON, err := json.Marshal(msg)
+	// Publishers don't watch an order, the connection only lives for the send
+	c, err := client.Dial(ctx, "default", client.Options{URL: conf.WebSocketURL, Logger: logger, PingInterval: -1})
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 
-	// Send the JSON message
-	err = conn.WriteMessage(websocket.TextMessage, msgJSON)
+	msg, err := c.Publish(ctx, MessageData{OrderID: input.OrderID, Status: input.Status})
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Sent message: %s", string(msgJSON))
+	logger.Info("sent message", "message_id", msg.ID, "status", msg.Status)
 	return nil
 }
+
+func flushTraces(ctx context.Context) {
+	if tp, ok := otel.GetTracerProvider().(interface{ ForceFlush(context.Context) error }); ok {
+		if err := tp.ForceFlush(ctx); err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+	}
+}
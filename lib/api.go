@@ -6,29 +6,53 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 )
 
+// Payloads address a channel, e.g. "shipment:S1", or an order for clients
+// that predate channels. Channel takes precedence, see ResolveChannel.
 type (
 	RequestConnection struct {
-		OrderID string `json:"order_id"`
+		Channel string `json:"channel,omitempty"`
+		OrderID string `json:"order_id,omitempty"`
 	}
 	Request struct {
 		Action  string `json:"action"`
-		OrderID string `json:"order_id"`
+		Channel string `json:"channel,omitempty"`
+		OrderID string `json:"order_id,omitempty"`
+		// RequestID is echoed in the reply to the request action, which
+		// tells it apart from the statuses pushed meanwhile.
+		RequestID string `json:"request_id,omitempty"`
 	}
 	ResponseConnection struct {
 		Message      string `json:"message"`
 		ConnectionID string `json:"connectionId"`
-		OrderID      string `json:"orderId"`
+		Channel      string `json:"channel,omitempty"`
+		OrderID      string `json:"orderId,omitempty"`
 	}
 	Message struct {
 		Action  string      `json:"action"`
 		Message MessageData `json:"message"`
-		OrderID string      `json:"order_id"`
+		Channel string      `json:"channel,omitempty"`
+		OrderID string      `json:"order_id,omitempty"`
 	}
 	MessageData struct {
-		ID      string `json:"id"`
-		Status  string `json:"status"`
-		Date    string `json:"date"`
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Date   string `json:"date"`
+		// Channel is set for messages published to a channel other than an
+		// order. OrderID may then still name the order they relate to.
+		Channel string `json:"channel,omitempty"`
 		OrderID string `json:"order_id"`
+		// CustomerID and MerchantID name the owners of the order. The status
+		// also reaches the connections watching their channels, and the
+		// webhooks subscribed to the customer. Publish remembers them, so a
+		// publisher may leave them out once a status of the channel named them.
+		CustomerID string `json:"customer_id,omitempty"`
+		MerchantID string `json:"merchant_id,omitempty"`
+		// Trace carries the W3C trace context of the publisher, see InjectTrace.
+		Trace map[string]string `json:"trace,omitempty"`
+		// PublishedAt is when Publish stored the status, in RFC 3339 with
+		// nanoseconds. Unlike Date it comes from the server clock, which
+		// also orders the history.
+		PublishedAt string `json:"published_at,omitempty"`
 	}
 )
 
@@ -2,16 +2,152 @@ package lib
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"log"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type (
+	// DynamoDBAPI is the subset of the DynamoDB client used by the handlers.
+	DynamoDBAPI interface {
+		PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+		GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+		UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+		DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+		Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+		Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+		TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+	}
+
+	// ManagementAPI is the subset of the API Gateway management API client used
+	// to push frames to connected clients, check on them and close their
+	// connections.
+	ManagementAPI interface {
+		PostToConnection(ctx context.Context, params *apigatewaymanagementapi.PostToConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error)
+		GetConnection(ctx context.Context, params *apigatewaymanagementapi.GetConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error)
+		DeleteConnection(ctx context.Context, params *apigatewaymanagementapi.DeleteConnectionInput, optFns ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error)
+	}
+
+	// Deps holds the clients shared by every invocation of a handler. It is
+	// built once per container in main and reused until the container dies.
+	Deps struct {
+		Config   *Config
+		AWS      aws.Config
+		DynamoDB DynamoDBAPI
+		Store    Store
+		Logger   *slog.Logger
+		Metrics  *Metrics
+		// DeadLetters keeps the deliveries that failed during fan-out.
+		DeadLetters DeadLetterStore
+		// Webhooks keeps the webhook subscriptions, which HTTPClient delivers
+		// to. A nil HTTPClient uses NewWebhookClient, a nil LookupIPAddr the
+		// default resolver, see CheckWebhookHost.
+		Webhooks     WebhookStore
+		HTTPClient   *http.Client
+		LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+		// RateLimits keeps the buckets of RateLimit, nil disables it.
+		RateLimits RateLimitStore
+		// TracerProvider is nil when tracing is disabled.
+		TracerProvider *sdktrace.TracerProvider
+		// NewManagementAPI builds the management API client for an endpoint.
+		// It is only called once per endpoint, see ManagementAPI.
+		NewManagementAPI func(endpoint string) ManagementAPI
+
+		mu             sync.Mutex
+		managementAPIs map[string]ManagementAPI
+	}
 )
 
-func LoadAwsConfig(ctx context.Context) (*aws.Config, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
+func LoadAwsConfig(ctx context.Context, region string) (*aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
 	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("unable to load AWS config: %w", err)
 	}
 	return &cfg, nil
 }
+
+// NewDeps loads the configuration from the environment and the AWS config and
+// builds the clients. Call it from main, not from the handler, so that
+// misconfiguration fails the cold start.
+func NewDeps(ctx context.Context) (*Deps, error) {
+	conf, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := LoadAwsConfig(ctx, conf.Region)
+	if err != nil {
+		return nil, err
+	}
+	deps := NewDepsFromConfig(conf, *cfg)
+	deps.TracerProvider, err = NewTracerProvider(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// NewDepsFromConfig builds the clients from an already loaded configuration.
+func NewDepsFromConfig(conf *Config, cfg aws.Config) *Deps {
+	dynamoClient := dynamodb.NewFromConfig(cfg)
+	return &Deps{
+		Config:   conf,
+		AWS:      cfg,
+		DynamoDB: dynamoClient,
+		Store:    &DynamoStore{DynamoDB: dynamoClient, Config: conf},
+		Logger:   NewLogger(os.Stdout, conf.LogLevel),
+		Metrics:  NewMetrics(os.Stdout, conf.MetricsNamespace),
+		DeadLetters: &DynamoDeadLetterStore{
+			DynamoDB: dynamoClient,
+			Table:    conf.DeadLettersTable,
+			TTL:      conf.DeadLetterTTL,
+		},
+		Webhooks: &DynamoWebhookStore{
+			DynamoDB: dynamoClient,
+			Table:    conf.WebhooksTable,
+			Index:    conf.WebhooksIndex,
+		},
+		HTTPClient: NewWebhookClient(),
+		RateLimits: &DynamoRateLimitStore{
+			DynamoDB: dynamoClient,
+			Table:    conf.RateLimitTable,
+		},
+		NewManagementAPI: func(endpoint string) ManagementAPI {
+			return apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+				o.BaseEndpoint = aws.String(endpoint)
+			})
+		},
+	}
+}
+
+// ManagementAPI returns the management API client for endpoint, building it
+// on first use. A container normally only ever sees one endpoint, but the
+// cache is keyed so custom domains and stages don't share a client.
+func (d *Deps) ManagementAPI(endpoint string) ManagementAPI {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if client, ok := d.managementAPIs[endpoint]; ok {
+		return client
+	}
+	if d.managementAPIs == nil {
+		d.managementAPIs = make(map[string]ManagementAPI)
+	}
+	client := d.NewManagementAPI(endpoint)
+	d.managementAPIs[endpoint] = client
+	return client
+}
+
+// Endpoint returns the @connections endpoint for the API that sent the request.
+func Endpoint(rc events.APIGatewayWebsocketProxyRequestContext) string {
+	return fmt.Sprintf("https://%s/%s", rc.DomainName, rc.Stage)
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+var benchRequestContext = events.APIGatewayWebsocketProxyRequestContext{
+	DomainName: "abc123.execute-api.us-east-1.amazonaws.com",
+	Stage:      "dev",
+}
+
+func setBenchEnv(b *testing.B) {
+	b.Setenv("AWS_ACCESS_KEY_ID", "test")
+	b.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	b.Setenv("AWS_CONFIG_FILE", "/dev/null")
+	b.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/dev/null")
+}
+
+func TestManagementAPICachedPerEndpoint(t *testing.T) {
+	conf := DefaultConfig()
+	deps := NewDepsFromConfig(&conf, aws.Config{Region: conf.Region})
+
+	a := deps.ManagementAPI("https://a.example.com/dev")
+	if deps.ManagementAPI("https://a.example.com/dev") != a {
+		t.Fatal("expected the same client for the same endpoint")
+	}
+	if deps.ManagementAPI("https://b.example.com/dev") == a {
+		t.Fatal("expected a different client for a different endpoint")
+	}
+}
+
+// BenchmarkPerInvocationClients is what the handlers used to do on every
+// invocation.
+func BenchmarkPerInvocationClients(b *testing.B) {
+	setBenchEnv(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = dynamodb.NewFromConfig(cfg)
+		_ = apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
+			o.BaseEndpoint = aws.String(Endpoint(benchRequestContext))
+		})
+	}
+}
+
+// BenchmarkSharedDeps is the per-invocation cost once Deps is built in main.
+func BenchmarkSharedDeps(b *testing.B) {
+	setBenchEnv(b)
+	deps, err := NewDeps(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = deps.DynamoDB
+		_ = deps.ManagementAPI(Endpoint(benchRequestContext))
+	}
+}
@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Channel types. A connection watches one channel, and every message is
+// published to one. Customer and merchant channels also get the messages of
+// everything their customer or merchant owns, see MessageData.Audience.
+const (
+	ChannelOrder    = "order"
+	ChannelShipment = "shipment"
+	ChannelPayment  = "payment"
+	ChannelMerchant = "merchant"
+	ChannelCustomer = "customer"
+)
+
+var channelTypes = map[string]bool{
+	ChannelOrder:    true,
+	ChannelShipment: true,
+	ChannelPayment:  true,
+	ChannelMerchant: true,
+	ChannelCustomer: true,
+}
+
+var (
+	// ErrMissingChannel is returned when a payload names neither a channel
+	// nor an order.
+	ErrMissingChannel = errors.New("missing channel or order_id")
+	// ErrMissingOrderID is the error returned before channels existed.
+	//
+	// Deprecated: use ErrMissingChannel.
+	ErrMissingOrderID = ErrMissingChannel
+	// ErrInvalidChannel is returned for channels of an unknown type or
+	// without an ID.
+	ErrInvalidChannel = errors.New("invalid channel")
+)
+
+// Channel is a stream of notifications about one thing, e.g. the order 42
+// or the shipment S1. It is written "type:id", as in "shipment:S1".
+type Channel struct {
+	Type string
+	ID   string
+}
+
+// OrderChannel returns the channel of an order.
+func OrderChannel(orderID string) Channel {
+	return Channel{Type: ChannelOrder, ID: orderID}
+}
+
+// ParseChannel parses "type:id". A bare ID is an order.
+func ParseChannel(s string) (Channel, error) {
+	c := OrderChannel(s)
+	if typ, id, ok := strings.Cut(s, ":"); ok {
+		c = Channel{Type: typ, ID: id}
+	}
+	if err := c.Validate(); err != nil {
+		return Channel{}, err
+	}
+	return c, nil
+}
+
+// ChannelFromKey returns the channel stored under key, see Key.
+func ChannelFromKey(key string) Channel {
+	if typ, id, ok := strings.Cut(key, ":"); ok && channelTypes[typ] {
+		return Channel{Type: typ, ID: id}
+	}
+	return OrderChannel(key)
+}
+
+// ResolveChannel returns the channel a payload addresses: channel when set,
+// otherwise the order channel of orderID, for clients that predate channels.
+func ResolveChannel(channel, orderID string) (Channel, error) {
+	switch {
+	case channel != "":
+		return ParseChannel(channel)
+	case orderID != "":
+		c := OrderChannel(orderID)
+		if err := c.Validate(); err != nil {
+			return Channel{}, err
+		}
+		return c, nil
+	}
+	return Channel{}, ErrMissingChannel
+}
+
+// Validate checks that the type is known and the ID set. Order IDs may not
+// look like another channel, which Key could not tell apart.
+func (c Channel) Validate() error {
+	if !channelTypes[c.Type] {
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidChannel, c.Type)
+	}
+	if c.ID == "" {
+		return fmt.Errorf("%w: missing %s ID", ErrInvalidChannel, c.Type)
+	}
+	if c.Type == ChannelOrder && ChannelFromKey(c.ID).Type != ChannelOrder {
+		return fmt.Errorf("%w: order ID %q names another channel", ErrInvalidChannel, c.ID)
+	}
+	return nil
+}
+
+// String returns "type:id".
+func (c Channel) String() string {
+	return c.Type + ":" + c.ID
+}
+
+// Key is what the tables store for the channel, in the attributes that held
+// order IDs before channels existed: the ID for orders, so existing rows and
+// the order index keep working, and "type:id" otherwise.
+func (c Channel) Key() string {
+	if c.Type == ChannelOrder {
+		return c.ID
+	}
+	return c.String()
+}
+
+// Target returns the channel m is published to.
+func (m MessageData) Target() (Channel, error) {
+	return ResolveChannel(m.Channel, m.OrderID)
+}
+
+// WithChannel returns m published to c. Order channels are written as
+// order_id alone, the way clients that predate channels expect them.
+func (m MessageData) WithChannel(c Channel) MessageData {
+	if c.Type == ChannelOrder {
+		m.Channel, m.OrderID = "", c.ID
+	} else {
+		m.Channel = c.String()
+	}
+	return m
+}
+
+// ChannelKey returns the Key of the channel m is published to, or "" when
+// it names none.
+func (m MessageData) ChannelKey() string {
+	c, err := m.Target()
+	if err != nil {
+		return ""
+	}
+	return c.Key()
+}
+
+// Audience returns the keys of the channels whose connections get m: the
+// channel it is published to and the customer and merchant channels of its
+// owners.
+func (m MessageData) Audience() []string {
+	var keys []string
+	for _, c := range []Channel{
+		ChannelFromKey(m.ChannelKey()),
+		{Type: ChannelCustomer, ID: m.CustomerID},
+		{Type: ChannelMerchant, ID: m.MerchantID},
+	} {
+		if c.ID == "" || slices.Contains(keys, c.Key()) {
+			continue
+		}
+		keys = append(keys, c.Key())
+	}
+	return keys
+}
+
+// HasOwners reports whether m names both its customer and merchant.
+func (m MessageData) HasOwners() bool {
+	return m.CustomerID != "" && m.MerchantID != ""
+}
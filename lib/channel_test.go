@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestParseChannel(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Channel
+		wantKey string
+		wantErr error
+	}{
+		{in: "42", want: OrderChannel("42"), wantKey: "42"},
+		{in: "order:42", want: OrderChannel("42"), wantKey: "42"},
+		{in: "shipment:S1", want: Channel{ChannelShipment, "S1"}, wantKey: "shipment:S1"},
+		{in: "merchant:m:7", want: Channel{ChannelMerchant, "m:7"}, wantKey: "merchant:m:7"},
+		{in: "invoice:1", wantErr: ErrInvalidChannel},
+		{in: "payment:", wantErr: ErrInvalidChannel},
+		{in: "order:shipment:S1", wantErr: ErrInvalidChannel},
+		{in: "", wantErr: ErrInvalidChannel},
+	}
+	for _, tt := range tests {
+		got, err := ParseChannel(tt.in)
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("ParseChannel(%q) = %v, %v, want %v, %v", tt.in, got, err, tt.want, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.Key() != tt.wantKey || ChannelFromKey(got.Key()) != got {
+			t.Errorf("%q: key %q does not round trip", tt.in, got.Key())
+		}
+	}
+}
+
+func TestResolveChannel(t *testing.T) {
+	if c, err := ResolveChannel("shipment:S1", "42"); err != nil || c != (Channel{ChannelShipment, "S1"}) {
+		t.Errorf("got %v, %v, want the channel to take precedence", c, err)
+	}
+	// Order IDs of older clients are taken as they are
+	if c, err := ResolveChannel("", "invoice:1"); err != nil || c != OrderChannel("invoice:1") {
+		t.Errorf("got %v, %v", c, err)
+	}
+	if _, err := ResolveChannel("", "shipment:S1"); !errors.Is(err, ErrInvalidChannel) {
+		t.Errorf("got %v, want an order ID naming another channel to be rejected", err)
+	}
+	if _, err := ResolveChannel("", ""); !errors.Is(err, ErrMissingChannel) || !errors.Is(err, ErrMissingOrderID) {
+		t.Errorf("got %v, want ErrMissingChannel", err)
+	}
+}
+
+func TestMessageChannelItem(t *testing.T) {
+	tests := []MessageData{
+		{ID: "m1", Status: "PAID", OrderID: "42"},
+		{ID: "m2", Status: "IN TRANSIT", Channel: "shipment:S1", OrderID: "42"},
+		{ID: "m3", Status: "ONLINE", Channel: "merchant:7"},
+	}
+	for _, data := range tests {
+		item := messageItem(StoredMessage{MessageData: data}, 0)
+		if key := item["eventId"].(*types.AttributeValueMemberS).Value; key != data.ChannelKey() {
+			t.Errorf("%s stored under %q, want %q", data.ID, key, data.ChannelKey())
+		}
+		got := messageFromAttributes(func(name string) string {
+			if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+				return v.Value
+			}
+			return ""
+		})
+		if got.ID != data.ID || got.Channel != data.Channel || got.OrderID != data.OrderID {
+			t.Errorf("got %+v, want %+v", got.MessageData, data)
+		}
+	}
+}
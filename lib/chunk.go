@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// Sizes API Gateway enforces on WebSocket traffic: a frame carries at most
+// 32 KiB and a message, or a PostToConnection payload, at most 128 KiB.
+const (
+	APIGatewayFrameSize   = 32 * 1024
+	APIGatewayMessageSize = 128 * 1024
+)
+
+const (
+	// CodeMessageTooLarge is the code of the ErrorFrame sent for actions
+	// larger than Config.MaxMessageSize.
+	CodeMessageTooLarge = "MESSAGE_TOO_LARGE"
+	// MaxChunks bounds the parts a frame is split into, and so the memory a
+	// client spends reassembling one.
+	MaxChunks = 64
+	// MinFrameSize is the smallest Config.MaxFrameSize a chunk fits in.
+	MinFrameSize = 1024
+	// chunkOverhead is the room left in a frame for the chunk envelope.
+	chunkOverhead = 128
+)
+
+// ErrFrameTooLarge is returned for frames that need more than MaxChunks parts.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ChunkFrame carries part Part of Parts, counted from 1, of a frame larger
+// than Config.MaxFrameSize. ID is the same for every part of a frame. Data
+// holds a slice of the encoded frame, in base64 on the wire.
+type ChunkFrame struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Part  int    `json:"part"`
+	Parts int    `json:"parts"`
+	Data  []byte `json:"data"`
+}
+
+// Chunk splits data into chunk frames that fit in frames of maxFrame bytes.
+// It returns nil when data fits as it is.
+func Chunk(data []byte, maxFrame int) ([]ChunkFrame, error) {
+	if len(data) <= maxFrame {
+		return nil, nil
+	}
+	// base64 turns every 3 bytes into 4
+	size := (maxFrame - chunkOverhead) / 4 * 3
+	if size <= 0 {
+		return nil, fmt.Errorf("frames of %d bytes cannot carry chunks", maxFrame)
+	}
+	parts := (len(data) + size - 1) / size
+	if parts > MaxChunks {
+		return nil, fmt.Errorf("%w: %d bytes need %d chunks, at most %d are sent", ErrFrameTooLarge, len(data), parts, MaxChunks)
+	}
+	id := uuid.NewString()
+	chunks := make([]ChunkFrame, 0, parts)
+	for i := 0; i < len(data); i += size {
+		chunks = append(chunks, ChunkFrame{
+			Type:  "chunk",
+			ID:    id,
+			Part:  len(chunks) + 1,
+			Parts: parts,
+			Data:  data[i:min(i+size, len(data))],
+		})
+	}
+	return chunks, nil
+}
+
+// Reassembler joins the chunk frames of a connection back into frames. Parts
+// may arrive in any order and interleaved with the parts of other frames. It
+// is not safe for concurrent use.
+type Reassembler struct {
+	max     int
+	pending map[string][][]byte
+	order   []string
+}
+
+// NewReassembler returns a Reassembler keeping up to max incomplete frames.
+// When another one starts, the oldest is dropped.
+func NewReassembler(max int) *Reassembler {
+	return &Reassembler{max: max, pending: make(map[string][][]byte)}
+}
+
+// Add records c and returns the frame it completes, if any. Invalid chunks
+// are reported as errors and otherwise ignored.
+func (r *Reassembler) Add(c ChunkFrame) ([]byte, bool, error) {
+	if c.ID == "" || c.Parts < 1 || c.Parts > MaxChunks || c.Part < 1 || c.Part > c.Parts {
+		return nil, false, fmt.Errorf("invalid chunk %d of %d of %q", c.Part, c.Parts, c.ID)
+	}
+	parts, ok := r.pending[c.ID]
+	if !ok {
+		if len(r.order) >= r.max {
+			delete(r.pending, r.order[0])
+			r.order = r.order[1:]
+		}
+		parts = make([][]byte, c.Parts)
+		r.pending[c.ID] = parts
+		r.order = append(r.order, c.ID)
+	}
+	if len(parts) != c.Parts {
+		return nil, false, fmt.Errorf("chunk %d of %q says %d parts, earlier ones %d", c.Part, c.ID, c.Parts, len(parts))
+	}
+	parts[c.Part-1] = c.Data
+	var data []byte
+	for _, p := range parts {
+		if p == nil {
+			return nil, false, nil
+		}
+		data = append(data, p...)
+	}
+	r.forget(c.ID)
+	return data, true, nil
+}
+
+func (r *Reassembler) forget(id string) {
+	delete(r.pending, id)
+	for i, pending := range r.order {
+		if pending == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// maxFrameSize returns the largest frame PostFrame sends whole.
+func (d *Deps) maxFrameSize() int {
+	if d.Config == nil || d.Config.MaxFrameSize <= 0 {
+		return APIGatewayFrameSize
+	}
+	return d.Config.MaxFrameSize
+}
+
+// LimitSize wraps a WebSocket route so actions larger than MaxMessageSize
+// are refused with a MESSAGE_TOO_LARGE ErrorFrame and a 413 before being
+// parsed.
+func (d *Deps) LimitSize(next func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)) func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		limit := d.Config.MaxMessageSize
+		if limit <= 0 || len(request.Body) <= limit {
+			return next(ctx, request)
+		}
+		ctx, logger := d.RequestLogger(ctx, request)
+		frame := ErrorFrame{
+			Type:    "error",
+			Code:    CodeMessageTooLarge,
+			Message: fmt.Sprintf("Message of %d bytes exceeds the limit of %d", len(request.Body), limit),
+			Action:  request.RequestContext.RouteKey,
+		}
+		return d.refuse(ctx, logger, request, http.StatusRequestEntityTooLarge, "MessagesTooLarge", frame, "size", len(request.Body)), nil
+	}
+}
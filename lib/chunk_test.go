@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+func TestChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 500)
+	if chunks, err := Chunk(data, len(data)); chunks != nil || err != nil {
+		t.Fatalf("got %d chunks, %v for data that fits", len(chunks), err)
+	}
+	a, err := Chunk(data, MinFrameSize)
+	if err != nil || len(a) != 8 {
+		t.Fatalf("got %d chunks, %v, want 8", len(a), err)
+	}
+	for _, c := range a {
+		frame, _ := json.Marshal(c)
+		if len(frame) > MinFrameSize {
+			t.Fatalf("chunk %d is %d bytes", c.Part, len(frame))
+		}
+	}
+	b, _ := Chunk([]byte(strings.Repeat("x", 2000)), MinFrameSize)
+
+	// Parts come out of order and interleaved with another frame
+	r := NewReassembler(4)
+	for i, c := range []ChunkFrame{a[7], a[0], b[1], a[2], a[1], a[5], a[4], a[6], b[0]} {
+		if got, done, err := r.Add(c); done || err != nil {
+			t.Fatalf("step %d completed %q, %v", i, got, err)
+		}
+	}
+	if got, done, err := r.Add(a[3]); !done || err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v, %v, want the frame back", len(got), done, err)
+	}
+	if got, done, _ := r.Add(b[2]); !done || string(got) != strings.Repeat("x", 2000) {
+		t.Fatalf("got %q, %v", got, done)
+	}
+
+	// The oldest incomplete frame is dropped for a new one
+	r = NewReassembler(1)
+	r.Add(a[0])
+	r.Add(b[0])
+	for _, c := range a[1:] {
+		if _, done, _ := r.Add(c); done {
+			t.Fatal("completed a dropped frame")
+		}
+	}
+
+	for _, c := range []ChunkFrame{
+		{ID: "x", Part: 0, Parts: 1},
+		{ID: "x", Part: 2, Parts: 1},
+		{ID: "x", Part: 1, Parts: MaxChunks + 1},
+		{Part: 1, Parts: 1},
+	} {
+		if _, _, err := r.Add(c); err == nil {
+			t.Errorf("accepted %+v", c)
+		}
+	}
+	if _, err := Chunk(make([]byte, MaxChunks*MinFrameSize), MinFrameSize); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestPostFrameChunks(t *testing.T) {
+	conf := DefaultConfig()
+	conf.MaxFrameSize = MinFrameSize
+	var posted [][]byte
+	deps := &Deps{Config: &conf, NewManagementAPI: func(string) ManagementAPI {
+		return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+			if len(in.Data) > MinFrameSize {
+				t.Errorf("posted %d bytes", len(in.Data))
+			}
+			posted = append(posted, in.Data)
+			return nil
+		})
+	}}
+	msg := MessageData{ID: "m1", Status: strings.Repeat("PACKED ", 500), OrderID: "42"}
+	if err := deps.PostFrame(context.Background(), "https://example.com", "c1", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReassembler(1)
+	var got MessageData
+	for i, data := range posted {
+		var c ChunkFrame
+		if err := json.Unmarshal(data, &c); err != nil || c.Type != "chunk" {
+			t.Fatalf("frame %d is not a chunk: %s", i, data)
+		}
+		whole, done, err := r.Add(c)
+		if err != nil || done != (i == len(posted)-1) {
+			t.Fatalf("chunk %d: done %v, %v", i, done, err)
+		}
+		if done {
+			json.Unmarshal(whole, &got)
+		}
+	}
+	if got.ID != msg.ID || got.Status != msg.Status {
+		t.Fatalf("got %+v back", got)
+	}
+}
+
+func TestLimitSize(t *testing.T) {
+	conf := DefaultConfig()
+	conf.MaxMessageSize = 100
+	var frames []ErrorFrame
+	deps := &Deps{Config: &conf, NewManagementAPI: func(string) ManagementAPI {
+		return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+			var frame ErrorFrame
+			json.Unmarshal(in.Data, &frame)
+			frames = append(frames, frame)
+			return nil
+		})
+	}}
+	handler := deps.LimitSize(func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	for _, tt := range []struct {
+		size int
+		want int
+	}{
+		{100, http.StatusOK},
+		{101, http.StatusRequestEntityTooLarge},
+	} {
+		req := events.APIGatewayWebsocketProxyRequest{
+			Body:           strings.Repeat("x", tt.size),
+			RequestContext: events.APIGatewayWebsocketProxyRequestContext{ConnectionID: "c1", RouteKey: "sendmessage"},
+		}
+		resp, err := handler(context.Background(), req)
+		if err != nil || resp.StatusCode != tt.want {
+			t.Fatalf("%d bytes: got %d, %v, want %d", tt.size, resp.StatusCode, err, tt.want)
+		}
+	}
+	if len(frames) != 1 || frames[0].Code != CodeMessageTooLarge || frames[0].Action != "sendmessage" {
+		t.Fatalf("got frames %+v", frames)
+	}
+}
@@ -0,0 +1,713 @@
+// Package client is a Go client for the order notification WebSocket API.
+//
+// A Client watches one order at a time over one connection, like the API
+// expects (?order_id= at $connect). It reconnects with jittered exponential
+// backoff, catches up on the statuses published while it was away through
+// the history route, pings to keep idle connections open and delivers status
+// updates on a channel or to a callback, each message ID at most once.
+// Frames the API posts in chunks, see lib.Chunk, are joined back.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lib"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Version is reported to the server as the client version, prefixed with
+// "go/", unless Options.Header sets lib.HeaderClientVersion.
+const Version = "1.0.0"
+
+// Defaults for the zero Options.
+const (
+	DefaultMinBackoff   = 500 * time.Millisecond
+	DefaultMaxBackoff   = 30 * time.Second
+	DefaultPingInterval = 30 * time.Second
+
+	// seenSize bounds how many message IDs are remembered for deduplication.
+	seenSize = 1024
+	// pendingChunked bounds the chunked frames reassembled at once.
+	pendingChunked = 8
+)
+
+var (
+	// ErrClosed is returned by the methods of a closed Client.
+	ErrClosed = errors.New("client closed")
+	// ErrNotFound is returned by Request when the order has no status.
+	ErrNotFound = lib.ErrNotFound
+	// ErrRateLimited is returned, wrapped, when the API refused an action
+	// for coming too fast.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrTooLarge is returned, wrapped, for actions larger than the API
+	// accepts.
+	ErrTooLarge = errors.New("message too large")
+)
+
+type (
+	// Options configure a Client. Only URL is required.
+	Options struct {
+		// URL is the ws:// or wss:// URL of the API, e.g. lib.Config's
+		// WebSocketURL. The order_id query parameter is added by the client.
+		URL string
+		// Filter, when set, selects the statuses the server sends, e.g.
+		// "DELIVERED,CANCELLED". See lib.ParseFilter.
+		Filter string
+		// Subprotocol, when set, is offered at connect to pick the encoding
+		// of the updates, e.g. lib.SubprotocolMsgpack. JSON is the default.
+		Subprotocol string
+		// Token, when set, is sent as a bearer Authorization header, or as
+		// the TokenParam query parameter for request authorizers that read
+		// it from the query string.
+		Token      string
+		TokenParam string
+		// Header is sent with every connection request.
+		Header http.Header
+		// MinBackoff and MaxBackoff bound the wait between reconnects.
+		MinBackoff time.Duration
+		MaxBackoff time.Duration
+		// PingInterval is how often the ping action is sent. A connection
+		// that stays silent for two intervals is reopened. A negative
+		// interval disables pings, and the server's idle reaper eventually
+		// closes the connection.
+		PingInterval time.Duration
+		// OnUpdate, when set, receives the status updates instead of the
+		// Updates channel. It is called from the reading goroutine.
+		OnUpdate func(lib.MessageData)
+		// OnPresence, when set, receives the join and leave frames of the
+		// other watchers of the order. It is called from the reading
+		// goroutine.
+		OnPresence func(lib.PresenceFrame)
+		Logger     *slog.Logger
+		Dialer     *websocket.Dialer
+	}
+
+	// Client is a connection to the API that survives disconnects. Its
+	// methods are safe for concurrent use.
+	Client struct {
+		opts    Options
+		filter  lib.Filter
+		updates chan lib.MessageData
+		ctx     context.Context
+		cancel  context.CancelFunc
+		done    chan struct{}
+
+		mu        sync.Mutex
+		orderID   string
+		conn      *websocket.Conn
+		connOrder string
+		connected chan struct{}
+		waiters   map[*waiter]struct{}
+		seen      seenSet
+		// lastAt is the latest PublishedAt received for orderID, where
+		// resume picks up.
+		lastAt time.Time
+
+		writeMu sync.Mutex
+	}
+
+	// HistoryRequest is the history action, see lib.HistoryQuery.
+	HistoryRequest struct {
+		OrderID string
+		Limit   int
+		Cursor  string
+		Status  []string
+		From    time.Time
+		To      time.Time
+	}
+
+	// frame is any frame the API sends: a status, a typed reply, an error
+	// frame or an API Gateway error.
+	frame struct {
+		lib.MessageData
+		Type    string             `json:"type"`
+		Message string             `json:"message"`
+		Events  []lib.HistoryEvent `json:"events"`
+		Cursor  string             `json:"cursor"`
+		// RequestID is set on replies to the request action
+		RequestID string `json:"request_id"`
+		// Event and Watchers are set on presence frames
+		Event    string `json:"event"`
+		Watchers int    `json:"watchers"`
+		// Code, Action and RetryAfter are set on error frames
+		Code       string `json:"code"`
+		Action     string `json:"action"`
+		RetryAfter int    `json:"retry_after"`
+		// Part, Parts and Data are set on chunk frames
+		Part  int    `json:"part"`
+		Parts int    `json:"parts"`
+		Data  []byte `json:"data"`
+	}
+
+	// waiter waits for the reply to an action, or for the error frame
+	// refusing it.
+	waiter struct {
+		action string
+		match  func(*frame) bool
+		ch     chan *frame
+	}
+)
+
+// Dial connects to the API watching orderID and keeps the connection open
+// until Close. Only the first connection attempt is reported, later ones are
+// retried in the background.
+func Dial(ctx context.Context, orderID string, opts Options) (*Client, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = DefaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(DefaultMaxBackoff, opts.MinBackoff)
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = DefaultPingInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	if _, err := url.Parse(opts.URL); err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	filter, err := lib.ParseFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Subprotocol != "" && lib.CodecFor(opts.Subprotocol).Subprotocol() != opts.Subprotocol {
+		return nil, fmt.Errorf("%w: %s", lib.ErrUnsupportedSubprotocol, opts.Subprotocol)
+	}
+
+	c := &Client{
+		opts:      opts,
+		filter:    filter,
+		updates:   make(chan lib.MessageData, 64),
+		done:      make(chan struct{}),
+		orderID:   orderID,
+		connected: make(chan struct{}),
+		waiters:   make(map[*waiter]struct{}),
+		seen:      newSeenSet(seenSize),
+	}
+	conn, err := c.dial(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.run(conn)
+	return c, nil
+}
+
+// Updates returns the channel status updates are delivered on, unless
+// Options.OnUpdate is set. It is closed by Close. Keep draining it: the
+// client stops reading from the connection while it is full.
+func (c *Client) Updates() <-chan lib.MessageData {
+	return c.updates
+}
+
+// OrderID returns the order the client watches.
+func (c *Client) OrderID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.orderID
+}
+
+// Subscribe switches the client to orderID, reconnecting with the new order,
+// and waits for the new connection.
+func (c *Client) Subscribe(ctx context.Context, orderID string) error {
+	c.mu.Lock()
+	if c.orderID == orderID {
+		c.mu.Unlock()
+		return nil
+	}
+	c.orderID = orderID
+	c.lastAt = time.Time{}
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		// The read loop notices and reconnects with the new order
+		conn.Close()
+	}
+	for {
+		c.mu.Lock()
+		conn, current, connected := c.conn, c.connOrder, c.connected
+		c.mu.Unlock()
+		if conn != nil && current == orderID {
+			return nil
+		}
+		wait := connected
+		if conn != nil {
+			// Still the old connection, give the read loop a moment
+			wait = nil
+		}
+		select {
+		case <-wait:
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+}
+
+// Request asks for the current status of orderID. It returns ErrNotFound when
+// the order has none.
+func (c *Client) Request(ctx context.Context, orderID string) (lib.MessageData, error) {
+	id := uuid.NewString()
+	reply, err := c.roundTrip(ctx, "request", lib.Request{Action: "request", OrderID: orderID, RequestID: id}, func(f *frame) bool {
+		return f.Type == "" && f.RequestID == id
+	})
+	if err != nil {
+		return lib.MessageData{}, err
+	}
+	if reply.Status == "NOT FOUND" && reply.ID == "" {
+		return lib.MessageData{}, ErrNotFound
+	}
+	return reply.MessageData, nil
+}
+
+// History fetches one page of the events of an order.
+func (c *Client) History(ctx context.Context, req HistoryRequest) (lib.HistoryPage, error) {
+	body := map[string]any{"action": "history", "order_id": req.OrderID, "delivery": "page"}
+	if req.Limit > 0 {
+		body["limit"] = req.Limit
+	}
+	if req.Cursor != "" {
+		body["cursor"] = req.Cursor
+	}
+	if len(req.Status) > 0 {
+		body["status"] = req.Status
+	}
+	if !req.From.IsZero() {
+		body["from"] = req.From.UTC().Format(time.RFC3339)
+	}
+	if !req.To.IsZero() {
+		body["to"] = req.To.UTC().Format(time.RFC3339)
+	}
+	reply, err := c.roundTrip(ctx, "history", body, func(f *frame) bool { return f.Type == "history" && f.OrderID == req.OrderID })
+	if err != nil {
+		return lib.HistoryPage{}, err
+	}
+	return lib.HistoryPage{Events: reply.Events, Cursor: reply.Cursor}, nil
+}
+
+// Publish sends msg as the new status of its order. A missing ID or date is
+// filled in and the trace in ctx is attached. The returned message is what
+// was sent.
+func (c *Client) Publish(ctx context.Context, msg lib.MessageData) (lib.MessageData, error) {
+	if msg.OrderID == "" {
+		return msg, lib.ErrMissingOrderID
+	}
+	if msg.ID == "" {
+		msg.ID = uuid.NewString()
+	}
+	if msg.Date == "" {
+		msg.Date = time.Now().Format("2006-01-02 15:04:05")
+	}
+	if msg.Trace == nil {
+		msg.Trace = lib.InjectTrace(ctx)
+	}
+	// Our own publish is not fanned back to us, count it as seen
+	c.mu.Lock()
+	c.seen.add(msg.ID)
+	c.mu.Unlock()
+	return msg, c.send(ctx, lib.Message{Action: "sendmessage", OrderID: msg.OrderID, Message: msg})
+}
+
+// Presence returns how many connections watch orderID, this one included
+// when it watches that order.
+func (c *Client) Presence(ctx context.Context, orderID string) (int, error) {
+	reply, err := c.roundTrip(ctx, "presence", lib.Request{Action: "presence", OrderID: orderID}, func(f *frame) bool {
+		return f.Type == "presence" && f.Event == lib.PresenceCount && f.OrderID == orderID
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Watchers, nil
+}
+
+// Ack acknowledges the status of orderID, removing it from the store.
+func (c *Client) Ack(ctx context.Context, orderID string) error {
+	return c.send(ctx, lib.Request{Action: "ack", OrderID: orderID})
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context, orderID string) (*websocket.Conn, error) {
+	u, _ := url.Parse(c.opts.URL)
+	q := u.Query()
+	q.Set("order_id", orderID)
+	if c.opts.Filter != "" {
+		q.Set("filter", c.opts.Filter)
+	}
+	if c.opts.Token != "" && c.opts.TokenParam != "" {
+		q.Set(c.opts.TokenParam, c.opts.Token)
+	}
+	u.RawQuery = q.Encode()
+
+	header := c.opts.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if c.opts.Token != "" && c.opts.TokenParam == "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	if header.Get(lib.HeaderClientVersion) == "" {
+		header.Set(lib.HeaderClientVersion, "go/"+Version)
+	}
+	header.Set(lib.HeaderProtocolVersion, lib.ProtocolVersion)
+	if c.opts.Subprotocol != "" {
+		header.Set(lib.HeaderSubprotocol, c.opts.Subprotocol)
+	}
+	conn, resp, err := c.opts.Dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		// Leave the query, and the token with it, out of the error
+		u.RawQuery = ""
+		if resp != nil {
+			return nil, fmt.Errorf("connect to %s: %w (HTTP %d)", u.Redacted(), err, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("connect to %s: %w", u.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// run reads from conn until it fails, then reconnects, until Close.
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+	defer close(c.updates)
+
+	resume := false
+	backoff := c.opts.MinBackoff
+	for {
+		orderID := c.OrderID()
+		if conn == nil {
+			var err error
+			if conn, err = c.dial(c.ctx, orderID); err != nil {
+				if c.ctx.Err() != nil {
+					return
+				}
+				wait := jitter(backoff)
+				c.opts.Logger.Warn("reconnect failed", "error", err, "retry_in", wait)
+				select {
+				case <-c.ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				backoff = min(backoff*2, c.opts.MaxBackoff)
+				continue
+			}
+		}
+		backoff = c.opts.MinBackoff
+		c.setConn(conn, orderID)
+		if resume {
+			go c.resume(orderID)
+		}
+		c.read(conn)
+		c.setConn(nil, "")
+		conn = nil
+		resume = true
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.opts.Logger.Info("connection lost, reconnecting", "order_id", orderID)
+	}
+}
+
+func (c *Client) setConn(conn *websocket.Conn, orderID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn, c.connOrder = conn, orderID
+	if conn != nil {
+		if c.ctx.Err() != nil {
+			// Close ran before the connection was set, read returns at once
+			conn.Close()
+		}
+		close(c.connected)
+		return
+	}
+	c.connected = make(chan struct{})
+}
+
+// read dispatches frames until the connection fails, pinging meanwhile.
+// Chunked frames are dispatched once all their parts arrived.
+func (c *Client) read(conn *websocket.Conn) {
+	chunks := lib.NewReassembler(pendingChunked)
+	stop := make(chan struct{})
+	defer close(stop)
+	if c.opts.PingInterval > 0 {
+		conn.SetReadDeadline(time.Now().Add(2 * c.opts.PingInterval))
+		go c.ping(conn, stop)
+	}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if c.opts.PingInterval > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * c.opts.PingInterval))
+		}
+		var f frame
+		if err := lib.FrameCodec(data, c.opts.Subprotocol).Unmarshal(data, &f); err != nil {
+			c.opts.Logger.Warn("ignoring invalid frame", "error", err)
+			continue
+		}
+		if f.Type == "chunk" {
+			whole, done, err := chunks.Add(lib.ChunkFrame{ID: f.ID, Part: f.Part, Parts: f.Parts, Data: f.Data})
+			if err != nil {
+				c.opts.Logger.Warn("ignoring invalid frame", "error", err)
+			}
+			if !done {
+				continue
+			}
+			f = frame{}
+			if err := lib.FrameCodec(whole, c.opts.Subprotocol).Unmarshal(whole, &f); err != nil {
+				c.opts.Logger.Warn("ignoring invalid frame", "error", err)
+				continue
+			}
+		}
+		c.dispatch(&f)
+	}
+}
+
+// ping sends the ping action, which also keeps the connection's last-seen
+// time fresh so the idle reaper leaves it alone. Any frame, the pong
+// included, extends the read deadline.
+func (c *Client) ping(conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+	data, _ := json.Marshal(lib.Ping{Action: "ping"})
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(c.opts.PingInterval))
+			err := conn.WriteMessage(websocket.TextMessage, data)
+			conn.SetWriteDeadline(time.Time{})
+			c.writeMu.Unlock()
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// dispatch hands f to the first waiter it matches, and status frames to the
+// subscriber as well.
+func (c *Client) dispatch(f *frame) {
+	c.mu.Lock()
+	for w := range c.waiters {
+		if f.Type == "error" && f.Action == w.action || f.Type != "error" && w.match(f) {
+			delete(c.waiters, w)
+			w.ch <- f
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case f.Type == "history_event":
+		c.deliver(f.MessageData)
+	case f.Type == "" && f.Status != "" && f.ID != "":
+		c.deliver(f.MessageData)
+	case f.Type == "presence" && f.Event != lib.PresenceCount && c.opts.OnPresence != nil:
+		c.opts.OnPresence(lib.PresenceFrame{Type: f.Type, Event: f.Event, Channel: f.Channel, OrderID: f.OrderID, Watchers: f.Watchers})
+	case f.Type == "" && f.Message != "":
+		c.opts.Logger.Warn("error from the API", "message", f.Message)
+	case f.Type == "error":
+		c.opts.Logger.Warn("error from the API", "code", f.Code, "action", f.Action, "message", f.Message)
+	}
+}
+
+// deliver passes msg on unless its ID was delivered before. The filter is
+// applied here too, for the statuses caught up on by resume.
+func (c *Client) deliver(msg lib.MessageData) {
+	c.mu.Lock()
+	if msg.OrderID != c.orderID {
+		c.mu.Unlock()
+		return
+	}
+	if at, err := time.Parse(time.RFC3339Nano, msg.PublishedAt); err == nil && at.After(c.lastAt) {
+		c.lastAt = at
+	}
+	if !c.filter.Match(msg) || !c.seen.add(msg.ID) {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	if c.opts.OnUpdate != nil {
+		c.opts.OnUpdate(msg)
+		return
+	}
+	select {
+	case c.updates <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+// resume catches up on what was published for orderID while disconnected,
+// from the server time of the last status received. Before the first one
+// there is nothing to resume from, and the history is not replayed.
+func (c *Client) resume(orderID string) {
+	c.mu.Lock()
+	lastAt := c.lastAt
+	c.mu.Unlock()
+	if lastAt.IsZero() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+	// From is inclusive, the status at lastAt is deduplicated
+	req := HistoryRequest{OrderID: orderID, Limit: lib.MaxHistoryLimit, From: lastAt}
+	for {
+		page, err := c.History(ctx, req)
+		if err != nil {
+			c.opts.Logger.Warn("history unavailable, requesting the current status", "error", err)
+			if msg, err := c.Request(ctx, orderID); err == nil {
+				c.deliver(msg)
+			}
+			return
+		}
+		for _, event := range page.Events {
+			msg := event.MessageData
+			msg.PublishedAt = event.PublishedAt.Format(time.RFC3339Nano)
+			c.deliver(msg)
+		}
+		if page.Cursor == "" {
+			return
+		}
+		req.Cursor = page.Cursor
+	}
+}
+
+// roundTrip sends body, the action of the given route, and waits for the
+// first frame matching match. An error frame refusing the action ends the
+// wait too.
+func (c *Client) roundTrip(ctx context.Context, action string, body any, match func(*frame) bool) (*frame, error) {
+	w := &waiter{action: action, match: match, ch: make(chan *frame, 1)}
+	c.mu.Lock()
+	c.waiters[w] = struct{}{}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiters, w)
+		c.mu.Unlock()
+	}()
+
+	if err := c.send(ctx, body); err != nil {
+		return nil, err
+	}
+	select {
+	case f := <-w.ch:
+		if f.Type != "error" {
+			return f, nil
+		}
+		switch f.Code {
+		case lib.CodeRateLimited:
+			return nil, fmt.Errorf("%s: %w, retry after %ds", action, ErrRateLimited, f.RetryAfter)
+		case lib.CodeMessageTooLarge:
+			return nil, fmt.Errorf("%s: %w: %s", action, ErrTooLarge, f.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", action, f.Message)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// send writes body as JSON, waiting for a connection if there is none.
+// Bodies API Gateway would refuse, closing the connection, are not sent.
+func (c *Client) send(ctx context.Context, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if len(data) > lib.APIGatewayMessageSize {
+		return fmt.Errorf("%w: %d bytes, at most %d are accepted", ErrTooLarge, len(data), lib.APIGatewayMessageSize)
+	}
+	conn, err := c.waitConnected(ctx)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *Client) waitConnected(ctx context.Context) (*websocket.Conn, error) {
+	for {
+		c.mu.Lock()
+		conn, connected := c.conn, c.connected
+		c.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
+
+// seenSet remembers the last n message IDs.
+type seenSet struct {
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newSeenSet(n int) seenSet {
+	return seenSet{ids: make(map[string]struct{}, n), ring: make([]string, n)}
+}
+
+// add records id and reports whether it is new. Empty IDs are always new.
+func (s *seenSet) add(id string) bool {
+	if id == "" {
+		return true
+	}
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if old := s.ring[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.ring[s.next] = id
+	s.ids[id] = struct{}{}
+	s.next = (s.next + 1) % len(s.ring)
+	return true
+}
@@ -0,0 +1,422 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"lib"
+	"lib/gateway"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// flakyGateway serves a local gateway that refuses new connections while down.
+type flakyGateway struct {
+	*gateway.Gateway
+	down atomic.Bool
+}
+
+func (g *flakyGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.down.Load() {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	g.Gateway.ServeHTTP(w, r)
+}
+
+func newServer(t *testing.T) (*flakyGateway, Options) {
+	g := &flakyGateway{Gateway: gateway.NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))}
+	server := httptest.NewServer(g)
+	t.Cleanup(func() {
+		server.Close()
+		g.Close()
+	})
+	return g, Options{
+		URL:          "ws" + strings.TrimPrefix(server.URL, "http") + "/ws",
+		MinBackoff:   10 * time.Millisecond,
+		MaxBackoff:   50 * time.Millisecond,
+		PingInterval: 100 * time.Millisecond,
+	}
+}
+
+func dial(t *testing.T, orderID string, opts Options) *Client {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, orderID, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func next(t *testing.T, c *Client) lib.MessageData {
+	t.Helper()
+	select {
+	case msg := <-c.Updates():
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an update")
+		return lib.MessageData{}
+	}
+}
+
+func TestPublishRequestAck(t *testing.T) {
+	_, opts := newServer(t)
+	watcher := dial(t, "42", opts)
+	publisher := dial(t, "42", opts)
+	ctx := context.Background()
+
+	if _, err := publisher.Request(ctx, "42"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+	sent, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "SHIPPED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent.ID == "" || sent.Date == "" {
+		t.Fatalf("expected an ID and a date, got %+v", sent)
+	}
+	if got := next(t, watcher); got.ID != sent.ID || got.Status != "SHIPPED" {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+
+	current, err := watcher.Request(ctx, "42")
+	if err != nil || current.ID != sent.ID {
+		t.Fatalf("got %+v, %v", current, err)
+	}
+	if err := watcher.Ack(ctx, "42"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := watcher.Request(ctx, "42"); errors.Is(err, ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ack did not remove the status")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case msg := <-watcher.Updates():
+		t.Fatalf("request replies must not be delivered twice, got %+v", msg)
+	default:
+	}
+}
+
+func TestResumeAfterReconnect(t *testing.T) {
+	g, opts := newServer(t)
+	watcher := dial(t, "42", opts)
+	publisher := dial(t, "42", opts)
+	ctx := context.Background()
+
+	first, _ := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "PACKED"})
+	got := next(t, watcher)
+	if got.ID != first.ID || got.PublishedAt == "" {
+		t.Fatalf("got %+v", got)
+	}
+	// Resume picks up from the server's time, not the watcher's
+	watcher.mu.Lock()
+	lastAt := watcher.lastAt.Format(time.RFC3339Nano)
+	watcher.mu.Unlock()
+	if lastAt != got.PublishedAt {
+		t.Fatalf("got last at %s, want %s", lastAt, got.PublishedAt)
+	}
+
+	// Drop the watcher and publish while it cannot reconnect
+	g.down.Store(true)
+	watcher.mu.Lock()
+	watcher.conn.Close()
+	watcher.mu.Unlock()
+	missed, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "SHIPPED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	g.down.Store(false)
+
+	if got := next(t, watcher); got.ID != missed.ID {
+		t.Fatalf("got %+v, want the missed %s", got, missed.ID)
+	}
+	select {
+	case msg := <-watcher.Updates():
+		t.Fatalf("resume must not redeliver, got %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestResumeNeedsAStatus(t *testing.T) {
+	g, opts := newServer(t)
+	publisher := dial(t, "42", opts)
+	ctx := context.Background()
+	if _, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "PACKED"}); err != nil {
+		t.Fatal(err)
+	}
+	// Let the fan-out of the publish pass before the watcher connects
+	time.Sleep(100 * time.Millisecond)
+	watcher := dial(t, "42", opts)
+
+	// Nothing was received, so there is nothing to resume from
+	dropped, err := watcher.waitConnected(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.down.Store(true)
+	dropped.Close()
+	time.Sleep(50 * time.Millisecond)
+	g.down.Store(false)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		watcher.mu.Lock()
+		conn := watcher.conn
+		watcher.mu.Unlock()
+		if conn != nil && conn != dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the watcher did not reconnect")
+		}
+	}
+	select {
+	case msg := <-watcher.Updates():
+		t.Fatalf("resume must not replay the history, got %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestRequestMatchesTheReply(t *testing.T) {
+	// The server pushes a status of the order just before the reply
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req lib.Request
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if req.Action != "request" {
+				continue
+			}
+			conn.WriteJSON(lib.MessageData{ID: "m2", OrderID: "42", Status: "DELIVERED"})
+			conn.WriteJSON(map[string]string{"id": "m1", "order_id": "42", "status": "SHIPPED", "request_id": req.RequestID})
+		}
+	}))
+	defer server.Close()
+	c := dial(t, "42", Options{URL: "ws" + strings.TrimPrefix(server.URL, "http"), PingInterval: -1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := c.Request(ctx, "42")
+	if err != nil || got.ID != "m1" {
+		t.Fatalf("got %+v, %v, want the reply m1", got, err)
+	}
+}
+
+func TestSubscribeSwitchesOrder(t *testing.T) {
+	_, opts := newServer(t)
+	var got atomic.Value
+	opts.OnUpdate = func(msg lib.MessageData) { got.Store(msg) }
+	watcher := dial(t, "1", opts)
+	publisher := dial(t, "2", Options{URL: opts.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := watcher.Subscribe(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if watcher.OrderID() != "2" {
+		t.Fatalf("got order %s", watcher.OrderID())
+	}
+	sent, _ := publisher.Publish(ctx, lib.MessageData{OrderID: "2", Status: "DELIVERED"})
+	for got.Load() == nil {
+		select {
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the callback")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if msg := got.Load().(lib.MessageData); msg.ID != sent.ID {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	_, opts := newServer(t)
+	publisher := dial(t, "42", opts)
+	opts.Filter = "DELIVERED, CANCELLED"
+	watcher := dial(t, "42", opts)
+	ctx := context.Background()
+
+	publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "SHIPPED"})
+	delivered, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: "DELIVERED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, watcher); got.ID != delivered.ID {
+		t.Fatalf("got %+v, want the DELIVERED status alone", got)
+	}
+
+	opts.Filter = "status in (DELIVERED"
+	if _, err := Dial(ctx, "42", opts); !errors.Is(err, lib.ErrInvalidFilter) {
+		t.Fatalf("got %v, want ErrInvalidFilter", err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	_, opts := newServer(t)
+	frames := make(chan lib.PresenceFrame, 4)
+	watcherOpts := opts
+	watcherOpts.OnPresence = func(f lib.PresenceFrame) { frames <- f }
+	watcher := dial(t, "42", watcherOpts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	other := dial(t, "42", opts)
+	for _, want := range []lib.PresenceFrame{
+		{Type: "presence", Event: lib.PresenceJoin, Channel: "order:42", OrderID: "42", Watchers: 2},
+		{Type: "presence", Event: lib.PresenceLeave, Channel: "order:42", OrderID: "42", Watchers: 1},
+	} {
+		select {
+		case got := <-frames:
+			if got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", want.Event)
+		}
+		if want.Event == lib.PresenceJoin {
+			if n, err := watcher.Presence(ctx, "42"); err != nil || n != 2 {
+				t.Fatalf("got %d watchers, %v", n, err)
+			}
+			other.Close()
+		}
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	g, opts := newServer(t)
+	g.Deps.Config.ConnectionRateLimit = lib.RateLimit{PerMinute: 1, Burst: 1}
+	c := dial(t, "42", opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Request(ctx, "42"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want the first request through", err)
+	}
+	if _, err := c.Request(ctx, "42"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want ErrRateLimited", err)
+	}
+}
+
+func TestLargeMessages(t *testing.T) {
+	g, opts := newServer(t)
+	g.Deps.Config.MaxFrameSize = lib.MinFrameSize
+	g.Deps.Config.MaxMessageSize = 10000
+	watcher := dial(t, "42", opts)
+	publisher := dial(t, "42", opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Delivered in chunks, and joined back
+	sent, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: strings.Repeat("PACKED ", 1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := next(t, watcher); got.ID != sent.ID || got.Status != sent.Status {
+		t.Fatalf("got %+v, want %+v", got, sent)
+	}
+	if current, err := watcher.Request(ctx, "42"); err != nil || current.ID != sent.ID {
+		t.Fatalf("got %+v, %v", current, err)
+	}
+
+	// Over the limits of the API, refused
+	if _, err := publisher.History(ctx, HistoryRequest{OrderID: "42", Cursor: strings.Repeat("c", 10000)}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	if _, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: strings.Repeat("x", lib.APIGatewayMessageSize)}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestSubprotocol(t *testing.T) {
+	g, opts := newServer(t)
+	g.Deps.Config.MaxFrameSize = lib.MinFrameSize
+	packedOpts := opts
+	packedOpts.Subprotocol = lib.SubprotocolMsgpack
+	watcher := dial(t, "42", packedOpts)
+	publisher := dial(t, "42", opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conns, _ := g.Store.ConnectionsForChannel(ctx, "42")
+	subprotocols := map[string]int{}
+	for _, conn := range conns {
+		subprotocols[conn.Subprotocol]++
+	}
+	if subprotocols[lib.SubprotocolMsgpack] != 1 || subprotocols[""] != 1 {
+		t.Fatalf("got subprotocols %v", subprotocols)
+	}
+
+	for _, status := range []string{"SHIPPED", strings.Repeat("PACKED ", 1000)} {
+		sent, err := publisher.Publish(ctx, lib.MessageData{OrderID: "42", Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := next(t, watcher); got.ID != sent.ID || got.Status != status {
+			t.Fatalf("got %+v, want %+v", got, sent)
+		}
+	}
+	// Replies to actions stay JSON
+	if _, err := watcher.Request(ctx, "42"); err != nil {
+		t.Fatal(err)
+	}
+
+	packedOpts.Subprotocol = "orders.v1.protobuf"
+	if _, err := Dial(ctx, "42", packedOpts); !errors.Is(err, lib.ErrUnsupportedSubprotocol) {
+		t.Fatalf("got %v, want ErrUnsupportedSubprotocol", err)
+	}
+}
+
+func TestDialFails(t *testing.T) {
+	g, opts := newServer(t)
+	g.down.Store(true)
+	if _, err := Dial(context.Background(), "42", opts); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v, want the HTTP status", err)
+	}
+}
+
+func TestSeenSet(t *testing.T) {
+	s := newSeenSet(2)
+	for _, step := range []struct {
+		id   string
+		want bool
+	}{{"a", true}, {"a", false}, {"b", true}, {"c", true}, {"a", true}, {"c", false}, {"", true}, {"", true}} {
+		if got := s.add(step.id); got != step.want {
+			t.Errorf("add(%q) = %v, want %v", step.id, got, step.want)
+		}
+	}
+}
+
+func TestReportsVersion(t *testing.T) {
+	g, opts := newServer(t)
+	dial(t, "42", opts)
+
+	conns, err := g.Deps.Store.ConnectionsForChannel(context.Background(), "42")
+	if err != nil || len(conns) != 1 {
+		t.Fatalf("got %+v, %v", conns, err)
+	}
+	if conns[0].ClientVersion != "go/"+Version || conns[0].ProtocolVersion != lib.ProtocolVersion || conns[0].UserAgent == "" {
+		t.Fatalf("got %+v", conns[0])
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols a client may offer in the Sec-WebSocket-Protocol header of
+// its $connect request. They pick the encoding of the frames pushed to the
+// connection: fan-out and presence. Actions are JSON whatever the
+// subprotocol, since API Gateway routes on $request.body.action, and so are
+// the replies to them.
+const (
+	HeaderSubprotocol  = "Sec-WebSocket-Protocol"
+	SubprotocolJSON    = "orders.v1.json"
+	SubprotocolMsgpack = "orders.v1.msgpack"
+)
+
+// ErrUnsupportedSubprotocol is returned when a client offers subprotocols
+// but none this tree speaks.
+var ErrUnsupportedSubprotocol = errors.New("unsupported subprotocol")
+
+// Codec encodes the frames of a subprotocol.
+type Codec interface {
+	// Subprotocol is the name the codec is negotiated by.
+	Subprotocol() string
+	// Binary reports whether frames are sent as binary WebSocket messages.
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// The codecs of the supported subprotocols. Msgpack uses the JSON field
+// names, so one set of struct tags describes both.
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+)
+
+var codecs = map[string]Codec{
+	SubprotocolJSON:    JSON,
+	SubprotocolMsgpack: Msgpack,
+}
+
+// CodecFor returns the codec of subprotocol. Connections that negotiated
+// none, including those stored before subprotocols existed, get JSON.
+func CodecFor(subprotocol string) Codec {
+	if c, ok := codecs[subprotocol]; ok {
+		return c
+	}
+	return JSON
+}
+
+// FrameCodec returns the codec that encoded a frame received on a connection
+// that negotiated subprotocol. JSON frames, such as the replies to actions,
+// start with '{', which no msgpack map does.
+func FrameCodec(data []byte, subprotocol string) Codec {
+	if len(data) > 0 && data[0] == '{' {
+		return JSON
+	}
+	return CodecFor(subprotocol)
+}
+
+// NegotiateSubprotocol picks the first subprotocol the $connect request
+// offers that is supported, in the client's order of preference. It returns
+// "" when none is offered, and ErrUnsupportedSubprotocol when none of those
+// offered is supported.
+func NegotiateSubprotocol(request events.APIGatewayWebsocketProxyRequest) (string, error) {
+	offered := header(request.Headers, HeaderSubprotocol)
+	if offered == "" {
+		return "", nil
+	}
+	for _, p := range strings.Split(offered, ",") {
+		if p = strings.TrimSpace(p); codecs[p] != nil {
+			return p, nil
+		}
+	}
+	return "", ErrUnsupportedSubprotocol
+}
+
+type (
+	jsonCodec    struct{}
+	msgpackCodec struct{}
+)
+
+func (jsonCodec) Subprotocol() string                { return SubprotocolJSON }
+func (jsonCodec) Binary() bool                       { return false }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (msgpackCodec) Subprotocol() string { return SubprotocolMsgpack }
+func (msgpackCodec) Binary() bool        { return true }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
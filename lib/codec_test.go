@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	frames := []any{
+		&MessageData{
+			ID:         "m1",
+			Status:     "SHIPPED",
+			Date:       "2024-05-01 12:00:00",
+			OrderID:    "42",
+			CustomerID: "C1",
+			Trace:      map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		},
+		&HistoryEvent{
+			MessageData: MessageData{ID: "m1", Status: "SHIPPED", OrderID: "42"},
+			PublishedAt: time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC),
+		},
+		&PresenceFrame{Type: "presence", Event: PresenceJoin, Channel: "order:42", OrderID: "42", Watchers: 2},
+		&ChunkFrame{Type: "chunk", ID: "c1", Part: 2, Parts: 3, Data: []byte{0, 1, 0xff}},
+	}
+	for _, codec := range []Codec{JSON, Msgpack} {
+		t.Run(codec.Subprotocol(), func(t *testing.T) {
+			if CodecFor(codec.Subprotocol()) != codec {
+				t.Fatalf("CodecFor(%q) is not the codec", codec.Subprotocol())
+			}
+			for _, frame := range frames {
+				data, err := codec.Marshal(frame)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+				if err := codec.Unmarshal(data, got); err != nil {
+					t.Fatal(err)
+				}
+				if e, ok := got.(*HistoryEvent); ok {
+					// msgpack decodes times in the local zone
+					e.PublishedAt = e.PublishedAt.UTC()
+				}
+				if !reflect.DeepEqual(got, frame) {
+					t.Errorf("got %+v, want %+v", got, frame)
+				}
+
+				// Every codec names fields alike
+				var fields map[string]any
+				if err := codec.Unmarshal(data, &fields); err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := fields["order_id"]; !ok && frame != frames[3] {
+					t.Errorf("%T has no order_id field: %v", frame, fields)
+				}
+			}
+		})
+	}
+
+	msg, _ := JSON.Marshal(frames[0])
+	packed, _ := Msgpack.Marshal(frames[0])
+	if len(packed) >= len(msg) {
+		t.Errorf("msgpack frame is %d bytes, JSON %d", len(packed), len(msg))
+	}
+}
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	tests := []struct {
+		offered string
+		want    string
+		err     error
+	}{
+		{"", "", nil},
+		{SubprotocolMsgpack, SubprotocolMsgpack, nil},
+		{"orders.v2.protobuf, orders.v1.json , orders.v1.msgpack", SubprotocolJSON, nil},
+		{"graphql-ws", "", ErrUnsupportedSubprotocol},
+	}
+	for _, tt := range tests {
+		request := events.APIGatewayWebsocketProxyRequest{Headers: map[string]string{"sec-websocket-protocol": tt.offered}}
+		got, err := NegotiateSubprotocol(request)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.offered, got, err, tt.want, tt.err)
+		}
+	}
+	if CodecFor("") != JSON {
+		t.Error("connections without a subprotocol must get JSON")
+	}
+}
@@ -0,0 +1,327 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the environment driven configuration shared by every function.
+//
+// Each setting is read from its environment variable, e.g. MESSAGES_TABLE.
+// When STAGE is set, a variable prefixed with the upper-cased stage, e.g.
+// PROD_MESSAGES_TABLE, takes precedence so one set of variables can describe
+// several stages.
+type Config struct {
+	Stage            string
+	Region           string
+	ConnectionsTable string
+	MessagesTable    string
+	OrderIndex       string
+	MessageTTL       time.Duration
+	DeadLettersTable string
+	DeadLetterTTL    time.Duration
+	HistoryTable     string
+	HistoryTTL       time.Duration
+	WebhooksTable    string
+	WebhooksIndex    string
+	// PresenceTable keeps the number of connections watching each channel.
+	PresenceTable string
+	// RateLimitTable keeps the token buckets of ConnectionRateLimit and
+	// PrincipalRateLimit, which bound the actions of each connection and of
+	// each authenticated principal across its connections.
+	RateLimitTable      string
+	ConnectionRateLimit RateLimit
+	PrincipalRateLimit  RateLimit
+	// MaxMessageSize bounds the actions clients send, in bytes. Frames
+	// posted to clients that are larger than MaxFrameSize are split into
+	// chunk frames, see Chunk.
+	MaxMessageSize int
+	MaxFrameSize   int
+	// WebhookTimeout bounds the webhook requests of a fan-out, made at once
+	// and once each. WebhookMaxAttempts bounds the requests of a replay,
+	// whose retries wait WebhookBackoff, doubling each time.
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	// IdleTimeout is how long a connection may go without a ping before the
+	// reaper closes it.
+	IdleTimeout time.Duration
+	// SweepSegments is how many parts of the connections table the sweeper
+	// checks in parallel.
+	SweepSegments int
+	// AdminPrincipals is the comma separated list of principals that may
+	// use the operator routes of the HTTP API, see IsAdmin.
+	AdminPrincipals string
+
+	WebSocketURL string
+	// ConnectionsEndpoint is the @connections URL used when a stored message
+	// does not say which API it was published through.
+	ConnectionsEndpoint string
+
+	LogLevel         slog.Level
+	MetricsNamespace string
+	TracesExporter   string
+}
+
+const (
+	envStage            = "STAGE"
+	envRegion           = "AWS_REGION"
+	envConnectionsTable = "CONNECTIONS_TABLE"
+	envMessagesTable    = "MESSAGES_TABLE"
+	envOrderIndex       = "ORDER_INDEX"
+	envMessageTTL       = "MESSAGE_TTL"
+	envDeadLettersTable = "DEADLETTERS_TABLE"
+	envDeadLetterTTL    = "DEADLETTER_TTL"
+	envHistoryTable     = "HISTORY_TABLE"
+	envHistoryTTL       = "HISTORY_TTL"
+	envWebhooksTable    = "WEBHOOKS_TABLE"
+	envWebhooksIndex    = "WEBHOOKS_INDEX"
+	envPresenceTable    = "PRESENCE_TABLE"
+	envRateLimitTable   = "RATE_LIMIT_TABLE"
+	envConnectionRate   = "CONNECTION_RATE_LIMIT"
+	envConnectionBurst  = "CONNECTION_RATE_BURST"
+	envPrincipalRate    = "PRINCIPAL_RATE_LIMIT"
+	envPrincipalBurst   = "PRINCIPAL_RATE_BURST"
+	envMaxMessageSize   = "MAX_MESSAGE_SIZE"
+	envMaxFrameSize     = "MAX_FRAME_SIZE"
+	envWebhookTimeout   = "WEBHOOK_TIMEOUT"
+	envWebhookAttempts  = "WEBHOOK_MAX_ATTEMPTS"
+	envWebhookBackoff   = "WEBHOOK_BACKOFF"
+	envIdleTimeout      = "IDLE_TIMEOUT"
+	envSweepSegments    = "SWEEP_SEGMENTS"
+	envAdminPrincipals  = "ADMIN_PRINCIPALS"
+	envWebSocketURL     = "WEBSOCKET_URL"
+	envConnectionsURL   = "CONNECTIONS_ENDPOINT"
+	envLogLevel         = "LOG_LEVEL"
+	envMetricsNamespace = "METRICS_NAMESPACE"
+	envTracesExporter   = "TRACES_EXPORTER"
+)
+
+var tableName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,255}$`)
+
+// DefaultConfig returns the settings used when nothing is set in the
+// environment.
+func DefaultConfig() Config {
+	return Config{
+		Region:              "us-east-1",
+		ConnectionsTable:    "WebSocketConnections",
+		MessagesTable:       "WebSocketMessages",
+		OrderIndex:          "orderId-index",
+		MessageTTL:          time.Hour,
+		DeadLettersTable:    "WebSocketDeadLetters",
+		DeadLetterTTL:       14 * 24 * time.Hour,
+		HistoryTable:        "WebSocketOrderHistory",
+		HistoryTTL:          30 * 24 * time.Hour,
+		WebhooksTable:       "WebSocketWebhooks",
+		WebhooksIndex:       "subscription-index",
+		PresenceTable:       "WebSocketPresence",
+		RateLimitTable:      "WebSocketRateLimits",
+		ConnectionRateLimit: RateLimit{PerMinute: 120, Burst: 30},
+		PrincipalRateLimit:  RateLimit{PerMinute: 600, Burst: 100},
+		MaxMessageSize:      APIGatewayFrameSize,
+		MaxFrameSize:        APIGatewayFrameSize,
+		WebhookTimeout:      5 * time.Second,
+		WebhookMaxAttempts:  4,
+		WebhookBackoff:      500 * time.Millisecond,
+		IdleTimeout:         15 * time.Minute,
+		SweepSegments:       4,
+		WebSocketURL:        "wss://o2hn4hxw55.execute-api.us-east-1.amazonaws.com/dev",
+		LogLevel:            slog.LevelInfo,
+		MetricsNamespace:    "WebSocketNotifications",
+		TracesExporter:      TracesExporterNone,
+	}
+}
+
+// LoadConfig reads the configuration from the process environment. Call it
+// once from main so a bad deployment fails at cold start.
+func LoadConfig() (*Config, error) {
+	return LoadConfigFrom(os.Getenv)
+}
+
+// LoadConfigFrom reads the configuration through getenv and validates it.
+func LoadConfigFrom(getenv func(string) string) (*Config, error) {
+	cfg := DefaultConfig()
+	cfg.Stage = getenv(envStage)
+
+	lookup := func(name string) string {
+		if cfg.Stage != "" {
+			if v := getenv(strings.ToUpper(cfg.Stage) + "_" + name); v != "" {
+				return v
+			}
+		}
+		return getenv(name)
+	}
+	set := func(dst *string, name string) {
+		if v := lookup(name); v != "" {
+			*dst = v
+		}
+	}
+
+	set(&cfg.Region, envRegion)
+	set(&cfg.ConnectionsTable, envConnectionsTable)
+	set(&cfg.MessagesTable, envMessagesTable)
+	set(&cfg.OrderIndex, envOrderIndex)
+	set(&cfg.DeadLettersTable, envDeadLettersTable)
+	set(&cfg.HistoryTable, envHistoryTable)
+	set(&cfg.WebhooksTable, envWebhooksTable)
+	set(&cfg.WebhooksIndex, envWebhooksIndex)
+	set(&cfg.PresenceTable, envPresenceTable)
+	set(&cfg.RateLimitTable, envRateLimitTable)
+	set(&cfg.WebSocketURL, envWebSocketURL)
+	set(&cfg.ConnectionsEndpoint, envConnectionsURL)
+	set(&cfg.MetricsNamespace, envMetricsNamespace)
+	set(&cfg.TracesExporter, envTracesExporter)
+	set(&cfg.AdminPrincipals, envAdminPrincipals)
+
+	var errs []error
+	setDuration := func(dst *time.Duration, name string) {
+		if v := lookup(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				// Keep the default, so Validate does not report it again
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	setDuration(&cfg.MessageTTL, envMessageTTL)
+	setDuration(&cfg.DeadLetterTTL, envDeadLetterTTL)
+	setDuration(&cfg.HistoryTTL, envHistoryTTL)
+	setDuration(&cfg.WebhookTimeout, envWebhookTimeout)
+	setDuration(&cfg.WebhookBackoff, envWebhookBackoff)
+	setDuration(&cfg.IdleTimeout, envIdleTimeout)
+	setInt := func(dst *int, name string) {
+		if v := lookup(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	setInt(&cfg.WebhookMaxAttempts, envWebhookAttempts)
+	setInt(&cfg.SweepSegments, envSweepSegments)
+	setInt(&cfg.ConnectionRateLimit.PerMinute, envConnectionRate)
+	setInt(&cfg.ConnectionRateLimit.Burst, envConnectionBurst)
+	setInt(&cfg.PrincipalRateLimit.PerMinute, envPrincipalRate)
+	setInt(&cfg.PrincipalRateLimit.Burst, envPrincipalBurst)
+	setInt(&cfg.MaxMessageSize, envMaxMessageSize)
+	setInt(&cfg.MaxFrameSize, envMaxFrameSize)
+	if v := lookup(envLogLevel); v != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", envLogLevel, err))
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Validate reports every setting that is unusable.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Region == "" {
+		errs = append(errs, fmt.Errorf("%s is empty", envRegion))
+	}
+	for _, t := range []struct{ env, name string }{
+		{envConnectionsTable, c.ConnectionsTable},
+		{envMessagesTable, c.MessagesTable},
+		{envOrderIndex, c.OrderIndex},
+		{envDeadLettersTable, c.DeadLettersTable},
+		{envHistoryTable, c.HistoryTable},
+		{envWebhooksTable, c.WebhooksTable},
+		{envWebhooksIndex, c.WebhooksIndex},
+		{envPresenceTable, c.PresenceTable},
+		{envRateLimitTable, c.RateLimitTable},
+	} {
+		if !tableName.MatchString(t.name) {
+			errs = append(errs, fmt.Errorf("%s %q is not a valid DynamoDB name", t.env, t.name))
+		}
+	}
+	if c.MessageTTL <= 0 {
+		errs = append(errs, fmt.Errorf("%s must be positive, got %s", envMessageTTL, c.MessageTTL))
+	}
+	if c.DeadLetterTTL <= 0 {
+		errs = append(errs, fmt.Errorf("%s must be positive, got %s", envDeadLetterTTL, c.DeadLetterTTL))
+	}
+	if c.HistoryTTL <= 0 {
+		errs = append(errs, fmt.Errorf("%s must be positive, got %s", envHistoryTTL, c.HistoryTTL))
+	}
+	if c.WebhookTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s must be positive, got %s", envWebhookTimeout, c.WebhookTimeout))
+	}
+	if c.WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", envWebhookAttempts, c.WebhookMaxAttempts))
+	}
+	if c.WebhookBackoff < 0 {
+		errs = append(errs, fmt.Errorf("%s must not be negative, got %s", envWebhookBackoff, c.WebhookBackoff))
+	}
+	if c.IdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s must be positive, got %s", envIdleTimeout, c.IdleTimeout))
+	}
+	if c.SweepSegments < 1 {
+		errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", envSweepSegments, c.SweepSegments))
+	}
+	for _, l := range []struct {
+		rate, burst string
+		limit       RateLimit
+	}{
+		{envConnectionRate, envConnectionBurst, c.ConnectionRateLimit},
+		{envPrincipalRate, envPrincipalBurst, c.PrincipalRateLimit},
+	} {
+		if l.limit.PerMinute < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", l.rate, l.limit.PerMinute))
+		}
+		if l.limit.PerMinute > 0 && l.limit.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", l.burst, l.limit.Burst))
+		}
+	}
+	if c.MaxMessageSize < 1 || c.MaxMessageSize > APIGatewayMessageSize {
+		errs = append(errs, fmt.Errorf("%s must be between 1 and %d, got %d", envMaxMessageSize, APIGatewayMessageSize, c.MaxMessageSize))
+	}
+	if c.MaxFrameSize < MinFrameSize || c.MaxFrameSize > APIGatewayMessageSize {
+		errs = append(errs, fmt.Errorf("%s must be between %d and %d, got %d", envMaxFrameSize, MinFrameSize, APIGatewayMessageSize, c.MaxFrameSize))
+	}
+	if u, err := url.Parse(c.WebSocketURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("%s %q is not a ws:// or wss:// URL", envWebSocketURL, c.WebSocketURL))
+	}
+	if c.ConnectionsEndpoint != "" {
+		if u, err := url.Parse(c.ConnectionsEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s %q is not an http:// or https:// URL", envConnectionsURL, c.ConnectionsEndpoint))
+		}
+	}
+	switch c.TracesExporter {
+	case TracesExporterNone, TracesExporterStdout, TracesExporterOTLP:
+	default:
+		errs = append(errs, fmt.Errorf("%s %q is not one of none, stdout or otlp", envTracesExporter, c.TracesExporter))
+	}
+	return errors.Join(errs...)
+}
+
+// IsAdmin reports whether principal is listed in AdminPrincipals. Anonymous
+// callers never are.
+func (c *Config) IsAdmin(principal string) bool {
+	if principal == "" {
+		return false
+	}
+	for _, p := range strings.Split(c.AdminPrincipals, ",") {
+		if strings.TrimSpace(p) == principal {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfigFrom(env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg != DefaultConfig() {
+		t.Fatalf("got %+v, want defaults", cfg)
+	}
+}
+
+func TestLoadConfigStageOverrides(t *testing.T) {
+	cfg, err := LoadConfigFrom(env(map[string]string{
+		"STAGE":               "prod",
+		"MESSAGES_TABLE":      "Messages",
+		"PROD_MESSAGES_TABLE": "ProdMessages",
+		"CONNECTIONS_TABLE":   "Connections",
+		"DEV_MESSAGE_TTL":     "5m",
+		"MESSAGE_TTL":         "2h",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MessagesTable != "ProdMessages" {
+		t.Errorf("MessagesTable = %q, want the stage override", cfg.MessagesTable)
+	}
+	if cfg.ConnectionsTable != "Connections" {
+		t.Errorf("ConnectionsTable = %q, want the unprefixed value", cfg.ConnectionsTable)
+	}
+	if cfg.MessageTTL != 2*time.Hour {
+		t.Errorf("MessageTTL = %s, other stages must not leak in", cfg.MessageTTL)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		vars map[string]string
+		want string
+	}{
+		{"bad ttl", map[string]string{"MESSAGE_TTL": "soon"}, "MESSAGE_TTL"},
+		{"negative ttl", map[string]string{"MESSAGE_TTL": "-1h"}, "must be positive"},
+		{"bad table", map[string]string{"MESSAGES_TABLE": "a b"}, "MESSAGES_TABLE"},
+		{"bad url", map[string]string{"WEBSOCKET_URL": "https://example.com"}, "WEBSOCKET_URL"},
+		{"bad log level", map[string]string{"LOG_LEVEL": "loud"}, "LOG_LEVEL"},
+		{"bad exporter", map[string]string{"TRACES_EXPORTER": "zipkin"}, "TRACES_EXPORTER"},
+		{"zero history ttl", map[string]string{"HISTORY_TTL": "0s"}, "HISTORY_TTL"},
+		{"no webhook attempts", map[string]string{"WEBHOOK_MAX_ATTEMPTS": "0"}, "WEBHOOK_MAX_ATTEMPTS"},
+		{"bad webhook attempts", map[string]string{"WEBHOOK_MAX_ATTEMPTS": "many"}, "WEBHOOK_MAX_ATTEMPTS"},
+		{"zero idle timeout", map[string]string{"IDLE_TIMEOUT": "0s"}, "IDLE_TIMEOUT"},
+		{"no sweep segments", map[string]string{"SWEEP_SEGMENTS": "0"}, "SWEEP_SEGMENTS"},
+		{"bad sweep segments", map[string]string{"SWEEP_SEGMENTS": "all"}, "SWEEP_SEGMENTS"},
+		{"negative rate limit", map[string]string{"CONNECTION_RATE_LIMIT": "-1"}, "CONNECTION_RATE_LIMIT"},
+		{"empty bucket", map[string]string{"PRINCIPAL_RATE_BURST": "0"}, "PRINCIPAL_RATE_BURST"},
+		{"message over the API Gateway limit", map[string]string{"MAX_MESSAGE_SIZE": "200000"}, "MAX_MESSAGE_SIZE"},
+		{"frame too small for chunks", map[string]string{"MAX_FRAME_SIZE": "100"}, "MAX_FRAME_SIZE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFrom(env(tt.vars))
+			if err == nil || strings.Count(err.Error(), tt.want) != 1 {
+				t.Fatalf("got %v, want one error mentioning %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	cfg, err := LoadConfigFrom(env(map[string]string{"ADMIN_PRINCIPALS": "ops-alice, svc-support"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for principal, want := range map[string]bool{
+		"ops-alice":   true,
+		"svc-support": true,
+		"ops":         false,
+		"":            false,
+	} {
+		if got := cfg.IsAdmin(principal); got != want {
+			t.Errorf("IsAdmin(%q) = %v, want %v", principal, got, want)
+		}
+	}
+	if defaults := DefaultConfig(); defaults.IsAdmin("ops-alice") {
+		t.Error("nobody is an admin by default")
+	}
+}
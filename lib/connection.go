@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// MaxConnectionDuration is how long API Gateway keeps a WebSocket connection
+// open. Connection records expire after it, in case $disconnect never ran.
+const MaxConnectionDuration = 2 * time.Hour
+
+// ProtocolVersion is the version of the notification protocol spoken by
+// this tree, reported by clients when they connect.
+const ProtocolVersion = "1"
+
+// Headers and query parameters a client uses to describe itself to $connect.
+// Browsers cannot set headers on a WebSocket, so the query takes precedence.
+const (
+	HeaderClientVersion   = "X-Client-Version"
+	HeaderProtocolVersion = "X-Protocol-Version"
+	ParamClientVersion    = "client_version"
+	ParamProtocolVersion  = "protocol_version"
+)
+
+// NewConnection returns the record for a $connect request watching channel,
+// with what API Gateway and the client told about the caller.
+func NewConnection(request events.APIGatewayWebsocketProxyRequest, channel Channel, now time.Time) Connection {
+	rc := request.RequestContext
+	now = now.UTC()
+	conn := Connection{
+		ConnectionID:    rc.ConnectionID,
+		Channel:         channel.Key(),
+		ConnectedAt:     now,
+		LastSeen:        now,
+		ExpiresAt:       now.Add(MaxConnectionDuration),
+		SourceIP:        rc.Identity.SourceIP,
+		UserAgent:       rc.Identity.UserAgent,
+		Principal:       Principal(rc),
+		ClientVersion:   clientParam(request, ParamClientVersion, HeaderClientVersion),
+		ProtocolVersion: clientParam(request, ParamProtocolVersion, HeaderProtocolVersion),
+	}
+	if conn.UserAgent == "" {
+		conn.UserAgent = header(request.Headers, "User-Agent")
+	}
+	return conn
+}
+
+func clientParam(request events.APIGatewayWebsocketProxyRequest, param, name string) string {
+	if v := request.QueryStringParameters[param]; v != "" {
+		return v
+	}
+	return header(request.Headers, name)
+}
+
+// header looks name up in headers whatever the case the client sent it in.
+func header(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+func TestNewConnection(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	request := events.APIGatewayWebsocketProxyRequest{
+		Headers: map[string]string{
+			"x-client-version":   "ios/3.2.0",
+			"X-Protocol-Version": "0",
+		},
+		QueryStringParameters: map[string]string{"protocol_version": ProtocolVersion},
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: "c1",
+			Identity:     events.APIGatewayRequestIdentity{SourceIP: "203.0.113.7", UserAgent: "okhttp/4.12"},
+			Authorizer:   map[string]interface{}{"principalId": "user123"},
+		},
+	}
+
+	got := NewConnection(request, OrderChannel("42"), now)
+	want := Connection{
+		ConnectionID:    "c1",
+		Channel:         "42",
+		LastSeen:        now.UTC(),
+		ConnectedAt:     now.UTC(),
+		ExpiresAt:       now.UTC().Add(2 * time.Hour),
+		SourceIP:        "203.0.113.7",
+		UserAgent:       "okhttp/4.12",
+		Principal:       "user123",
+		ClientVersion:   "ios/3.2.0",
+		ProtocolVersion: ProtocolVersion,
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Without an identity, e.g. through the local gateway of an older tree
+	request.RequestContext.Identity = events.APIGatewayRequestIdentity{}
+	request.Headers["User-Agent"] = "curl/8.5"
+	if got := NewConnection(request, OrderChannel("42"), now); got.UserAgent != "curl/8.5" || got.SourceIP != "" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+// putCapture keeps the last item written through PutItem and the last
+// transaction of watcher counts.
+type putCapture struct {
+	DynamoDBAPI
+	item *dynamodb.PutItemInput
+	txn  *dynamodb.TransactWriteItemsInput
+}
+
+func (p *putCapture) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	p.item = in
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (p *putCapture) TransactWriteItems(_ context.Context, in *dynamodb.TransactWriteItemsInput, _ ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	p.txn = in
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestConnectionItem(t *testing.T) {
+	now := time.Unix(1714564800, 0).UTC()
+	tests := []Connection{
+		{ConnectionID: "c1", Channel: "42"},
+		{ConnectionID: "c2", Channel: "shipment:S1", LastSeen: now},
+		{
+			ConnectionID:    "c3",
+			Channel:         "42",
+			LastSeen:        now.Add(time.Minute),
+			ConnectedAt:     now,
+			ExpiresAt:       now.Add(MaxConnectionDuration),
+			SourceIP:        "203.0.113.7",
+			UserAgent:       "okhttp/4.12",
+			Principal:       "user123",
+			ClientVersion:   "ios/3.2.0",
+			ProtocolVersion: ProtocolVersion,
+			Filter:          "status != CREATED",
+			Subprotocol:     SubprotocolMsgpack,
+		},
+	}
+	for _, conn := range tests {
+		t.Run(conn.ConnectionID, func(t *testing.T) {
+			db := &putCapture{}
+			store := &DynamoStore{DynamoDB: db, Config: &Config{ConnectionsTable: "WebSocketConnections", PresenceTable: "WebSocketPresence"}}
+			if err := store.PutConnection(context.Background(), conn); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := db.item.Item["ttl"]; ok != !conn.ExpiresAt.IsZero() {
+				t.Errorf("ttl written: %v, want %v", ok, !conn.ExpiresAt.IsZero())
+			}
+			got, ok := connectionFromItem(db.item.Item)
+			if !ok || got != conn {
+				t.Fatalf("got %+v, want %+v", got, conn)
+			}
+		})
+	}
+}
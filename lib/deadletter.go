@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// ErrDeadLetterNotFound is returned by DeadLetterStore.Get for unknown IDs.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+type (
+	// DeadLetter is an update that could not be delivered to a connection or
+	// a webhook.
+	DeadLetter struct {
+		ID           string `json:"id"`
+		ConnectionID string `json:"connection_id,omitempty"`
+		// WebhookID is set instead of ConnectionID for webhook deliveries.
+		WebhookID string `json:"webhook_id,omitempty"`
+		// Endpoint is the @connections endpoint the delivery went to, needed
+		// to replay it, or the webhook URL.
+		Endpoint string      `json:"endpoint"`
+		Message  MessageData `json:"message"`
+		// Subprotocol is the one of the connection, which the replay
+		// encodes the message for.
+		Subprotocol string    `json:"subprotocol,omitempty"`
+		Reason      string    `json:"reason"`
+		Attempts    int       `json:"attempts"`
+		FailedAt    time.Time `json:"failed_at"`
+	}
+
+	// DeadLetterStore keeps undeliverable updates until they are replayed or
+	// purged.
+	DeadLetterStore interface {
+		Put(ctx context.Context, dl DeadLetter) error
+		Get(ctx context.Context, id string) (*DeadLetter, error)
+		// List returns up to limit dead letters, oldest first. A limit of 0
+		// returns all of them.
+		List(ctx context.Context, limit int) ([]DeadLetter, error)
+		Delete(ctx context.Context, id string) error
+	}
+
+	// DynamoDeadLetterStore stores dead letters in a DynamoDB table keyed by
+	// id. Items expire after TTL.
+	DynamoDeadLetterStore struct {
+		DynamoDB DynamoDBAPI
+		Table    string
+		TTL      time.Duration
+	}
+
+	// MemoryDeadLetterStore is an in-process DeadLetterStore for tests and
+	// local runs.
+	MemoryDeadLetterStore struct {
+		mu    sync.Mutex
+		items map[string]DeadLetter
+	}
+)
+
+// NewDeadLetter returns a dead letter for a first failed delivery.
+func NewDeadLetter(endpoint, connectionID string, message MessageData, err error) DeadLetter {
+	return DeadLetter{
+		ID:           uuid.NewString(),
+		ConnectionID: connectionID,
+		Endpoint:     endpoint,
+		Message:      message,
+		Reason:       err.Error(),
+		Attempts:     1,
+		FailedAt:     time.Now().UTC(),
+	}
+}
+
+// NewWebhookDeadLetter returns a dead letter for a failed webhook delivery.
+func NewWebhookDeadLetter(hook Webhook, message MessageData, err error) DeadLetter {
+	dl := NewDeadLetter(hook.URL, "", message, err)
+	dl.WebhookID = hook.ID
+	return dl
+}
+
+// Replay posts dl to its connection or webhook again. On success dl is
+// removed from store, otherwise it is stored back with the new reason and
+// attempt count.
+func (d *Deps) Replay(ctx context.Context, store DeadLetterStore, dl DeadLetter) error {
+	err := d.redeliver(ctx, dl)
+	if err != nil {
+		dl.Attempts++
+		dl.Reason = err.Error()
+		dl.FailedAt = time.Now().UTC()
+		if putErr := store.Put(ctx, dl); putErr != nil {
+			return errors.Join(err, putErr)
+		}
+		return err
+	}
+	return store.Delete(ctx, dl.ID)
+}
+
+func (d *Deps) redeliver(ctx context.Context, dl DeadLetter) error {
+	if dl.WebhookID != "" {
+		// Look the webhook up again so a rotated secret or URL is used
+		hook, err := d.Webhooks.GetWebhook(ctx, dl.WebhookID)
+		if err != nil {
+			return err
+		}
+		_, err = d.PostWebhook(ctx, *hook, dl.Message)
+		return err
+	}
+	codec := CodecFor(dl.Subprotocol)
+	data, err := codec.Marshal(dl.Message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	return d.postData(ctx, codec, dl.Endpoint, dl.ConnectionID, data)
+}
+
+func (s *DynamoDeadLetterStore) Put(ctx context.Context, dl DeadLetter) error {
+	message, err := json.Marshal(dl.Message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	item := map[string]types.AttributeValue{
+		"id":           &types.AttributeValueMemberS{Value: dl.ID},
+		"connectionId": &types.AttributeValueMemberS{Value: dl.ConnectionID},
+		"endpoint":     &types.AttributeValueMemberS{Value: dl.Endpoint},
+		"message":      &types.AttributeValueMemberS{Value: string(message)},
+		"reason":       &types.AttributeValueMemberS{Value: dl.Reason},
+		"attempts":     &types.AttributeValueMemberN{Value: strconv.Itoa(dl.Attempts)},
+		"failedAt":     &types.AttributeValueMemberS{Value: dl.FailedAt.Format(time.RFC3339Nano)},
+		"ttl":          &types.AttributeValueMemberN{Value: strconv.FormatInt(dl.FailedAt.Add(s.TTL).Unix(), 10)},
+	}
+	if dl.WebhookID != "" {
+		item["webhookId"] = &types.AttributeValueMemberS{Value: dl.WebhookID}
+	}
+	if dl.Subprotocol != "" {
+		item["subprotocol"] = &types.AttributeValueMemberS{Value: dl.Subprotocol}
+	}
+	_, err = s.DynamoDB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoDeadLetterStore) Get(ctx context.Context, id string) (*DeadLetter, error) {
+	out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return deadLetterFromItem(out.Item)
+}
+
+func (s *DynamoDeadLetterStore) List(ctx context.Context, limit int) ([]DeadLetter, error) {
+	var (
+		dls   []DeadLetter
+		start map[string]types.AttributeValue
+	)
+	for {
+		out, err := s.DynamoDB.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(s.Table),
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			dl, err := deadLetterFromItem(item)
+			if err != nil {
+				return nil, err
+			}
+			dls = append(dls, *dl)
+		}
+		if start = out.LastEvaluatedKey; len(start) == 0 {
+			break
+		}
+	}
+	return oldestFirst(dls, limit), nil
+}
+
+func (s *DynamoDeadLetterStore) Delete(ctx context.Context, id string) error {
+	_, err := s.DynamoDB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	return err
+}
+
+func deadLetterFromItem(item map[string]types.AttributeValue) (*DeadLetter, error) {
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	dl := &DeadLetter{
+		ID:           str("id"),
+		ConnectionID: str("connectionId"),
+		WebhookID:    str("webhookId"),
+		Endpoint:     str("endpoint"),
+		Subprotocol:  str("subprotocol"),
+		Reason:       str("reason"),
+	}
+	if err := json.Unmarshal([]byte(str("message")), &dl.Message); err != nil {
+		return nil, fmt.Errorf("dead letter %s: invalid message: %w", dl.ID, err)
+	}
+	if v, ok := item["attempts"].(*types.AttributeValueMemberN); ok {
+		dl.Attempts, _ = strconv.Atoi(v.Value)
+	}
+	dl.FailedAt, _ = time.Parse(time.RFC3339Nano, str("failedAt"))
+	return dl, nil
+}
+
+// NewMemoryDeadLetterStore returns an empty in-process store.
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{items: make(map[string]DeadLetter)}
+}
+
+func (s *MemoryDeadLetterStore) Put(_ context.Context, dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[dl.ID] = dl
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) Get(_ context.Context, id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dl, ok := s.items[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &dl, nil
+}
+
+func (s *MemoryDeadLetterStore) List(_ context.Context, limit int) ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dls := make([]DeadLetter, 0, len(s.items))
+	for _, dl := range s.items {
+		dls = append(dls, dl)
+	}
+	return oldestFirst(dls, limit), nil
+}
+
+func (s *MemoryDeadLetterStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, id)
+	return nil
+}
+
+func oldestFirst(dls []DeadLetter, limit int) []DeadLetter {
+	sort.Slice(dls, func(i, j int) bool {
+		if !dls[i].FailedAt.Equal(dls[j].FailedAt) {
+			return dls[i].FailedAt.Before(dls[j].FailedAt)
+		}
+		return dls[i].ID < dls[j].ID
+	})
+	if limit > 0 && len(dls) > limit {
+		dls = dls[:limit]
+	}
+	return dls
+}
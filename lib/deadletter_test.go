@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+type postFunc func(*apigatewaymanagementapi.PostToConnectionInput) error
+
+func (f postFunc) PostToConnection(_ context.Context, in *apigatewaymanagementapi.PostToConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, f(in)
+}
+
+func (f postFunc) GetConnection(context.Context, *apigatewaymanagementapi.GetConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	return nil, errors.New("unexpected GetConnection")
+}
+
+func (f postFunc) DeleteConnection(context.Context, *apigatewaymanagementapi.DeleteConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	return nil, errors.New("unexpected DeleteConnection")
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	postErr := errors.New("throttled")
+	var posted []string
+	deps := &Deps{NewManagementAPI: func(string) ManagementAPI {
+		return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+			posted = append(posted, *in.ConnectionId)
+			return postErr
+		})
+	}}
+	store := NewMemoryDeadLetterStore()
+	dl := NewDeadLetter("https://example.com/dev", "conn-1", MessageData{OrderID: "42", Status: "SHIPPED"}, errors.New("boom"))
+	if err := store.Put(ctx, dl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := deps.Replay(ctx, store, dl); !errors.Is(err, postErr) {
+		t.Fatalf("got %v, want %v", err, postErr)
+	}
+	got, err := store.Get(ctx, dl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Attempts != 2 || got.Reason != "throttled" {
+		t.Fatalf("got attempts=%d reason=%q, want 2 and the replay error", got.Attempts, got.Reason)
+	}
+
+	postErr = nil
+	if err := deps.Replay(ctx, store, *got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, dl.ID); !errors.Is(err, ErrDeadLetterNotFound) {
+		t.Fatalf("got %v, want the dead letter removed after a successful replay", err)
+	}
+	if len(posted) != 2 || posted[0] != "conn-1" {
+		t.Fatalf("posted to %v", posted)
+	}
+}
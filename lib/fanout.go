@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FanoutResult counts what happened to the connections and webhooks of a
+// fan-out. Delivered, Failed and DeadLettered count both.
+type FanoutResult struct {
+	Connections int
+	// Filtered counts the connections whose filter turned the message
+	// down. They are not counted in Connections.
+	Filtered     int
+	Webhooks     int
+	Delivered    int
+	Gone         int
+	Failed       int
+	DeadLettered int
+}
+
+// Fanout posts msg to every connection watching its channel or the channel
+// of one of its owners, except the one that published it and those whose
+// filter rejects it, and to the webhooks subscribed to its order or customer.
+// Webhooks are called once each, within WebhookTimeout altogether.
+// Connections that are gone are counted and left to the sweeper, other failed
+// deliveries are dead-lettered, so the returned error only reports what could not be
+// recorded: a subscriber lookup or a dead letter write.
+func (d *Deps) Fanout(ctx context.Context, msg StoredMessage) (FanoutResult, error) {
+	var result FanoutResult
+	channel := msg.ChannelKey()
+	logger := Logger(ctx).With(channelAttr(ChannelFromKey(channel))...)
+
+	endpoint := msg.Endpoint
+	if endpoint == "" {
+		endpoint = d.Config.ConnectionsEndpoint
+	}
+
+	ctx, span := d.Tracer().Start(ctx, "fanout", trace.WithAttributes(attribute.String("channel", channel)))
+
+	// A connection watches a single channel, so the audience has no duplicates
+	var conns []Connection
+	for _, key := range msg.Audience() {
+		watchers, err := d.Store.ConnectionsForChannel(ctx, key)
+		if err != nil {
+			EndSpan(span, err)
+			return result, fmt.Errorf("failed to query connections of %s: %w", key, err)
+		}
+		conns = append(conns, watchers...)
+	}
+	if endpoint == "" && len(conns) > 0 {
+		err := errors.New("no @connections endpoint for the message or in the configuration")
+		EndSpan(span, err)
+		return result, err
+	}
+	var hooks []Webhook
+	var err error
+	if d.Webhooks != nil {
+		if hooks, err = d.Webhooks.WebhooksFor(ctx, msg.OrderID, msg.CustomerID); err != nil {
+			EndSpan(span, err)
+			return result, fmt.Errorf("failed to query webhooks: %w", err)
+		}
+	}
+	span.SetAttributes(attribute.Int("connections", len(conns)), attribute.Int("webhooks", len(hooks)))
+	logger.Debug("fanning out", "connections", len(conns), "webhooks", len(hooks))
+
+	frame := msg.MessageData
+	frame.Trace = InjectTrace(ctx)
+
+	var errs []error
+	filters := make(map[string]Filter)
+	for _, conn := range conns {
+		// Avoid sending to the same connection that originated the message
+		if conn.ConnectionID == msg.SourceConnectionID {
+			continue
+		}
+		if conn.Filter != "" {
+			filter, ok := filters[conn.Filter]
+			if !ok {
+				// Filters are checked at $connect, a broken one lets everything through
+				var err error
+				if filter, err = ParseFilter(conn.Filter); err != nil {
+					logger.Warn("ignoring invalid filter", "target", conn.ConnectionID, "error", err)
+				}
+				filters[conn.Filter] = filter
+			}
+			if !filter.Match(msg.MessageData) {
+				result.Filtered++
+				continue
+			}
+		}
+		result.Connections++
+
+		err := d.PostFrameTo(ctx, endpoint, conn, frame)
+		switch {
+		case IsGone(err):
+			// The client went away without $disconnect, the sweeper removes
+			// the stale row
+			logger.Info("skipping gone connection", "target", conn.ConnectionID)
+			result.Gone++
+		case err != nil:
+			logger.Error("failed to send message", "target", conn.ConnectionID, "error", err)
+			result.Failed++
+			// Keep the update so it can be replayed instead of losing it
+			dl := NewDeadLetter(endpoint, conn.ConnectionID, frame, err)
+			dl.Subprotocol = conn.Subprotocol
+			if err := d.DeadLetters.Put(ctx, dl); err != nil {
+				errs = append(errs, fmt.Errorf("failed to store dead letter for %s: %w", conn.ConnectionID, err))
+				continue
+			}
+			result.DeadLettered++
+		default:
+			result.Delivered++
+		}
+	}
+
+	for i, err := range d.deliverWebhooks(ctx, hooks, frame) {
+		hook := hooks[i]
+		result.Webhooks++
+		if err == nil {
+			result.Delivered++
+			continue
+		}
+		logger.Error("failed to call webhook", "webhook", hook.ID, "error", err)
+		result.Failed++
+		dl := NewWebhookDeadLetter(hook, frame, err)
+		if err := d.DeadLetters.Put(ctx, dl); err != nil {
+			errs = append(errs, fmt.Errorf("failed to store dead letter for webhook %s: %w", hook.ID, err))
+			continue
+		}
+		result.DeadLettered++
+	}
+	err = errors.Join(errs...)
+	EndSpan(span, err)
+	return result, err
+}
+
+// PostFrame marshals frame to JSON and posts it to a connection. Frames
+// larger than MaxFrameSize are posted as chunk frames, which the client
+// joins back, see Reassembler.
+func (d *Deps) PostFrame(ctx context.Context, endpoint, connectionID string, frame any) error {
+	return d.postFrame(ctx, JSON, endpoint, connectionID, frame)
+}
+
+// PostFrameTo is PostFrame encoding frame for the subprotocol of conn.
+func (d *Deps) PostFrameTo(ctx context.Context, endpoint string, conn Connection, frame any) error {
+	return d.postFrame(ctx, CodecFor(conn.Subprotocol), endpoint, conn.ConnectionID, frame)
+}
+
+func (d *Deps) postFrame(ctx context.Context, codec Codec, endpoint, connectionID string, frame any) (err error) {
+	ctx, span := d.Tracer().Start(ctx, "PostToConnection",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("connection_id", connectionID)))
+	defer func() { EndSpan(span, err) }()
+
+	data, err := codec.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if err := d.postData(ctx, codec, endpoint, connectionID, data); err != nil {
+		return fmt.Errorf("PostToConnection failed: %w", err)
+	}
+	return nil
+}
+
+// postData posts data to a connection, as chunk frames encoded by codec
+// when it is larger than MaxFrameSize.
+func (d *Deps) postData(ctx context.Context, codec Codec, endpoint, connectionID string, data []byte) error {
+	chunks, err := Chunk(data, d.maxFrameSize())
+	if err != nil {
+		return err
+	}
+	api := d.ManagementAPI(endpoint)
+	post := func(data []byte) error {
+		_, err := api.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+			ConnectionId: aws.String(connectionID),
+			Data:         data,
+		})
+		return err
+	}
+	if chunks == nil {
+		return post(data)
+	}
+	for _, chunk := range chunks {
+		data, err := codec.Marshal(chunk)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chunk: %w", err)
+		}
+		if err := post(data); err != nil {
+			return fmt.Errorf("chunk %d of %d: %w", chunk.Part, chunk.Parts, err)
+		}
+	}
+	return nil
+}
+
+// IsGone reports whether err says the connection no longer exists.
+func IsGone(err error) bool {
+	var gone *apigatewaytypes.GoneException
+	return errors.As(err, &gone)
+}
+
+// EndSpan records err, if any, on span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+func TestFanout(t *testing.T) {
+	ctx := context.Background()
+	conf := DefaultConfig()
+	store := NewMemoryStore()
+	deadLetters := NewMemoryDeadLetterStore()
+	frames := map[string]MessageData{}
+	deps := &Deps{
+		Config:      &conf,
+		Store:       store,
+		DeadLetters: deadLetters,
+		NewManagementAPI: func(string) ManagementAPI {
+			return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+				switch id := aws.ToString(in.ConnectionId); id {
+				case "gone":
+					return &apigatewaytypes.GoneException{}
+				case "broken":
+					return errors.New("throttled")
+				default:
+					codec := JSON
+					if id == "compact" {
+						codec = Msgpack
+					}
+					var frame MessageData
+					if err := codec.Unmarshal(in.Data, &frame); err != nil {
+						t.Fatal(err)
+					}
+					frames[id] = frame
+					return nil
+				}
+			})
+		},
+	}
+	for _, id := range []string{"publisher", "watcher", "gone", "broken"} {
+		if err := store.PutConnection(ctx, Connection{ConnectionID: id, Channel: "42"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutConnection(ctx, Connection{ConnectionID: "other", Channel: "7"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutConnection(ctx, Connection{ConnectionID: "compact", Channel: "42", Subprotocol: SubprotocolMsgpack}); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []events.DynamoDBEventRecord
+	store.OnMessageChange(func(r events.DynamoDBEventRecord) { records = append(records, r) })
+	msg := StoredMessage{
+		MessageData:        MessageData{ID: "m1", Status: "SHIPPED", OrderID: "42"},
+		Endpoint:           "https://example.com/dev",
+		SourceConnectionID: "publisher",
+	}
+	if err := deps.Publish(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].EventName != "INSERT" {
+		t.Fatalf("got records %+v, want one INSERT", records)
+	}
+
+	result, err := deps.Fanout(ctx, *MessageFromStreamImage(records[0].Change.NewImage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FanoutResult{Connections: 4, Delivered: 2, Gone: 1, Failed: 1, DeadLettered: 1}
+	if result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+	for _, id := range []string{"watcher", "compact"} {
+		if got := frames[id]; got.ID != "m1" || got.Status != "SHIPPED" {
+			t.Fatalf("%s got %+v", id, got)
+		}
+	}
+	if _, ok := frames["publisher"]; ok {
+		t.Fatal("the publisher must not receive its own message")
+	}
+	if _, err := store.GetConnection(ctx, "gone"); err != nil {
+		t.Fatalf("gone connection must be left to the sweeper: %v", err)
+	}
+	dls, _ := deadLetters.List(ctx, 0)
+	if len(dls) != 1 || dls[0].ConnectionID != "broken" || dls[0].Endpoint != msg.Endpoint {
+		t.Fatalf("got dead letters %+v", dls)
+	}
+}
+
+func TestFanoutOwners(t *testing.T) {
+	ctx := context.Background()
+	conf := DefaultConfig()
+	store := NewMemoryStore()
+	var got []string
+	deps := &Deps{
+		Config:      &conf,
+		Store:       store,
+		DeadLetters: NewMemoryDeadLetterStore(),
+		NewManagementAPI: func(string) ManagementAPI {
+			return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+				got = append(got, aws.ToString(in.ConnectionId))
+				return nil
+			})
+		},
+	}
+	for id, channel := range map[string]string{
+		"order":          "42",
+		"customer":       "customer:C1",
+		"merchant":       "merchant:M1",
+		"other-customer": "customer:C2",
+		"other-merchant": "merchant:M2",
+	} {
+		store.PutConnection(ctx, Connection{ConnectionID: id, Channel: channel})
+	}
+
+	var records []events.DynamoDBEventRecord
+	store.OnMessageChange(func(r events.DynamoDBEventRecord) { records = append(records, r) })
+	publish := func(data MessageData) []string {
+		t.Helper()
+		got = nil
+		if err := deps.Publish(ctx, StoredMessage{MessageData: data, Endpoint: "https://example.com/dev"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := deps.Fanout(ctx, *MessageFromStreamImage(records[len(records)-1].Change.NewImage)); err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		return got
+	}
+
+	if got := publish(MessageData{ID: "m1", Status: "PAID", OrderID: "42", CustomerID: "C1", MerchantID: "M1"}); !slices.Equal(got, []string{"customer", "merchant", "order"}) {
+		t.Fatalf("got %v, want the order, customer and merchant watchers", got)
+	}
+	// The owners of the order are remembered
+	if got := publish(MessageData{ID: "m2", Status: "SHIPPED", OrderID: "42"}); !slices.Equal(got, []string{"customer", "merchant", "order"}) {
+		t.Fatalf("got %v, want the owners to be resolved from the previous status", got)
+	}
+	stored, _ := store.GetMessage(ctx, "42")
+	if stored.CustomerID != "C1" || stored.MerchantID != "M1" {
+		t.Fatalf("got %+v", stored.MessageData)
+	}
+	if got := publish(MessageData{ID: "m3", Status: "ONLINE", Channel: "merchant:M1"}); !slices.Equal(got, []string{"merchant"}) {
+		t.Fatalf("got %v, want the merchant watcher alone", got)
+	}
+}
@@ -0,0 +1,276 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// MaxFilterLength bounds the filters stored with connections.
+const MaxFilterLength = 512
+
+// ErrInvalidFilter is returned by ParseFilter.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter selects the messages a subscription receives. It is either a list of
+// statuses, as in "SHIPPED,DELIVERED", or an expression over the JSON fields
+// of MessageData:
+//
+//	status in (SHIPPED, DELIVERED) and customer_id = C1
+//	status != CREATED or merchant_id = M1
+//
+// Conditions are field = value, field != value, field in (values) and field
+// not in (values). "and" binds tighter than "or", and values holding spaces
+// or punctuation are quoted with ' or ". The zero Filter matches everything.
+type Filter struct {
+	src string
+	// any is a disjunction of conjunctions.
+	any [][]condition
+}
+
+type condition struct {
+	field  string
+	negate bool
+	values []string
+}
+
+// filterFields are the MessageData fields a filter may test.
+var filterFields = map[string]func(MessageData) string{
+	"id":          func(m MessageData) string { return m.ID },
+	"status":      func(m MessageData) string { return m.Status },
+	"date":        func(m MessageData) string { return m.Date },
+	"channel":     func(m MessageData) string { return ChannelFromKey(m.ChannelKey()).String() },
+	"order_id":    func(m MessageData) string { return m.OrderID },
+	"customer_id": func(m MessageData) string { return m.CustomerID },
+	"merchant_id": func(m MessageData) string { return m.MerchantID },
+}
+
+// ParseFilter parses a filter, see Filter. An empty string matches everything.
+func ParseFilter(s string) (Filter, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Filter{}, nil
+	}
+	if len(s) > MaxFilterLength {
+		return Filter{}, fmt.Errorf("%w: longer than %d bytes", ErrInvalidFilter, MaxFilterLength)
+	}
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return Filter{}, err
+	}
+	p := filterParser{tokens: tokens}
+	f := Filter{src: s}
+	if p.isStatusList() {
+		values, err := p.values()
+		if err != nil {
+			return Filter{}, err
+		}
+		f.any = [][]condition{{{field: "status", values: values}}}
+	} else {
+		for {
+			all, err := p.conjunction()
+			if err != nil {
+				return Filter{}, err
+			}
+			f.any = append(f.any, all)
+			if !p.accept("or") {
+				break
+			}
+		}
+	}
+	if tok, ok := p.peek(); ok {
+		return Filter{}, fmt.Errorf("%w: unexpected %q", ErrInvalidFilter, tok.text)
+	}
+	return f, nil
+}
+
+// String returns the filter as it was parsed.
+func (f Filter) String() string {
+	return f.src
+}
+
+// Match reports whether m passes the filter.
+func (f Filter) Match(m MessageData) bool {
+	if len(f.any) == 0 {
+		return true
+	}
+	for _, all := range f.any {
+		if !slices.ContainsFunc(all, func(c condition) bool { return !c.match(m) }) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c condition) match(m MessageData) bool {
+	return slices.Contains(c.values, filterFields[c.field](m)) != c.negate
+}
+
+type filterToken struct {
+	text string
+	// quoted tokens are always values, never keywords or punctuation.
+	quoted bool
+}
+
+func lexFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrInvalidFilter)
+			}
+			tokens = append(tokens, filterToken{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.HasPrefix(s[i:], "!="):
+			tokens = append(tokens, filterToken{text: "!="})
+			i += 2
+		case strings.IndexByte("(),=", c) >= 0:
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		default:
+			end := i
+			for end < len(s) && strings.IndexByte(" \t(),=!'\"", s[end]) < 0 {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidFilter, s[i:i+1])
+			}
+			tokens = append(tokens, filterToken{text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (t filterToken) punct() bool {
+	if t.quoted {
+		return false
+	}
+	switch t.text {
+	case "(", ")", ",", "=", "!=":
+		return true
+	}
+	return false
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos == len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// accept consumes the next token if it is the keyword or punctuation want.
+func (p *filterParser) accept(want string) bool {
+	tok, ok := p.peek()
+	if !ok || tok.quoted || !strings.EqualFold(tok.text, want) {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+func (p *filterParser) expect(want string) error {
+	if !p.accept(want) {
+		return p.unexpected("expected " + want)
+	}
+	return nil
+}
+
+func (p *filterParser) unexpected(what string) error {
+	if tok, ok := p.peek(); ok {
+		return fmt.Errorf("%w: %s, got %q", ErrInvalidFilter, what, tok.text)
+	}
+	return fmt.Errorf("%w: %s at the end", ErrInvalidFilter, what)
+}
+
+// isStatusList reports whether the filter is a bare list of statuses: a
+// value followed by a comma or nothing.
+func (p *filterParser) isStatusList() bool {
+	return len(p.tokens) == 1 || (len(p.tokens) > 1 && p.tokens[1].punct() && p.tokens[1].text == ",")
+}
+
+// value consumes a value: a quoted string or a word.
+func (p *filterParser) value() (string, error) {
+	tok, ok := p.peek()
+	if !ok || tok.punct() {
+		return "", p.unexpected("expected a value")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// values consumes a comma separated list of values.
+func (p *filterParser) values() ([]string, error) {
+	var values []string
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if !p.accept(",") {
+			return values, nil
+		}
+	}
+}
+
+// conjunction consumes conditions joined by "and".
+func (p *filterParser) conjunction() ([]condition, error) {
+	var all []condition
+	for {
+		c, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, c)
+		if !p.accept("and") {
+			return all, nil
+		}
+	}
+}
+
+func (p *filterParser) condition() (condition, error) {
+	tok, ok := p.peek()
+	if !ok || tok.quoted || filterFields[strings.ToLower(tok.text)] == nil {
+		return condition{}, p.unexpected("expected a field")
+	}
+	p.pos++
+	c := condition{field: strings.ToLower(tok.text)}
+	switch {
+	case p.accept("="), p.accept("!="):
+		c.negate = p.tokens[p.pos-1].text == "!="
+		v, err := p.value()
+		if err != nil {
+			return c, err
+		}
+		c.values = []string{v}
+		return c, nil
+	case p.accept("not"):
+		c.negate = true
+		if err := p.expect("in"); err != nil {
+			return c, err
+		}
+	case !p.accept("in"):
+		return c, p.unexpected("expected =, !=, in or not in")
+	}
+	if err := p.expect("("); err != nil {
+		return c, err
+	}
+	values, err := p.values()
+	if err != nil {
+		return c, err
+	}
+	c.values = values
+	return c, p.expect(")")
+}
@@ -0,0 +1,56 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	shipped := MessageData{ID: "m1", Status: "SHIPPED", OrderID: "42", CustomerID: "C1", MerchantID: "M1"}
+	transit := MessageData{ID: "m2", Status: "IN TRANSIT", Channel: "shipment:S1", OrderID: "42"}
+	tests := []struct {
+		filter string
+		want   []bool // matches shipped, transit
+	}{
+		{"", []bool{true, true}},
+		{"SHIPPED", []bool{true, false}},
+		{"DELIVERED, SHIPPED", []bool{true, false}},
+		{"'IN TRANSIT'", []bool{false, true}},
+		{"status = SHIPPED", []bool{true, false}},
+		{"status != SHIPPED", []bool{false, true}},
+		{`status in ("IN TRANSIT", DELIVERED)`, []bool{false, true}},
+		{"status not in (CREATED, SHIPPED)", []bool{false, true}},
+		{"order_id = 42 and customer_id = C1", []bool{true, false}},
+		{"merchant_id = M1 or channel = shipment:S1", []bool{true, true}},
+		{"STATUS = CREATED AND id = m1 OR id = m2", []bool{false, true}},
+		{"channel = order:42", []bool{true, false}},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.filter, err)
+			continue
+		}
+		if got := []bool{f.Match(shipped), f.Match(transit)}; got[0] != tt.want[0] || got[1] != tt.want[1] {
+			t.Errorf("%q matches %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{
+		"status =",
+		"status = SHIPPED and",
+		"price > 10",
+		"status in (SHIPPED",
+		"status in ()",
+		"status not SHIPPED",
+		"SHIPPED, DELIVERED extra",
+		"'SHIPPED",
+		"status ! SHIPPED",
+		"status = " + strings.Repeat("x", MaxFilterLength),
+	} {
+		if _, err := ParseFilter(s); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("ParseFilter(%q) = %v, want ErrInvalidFilter", s, err)
+		}
+	}
+}
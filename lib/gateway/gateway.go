@@ -0,0 +1,318 @@
+// Package gateway is a local stand-in for the API Gateway WebSocket API, its
+// @connections endpoint and the messages table stream, for development and
+// tests. Besides WebSockets it serves Server-Sent Events and long polls per
+// order for clients on networks that block WebSockets. All three transports
+// register in the same connection store, so a publish reaches them through
+// the same fan-out.
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"lib"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Endpoint is the @connections endpoint local messages are published
+// through.
+const Endpoint = "local"
+
+var errUnauthorized = errors.New("unauthorized")
+
+type (
+	// Route handles one WebSocket route the way its Lambda integration would.
+	Route func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)
+
+	// Authorizer checks a connection request and returns the authorizer
+	// context handed to the routes, like a Lambda REQUEST authorizer.
+	Authorizer func(r *http.Request) (map[string]interface{}, error)
+
+	// Gateway serves WebSocket connections on /ws, SSE streams on
+	// /orders/{id}/stream and long polls on /orders/{id}/poll.
+	Gateway struct {
+		Deps  *lib.Deps
+		Store *lib.MemoryStore
+		// Routes maps route keys to handlers, see DefaultRoutes.
+		Routes map[string]Route
+		// Authorize is optional, all connections are accepted without it.
+		Authorize   Authorizer
+		Stage       string
+		PollTimeout time.Duration
+		KeepAlive   time.Duration
+
+		mux      *http.ServeMux
+		upgrader websocket.Upgrader
+		mu       sync.Mutex
+		sinks    map[string]sink
+		records  chan events.DynamoDBEventRecord
+		done     chan struct{}
+	}
+
+	// sink is where frames posted to a connection go.
+	sink interface {
+		send(data []byte) error
+		close()
+	}
+)
+
+// New returns a gateway on top of deps, whose Store must be store. Frames
+// posted through deps go to the gateway's connections and changes to store
+// messages are fanned out like the messages table stream would. Close stops
+// the fan-out.
+func New(deps *lib.Deps, store *lib.MemoryStore) *Gateway {
+	g := &Gateway{
+		Deps:        deps,
+		Store:       store,
+		Routes:      DefaultRoutes(deps),
+		Stage:       "local",
+		PollTimeout: 25 * time.Second,
+		KeepAlive:   15 * time.Second,
+		mux:         http.NewServeMux(),
+		upgrader:    websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		sinks:       make(map[string]sink),
+		records:     make(chan events.DynamoDBEventRecord, 1024),
+		done:        make(chan struct{}),
+	}
+	deps.NewManagementAPI = func(string) lib.ManagementAPI { return g }
+	if deps.Config.ConnectionsEndpoint == "" {
+		deps.Config.ConnectionsEndpoint = Endpoint
+	}
+	store.OnMessageChange(func(record events.DynamoDBEventRecord) { g.records <- record })
+	// The store counts watchers as connections are written, so presence is
+	// announced right away instead of by a watchers consumer
+	store.OnConnectionChange(func(connectionID string, changes map[string]int) {
+		deps.AnnounceChanges(context.Background(), Endpoint, connectionID, changes)
+	})
+	go g.fanout()
+
+	g.mux.HandleFunc("GET /ws", g.serveWebSocket)
+	g.mux.HandleFunc("GET /orders/{id}/stream", g.serveSSE)
+	g.mux.HandleFunc("GET /orders/{id}/poll", g.servePoll)
+	return g
+}
+
+// NewLocal returns a gateway with in-memory stores and the default
+// configuration, logging to logger.
+func NewLocal(logger *slog.Logger) *Gateway {
+	conf := lib.DefaultConfig()
+	conf.ConnectionsEndpoint = Endpoint
+	store := lib.NewMemoryStore()
+	deps := lib.NewDepsFromConfig(&conf, aws.Config{Region: conf.Region})
+	deps.Store = store
+	deps.DeadLetters = lib.NewMemoryDeadLetterStore()
+	deps.Webhooks = lib.NewMemoryWebhookStore()
+	deps.RateLimits = lib.NewMemoryRateLimitStore()
+	deps.Logger = logger
+	deps.Metrics = lib.NewMetrics(io.Discard, conf.MetricsNamespace)
+	return New(deps, store)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mux.ServeHTTP(w, r)
+}
+
+// Close stops the fan-out. Connections are left to the HTTP server.
+func (g *Gateway) Close() {
+	close(g.done)
+}
+
+// PostToConnection is the @connections endpoint of the gateway. Like API
+// Gateway, it refuses data larger than lib.APIGatewayMessageSize.
+func (g *Gateway) PostToConnection(_ context.Context, in *apigatewaymanagementapi.PostToConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	if len(in.Data) > lib.APIGatewayMessageSize {
+		return nil, &apigatewaytypes.PayloadTooLargeException{Message: aws.String("payload too large")}
+	}
+	g.mu.Lock()
+	s, ok := g.sinks[aws.ToString(in.ConnectionId)]
+	g.mu.Unlock()
+	if !ok {
+		return nil, &apigatewaytypes.GoneException{Message: aws.String("connection is gone")}
+	}
+	if err := s.send(in.Data); err != nil {
+		return nil, err
+	}
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, nil
+}
+
+// GetConnection answers for the open connections of every transport, and
+// with GoneException for the others.
+func (g *Gateway) GetConnection(_ context.Context, in *apigatewaymanagementapi.GetConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	g.mu.Lock()
+	_, ok := g.sinks[aws.ToString(in.ConnectionId)]
+	g.mu.Unlock()
+	if !ok {
+		return nil, &apigatewaytypes.GoneException{Message: aws.String("connection is gone")}
+	}
+	return &apigatewaymanagementapi.GetConnectionOutput{}, nil
+}
+
+// DeleteConnection closes a connection like the @connections endpoint does,
+// which runs $disconnect.
+func (g *Gateway) DeleteConnection(_ context.Context, in *apigatewaymanagementapi.DeleteConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	id := aws.ToString(in.ConnectionId)
+	g.mu.Lock()
+	_, ok := g.sinks[id]
+	g.mu.Unlock()
+	if !ok {
+		return nil, &apigatewaytypes.GoneException{Message: aws.String("connection is gone")}
+	}
+	g.unregister(id)
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, nil
+}
+
+// Connections returns the IDs of the open connections of every transport.
+func (g *Gateway) Connections() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]string, 0, len(g.sinks))
+	for id := range g.sinks {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (g *Gateway) register(id string, s sink) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sinks[id] = s
+}
+
+func (g *Gateway) unregister(id string) {
+	g.mu.Lock()
+	s, ok := g.sinks[id]
+	delete(g.sinks, id)
+	g.mu.Unlock()
+	if ok {
+		s.close()
+	}
+}
+
+// fanout plays the fanout function: records are processed one at a time, in
+// order, like a single stream shard.
+func (g *Gateway) fanout() {
+	for {
+		select {
+		case <-g.done:
+			return
+		case record := <-g.records:
+			if record.EventName != "INSERT" && record.EventName != "MODIFY" {
+				continue
+			}
+			msg := lib.MessageFromStreamImage(record.Change.NewImage)
+			if record.EventName == "MODIFY" && lib.MessageFromStreamImage(record.Change.OldImage).ID == msg.ID {
+				continue
+			}
+			ctx := lib.WithLogger(context.Background(), g.Deps.Logger)
+			if _, err := g.Deps.Fanout(ctx, *msg); err != nil {
+				g.Deps.Logger.Error("fan-out failed", "order_id", msg.OrderID, "error", err)
+			}
+		}
+	}
+}
+
+// newConnectionID returns an ID shaped like API Gateway's.
+func newConnectionID() string {
+	return strings.ReplaceAll(uuid.NewString(), "-", "")[:16] + "="
+}
+
+// request builds the proxy request API Gateway would send for r.
+func (g *Gateway) request(r *http.Request, connectionID, routeKey, eventType, body string, authorizer map[string]interface{}) events.APIGatewayWebsocketProxyRequest {
+	query := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		query[name] = values[0]
+	}
+	headers := make(map[string]string)
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+	req := events.APIGatewayWebsocketProxyRequest{
+		Body: body,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     routeKey,
+			EventType:    eventType,
+			RequestID:    uuid.NewString(),
+			Stage:        g.Stage,
+			DomainName:   r.Host,
+			APIID:        "local",
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP:  strings.Split(r.RemoteAddr, ":")[0],
+				UserAgent: r.UserAgent(),
+			},
+			RequestTimeEpoch: time.Now().UnixMilli(),
+		},
+	}
+	if authorizer != nil {
+		req.RequestContext.Authorizer = authorizer
+	}
+	if eventType == "CONNECT" {
+		req.Headers = headers
+		req.QueryStringParameters = query
+	}
+	return req
+}
+
+// invoke calls the route, reporting a missing route like API Gateway.
+func (g *Gateway) invoke(ctx context.Context, routeKey string, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	route, ok := g.Routes[routeKey]
+	if !ok {
+		if route, ok = g.Routes["$default"]; !ok {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusForbidden, Body: `{"message": "Forbidden"}`}, nil
+		}
+		req.RequestContext.RouteKey = "$default"
+	}
+	return route(ctx, req)
+}
+
+func postInput(connectionID string, data []byte) *apigatewaymanagementapi.PostToConnectionInput {
+	return &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: aws.String(connectionID), Data: data}
+}
+
+func disconnectRequest(connectionID, stage string) events.APIGatewayWebsocketProxyRequest {
+	return events.APIGatewayWebsocketProxyRequest{
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "$disconnect",
+			EventType:    "DISCONNECT",
+			RequestID:    uuid.NewString(),
+			Stage:        stage,
+			APIID:        "local",
+		},
+	}
+}
+
+// routeKey applies the $request.body.action selection expression.
+func routeKey(body []byte) string {
+	var sel struct {
+		Action string `json:"action"`
+	}
+	if json.Unmarshal(body, &sel) != nil || sel.Action == "" {
+		return "$default"
+	}
+	return sel.Action
+}
+
+func (g *Gateway) authorize(r *http.Request) (map[string]interface{}, error) {
+	if g.Authorize == nil {
+		return nil, nil
+	}
+	authorizer, err := g.Authorize(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	return authorizer, nil
+}
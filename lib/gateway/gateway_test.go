@@ -0,0 +1,182 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"lib"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPublishReachesEveryTransport(t *testing.T) {
+	g := NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?order_id=42"
+
+	watcher, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	publisher, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	stream, err := http.Get(server.URL + "/orders/42/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != lib.SSEContentType {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	polled := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(server.URL + "/orders/42/poll?timeout=5s")
+		if err != nil {
+			t.Error(err)
+		}
+		polled <- resp
+	}()
+	waitFor(t, func() bool { return len(g.Connections()) == 4 })
+
+	err = publisher.WriteJSON(lib.Message{Action: "sendmessage", OrderID: "42", Message: lib.MessageData{ID: "m1", Status: "SHIPPED"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame lib.MessageData
+	for frame.ID == "" {
+		// Skip the presence frames of the other transports joining
+		frame = lib.MessageData{}
+		if err := watcher.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if frame.ID != "m1" || frame.Status != "SHIPPED" || frame.OrderID != "42" {
+		t.Fatalf("websocket got %+v", frame)
+	}
+
+	lines := bufio.NewScanner(stream.Body)
+	var event []string
+	for lines.Scan() && lines.Text() != "" {
+		event = append(event, lines.Text())
+	}
+	if len(event) != 3 || event[0] != "id: m1" || event[1] != "event: status" || !strings.Contains(event[2], `"status":"SHIPPED"`) {
+		t.Fatalf("sse got %q", event)
+	}
+
+	resp := <-polled
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&frame); err != nil || frame.ID != "m1" {
+		t.Fatalf("long poll got %+v, %v", frame, err)
+	}
+}
+
+func TestPollAfterCurrentTimesOut(t *testing.T) {
+	g := NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+	g.Deps.Store.PutMessage(context.Background(), lib.StoredMessage{MessageData: lib.MessageData{ID: "m1", OrderID: "42"}})
+
+	resp, err := http.Get(server.URL + "/orders/42/poll?after=m1&timeout=20ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got %d, want 204", resp.StatusCode)
+	}
+	waitFor(t, func() bool { return len(g.Connections()) == 0 })
+}
+
+func TestPingAndReap(t *testing.T) {
+	g := NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+	ctx := context.Background()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?order_id=42", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(lib.Ping{Action: "ping", ID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var pong lib.Pong
+	if err := conn.ReadJSON(&pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong.Type != "pong" || pong.ID != "p1" || time.Since(pong.ServerTime) > time.Minute {
+		t.Fatalf("got %+v", pong)
+	}
+
+	if result, err := g.Deps.Reap(ctx, time.Now().Add(-time.Minute)); err != nil || result.Idle != 0 {
+		t.Fatalf("a pinged connection must not be reaped, got %+v, %v", result, err)
+	}
+	result, err := g.Deps.Reap(ctx, time.Now().Add(time.Minute))
+	if err != nil || result.Closed != 1 {
+		t.Fatalf("got %+v, %v", result, err)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected the reaped connection to be closed")
+	}
+	waitFor(t, func() bool {
+		conns, _ := g.Store.ConnectionsForChannel(ctx, "42")
+		return len(g.Connections()) == 0 && len(conns) == 0
+	})
+}
+
+func TestSweep(t *testing.T) {
+	g := NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+	ctx := context.Background()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?order_id=42", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A row left behind by a socket that died without $disconnect
+	g.Store.PutConnection(ctx, lib.Connection{ConnectionID: "orphan", Channel: "42"})
+
+	report, err := g.Deps.Sweep(ctx, 2)
+	if err != nil || report.Scanned != 2 || report.Alive != 1 || report.Removed != 1 {
+		t.Fatalf("got %+v, %v", report, err)
+	}
+	conns, _ := g.Store.ConnectionsForChannel(ctx, "42")
+	if len(conns) != 1 || conns[0].ConnectionID == "orphan" || len(g.Connections()) != 1 {
+		t.Fatalf("left %+v", conns)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
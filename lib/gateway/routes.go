@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DefaultRoutes returns local equivalents of the Lambda functions behind each
+// route, working on deps. The actions are size and rate limited like the
+// functions are, see lib.Deps.LimitSize and lib.Deps.RateLimit.
+func DefaultRoutes(deps *lib.Deps) map[string]Route {
+	limit := func(r Route) Route { return deps.LimitSize(deps.RateLimit(r)) }
+	return map[string]Route{
+		"$connect":    connectRoute(deps),
+		"$disconnect": disconnectRoute(deps),
+		"sendmessage": limit(sendMessageRoute(deps)),
+		"request":     limit(requestRoute(deps)),
+		"history":     limit(historyRoute(deps)),
+		"ack":         limit(ackRoute(deps)),
+		"ping":        pingRoute(deps),
+		"presence":    limit(presenceRoute(deps)),
+		"subscribe":   limit(subscribeRoute(deps)),
+		"unsubscribe": limit(subscribeRoute(deps)),
+	}
+}
+
+func status(code int, message string) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(map[string]string{"message": message})
+	return events.APIGatewayProxyResponse{StatusCode: code, Body: string(body)}
+}
+
+func connectRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		channel, err := lib.ResolveChannel(req.QueryStringParameters["channel"], req.QueryStringParameters["order_id"])
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		filter, err := lib.ParseFilter(req.QueryStringParameters["filter"])
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		subprotocol, err := lib.NegotiateSubprotocol(req)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		conn := lib.NewConnection(req, channel, time.Now())
+		conn.Filter = filter.String()
+		conn.Subprotocol = subprotocol
+		if err := deps.Join(ctx, conn); err != nil {
+			return status(http.StatusInternalServerError, "Error saving connection"), nil
+		}
+		resp := status(http.StatusOK, "Connection saved")
+		if subprotocol != "" {
+			resp.Headers = map[string]string{lib.HeaderSubprotocol: subprotocol}
+		}
+		return resp, nil
+	}
+}
+
+func disconnectRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if err := deps.Leave(ctx, req.RequestContext.ConnectionID); err != nil {
+			return status(http.StatusInternalServerError, "Error deleting connection"), nil
+		}
+		return status(http.StatusOK, "Connection deleted"), nil
+	}
+}
+
+func sendMessageRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var msg lib.Message
+		if err := json.Unmarshal([]byte(req.Body), &msg); err != nil {
+			return status(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		channel, err := lib.ResolveChannel(msg.Channel, msg.OrderID)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		err = deps.Publish(ctx, lib.StoredMessage{
+			MessageData:        msg.Message.WithChannel(channel),
+			Endpoint:           Endpoint,
+			SourceConnectionID: req.RequestContext.ConnectionID,
+		})
+		if err != nil {
+			return status(http.StatusInternalServerError, "Error saving message"), nil
+		}
+		return status(http.StatusOK, "Message sent successfully"), nil
+	}
+}
+
+func requestRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		channel, body, err := requestChannel(req)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		var frame struct {
+			lib.MessageData
+			RequestID string `json:"request_id,omitempty"`
+		}
+		frame.MessageData = lib.MessageData{Status: "NOT FOUND", Channel: body.Channel, OrderID: body.OrderID}
+		frame.RequestID = body.RequestID
+		stored, err := deps.Store.GetMessage(ctx, channel.Key())
+		switch {
+		case err == nil:
+			frame.MessageData = stored.MessageData
+		case !errors.Is(err, lib.ErrNotFound):
+			return status(http.StatusInternalServerError, "cannot get item"), nil
+		}
+		if err := deps.PostFrame(ctx, Endpoint, req.RequestContext.ConnectionID, frame); err != nil {
+			return status(http.StatusInternalServerError, "Failed to send WebSocket response"), nil
+		}
+		return status(http.StatusOK, frame.Status), nil
+	}
+}
+
+func historyRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var body struct {
+			Channel  string   `json:"channel"`
+			OrderID  string   `json:"order_id"`
+			Limit    int      `json:"limit"`
+			Cursor   string   `json:"cursor"`
+			Status   []string `json:"status"`
+			From     string   `json:"from"`
+			To       string   `json:"to"`
+			Delivery string   `json:"delivery"`
+		}
+		if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+			return status(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		channel, err := lib.ResolveChannel(body.Channel, body.OrderID)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		q := lib.HistoryQuery{Channel: channel.Key(), Limit: body.Limit, Cursor: body.Cursor, Statuses: body.Status}
+		q.From, _ = time.Parse(time.RFC3339, body.From)
+		q.To, _ = time.Parse(time.RFC3339, body.To)
+		page, err := deps.Store.History(ctx, q)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+
+		connectionID := req.RequestContext.ConnectionID
+		if body.Delivery == "frames" {
+			for _, event := range page.Events {
+				frame := struct {
+					Type string `json:"type"`
+					lib.HistoryEvent
+				}{"history_event", event}
+				if err := deps.PostFrame(ctx, Endpoint, connectionID, frame); err != nil {
+					return status(http.StatusInternalServerError, "Failed to send WebSocket response"), nil
+				}
+			}
+			err = deps.PostFrame(ctx, Endpoint, connectionID, map[string]any{
+				"type": "history_end", "channel": body.Channel, "order_id": body.OrderID, "count": len(page.Events), "cursor": page.Cursor,
+			})
+		} else {
+			err = deps.PostFrame(ctx, Endpoint, connectionID, map[string]any{
+				"type": "history", "channel": body.Channel, "order_id": body.OrderID, "events": append([]lib.HistoryEvent{}, page.Events...), "cursor": page.Cursor,
+			})
+		}
+		if err != nil {
+			return status(http.StatusInternalServerError, "Failed to send WebSocket response"), nil
+		}
+		return status(http.StatusOK, "History sent"), nil
+	}
+}
+
+// requestChannel parses a lib.Request body and the channel it addresses.
+func requestChannel(req events.APIGatewayWebsocketProxyRequest) (lib.Channel, lib.Request, error) {
+	var body lib.Request
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return lib.Channel{}, body, err
+	}
+	channel, err := lib.ResolveChannel(body.Channel, body.OrderID)
+	return channel, body, err
+}
+
+func ackRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		channel, _, err := requestChannel(req)
+		if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		if err := deps.Store.DeleteMessage(ctx, channel.Key()); err != nil {
+			return status(http.StatusBadRequest, "cannot delete item"), nil
+		}
+		return status(http.StatusOK, "Message sent successfully"), nil
+	}
+}
+
+func pingRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var ping lib.Ping
+		if err := json.Unmarshal([]byte(req.Body), &ping); err != nil {
+			return status(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		err := deps.Heartbeat(ctx, Endpoint, req.RequestContext.ConnectionID, ping)
+		if errors.Is(err, lib.ErrNotFound) {
+			return status(http.StatusGone, "Unknown connection"), nil
+		}
+		if err != nil {
+			return status(http.StatusInternalServerError, "Failed to send pong"), nil
+		}
+		return status(http.StatusOK, "pong"), nil
+	}
+}
+
+func presenceRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		channel, _, err := requestChannel(req)
+		if errors.Is(err, lib.ErrMissingChannel) {
+			// Without a channel the connection asks about its own
+			conn, err := deps.Store.GetConnection(ctx, req.RequestContext.ConnectionID)
+			if err != nil || conn.Channel == "" {
+				return status(http.StatusGone, "Unknown connection"), nil
+			}
+			channel = lib.ChannelFromKey(conn.Channel)
+		} else if err != nil {
+			return status(http.StatusBadRequest, err.Error()), nil
+		}
+		frame, err := deps.Presence(ctx, channel, lib.PresenceCount)
+		if err == nil {
+			err = deps.PostFrame(ctx, Endpoint, req.RequestContext.ConnectionID, frame)
+		}
+		if err != nil {
+			return status(http.StatusInternalServerError, "Failed to count watchers"), nil
+		}
+		return status(http.StatusOK, "Presence sent"), nil
+	}
+}
+
+func subscribeRoute(deps *lib.Deps) Route {
+	return func(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var body lib.Subscription
+		if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+			return status(http.StatusBadRequest, "Invalid request body"), nil
+		}
+		var (
+			channel lib.Channel
+			filter  lib.Filter
+			err     error
+		)
+		if req.RequestContext.RouteKey == "subscribe" {
+			if channel, err = lib.ResolveChannel(body.Channel, body.OrderID); err != nil {
+				return status(http.StatusBadRequest, err.Error()), nil
+			}
+			if filter, err = lib.ParseFilter(body.Filter); err != nil {
+				return status(http.StatusBadRequest, err.Error()), nil
+			}
+		}
+		err = deps.Subscribe(ctx, req.RequestContext.ConnectionID, channel, filter)
+		if errors.Is(err, lib.ErrNotFound) {
+			return status(http.StatusGone, "Unknown connection"), nil
+		}
+		if err != nil {
+			return status(http.StatusInternalServerError, "Failed to subscribe"), nil
+		}
+		if channel == (lib.Channel{}) {
+			return status(http.StatusOK, "Unsubscribed"), nil
+		}
+		return status(http.StatusOK, "Subscribed"), nil
+	}
+}
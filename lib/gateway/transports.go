@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errBacklog is returned when a streaming client does not keep up.
+var errBacklog = errors.New("client is not reading, frame dropped")
+
+type (
+	// wsSink writes frames as binary messages when the subprotocol of the
+	// connection has a binary codec.
+	wsSink struct {
+		mu     sync.Mutex
+		conn   *websocket.Conn
+		binary bool
+	}
+
+	// chanSink buffers frames for an SSE stream or a long poll. Chunked
+	// frames are joined back, as the client would.
+	chanSink struct {
+		frames chan []byte
+		once   sync.Once
+		done   chan struct{}
+
+		mu     sync.Mutex
+		chunks *lib.Reassembler
+	}
+)
+
+func (s *wsSink) send(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.binary {
+		return s.conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s *wsSink) close() { s.conn.Close() }
+
+func newChanSink() *chanSink {
+	return &chanSink{frames: make(chan []byte, 64), done: make(chan struct{}), chunks: lib.NewReassembler(4)}
+}
+
+// send drops typed frames, such as presence: streams only carry statuses.
+func (s *chanSink) send(data []byte) error {
+	var frame lib.ChunkFrame
+	if json.Unmarshal(data, &frame) == nil && frame.Type == "chunk" {
+		s.mu.Lock()
+		whole, done, err := s.chunks.Add(frame)
+		s.mu.Unlock()
+		if err != nil || !done {
+			return err
+		}
+		return s.send(whole)
+	}
+	if frame.Type != "" {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return errBacklog
+	case s.frames <- data:
+		return nil
+	default:
+		return errBacklog
+	}
+}
+
+func (s *chanSink) close() { s.once.Do(func() { close(s.done) }) }
+
+// serveWebSocket runs $connect, then routes every frame by its action until
+// the client leaves, then runs $disconnect.
+func (g *Gateway) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	authorizer, err := g.authorize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id := newConnectionID()
+	resp, err := g.invoke(ctx, "$connect", g.request(r, id, "$connect", "CONNECT", "", authorizer))
+	if err != nil || resp.StatusCode >= 300 {
+		status := resp.StatusCode
+		if err != nil || status == 0 {
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, resp.Body, status)
+		return
+	}
+
+	// Echo the subprotocol $connect chose, as API Gateway does
+	header := http.Header{}
+	if p := resp.Headers[lib.HeaderSubprotocol]; p != "" {
+		header.Set(lib.HeaderSubprotocol, p)
+	}
+	conn, err := g.upgrader.Upgrade(w, r, header)
+	if err != nil {
+		// The upgrader already replied, the connection is unusable
+		g.invoke(ctx, "$disconnect", g.request(r, id, "$disconnect", "DISCONNECT", "", authorizer))
+		return
+	}
+	g.register(id, &wsSink{conn: conn, binary: lib.CodecFor(conn.Subprotocol()).Binary()})
+	defer func() {
+		g.unregister(id)
+		g.invoke(ctx, "$disconnect", g.request(r, id, "$disconnect", "DISCONNECT", "", authorizer))
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		key := routeKey(data)
+		resp, err := g.invoke(ctx, key, g.request(r, id, key, "MESSAGE", string(data), authorizer))
+		switch {
+		case err != nil:
+			g.Deps.Logger.Error("route failed", "routeKey", key, "connectionId", id, "error", err)
+		case resp.StatusCode == http.StatusForbidden && resp.Body == `{"message": "Forbidden"}`:
+			// What API Gateway answers for an unknown route
+			g.PostToConnection(ctx, postInput(id, []byte(resp.Body)))
+		case resp.StatusCode >= 400:
+			// Without route responses API Gateway drops the body, log it
+			g.Deps.Logger.Warn("route returned an error", "routeKey", key, "connectionId", id,
+				"status", resp.StatusCode, "body", resp.Body)
+		}
+	}
+}
+
+// serveSSE streams the statuses of an order as Server-Sent Events, starting
+// with the current one unless Last-Event-ID says the client has it.
+func (g *Gateway) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	orderID := r.PathValue("id")
+	id, s, err := g.subscribe(r, "sse-")
+	if err != nil {
+		subscribeError(w, err)
+		return
+	}
+	defer g.unsubscribe(id)
+
+	w.Header().Set("Content-Type", lib.SSEContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if msg, err := g.Store.GetMessage(r.Context(), orderID); err == nil && msg.ID != r.Header.Get("Last-Event-ID") {
+		lib.WriteSSE(w, msg.ID, "status", msg.MessageData)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(g.KeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case <-keepAlive.C:
+			lib.WriteSSEComment(w, "keepalive")
+		case frame := <-s.frames:
+			if err := lib.WriteSSE(w, frameID(frame), "status", json.RawMessage(frame)); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// servePoll answers with the current status if it is not the one named by
+// the after parameter, otherwise with the next one published, or 204 No
+// Content after the timeout.
+func (g *Gateway) servePoll(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("id")
+	timeout := g.PollTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "timeout must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		timeout = min(d, g.PollTimeout)
+	}
+	// Subscribe before reading the current status so nothing published in
+	// between is missed
+	id, s, err := g.subscribe(r, "poll-")
+	if err != nil {
+		subscribeError(w, err)
+		return
+	}
+	defer g.unsubscribe(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	if msg, err := g.Store.GetMessage(r.Context(), orderID); err == nil && msg.ID != r.URL.Query().Get("after") {
+		json.NewEncoder(w).Encode(msg.MessageData)
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-r.Context().Done():
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case frame := <-s.frames:
+		w.Write(frame)
+	}
+}
+
+// subscribe registers a streaming client as a connection watching the order
+// in the path, through the $connect route like a WebSocket would.
+func (g *Gateway) subscribe(r *http.Request, prefix string) (string, *chanSink, error) {
+	authorizer, err := g.authorize(r)
+	if err != nil {
+		return "", nil, err
+	}
+	id := prefix + newConnectionID()
+	req := g.request(r, id, "$connect", "CONNECT", "", authorizer)
+	req.QueryStringParameters["order_id"] = r.PathValue("id")
+	s := newChanSink()
+	g.register(id, s)
+	resp, err := g.invoke(r.Context(), "$connect", req)
+	if err != nil || resp.StatusCode >= 300 {
+		g.unregister(id)
+		if err == nil {
+			err = errors.New(resp.Body)
+		}
+		return "", nil, err
+	}
+	return id, s, nil
+}
+
+func subscribeError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, errUnauthorized) {
+		status = http.StatusUnauthorized
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func (g *Gateway) unsubscribe(id string) {
+	g.unregister(id)
+	g.invoke(context.Background(), "$disconnect", disconnectRequest(id, g.Stage))
+}
+
+// frameID returns the message ID of a status frame, used as the SSE event id.
+func frameID(frame []byte) string {
+	var msg struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(frame, &msg)
+	return msg.ID
+}
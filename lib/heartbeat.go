@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+// ErrNoConnectionsEndpoint is returned by Reap and Sweep when
+// CONNECTIONS_ENDPOINT is not set: connection rows don't record the API they
+// belong to.
+var ErrNoConnectionsEndpoint = errors.New("CONNECTIONS_ENDPOINT is not set")
+
+type (
+	// Ping is the ping action. ID is optional and echoed in the Pong.
+	Ping struct {
+		Action string `json:"action"`
+		ID     string `json:"id,omitempty"`
+	}
+
+	// Pong is the reply to a ping, carrying the server time so clients can
+	// estimate their clock offset.
+	Pong struct {
+		Type       string    `json:"type"`
+		ID         string    `json:"id,omitempty"`
+		ServerTime time.Time `json:"server_time"`
+	}
+
+	// ReapResult counts what Reap did with the idle connections.
+	ReapResult struct {
+		Idle   int `json:"idle"`
+		Closed int `json:"closed"`
+		Gone   int `json:"gone"`
+		Failed int `json:"failed"`
+	}
+)
+
+// NewPong returns the reply to ping.
+func NewPong(ping Ping, now time.Time) Pong {
+	return Pong{Type: "pong", ID: ping.ID, ServerTime: now.UTC()}
+}
+
+// Heartbeat records that connectionID is alive and replies to ping. It
+// returns ErrNotFound, without replying, for connections the store doesn't
+// know, e.g. already reaped ones.
+func (d *Deps) Heartbeat(ctx context.Context, endpoint, connectionID string, ping Ping) error {
+	now := time.Now()
+	if err := d.Store.TouchConnection(ctx, connectionID, now); err != nil {
+		return err
+	}
+	return d.PostFrame(ctx, endpoint, connectionID, NewPong(ping, now))
+}
+
+// Reap closes the connections not seen since before and removes their rows.
+// A connection whose close fails for another reason than being gone keeps
+// its row, so the next run retries it.
+func (d *Deps) Reap(ctx context.Context, before time.Time) (ReapResult, error) {
+	var result ReapResult
+	endpoint := d.Config.ConnectionsEndpoint
+	if endpoint == "" {
+		return result, ErrNoConnectionsEndpoint
+	}
+	conns, err := d.Store.IdleConnections(ctx, before)
+	if err != nil {
+		return result, fmt.Errorf("failed to list idle connections: %w", err)
+	}
+	result.Idle = len(conns)
+
+	logger := Logger(ctx)
+	var errs []error
+	for _, conn := range conns {
+		_, err := d.ManagementAPI(endpoint).DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+			ConnectionId: aws.String(conn.ConnectionID),
+		})
+		switch {
+		case IsGone(err):
+			result.Gone++
+		case err != nil:
+			logger.Warn("failed to close idle connection", "target", conn.ConnectionID, "error", err)
+			result.Failed++
+			continue
+		default:
+			result.Closed++
+		}
+		// $disconnect usually removes the row too, this covers when it doesn't
+		if err := d.Store.DeleteConnection(ctx, conn.ConnectionID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", conn.ConnectionID, err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
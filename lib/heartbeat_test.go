@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+// closeFunc is a ManagementAPI that only closes connections.
+type closeFunc func(connectionID string) error
+
+func (f closeFunc) PostToConnection(context.Context, *apigatewaymanagementapi.PostToConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	return nil, errors.New("unexpected PostToConnection")
+}
+
+func (f closeFunc) GetConnection(context.Context, *apigatewaymanagementapi.GetConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	return nil, errors.New("unexpected GetConnection")
+}
+
+func (f closeFunc) DeleteConnection(_ context.Context, in *apigatewaymanagementapi.DeleteConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, f(aws.ToString(in.ConnectionId))
+}
+
+func TestReap(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	conf := DefaultConfig()
+	conf.ConnectionsEndpoint = "https://example.com/dev"
+	store := NewMemoryStore()
+	var closed []string
+	deps := &Deps{
+		Config: &conf,
+		Store:  store,
+		NewManagementAPI: func(string) ManagementAPI {
+			return closeFunc(func(id string) error {
+				switch id {
+				case "gone":
+					return &apigatewaytypes.GoneException{}
+				case "broken":
+					return errors.New("throttled")
+				}
+				closed = append(closed, id)
+				return nil
+			})
+		},
+	}
+	for id, lastSeen := range map[string]time.Time{
+		"fresh":  now,
+		"idle":   now.Add(-time.Hour),
+		"legacy": {},
+		"gone":   now.Add(-time.Hour),
+		"broken": now.Add(-time.Hour),
+	} {
+		store.PutConnection(ctx, Connection{ConnectionID: id, Channel: "42", LastSeen: lastSeen})
+	}
+	if err := store.TouchConnection(ctx, "idle", now.Add(-30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TouchConnection(ctx, "unknown", now); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+
+	result, err := deps.Reap(ctx, now.Add(-conf.IdleTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReapResult{Idle: 4, Closed: 2, Gone: 1, Failed: 1}); result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+	if len(closed) != 2 || closed[0] != "idle" || closed[1] != "legacy" {
+		t.Fatalf("closed %v", closed)
+	}
+	conns, _ := store.ConnectionsForChannel(ctx, "42")
+	if len(conns) != 2 || conns[0].ConnectionID != "broken" || conns[1].ConnectionID != "fresh" {
+		t.Fatalf("left %+v, want broken to be retried and fresh kept", conns)
+	}
+
+	conf.ConnectionsEndpoint = ""
+	if _, err := deps.Reap(ctx, now); !errors.Is(err, ErrNoConnectionsEndpoint) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// History page sizes.
+const (
+	DefaultHistoryLimit = 20
+	MaxHistoryLimit     = 100
+)
+
+// historyKeyLayout is fixed width so history sort keys order by time.
+const historyKeyLayout = "2006-01-02T15:04:05.000000000Z"
+
+// ErrInvalidCursor is returned for cursors that were not issued by History.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type (
+	// HistoryEvent is one stored status of a channel.
+	HistoryEvent struct {
+		MessageData
+		PublishedAt time.Time `json:"published_at"`
+	}
+
+	// HistoryQuery selects the events of a channel, by Key, oldest first.
+	// Statuses, From and To are optional filters, From is inclusive and To
+	// exclusive.
+	HistoryQuery struct {
+		Channel  string
+		Limit    int
+		Cursor   string
+		Statuses []string
+		From     time.Time
+		To       time.Time
+	}
+
+	// HistoryPage is one page of events. Cursor is empty on the last page.
+	HistoryPage struct {
+		Events []HistoryEvent `json:"events"`
+		Cursor string         `json:"cursor,omitempty"`
+	}
+
+	// HistoryStore keeps every status a channel went through.
+	HistoryStore interface {
+		AppendHistory(ctx context.Context, event HistoryEvent) error
+		History(ctx context.Context, q HistoryQuery) (HistoryPage, error)
+	}
+
+	historyCursor struct {
+		After string `json:"a"`
+	}
+)
+
+// Normalize applies the default limit and checks the query.
+func (q *HistoryQuery) Normalize() error {
+	if q.Channel == "" {
+		return ErrMissingChannel
+	}
+	switch {
+	case q.Limit == 0:
+		q.Limit = DefaultHistoryLimit
+	case q.Limit < 0 || q.Limit > MaxHistoryLimit:
+		return fmt.Errorf("limit must be between 1 and %d", MaxHistoryLimit)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return errors.New("from must be before to")
+	}
+	if _, err := q.after(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Matches reports whether e passes the status and time filters of q.
+func (q *HistoryQuery) Matches(e HistoryEvent) bool {
+	if !q.From.IsZero() && e.PublishedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.PublishedAt.Before(q.To) {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	for _, status := range q.Statuses {
+		if e.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// after returns the sort key the cursor points after, if any.
+func (q *HistoryQuery) after() (string, error) {
+	if q.Cursor == "" {
+		return "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+	var c historyCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.After == "" {
+		return "", ErrInvalidCursor
+	}
+	return c.After, nil
+}
+
+// historyKey is the sort key of e within its order.
+func historyKey(e HistoryEvent) string {
+	return e.PublishedAt.UTC().Format(historyKeyLayout) + "#" + e.ID
+}
+
+func encodeHistoryCursor(key string) string {
+	data, _ := json.Marshal(historyCursor{After: key})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreHistory(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	statuses := []string{"CREATED", "PAID", "SHIPPED", "PAID", "DELIVERED"}
+	for i, status := range statuses {
+		err := store.AppendHistory(ctx, HistoryEvent{
+			MessageData: MessageData{ID: fmt.Sprintf("m%d", i), Status: status, OrderID: "42"},
+			PublishedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(page HistoryPage) []string {
+		var ids []string
+		for _, e := range page.Events {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		var got []string
+		q := HistoryQuery{Channel: "42", Limit: 2}
+		for pages := 0; ; pages++ {
+			page, err := store.History(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ids(page)...)
+			if page.Cursor == "" {
+				if pages != 2 {
+					t.Fatalf("got %d pages, want 3", pages+1)
+				}
+				break
+			}
+			q.Cursor = page.Cursor
+		}
+		if fmt.Sprint(got) != "[m0 m1 m2 m3 m4]" {
+			t.Fatalf("got %v", got)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		page, err := store.History(ctx, HistoryQuery{
+			Channel:  "42",
+			Statuses: []string{"PAID"},
+			From:     start.Add(2 * time.Minute),
+			To:       start.Add(4 * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids(page)) != "[m3]" || page.Cursor != "" {
+			t.Fatalf("got %v, cursor %q", ids(page), page.Cursor)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := store.History(ctx, HistoryQuery{Channel: "42", Cursor: "nope"}); !errors.Is(err, ErrInvalidCursor) {
+			t.Fatalf("got %v, want ErrInvalidCursor", err)
+		}
+		if _, err := store.History(ctx, HistoryQuery{Channel: "42", Limit: MaxHistoryLimit + 1}); err == nil {
+			t.Fatal("want an error for a limit above the maximum")
+		}
+	})
+}
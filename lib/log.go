@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type loggerKey struct{}
+
+// redacted lists the attribute keys, lower-cased, whose values never reach the
+// logs.
+var redacted = map[string]bool{
+	"authorization": true,
+	"token":         true,
+	"password":      true,
+	"secret":        true,
+	"api_key":       true,
+	"apikey":        true,
+	"cookie":        true,
+}
+
+// NewLogger returns a JSON logger writing to w at level, with sensitive
+// attributes redacted.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}))
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if redacted[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+// RequestLogger returns d.Logger enriched with the correlation fields of the
+// WebSocket request, and a context carrying it for code further down.
+func (d *Deps) RequestLogger(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (context.Context, *slog.Logger) {
+	rc := req.RequestContext
+	attrs := []any{
+		"connectionId", rc.ConnectionID,
+		"routeKey", rc.RouteKey,
+		"requestId", rc.RequestID,
+		"stage", rc.Stage,
+	}
+	if channel, err := requestChannel(req); err == nil {
+		attrs = append(attrs, channelAttr(channel)...)
+	}
+	if principal := Principal(rc); principal != "" {
+		attrs = append(attrs, "principal", principal)
+	}
+
+	logger := d.logger().With(attrs...)
+	return WithLogger(ctx, logger), logger
+}
+
+// HTTPRequestLogger is RequestLogger for requests to the HTTP API.
+func (d *Deps) HTTPRequestLogger(ctx context.Context, req events.APIGatewayV2HTTPRequest) (context.Context, *slog.Logger) {
+	rc := req.RequestContext
+	attrs := []any{
+		"routeKey", rc.RouteKey,
+		"requestId", rc.RequestID,
+		"stage", rc.Stage,
+	}
+	id := req.PathParameters["id"]
+	switch {
+	case id == "":
+	case strings.Contains(rc.RouteKey, " /orders/"):
+		attrs = append(attrs, channelAttr(OrderChannel(id))...)
+	case strings.Contains(rc.RouteKey, " /channels/"):
+		attrs = append(attrs, channelAttr(Channel{Type: req.PathParameters["type"], ID: id})...)
+	}
+	if principal := HTTPPrincipal(rc); principal != "" {
+		attrs = append(attrs, "principal", principal)
+	}
+	logger := d.logger().With(attrs...)
+	return WithLogger(ctx, logger), logger
+}
+
+func (d *Deps) logger() *slog.Logger {
+	if d.Logger == nil {
+		return slog.Default()
+	}
+	return d.Logger
+}
+
+// WithLogger returns a context carrying logger, for handlers that are not
+// invoked by a WebSocket request.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Logger returns the logger stored in ctx by RequestLogger or WithLogger, or
+// the default logger.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Principal returns the principal the authorizer attached to the connection.
+func Principal(rc events.APIGatewayWebsocketProxyRequestContext) string {
+	authorizer, ok := rc.Authorizer.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	principal, _ := authorizer["principalId"].(string)
+	return principal
+}
+
+// HTTPPrincipal returns the principal the authorizer attached to an HTTP API
+// request: the principalId of a Lambda authorizer, as on the WebSocket API,
+// or the subject of a JWT authorizer. HTTP APIs only pass on the context of
+// a Lambda authorizer, so the user the authorizer puts there is used when
+// there is no principalId.
+func HTTPPrincipal(rc events.APIGatewayV2HTTPRequestContext) string {
+	if rc.Authorizer == nil {
+		return ""
+	}
+	for _, key := range []string{"principalId", "user"} {
+		if principal, ok := rc.Authorizer.Lambda[key].(string); ok && principal != "" {
+			return principal
+		}
+	}
+	if rc.Authorizer.JWT != nil {
+		return rc.Authorizer.JWT.Claims["sub"]
+	}
+	return ""
+}
+
+// requestChannel returns the channel the request names, in the query of
+// $connect or the body of other routes.
+func requestChannel(req events.APIGatewayWebsocketProxyRequest) (Channel, error) {
+	query := req.QueryStringParameters
+	if query["channel"] != "" || query["order_id"] != "" {
+		return ResolveChannel(query["channel"], query["order_id"])
+	}
+	var body RequestConnection
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		return Channel{}, err
+	}
+	return ResolveChannel(body.Channel, body.OrderID)
+}
+
+// channelAttr returns the log fields of c. Orders keep the order_id field
+// they were logged under before channels existed.
+func channelAttr(c Channel) []any {
+	if c.Type == ChannelOrder {
+		return []any{"order_id", c.ID}
+	}
+	return []any{"channel", c.String()}
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	deps := &Deps{Logger: NewLogger(&buf, slog.LevelInfo)}
+
+	ctx, logger := deps.RequestLogger(context.Background(), events.APIGatewayWebsocketProxyRequest{
+		Body: `{"action":"request","order_id":"42"}`,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: "conn-1",
+			RouteKey:     "request",
+			RequestID:    "req-1",
+			Stage:        "dev",
+			Authorizer:   map[string]interface{}{"principalId": "user123"},
+		},
+	})
+	logger.Info("hello", "token", "s3cr3t")
+	Logger(ctx).Debug("dropped below the configured level")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":          "hello",
+		"connectionId": "conn-1",
+		"routeKey":     "request",
+		"requestId":    "req-1",
+		"stage":        "dev",
+		"order_id":     "42",
+		"principal":    "user123",
+		"token":        "[REDACTED]",
+	}
+	for k, v := range want {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+}
+
+func TestLoggerDefault(t *testing.T) {
+	if Logger(context.Background()) != slog.Default() {
+		t.Fatal("expected the default logger without RequestLogger")
+	}
+}
+
+func TestHTTPRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	deps := &Deps{Logger: NewLogger(&buf, slog.LevelInfo)}
+
+	_, logger := deps.HTTPRequestLogger(context.Background(), events.APIGatewayV2HTTPRequest{
+		PathParameters: map[string]string{"id": "42"},
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey:  "GET /orders/{id}/status",
+			RequestID: "req-1",
+			Stage:     "$default",
+			Authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+				JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+					Claims: map[string]string{"sub": "svc-billing"},
+				},
+			},
+		},
+	})
+	logger.Info("hello")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", buf.String(), err)
+	}
+	for k, v := range map[string]any{"routeKey": "GET /orders/{id}/status", "order_id": "42", "principal": "svc-billing"} {
+		if line[k] != v {
+			t.Errorf("%s = %v, want %v", k, line[k], v)
+		}
+	}
+
+	lambda := events.APIGatewayV2HTTPRequestContext{Authorizer: &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		Lambda: map[string]interface{}{"user": "user123"},
+	}}
+	if got := HTTPPrincipal(lambda); got != "user123" {
+		t.Errorf("got principal %q from the Lambda authorizer context, want user123", got)
+	}
+}
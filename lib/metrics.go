@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Metric units understood by CloudWatch.
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+type (
+	// Metrics writes CloudWatch Embedded Metric Format records. Lambda ships
+	// stdout to CloudWatch Logs, which extracts the metrics, so nothing here
+	// talks to AWS and the output can be inspected in tests.
+	Metrics struct {
+		Namespace string
+
+		mu  sync.Mutex
+		w   io.Writer
+		now func() time.Time
+	}
+
+	// Recorder collects the metrics of one invocation under a fixed set of
+	// dimensions and writes them as a single record on Flush.
+	Recorder struct {
+		metrics    *Metrics
+		dimensions []string
+		values     map[string]any
+		names      []string
+		units      map[string]string
+	}
+
+	emfMetric struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit"`
+	}
+	emfDirective struct {
+		Namespace  string      `json:"Namespace"`
+		Dimensions [][]string  `json:"Dimensions"`
+		Metrics    []emfMetric `json:"Metrics"`
+	}
+	emfMetadata struct {
+		Timestamp         int64          `json:"Timestamp"`
+		CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+	}
+)
+
+// NewMetrics returns an emitter writing to w under namespace.
+func NewMetrics(w io.Writer, namespace string) *Metrics {
+	return &Metrics{Namespace: namespace, w: w, now: time.Now}
+}
+
+// Recorder returns a recorder with the given dimensions, passed as
+// name/value pairs.
+func (m *Metrics) Recorder(dimensions ...string) *Recorder {
+	return &Recorder{
+		metrics:    m,
+		dimensions: dimensions,
+		values:     make(map[string]any),
+		units:      make(map[string]string),
+	}
+}
+
+// RequestMetrics returns a recorder with the Route and Stage dimensions of the
+// WebSocket request.
+func (d *Deps) RequestMetrics(req events.APIGatewayWebsocketProxyRequest) *Recorder {
+	metrics := d.Metrics
+	if metrics == nil {
+		metrics = NewMetrics(io.Discard, "")
+	}
+	return metrics.Recorder("Route", req.RequestContext.RouteKey, "Stage", req.RequestContext.Stage)
+}
+
+// HTTPRequestMetrics is RequestMetrics for requests to the HTTP API.
+func (d *Deps) HTTPRequestMetrics(req events.APIGatewayV2HTTPRequest) *Recorder {
+	metrics := d.Metrics
+	if metrics == nil {
+		metrics = NewMetrics(io.Discard, "")
+	}
+	return metrics.Recorder("Route", req.RequestContext.RouteKey, "Stage", req.RequestContext.Stage)
+}
+
+// Count adds n to the named counter.
+func (r *Recorder) Count(name string, n int) {
+	r.add(name, UnitCount, float64(n))
+}
+
+// Duration records d in milliseconds.
+func (r *Recorder) Duration(name string, d time.Duration) {
+	r.add(name, UnitMilliseconds, float64(d.Microseconds())/1000)
+}
+
+func (r *Recorder) add(name, unit string, v float64) {
+	if _, ok := r.units[name]; !ok {
+		r.names = append(r.names, name)
+		r.units[name] = unit
+		r.values[name] = v
+		return
+	}
+	r.values[name] = r.values[name].(float64) + v
+}
+
+// Flush writes the collected metrics, if any, and resets the recorder.
+func (r *Recorder) Flush() {
+	if len(r.names) == 0 {
+		return
+	}
+	m := r.metrics
+
+	record := make(map[string]any, len(r.values)+len(r.dimensions)/2+1)
+	var dimensionNames []string
+	for i := 0; i+1 < len(r.dimensions); i += 2 {
+		dimensionNames = append(dimensionNames, r.dimensions[i])
+		record[r.dimensions[i]] = r.dimensions[i+1]
+	}
+	directive := emfDirective{Namespace: m.Namespace, Dimensions: [][]string{dimensionNames}}
+	for _, name := range r.names {
+		directive.Metrics = append(directive.Metrics, emfMetric{Name: name, Unit: r.units[name]})
+		record[name] = r.values[name]
+	}
+	record["_aws"] = emfMetadata{
+		Timestamp:         m.now().UnixMilli(),
+		CloudWatchMetrics: []emfDirective{directive},
+	}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		m.mu.Lock()
+		_, _ = m.w.Write(append(line, '\n'))
+		m.mu.Unlock()
+	}
+
+	r.names = nil
+	r.values = make(map[string]any)
+	r.units = make(map[string]string)
+}
@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestRecorderFlush(t *testing.T) {
+	var buf bytes.Buffer
+	metrics := NewMetrics(&buf, "Orders")
+	metrics.now = func() time.Time { return time.UnixMilli(1700000000000) }
+	deps := &Deps{Metrics: metrics}
+
+	rec := deps.RequestMetrics(events.APIGatewayWebsocketProxyRequest{
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{RouteKey: "sendmessage", Stage: "dev"},
+	})
+	rec.Count("Deliveries", 2)
+	rec.Count("Deliveries", 1)
+	rec.Duration("PublishLatency", 1500*time.Microsecond)
+	rec.Flush()
+	rec.Flush()
+
+	want := `{"Deliveries":3,"PublishLatency":1.5,"Route":"sendmessage","Stage":"dev",` +
+		`"_aws":{"Timestamp":1700000000000,"CloudWatchMetrics":[{"Namespace":"Orders",` +
+		`"Dimensions":[["Route","Stage"]],"Metrics":[{"Name":"Deliveries","Unit":"Count"},` +
+		`{"Name":"PublishLatency","Unit":"Milliseconds"}]}]}}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Fatal("record is not valid JSON")
+	}
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Events of a PresenceFrame.
+const (
+	PresenceJoin  = "join"
+	PresenceLeave = "leave"
+	PresenceCount = "count"
+)
+
+type (
+	// PresenceFrame tells how many connections watch a channel. Join and
+	// leave frames are pushed to the other watchers of the channel when a
+	// connection comes or goes, count frames answer the presence action.
+	PresenceFrame struct {
+		Type     string `json:"type"`
+		Event    string `json:"event"`
+		Channel  string `json:"channel"`
+		OrderID  string `json:"order_id,omitempty"`
+		Watchers int    `json:"watchers"`
+	}
+
+	// Subscription is the subscribe action, which moves the connection to
+	// another channel without reconnecting. Filter replaces the one of the
+	// connection, see ParseFilter. The unsubscribe action leaves the
+	// connection watching nothing.
+	Subscription struct {
+		Action  string `json:"action"`
+		Channel string `json:"channel,omitempty"`
+		OrderID string `json:"order_id,omitempty"`
+		Filter  string `json:"filter,omitempty"`
+	}
+)
+
+// Presence returns the frame for event with the current count of channel.
+func (d *Deps) Presence(ctx context.Context, channel Channel, event string) (PresenceFrame, error) {
+	n, err := d.Store.Watchers(ctx, channel.Key())
+	if err != nil {
+		return PresenceFrame{}, fmt.Errorf("failed to count watchers of %s: %w", channel, err)
+	}
+	frame := PresenceFrame{Type: "presence", Event: event, Channel: channel.String(), Watchers: n}
+	if channel.Type == ChannelOrder {
+		frame.OrderID = channel.ID
+	}
+	return frame, nil
+}
+
+// WatcherChanges returns how a connections table stream record changes the
+// watcher counts, by channel. Rows removed by their TTL come as REMOVE
+// records like those deleted on $disconnect, so they are counted out too.
+// Records that keep the channel, such as a TouchConnection, change nothing.
+func WatcherChanges(record events.DynamoDBEventRecord) map[string]int {
+	channel := func(image map[string]events.DynamoDBAttributeValue) string {
+		if v, ok := image["orderId"]; ok && v.DataType() == events.DataTypeString {
+			return v.String()
+		}
+		return ""
+	}
+	old, new := channel(record.Change.OldImage), channel(record.Change.NewImage)
+	changes := make(map[string]int)
+	if old == new {
+		return changes
+	}
+	if old != "" {
+		changes[old]--
+	}
+	if new != "" {
+		changes[new]++
+	}
+	return changes
+}
+
+// Join stores conn. The other watchers of its channel are told once the
+// count includes it, see AnnounceChanges.
+func (d *Deps) Join(ctx context.Context, conn Connection) error {
+	return d.Store.PutConnection(ctx, conn)
+}
+
+// Leave removes the connection, whose watchers are told like for Join.
+// Unknown connections are not an error: $disconnect may come after the
+// reaper or a fan-out removed the row.
+func (d *Deps) Leave(ctx context.Context, connectionID string) error {
+	return d.Store.DeleteConnection(ctx, connectionID)
+}
+
+// Subscribe moves the connection to channel with filter. The watchers of
+// the channel it leaves and of the one it joins are told like for Join. The
+// zero Channel unsubscribes. It returns ErrNotFound for unknown connections.
+func (d *Deps) Subscribe(ctx context.Context, connectionID string, channel Channel, filter Filter) error {
+	conn, err := d.Store.GetConnection(ctx, connectionID)
+	if err != nil {
+		return err
+	}
+	conn.Channel = ""
+	if channel != (Channel{}) {
+		conn.Channel = channel.Key()
+	}
+	conn.Filter = filter.String()
+	return d.Store.PutConnection(ctx, *conn)
+}
+
+// AnnounceChanges tells the watchers of the channels in changes, from
+// WatcherChanges, that connectionID left or joined them, and sends
+// connectionID the count of the channels it joined. The frames carry
+// the counts read back from the store, so it must be called once they
+// include changes: DynamoStore counts from the connections table stream,
+// which the watchers Lambda announces from after AddWatchers, while a
+// MemoryStore counts inline and reports its changes to OnConnectionChange.
+func (d *Deps) AnnounceChanges(ctx context.Context, endpoint, connectionID string, changes map[string]int) {
+	// Leave before join, as seen by a connection moving between channels
+	for channel, delta := range changes {
+		if delta < 0 {
+			d.announce(ctx, endpoint, connectionID, channel, PresenceLeave)
+		}
+	}
+	for channel, delta := range changes {
+		if delta > 0 {
+			d.announce(ctx, endpoint, connectionID, channel, PresenceJoin)
+		}
+	}
+}
+
+// WatcherConnection returns the ID of the connection a connections table
+// stream record is about.
+func WatcherConnection(record events.DynamoDBEventRecord) string {
+	if v, ok := record.Change.Keys["connectionId"]; ok && v.DataType() == events.DataTypeString {
+		return v.String()
+	}
+	return ""
+}
+
+// announce posts the presence frame for event to the watchers of channel
+// other than the connection that caused it, which gets a count frame when it
+// joined. Presence is advisory: failures are logged and the count can always
+// be asked for again.
+func (d *Deps) announce(ctx context.Context, endpoint, connectionID, channel, event string) {
+	if channel == "" {
+		return
+	}
+	c := ChannelFromKey(channel)
+	logger := Logger(ctx).With(channelAttr(c)...)
+	frame, err := d.Presence(ctx, c, event)
+	if err != nil {
+		logger.Error("failed to announce presence", "event", event, "error", err)
+		return
+	}
+	conns, err := d.Store.ConnectionsForChannel(ctx, channel)
+	if err != nil {
+		logger.Error("failed to announce presence", "event", event, "error", err)
+		return
+	}
+	for _, conn := range conns {
+		frame := frame
+		if conn.ConnectionID == connectionID {
+			if event != PresenceJoin {
+				continue
+			}
+			frame.Event = PresenceCount
+		}
+		if err := d.PostFrameTo(ctx, endpoint, conn, frame); err != nil && !IsGone(err) {
+			logger.Warn("failed to announce presence", "target", conn.ConnectionID, "event", event, "error", err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// presenceDeps returns deps over store with the presence frames posted so
+// far, by target connection.
+func presenceDeps(t *testing.T, store Store) (*Deps, func() ([]PresenceFrame, []string)) {
+	conf := DefaultConfig()
+	var frames []PresenceFrame
+	var targets []string
+	deps := &Deps{
+		Config: &conf,
+		Store:  store,
+		NewManagementAPI: func(string) ManagementAPI {
+			return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+				var frame PresenceFrame
+				if err := json.Unmarshal(in.Data, &frame); err != nil {
+					t.Fatal(err)
+				}
+				frames = append(frames, frame)
+				targets = append(targets, aws.ToString(in.ConnectionId))
+				return nil
+			})
+		},
+	}
+	return deps, func() ([]PresenceFrame, []string) {
+		defer func() { frames, targets = nil, nil }()
+		return frames, targets
+	}
+}
+
+func TestPresence(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	deps, posted := presenceDeps(t, store)
+	const endpoint = "https://example.com/dev"
+	store.OnConnectionChange(func(connectionID string, changes map[string]int) {
+		deps.AnnounceChanges(ctx, endpoint, connectionID, changes)
+	})
+	watchers := func(channel string) int {
+		t.Helper()
+		n, err := store.Watchers(ctx, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, id := range []string{"c1", "c2"} {
+		if err := deps.Join(ctx, Connection{ConnectionID: id, Channel: "42"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Storing a connection again does not count it twice
+	if err := store.PutConnection(ctx, Connection{ConnectionID: "c2", Channel: "42", Filter: "SHIPPED"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := watchers("42"); n != 2 {
+		t.Fatalf("got %d watchers, want 2", n)
+	}
+	frames, targets := posted()
+	want := []PresenceFrame{
+		{Type: "presence", Event: PresenceCount, Channel: "order:42", OrderID: "42", Watchers: 1},
+		{Type: "presence", Event: PresenceJoin, Channel: "order:42", OrderID: "42", Watchers: 2},
+		{Type: "presence", Event: PresenceCount, Channel: "order:42", OrderID: "42", Watchers: 2},
+	}
+	if !reflect.DeepEqual(frames, want) || !reflect.DeepEqual(targets, []string{"c1", "c1", "c2"}) {
+		t.Fatalf("got %+v to %v, want c1 to hear of c2 and both their counts", frames, targets)
+	}
+
+	if err := deps.Subscribe(ctx, "c2", Channel{ChannelShipment, "S1"}, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+	if watchers("42") != 1 || watchers("shipment:S1") != 1 {
+		t.Fatalf("got %d and %d watchers after the move", watchers("42"), watchers("shipment:S1"))
+	}
+	frames, targets = posted()
+	if len(frames) != 2 || targets[0] != "c1" || frames[0].Event != PresenceLeave || frames[0].Watchers != 1 ||
+		targets[1] != "c2" || frames[1].Event != PresenceCount || frames[1].Channel != "shipment:S1" {
+		t.Fatalf("got %+v to %v, want c1 to hear of c2 leaving and c2 its new count", frames, targets)
+	}
+	if err := deps.Subscribe(ctx, "c2", Channel{}, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+	if watchers("shipment:S1") != 0 {
+		t.Fatalf("got %d watchers after unsubscribing", watchers("shipment:S1"))
+	}
+
+	posted()
+	for range 2 {
+		if err := deps.Leave(ctx, "c1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := watchers("42"); n != 0 {
+		t.Fatalf("got %d watchers, want a connection that leaves twice counted out once", n)
+	}
+	if frames, _ := posted(); len(frames) != 0 {
+		t.Fatalf("got %+v with nobody left to tell", frames)
+	}
+	if err := deps.Subscribe(ctx, "c1", OrderChannel("42"), Filter{}); err != ErrNotFound {
+		t.Fatalf("got %v, want ErrNotFound", err)
+	}
+}
+
+// laggingStore counts watchers from AddWatchers only, like DynamoStore
+// counts from the connections table stream.
+type laggingStore struct {
+	*MemoryStore
+	counts map[string]int
+}
+
+func (s *laggingStore) AddWatchers(_ context.Context, _ string, changes map[string]int) error {
+	for channel, delta := range changes {
+		s.counts[channel] += delta
+	}
+	return nil
+}
+
+func (s *laggingStore) Watchers(_ context.Context, channel string) (int, error) {
+	return s.counts[channel], nil
+}
+
+func TestAnnounceChangesLaggingStore(t *testing.T) {
+	ctx := context.Background()
+	store := &laggingStore{MemoryStore: NewMemoryStore(), counts: map[string]int{"42": 1}}
+	deps, posted := presenceDeps(t, store)
+	const endpoint = "https://example.com/dev"
+	store.PutConnection(ctx, Connection{ConnectionID: "c1", Channel: "42"})
+
+	// The writes alone tell nobody, their counts are not in yet
+	if err := deps.Join(ctx, Connection{ConnectionID: "c2", Channel: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	if frames, _ := posted(); len(frames) != 0 {
+		t.Fatalf("got %+v before the count changed", frames)
+	}
+
+	changes := map[string]int{"42": 1}
+	store.AddWatchers(ctx, "e2", changes)
+	deps.AnnounceChanges(ctx, endpoint, "c2", changes)
+	frames, targets := posted()
+	want := []PresenceFrame{
+		{Type: "presence", Event: PresenceJoin, Channel: "order:42", OrderID: "42", Watchers: 2},
+		{Type: "presence", Event: PresenceCount, Channel: "order:42", OrderID: "42", Watchers: 2},
+	}
+	if !reflect.DeepEqual(frames, want) || !reflect.DeepEqual(targets, []string{"c1", "c2"}) {
+		t.Fatalf("got %+v to %v, want %+v to c1 and c2", frames, targets, want)
+	}
+
+	if err := deps.Subscribe(ctx, "c2", Channel{ChannelShipment, "S1"}, Filter{}); err != nil {
+		t.Fatal(err)
+	}
+	store.PutConnection(ctx, Connection{ConnectionID: "c3", Channel: "shipment:S1"})
+	store.counts["shipment:S1"] = 1
+	changes = map[string]int{"42": -1, "shipment:S1": 1}
+	store.AddWatchers(ctx, "e3", changes)
+	deps.AnnounceChanges(ctx, endpoint, "c2", changes)
+	frames, targets = posted()
+	want = []PresenceFrame{
+		{Type: "presence", Event: PresenceLeave, Channel: "order:42", OrderID: "42", Watchers: 1},
+		{Type: "presence", Event: PresenceCount, Channel: "shipment:S1", Watchers: 2},
+		{Type: "presence", Event: PresenceJoin, Channel: "shipment:S1", Watchers: 2},
+	}
+	if !reflect.DeepEqual(frames, want) || !reflect.DeepEqual(targets, []string{"c1", "c2", "c3"}) {
+		t.Fatalf("got %+v to %v, want %+v to c1, c2 and c3", frames, targets, want)
+	}
+}
+
+func TestWatcherChanges(t *testing.T) {
+	image := func(channel string) map[string]events.DynamoDBAttributeValue {
+		image := map[string]events.DynamoDBAttributeValue{"connectionId": events.NewStringAttribute("c1")}
+		if channel != "" {
+			image["orderId"] = events.NewStringAttribute(channel)
+		}
+		return image
+	}
+	tests := []struct {
+		name     string
+		old, new map[string]events.DynamoDBAttributeValue
+		want     map[string]int
+	}{
+		{"connect", nil, image("42"), map[string]int{"42": 1}},
+		{"connect unsubscribed", nil, image(""), map[string]int{}},
+		{"touch", image("42"), image("42"), map[string]int{}},
+		{"subscribe", image("42"), image("shipment:S1"), map[string]int{"42": -1, "shipment:S1": 1}},
+		{"unsubscribe", image("42"), image(""), map[string]int{"42": -1}},
+		{"disconnect or expiry", image("42"), nil, map[string]int{"42": -1}},
+	}
+	for _, tt := range tests {
+		var record events.DynamoDBEventRecord
+		record.Change.OldImage, record.Change.NewImage = tt.old, tt.new
+		if got := WatcherChanges(record); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	db := &putCapture{}
+	store := &DynamoStore{DynamoDB: db, Config: &Config{PresenceTable: "WebSocketPresence"}}
+	if err := store.AddWatchers(context.Background(), "e1", map[string]int{}); err != nil || db.txn != nil {
+		t.Fatalf("got %+v, %v for no changes", db.txn, err)
+	}
+	if err := store.AddWatchers(context.Background(), "e2", map[string]int{"42": -1, "shipment:S1": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(db.txn.ClientRequestToken) != "e2" || len(db.txn.TransactItems) != 2 {
+		t.Fatalf("got %+v, want both counts updated under the record's token", db.txn)
+	}
+	deltas := make(map[string]string)
+	for _, item := range db.txn.TransactItems {
+		channel := item.Update.Key["channel"].(*types.AttributeValueMemberS).Value
+		deltas[channel] = item.Update.ExpressionAttributeValues[":delta"].(*types.AttributeValueMemberN).Value
+	}
+	if want := map[string]string{"42": "-1", "shipment:S1": "1"}; !reflect.DeepEqual(deltas, want) {
+		t.Fatalf("got deltas %v, want %v", deltas, want)
+	}
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Publish stores msg as the latest status of its channel and appends it to
+// the channel history, both stamped with PublishedAt. Owners msg leaves out are taken from the previous
+// status, so that a customer or merchant keeps getting the statuses of their
+// orders. Subscribers are not notified here: the messages table stream feeds
+// the fan-out consumer, so the publisher never waits on the audience.
+func (d *Deps) Publish(ctx context.Context, msg StoredMessage) error {
+	channel, err := msg.Target()
+	if err != nil {
+		return err
+	}
+	msg.MessageData = msg.WithChannel(channel)
+	ctx, span := d.Tracer().Start(ctx, "store message", trace.WithAttributes(attribute.String("channel", channel.String())))
+	if !msg.HasOwners() {
+		err = d.resolveOwners(ctx, &msg.MessageData)
+	}
+	if err == nil {
+		at := time.Now().UTC()
+		msg.PublishedAt = at.Format(time.RFC3339Nano)
+		err = d.Store.AppendHistory(ctx, HistoryEvent{MessageData: msg.MessageData, PublishedAt: at})
+	}
+	if err == nil {
+		err = d.Store.PutMessage(ctx, msg)
+	}
+	EndSpan(span, err)
+	return err
+}
+
+// resolveOwners fills the owners msg leaves out from the latest status of its
+// channel.
+func (d *Deps) resolveOwners(ctx context.Context, msg *MessageData) error {
+	prev, err := d.Store.GetMessage(ctx, msg.ChannelKey())
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve owners: %w", err)
+	}
+	if msg.CustomerID == "" {
+		msg.CustomerID = prev.CustomerID
+	}
+	if msg.MerchantID == "" {
+		msg.MerchantID = prev.MerchantID
+	}
+	return nil
+}
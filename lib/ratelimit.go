@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// CodeRateLimited is the code of the ErrorFrame sent for refused actions.
+const CodeRateLimited = "RATE_LIMITED"
+
+// rateLimitAttempts bounds the writes Take tries when other takes of the
+// same bucket keep winning.
+const rateLimitAttempts = 3
+
+type (
+	// RateLimit is a token bucket holding up to Burst tokens, refilled by
+	// PerMinute tokens a minute. Every action takes a token. The zero
+	// RateLimit allows everything.
+	RateLimit struct {
+		PerMinute int
+		Burst     int
+	}
+
+	// RateLimitStore keeps token buckets by key. Take returns how long to
+	// wait for a token, zero when one was taken. Two takes of the same bucket
+	// never spend the same token.
+	RateLimitStore interface {
+		Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error)
+	}
+
+	// ErrorFrame tells a client why its action was refused. Action is the
+	// route of the refused action, RetryAfter how many seconds to wait before
+	// trying again.
+	ErrorFrame struct {
+		Type       string `json:"type"`
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		Action     string `json:"action,omitempty"`
+		RetryAfter int    `json:"retry_after,omitempty"`
+	}
+
+	// DynamoRateLimitStore keeps buckets in a DynamoDB table keyed by
+	// limitKey. A bucket is written conditionally on the state it was read
+	// in, both its tokens and updatedAt, and expires once it would be full
+	// again.
+	DynamoRateLimitStore struct {
+		DynamoDB DynamoDBAPI
+		Table    string
+	}
+
+	// MemoryRateLimitStore is an in-process RateLimitStore for tests and
+	// local runs.
+	MemoryRateLimitStore struct {
+		mu      sync.Mutex
+		buckets map[string]bucket
+	}
+
+	bucket struct {
+		tokens  float64
+		updated time.Time
+	}
+
+	// rateBucket names a bucket an action takes from.
+	rateBucket struct {
+		key   string
+		limit RateLimit
+	}
+)
+
+// take refills b up to now and takes a token from it. It returns the bucket
+// to store, or how long until a token is available.
+func (l RateLimit) take(b bucket, found bool, now time.Time) (bucket, time.Duration) {
+	if !found {
+		b = bucket{tokens: float64(l.Burst), updated: now}
+	}
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = min(float64(l.Burst), b.tokens+elapsed.Minutes()*float64(l.PerMinute))
+		b.updated = now
+	}
+	if b.tokens < 1 {
+		return b, time.Duration((1 - b.tokens) / float64(l.PerMinute) * float64(time.Minute))
+	}
+	b.tokens--
+	return b, 0
+}
+
+// full returns when b holds Burst tokens again, after which it can be
+// forgotten.
+func (l RateLimit) full(b bucket) time.Time {
+	missing := float64(l.Burst) - b.tokens
+	return b.updated.Add(time.Duration(missing / float64(l.PerMinute) * float64(time.Minute)))
+}
+
+// RateLimit wraps a WebSocket route so each action takes a token from the
+// bucket of its connection and, for authenticated callers, of its principal.
+// Refused actions get a RATE_LIMITED ErrorFrame and a 429. The limits are a
+// safeguard, so a failing store lets actions through. A nil RateLimits
+// disables them. $connect, $disconnect and ping are left unlimited, so a
+// limited client still keeps its connection alive.
+func (d *Deps) RateLimit(next func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error)) func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return func(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if d.RateLimits == nil {
+			return next(ctx, request)
+		}
+		ctx, logger := d.RequestLogger(ctx, request)
+		rc := request.RequestContext
+		buckets := []rateBucket{{"connection#" + rc.ConnectionID, d.Config.ConnectionRateLimit}}
+		if principal := Principal(rc); principal != "" {
+			buckets = append(buckets, rateBucket{"principal#" + principal, d.Config.PrincipalRateLimit})
+		}
+
+		now := time.Now()
+		for _, b := range buckets {
+			if b.limit.PerMinute == 0 {
+				continue
+			}
+			wait, err := d.RateLimits.Take(ctx, b.key, b.limit, now)
+			if err != nil {
+				logger.Warn("rate limit unavailable", "bucket", b.key, "error", err)
+				continue
+			}
+			if wait > 0 {
+				frame := ErrorFrame{
+					Type:       "error",
+					Code:       CodeRateLimited,
+					Message:    "Too many requests",
+					Action:     rc.RouteKey,
+					RetryAfter: int(math.Ceil(wait.Seconds())),
+				}
+				return d.refuse(ctx, logger, request, http.StatusTooManyRequests, "RateLimited", frame, "bucket", b.key, "retryAfter", frame.RetryAfter), nil
+			}
+		}
+		return next(ctx, request)
+	}
+}
+
+// refuse posts frame to the client whose action is refused, counts metric
+// and answers status. attrs are logged with the refusal to logger, the one
+// the caller got from RequestLogger along with ctx.
+func (d *Deps) refuse(ctx context.Context, logger *slog.Logger, request events.APIGatewayWebsocketProxyRequest, status int, metric string, frame ErrorFrame, attrs ...any) events.APIGatewayProxyResponse {
+	metrics := d.RequestMetrics(request)
+	defer metrics.Flush()
+	metrics.Count(metric, 1)
+
+	logger.Warn("action refused", append([]any{"code", frame.Code}, attrs...)...)
+	if err := d.PostFrame(ctx, Endpoint(request.RequestContext), request.RequestContext.ConnectionID, frame); err != nil {
+		logger.Warn("failed to send error frame", "code", frame.Code, "error", err)
+	}
+	return BuildResponse(status, frame)
+}
+
+func (s *DynamoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	for range rateLimitAttempts {
+		out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(s.Table),
+			Key: map[string]types.AttributeValue{
+				"limitKey": &types.AttributeValueMemberS{Value: key},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return 0, err
+		}
+		old, found, err := bucketFromItem(out.Item)
+		if err != nil {
+			return 0, fmt.Errorf("bucket %s: %w", key, err)
+		}
+		b, wait := limit.take(old, found, now)
+		if wait > 0 {
+			return wait, nil
+		}
+
+		in := &dynamodb.PutItemInput{
+			TableName: aws.String(s.Table),
+			Item: map[string]types.AttributeValue{
+				"limitKey":  &types.AttributeValueMemberS{Value: key},
+				"tokens":    &types.AttributeValueMemberN{Value: strconv.FormatFloat(b.tokens, 'f', -1, 64)},
+				"updatedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(b.updated.UnixMicro(), 10)},
+				"ttl":       &types.AttributeValueMemberN{Value: strconv.FormatInt(limit.full(b).Unix()+1, 10)},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(limitKey)"),
+		}
+		if found {
+			// Takes at the same instant leave updatedAt as it was, only
+			// the tokens tell them apart
+			in.ConditionExpression = aws.String("tokens = :tokens AND updatedAt = :updatedAt")
+			in.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":tokens":    out.Item["tokens"],
+				":updatedAt": out.Item["updatedAt"],
+			}
+		}
+		_, err = s.DynamoDB.PutItem(ctx, in)
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			// Another take got in between, start over from its state
+			continue
+		}
+		return 0, err
+	}
+	return 0, fmt.Errorf("bucket %s: too much contention", key)
+}
+
+func bucketFromItem(item map[string]types.AttributeValue) (bucket, bool, error) {
+	tokens, ok := item["tokens"].(*types.AttributeValueMemberN)
+	updated, ok2 := item["updatedAt"].(*types.AttributeValueMemberN)
+	if !ok || !ok2 {
+		return bucket{}, false, nil
+	}
+	n, err := strconv.ParseFloat(tokens.Value, 64)
+	if err != nil {
+		return bucket{}, false, err
+	}
+	us, err := strconv.ParseInt(updated.Value, 10, 64)
+	if err != nil {
+		return bucket{}, false, err
+	}
+	return bucket{tokens: n, updated: time.UnixMicro(us)}, true, nil
+}
+
+// NewMemoryRateLimitStore returns a store with every bucket full.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]bucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, found := s.buckets[key]
+	b, wait := limit.take(old, found, now)
+	if wait == 0 {
+		s.buckets[key] = b
+	}
+	return wait, nil
+}
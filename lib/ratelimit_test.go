@@ -0,0 +1,219 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestRateLimitBucket(t *testing.T) {
+	limit := RateLimit{PerMinute: 60, Burst: 2}
+	t0 := time.Unix(1714564800, 0)
+	store := NewMemoryRateLimitStore()
+	for _, step := range []struct {
+		at   time.Duration
+		want time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		{500 * time.Millisecond, 500 * time.Millisecond},
+		{time.Second, 0},
+		{time.Second, time.Second},
+		// An idle bucket fills up to Burst, not beyond
+		{time.Hour, 0},
+		{time.Hour, 0},
+		{time.Hour, time.Second},
+	} {
+		got, err := store.Take(context.Background(), "k", limit, t0.Add(step.at))
+		if err != nil || got != step.want {
+			t.Fatalf("at %s got %s, %v, want %s", step.at, got, err, step.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ctx := context.Background()
+	conf := DefaultConfig()
+	conf.ConnectionRateLimit = RateLimit{PerMinute: 60, Burst: 1}
+	conf.PrincipalRateLimit = RateLimit{PerMinute: 1, Burst: 2}
+	var frames []ErrorFrame
+	var logs bytes.Buffer
+	deps := &Deps{
+		Config:     &conf,
+		Logger:     slog.New(slog.NewJSONHandler(&logs, nil)),
+		RateLimits: NewMemoryRateLimitStore(),
+		NewManagementAPI: func(string) ManagementAPI {
+			return postFunc(func(in *apigatewaymanagementapi.PostToConnectionInput) error {
+				var frame ErrorFrame
+				if err := json.Unmarshal(in.Data, &frame); err != nil {
+					t.Fatal(err)
+				}
+				frames = append(frames, frame)
+				return nil
+			})
+		},
+	}
+	calls := 0
+	handler := deps.RateLimit(func(context.Context, events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+		calls++
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	})
+	request := func(connectionID, principal string) int {
+		t.Helper()
+		req := events.APIGatewayWebsocketProxyRequest{RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: connectionID,
+			RouteKey:     "request",
+		}}
+		if principal != "" {
+			req.RequestContext.Authorizer = map[string]interface{}{"principalId": principal}
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	for _, step := range []struct {
+		connection, principal string
+		want                  int
+	}{
+		{"c1", "", http.StatusOK},
+		{"c1", "", http.StatusTooManyRequests},
+		{"c2", "alice", http.StatusOK},
+		{"c3", "alice", http.StatusOK},
+		// alice spent her burst across connections
+		{"c4", "alice", http.StatusTooManyRequests},
+	} {
+		if got := request(step.connection, step.principal); got != step.want {
+			t.Fatalf("%s of %q got %d, want %d", step.connection, step.principal, got, step.want)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("handler called %d times, want 3", calls)
+	}
+	want := []ErrorFrame{
+		{Type: "error", Code: CodeRateLimited, Message: "Too many requests", Action: "request", RetryAfter: 1},
+		{Type: "error", Code: CodeRateLimited, Message: "Too many requests", Action: "request", RetryAfter: 60},
+	}
+	if len(frames) != len(want) || frames[0] != want[0] || frames[1] != want[1] {
+		t.Fatalf("got frames %+v, want %+v", frames, want)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if n := strings.Count(line, `"connectionId"`); n != 1 {
+			t.Fatalf("got the request attributes %d times in %s", n, line)
+		}
+	}
+
+	// A failing store lets actions through
+	deps.RateLimits = takeFunc(func() error { return errors.New("throttled") })
+	if got := request("c1", ""); got != http.StatusOK {
+		t.Fatalf("got %d with the store down", got)
+	}
+}
+
+type takeFunc func() error
+
+func (f takeFunc) Take(context.Context, string, RateLimit, time.Time) (time.Duration, error) {
+	return 0, f()
+}
+
+// bucketTable is a one item table whose conditional writes fail while
+// conflicts is positive, as if another take wrote first. Otherwise the
+// condition is checked against the item, after calling race, if set, in
+// between the read and the write.
+type bucketTable struct {
+	DynamoDBAPI
+	item      map[string]types.AttributeValue
+	conflicts int
+	puts      int
+	race      func()
+}
+
+func (b *bucketTable) GetItem(context.Context, *dynamodb.GetItemInput, ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: b.item}, nil
+}
+
+func (b *bucketTable) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	b.puts++
+	if b.conflicts > 0 {
+		b.conflicts--
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	if race := b.race; race != nil {
+		b.race = nil
+		race()
+	}
+	if aws.ToString(in.ConditionExpression) == "attribute_not_exists(limitKey)" {
+		if b.item != nil {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	} else {
+		for name, want := range in.ExpressionAttributeValues {
+			if got, ok := b.item[strings.TrimPrefix(name, ":")]; !ok || !reflect.DeepEqual(got, want) {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+		}
+	}
+	b.item = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestDynamoRateLimitStore(t *testing.T) {
+	ctx := context.Background()
+	limit := RateLimit{PerMinute: 60, Burst: 2}
+	now := time.Unix(1714564800, 0)
+	table := &bucketTable{conflicts: 1}
+	store := &DynamoRateLimitStore{DynamoDB: table, Table: "WebSocketRateLimits"}
+
+	for i, want := range []time.Duration{0, 0, time.Second} {
+		got, err := store.Take(ctx, "connection#c1", limit, now)
+		if err != nil || got != want {
+			t.Fatalf("take %d got %s, %v, want %s", i, got, err, want)
+		}
+	}
+	if table.puts != 3 {
+		t.Errorf("got %d writes, want the conflicting one retried", table.puts)
+	}
+	if ttl := table.item["ttl"].(*types.AttributeValueMemberN).Value; ttl != "1714564803" {
+		t.Errorf("got ttl %s, want the time the bucket is full again", ttl)
+	}
+
+	table.conflicts = rateLimitAttempts
+	if _, err := store.Take(ctx, "connection#c1", limit, now.Add(time.Minute)); err == nil {
+		t.Fatal("expected an error when every write conflicts")
+	}
+
+	// Two takes at the same instant, the second writing in between the
+	// read and the write of the first, spend a token each
+	table = &bucketTable{}
+	store.DynamoDB = table
+	if _, err := store.Take(ctx, "connection#c1", limit, now); err != nil {
+		t.Fatal(err)
+	}
+	table.race = func() {
+		if wait, err := store.Take(ctx, "connection#c1", limit, now); wait != 0 || err != nil {
+			t.Errorf("racing take got %s, %v", wait, err)
+		}
+	}
+	if wait, err := store.Take(ctx, "connection#c1", limit, now); wait != time.Second || err != nil {
+		t.Fatalf("got %s, %v, want the last token taken by the racing take", wait, err)
+	}
+	if tokens := table.item["tokens"].(*types.AttributeValueMemberN).Value; tokens != "0" {
+		t.Fatalf("got %s tokens left, want 0", tokens)
+	}
+}
@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrNotFound is returned by stores when the requested item does not exist.
+var ErrNotFound = errors.New("not found")
+
+type (
+	// Connection is a WebSocket connection watching a channel, whose Key is
+	// Channel. LastSeen is when the client connected or last pinged. The
+	// rest describes the caller, as recorded by NewConnection, and is empty
+	// for connections stored before it was.
+	Connection struct {
+		ConnectionID string    `json:"connectionId"`
+		Channel      string    `json:"channel"`
+		LastSeen     time.Time `json:"lastSeen"`
+		ConnectedAt  time.Time `json:"connectedAt"`
+		// ExpiresAt is when the store may drop the record, see
+		// MaxConnectionDuration.
+		ExpiresAt       time.Time `json:"expiresAt"`
+		SourceIP        string    `json:"sourceIp,omitempty"`
+		UserAgent       string    `json:"userAgent,omitempty"`
+		Principal       string    `json:"principal,omitempty"`
+		ClientVersion   string    `json:"clientVersion,omitempty"`
+		ProtocolVersion string    `json:"protocolVersion,omitempty"`
+		// Filter selects the messages the connection gets, see ParseFilter.
+		Filter string `json:"filter,omitempty"`
+		// Subprotocol is the one negotiated at $connect, which encodes the
+		// frames pushed to the connection, see CodecFor.
+		Subprotocol string `json:"subprotocol,omitempty"`
+	}
+
+	// StoredMessage is the latest status of a channel as kept in the
+	// messages table. Endpoint and SourceConnectionID describe the publish so
+	// the stream consumer can fan it out later.
+	StoredMessage struct {
+		MessageData
+		Endpoint           string
+		SourceConnectionID string
+	}
+
+	// ConnectionStore keeps track of who is watching which channel. Channels
+	// are named by their Key, and connections that unsubscribed have none.
+	ConnectionStore interface {
+		PutConnection(ctx context.Context, conn Connection) error
+		// GetConnection returns ErrNotFound for unknown connections.
+		GetConnection(ctx context.Context, connectionID string) (*Connection, error)
+		DeleteConnection(ctx context.Context, connectionID string) error
+		ConnectionsForChannel(ctx context.Context, channel string) ([]Connection, error)
+		// TouchConnection sets LastSeen. It returns ErrNotFound for unknown
+		// connections rather than creating them.
+		TouchConnection(ctx context.Context, connectionID string, at time.Time) error
+		// IdleConnections returns the connections last seen before before,
+		// including those that never recorded LastSeen.
+		IdleConnections(ctx context.Context, before time.Time) ([]Connection, error)
+		// ScanConnections returns the connections of one of segments disjoint
+		// parts of the store, numbered from 0, so that several workers can
+		// read it in parallel.
+		ScanConnections(ctx context.Context, segment, segments int) ([]Connection, error)
+	}
+
+	// PresenceStore counts the connections watching each channel, by Key.
+	PresenceStore interface {
+		Watchers(ctx context.Context, channel string) (int, error)
+		// AddWatchers applies changes, from WatcherChanges, to the counts
+		// all at once. Calls repeating a token are applied once, so a
+		// stream record can be retried.
+		AddWatchers(ctx context.Context, token string, changes map[string]int) error
+	}
+
+	// MessageStore keeps the latest status of each channel, by Key.
+	MessageStore interface {
+		PutMessage(ctx context.Context, msg StoredMessage) error
+		// GetMessage returns ErrNotFound when the channel has no status.
+		GetMessage(ctx context.Context, channel string) (*StoredMessage, error)
+		DeleteMessage(ctx context.Context, channel string) error
+	}
+
+	// Store is the data layer shared by the handlers.
+	Store interface {
+		ConnectionStore
+		PresenceStore
+		MessageStore
+		HistoryStore
+	}
+)
+
+// messageItem is the messages table item for msg. It is also the shape of
+// the stream images the fan-out consumer receives.
+func messageItem(msg StoredMessage, ttl int64) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"eventId":   &types.AttributeValueMemberS{Value: msg.ChannelKey()},
+		"status":    &types.AttributeValueMemberS{Value: msg.Status},
+		"messageId": &types.AttributeValueMemberS{Value: msg.ID},
+		"date":      &types.AttributeValueMemberS{Value: msg.Date},
+		"ttl":       &types.AttributeValueMemberN{Value: strconv.FormatInt(ttl, 10)},
+	}
+	optional := map[string]string{
+		"customerId":         msg.CustomerID,
+		"merchantId":         msg.MerchantID,
+		"traceparent":        msg.Trace["traceparent"],
+		"tracestate":         msg.Trace["tracestate"],
+		"endpoint":           msg.Endpoint,
+		"sourceConnectionId": msg.SourceConnectionID,
+		"publishedAt":        msg.PublishedAt,
+	}
+	for name, value := range optional {
+		if value != "" {
+			item[name] = &types.AttributeValueMemberS{Value: value}
+		}
+	}
+	channelAttributes(item, msg.MessageData)
+	return item
+}
+
+// channelAttributes records the channel of messages that are not about an
+// order, and the order they relate to if any, since the key attribute then
+// holds the channel.
+func channelAttributes(item map[string]types.AttributeValue, msg MessageData) {
+	if msg.Channel == "" {
+		return
+	}
+	item["channel"] = &types.AttributeValueMemberS{Value: msg.Channel}
+	if msg.OrderID != "" {
+		item["relatedOrderId"] = &types.AttributeValueMemberS{Value: msg.OrderID}
+	}
+}
+
+// setChannel is the reverse of channelAttributes, key being the value of the
+// key attribute.
+func setChannel(msg *MessageData, key string, str func(string) string) {
+	if msg.Channel = str("channel"); msg.Channel != "" {
+		msg.OrderID = str("relatedOrderId")
+		return
+	}
+	msg.OrderID = key
+}
+
+func messageFromItem(item map[string]types.AttributeValue) *StoredMessage {
+	return messageFromAttributes(func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	})
+}
+
+// MessageFromStreamImage decodes a messages table image from a DynamoDB
+// stream record.
+func MessageFromStreamImage(image map[string]events.DynamoDBAttributeValue) *StoredMessage {
+	return messageFromAttributes(func(name string) string {
+		if v, ok := image[name]; ok && v.DataType() == events.DataTypeString {
+			return v.String()
+		}
+		return ""
+	})
+}
+
+func messageFromAttributes(str func(string) string) *StoredMessage {
+	msg := &StoredMessage{
+		MessageData: MessageData{
+			ID:          str("messageId"),
+			Status:      str("status"),
+			Date:        str("date"),
+			CustomerID:  str("customerId"),
+			MerchantID:  str("merchantId"),
+			PublishedAt: str("publishedAt"),
+		},
+		Endpoint:           str("endpoint"),
+		SourceConnectionID: str("sourceConnectionId"),
+	}
+	setChannel(&msg.MessageData, str("eventId"), str)
+	for _, key := range []string{"traceparent", "tracestate"} {
+		if v := str(key); v != "" {
+			if msg.Trace == nil {
+				msg.Trace = make(map[string]string)
+			}
+			msg.Trace[key] = v
+		}
+	}
+	return msg
+}
@@ -0,0 +1,442 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoStore is the Store backed by the connections and messages tables.
+// Channel keys are kept in the attributes that held order IDs before there
+// were channels, orderId and eventId, so the order index still serves them.
+// Watcher counts live in the presence table, keyed by channel, and are kept
+// from the connections table stream by AddWatchers.
+type DynamoStore struct {
+	DynamoDB DynamoDBAPI
+	Config   *Config
+}
+
+func (s *DynamoStore) PutConnection(ctx context.Context, conn Connection) error {
+	item := map[string]types.AttributeValue{
+		"connectionId": &types.AttributeValueMemberS{Value: conn.ConnectionID},
+	}
+	// Index keys cannot be empty: unsubscribed connections stay out of it.
+	if conn.Channel != "" {
+		item["orderId"] = &types.AttributeValueMemberS{Value: conn.Channel}
+	}
+	times := map[string]time.Time{
+		"lastSeen":    conn.LastSeen,
+		"connectedAt": conn.ConnectedAt,
+		"ttl":         conn.ExpiresAt,
+	}
+	for name, t := range times {
+		if !t.IsZero() {
+			item[name] = &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+		}
+	}
+	optional := map[string]string{
+		"sourceIp":        conn.SourceIP,
+		"userAgent":       conn.UserAgent,
+		"principal":       conn.Principal,
+		"clientVersion":   conn.ClientVersion,
+		"protocolVersion": conn.ProtocolVersion,
+		"filter":          conn.Filter,
+		"subprotocol":     conn.Subprotocol,
+	}
+	for name, value := range optional {
+		if value != "" {
+			item[name] = &types.AttributeValueMemberS{Value: value}
+		}
+	}
+	_, err := s.DynamoDB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.ConnectionsTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoStore) GetConnection(ctx context.Context, connectionID string) (*Connection, error) {
+	out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Config.ConnectionsTable),
+		Key: map[string]types.AttributeValue{
+			"connectionId": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := connectionFromItem(out.Item)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &conn, nil
+}
+
+func (s *DynamoStore) DeleteConnection(ctx context.Context, connectionID string) error {
+	_, err := s.DynamoDB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Config.ConnectionsTable),
+		Key: map[string]types.AttributeValue{
+			"connectionId": &types.AttributeValueMemberS{Value: connectionID},
+		},
+	})
+	return err
+}
+
+// AddWatchers updates the counts in one transaction, with token as its
+// client request token: DynamoDB applies a repeated token once for ten
+// minutes, which covers the retries of a stream record.
+func (s *DynamoStore) AddWatchers(ctx context.Context, token string, changes map[string]int) error {
+	var items []types.TransactWriteItem
+	for channel, delta := range changes {
+		if channel == "" || delta == 0 {
+			continue
+		}
+		items = append(items, types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(s.Config.PresenceTable),
+			Key: map[string]types.AttributeValue{
+				"channel": &types.AttributeValueMemberS{Value: channel},
+			},
+			UpdateExpression: aws.String("ADD watchers :delta"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":delta": &types.AttributeValueMemberN{Value: strconv.Itoa(delta)},
+			},
+		}})
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := s.DynamoDB.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems:      items,
+		ClientRequestToken: aws.String(token),
+	})
+	return err
+}
+
+// Watchers reads the count kept from the connections table stream, so it
+// lags connection writes by the stream delay and counts out connections
+// removed by their TTL too. It never reports less than zero, which a count
+// only reaches when a record is retried after its token expired.
+func (s *DynamoStore) Watchers(ctx context.Context, channel string) (int, error) {
+	out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Config.PresenceTable),
+		Key: map[string]types.AttributeValue{
+			"channel": &types.AttributeValueMemberS{Value: channel},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, ok := out.Item["watchers"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v.Value)
+	if err != nil {
+		return 0, fmt.Errorf("watchers of %s: %w", channel, err)
+	}
+	return max(n, 0), nil
+}
+
+func (s *DynamoStore) ConnectionsForChannel(ctx context.Context, channel string) ([]Connection, error) {
+	var (
+		conns []Connection
+		start map[string]types.AttributeValue
+	)
+	for {
+		out, err := s.DynamoDB.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(s.Config.ConnectionsTable),
+			IndexName:              aws.String(s.Config.OrderIndex),
+			KeyConditionExpression: aws.String("orderId = :channel"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":channel": &types.AttributeValueMemberS{Value: channel},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if conn, ok := connectionFromItem(item); ok {
+				conns = append(conns, conn)
+			}
+		}
+		if start = out.LastEvaluatedKey; len(start) == 0 {
+			return conns, nil
+		}
+	}
+}
+
+func (s *DynamoStore) TouchConnection(ctx context.Context, connectionID string, at time.Time) error {
+	_, err := s.DynamoDB.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.Config.ConnectionsTable),
+		Key: map[string]types.AttributeValue{
+			"connectionId": &types.AttributeValueMemberS{Value: connectionID},
+		},
+		UpdateExpression:    aws.String("SET lastSeen = :at"),
+		ConditionExpression: aws.String("attribute_exists(connectionId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// IdleConnections scans the whole table. It runs from the scheduled reaper,
+// not per request, so the cost is bounded by how often that runs.
+func (s *DynamoStore) IdleConnections(ctx context.Context, before time.Time) ([]Connection, error) {
+	var (
+		conns []Connection
+		start map[string]types.AttributeValue
+	)
+	for {
+		out, err := s.DynamoDB.Scan(ctx, &dynamodb.ScanInput{
+			TableName:        aws.String(s.Config.ConnectionsTable),
+			FilterExpression: aws.String("attribute_not_exists(lastSeen) OR lastSeen < :before"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":before": &types.AttributeValueMemberN{Value: strconv.FormatInt(before.Unix(), 10)},
+			},
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if conn, ok := connectionFromItem(item); ok {
+				conns = append(conns, conn)
+			}
+		}
+		if start = out.LastEvaluatedKey; len(start) == 0 {
+			return conns, nil
+		}
+	}
+}
+
+func (s *DynamoStore) ScanConnections(ctx context.Context, segment, segments int) ([]Connection, error) {
+	if segment < 0 || segment >= segments {
+		return nil, fmt.Errorf("segment %d out of %d", segment, segments)
+	}
+	var (
+		conns []Connection
+		start map[string]types.AttributeValue
+	)
+	for {
+		out, err := s.DynamoDB.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(s.Config.ConnectionsTable),
+			Segment:           aws.Int32(int32(segment)),
+			TotalSegments:     aws.Int32(int32(segments)),
+			ExclusiveStartKey: start,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if conn, ok := connectionFromItem(item); ok {
+				conns = append(conns, conn)
+			}
+		}
+		if start = out.LastEvaluatedKey; len(start) == 0 {
+			return conns, nil
+		}
+	}
+}
+
+func connectionFromItem(item map[string]types.AttributeValue) (Connection, bool) {
+	id, ok := item["connectionId"].(*types.AttributeValueMemberS)
+	if !ok {
+		return Connection{}, false
+	}
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	unix := func(name string) time.Time {
+		if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+			if sec, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+				return time.Unix(sec, 0).UTC()
+			}
+		}
+		return time.Time{}
+	}
+	return Connection{
+		ConnectionID:    id.Value,
+		Channel:         str("orderId"),
+		LastSeen:        unix("lastSeen"),
+		ConnectedAt:     unix("connectedAt"),
+		ExpiresAt:       unix("ttl"),
+		SourceIP:        str("sourceIp"),
+		UserAgent:       str("userAgent"),
+		Principal:       str("principal"),
+		ClientVersion:   str("clientVersion"),
+		ProtocolVersion: str("protocolVersion"),
+		Filter:          str("filter"),
+		Subprotocol:     str("subprotocol"),
+	}, true
+}
+
+func (s *DynamoStore) PutMessage(ctx context.Context, msg StoredMessage) error {
+	_, err := s.DynamoDB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.MessagesTable),
+		Item:      messageItem(msg, time.Now().Add(s.Config.MessageTTL).Unix()),
+	})
+	return err
+}
+
+func (s *DynamoStore) GetMessage(ctx context.Context, channel string) (*StoredMessage, error) {
+	out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Config.MessagesTable),
+		Key: map[string]types.AttributeValue{
+			"eventId": &types.AttributeValueMemberS{Value: channel},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrNotFound
+	}
+	return messageFromItem(out.Item), nil
+}
+
+func (s *DynamoStore) DeleteMessage(ctx context.Context, channel string) error {
+	_, err := s.DynamoDB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Config.MessagesTable),
+		Key: map[string]types.AttributeValue{
+			"eventId": &types.AttributeValueMemberS{Value: channel},
+		},
+	})
+	return err
+}
+
+func (s *DynamoStore) AppendHistory(ctx context.Context, event HistoryEvent) error {
+	item := map[string]types.AttributeValue{
+		"orderId":     &types.AttributeValueMemberS{Value: event.ChannelKey()},
+		"sortKey":     &types.AttributeValueMemberS{Value: historyKey(event)},
+		"messageId":   &types.AttributeValueMemberS{Value: event.ID},
+		"status":      &types.AttributeValueMemberS{Value: event.Status},
+		"date":        &types.AttributeValueMemberS{Value: event.Date},
+		"publishedAt": &types.AttributeValueMemberS{Value: event.PublishedAt.UTC().Format(time.RFC3339Nano)},
+		"ttl":         &types.AttributeValueMemberN{Value: strconv.FormatInt(event.PublishedAt.Add(s.Config.HistoryTTL).Unix(), 10)},
+	}
+	if event.CustomerID != "" {
+		item["customerId"] = &types.AttributeValueMemberS{Value: event.CustomerID}
+	}
+	if event.MerchantID != "" {
+		item["merchantId"] = &types.AttributeValueMemberS{Value: event.MerchantID}
+	}
+	if traceparent := event.Trace["traceparent"]; traceparent != "" {
+		item["traceparent"] = &types.AttributeValueMemberS{Value: traceparent}
+	}
+	channelAttributes(item, event.MessageData)
+	_, err := s.DynamoDB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Config.HistoryTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoStore) History(ctx context.Context, q HistoryQuery) (HistoryPage, error) {
+	if err := q.Normalize(); err != nil {
+		return HistoryPage{}, err
+	}
+	after, _ := q.after()
+
+	values := map[string]types.AttributeValue{
+		":channel": &types.AttributeValueMemberS{Value: q.Channel},
+	}
+	keyCondition := "orderId = :channel"
+	switch {
+	case !q.From.IsZero() && !q.To.IsZero():
+		keyCondition += " AND sortKey BETWEEN :from AND :to"
+	case !q.From.IsZero():
+		keyCondition += " AND sortKey >= :from"
+	case !q.To.IsZero():
+		keyCondition += " AND sortKey < :to"
+	}
+	if !q.From.IsZero() {
+		values[":from"] = &types.AttributeValueMemberS{Value: q.From.UTC().Format(historyKeyLayout)}
+	}
+	if !q.To.IsZero() {
+		// Keys at To itself carry a #messageId suffix and sort after it
+		values[":to"] = &types.AttributeValueMemberS{Value: q.To.UTC().Format(historyKeyLayout)}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Config.HistoryTable),
+		KeyConditionExpression:    aws.String(keyCondition),
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int32(int32(q.Limit)),
+	}
+	if len(q.Statuses) > 0 {
+		placeholders := make([]string, len(q.Statuses))
+		for i, status := range q.Statuses {
+			placeholders[i] = fmt.Sprintf(":status%d", i)
+			values[placeholders[i]] = &types.AttributeValueMemberS{Value: status}
+		}
+		input.FilterExpression = aws.String("#status IN (" + strings.Join(placeholders, ", ") + ")")
+		input.ExpressionAttributeNames = map[string]string{"#status": "status"}
+	}
+	if after != "" {
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"orderId": &types.AttributeValueMemberS{Value: q.Channel},
+			"sortKey": &types.AttributeValueMemberS{Value: after},
+		}
+	}
+
+	var page HistoryPage
+	for {
+		out, err := s.DynamoDB.Query(ctx, input)
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		for i, item := range out.Items {
+			page.Events = append(page.Events, historyEventFromItem(item))
+			if len(page.Events) == q.Limit {
+				if i < len(out.Items)-1 || len(out.LastEvaluatedKey) > 0 {
+					page.Cursor = encodeHistoryCursor(historyKey(page.Events[len(page.Events)-1]))
+				}
+				return page, nil
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return page, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func historyEventFromItem(item map[string]types.AttributeValue) HistoryEvent {
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	event := HistoryEvent{
+		MessageData: MessageData{
+			ID:         str("messageId"),
+			Status:     str("status"),
+			Date:       str("date"),
+			CustomerID: str("customerId"),
+			MerchantID: str("merchantId"),
+		},
+	}
+	setChannel(&event.MessageData, str("orderId"), str)
+	event.PublishedAt, _ = time.Parse(time.RFC3339Nano, str("publishedAt"))
+	if traceparent := str("traceparent"); traceparent != "" {
+		event.Trace = map[string]string{"traceparent": traceparent}
+	}
+	return event
+}
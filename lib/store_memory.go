@@ -0,0 +1,324 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MemoryStore is an in-process Store for tests and local runs. Changes to
+// messages can be observed as DynamoDB stream records, see OnMessageChange.
+// It has no connections stream: watchers are counted as connections are
+// written, and the changes can be observed with OnConnectionChange.
+type MemoryStore struct {
+	// TTL is the message lifetime written into the ttl attribute. It is not
+	// enforced.
+	TTL time.Duration
+
+	mu            sync.Mutex
+	connections   map[string]Connection
+	watchers      map[string]int
+	messages      map[string]StoredMessage
+	history       map[string][]HistoryEvent
+	sequence      int
+	listeners     []func(events.DynamoDBEventRecord)
+	connListeners []func(connectionID string, changes map[string]int)
+}
+
+// NewMemoryStore returns an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		TTL:         time.Hour,
+		connections: make(map[string]Connection),
+		watchers:    make(map[string]int),
+		messages:    make(map[string]StoredMessage),
+		history:     make(map[string][]HistoryEvent),
+	}
+}
+
+// OnMessageChange registers fn to receive a record for every change to the
+// messages, like a stream with NEW_AND_OLD_IMAGES on the messages table. fn
+// is called synchronously, after the change is visible.
+func (s *MemoryStore) OnMessageChange(fn func(events.DynamoDBEventRecord)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// OnConnectionChange registers fn to receive the watcher changes of every
+// connection write, as WatcherChanges finds them in the connections table
+// stream. fn is called synchronously, after the counts include the changes.
+func (s *MemoryStore) OnConnectionChange(fn func(connectionID string, changes map[string]int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connListeners = append(s.connListeners, fn)
+}
+
+func (s *MemoryStore) PutConnection(_ context.Context, conn Connection) error {
+	s.mu.Lock()
+	old := s.connections[conn.ConnectionID]
+	s.connections[conn.ConnectionID] = conn
+	changes := s.moveWatcher(old.Channel, conn.Channel)
+	listeners := slices.Clone(s.connListeners)
+	s.mu.Unlock()
+
+	if len(changes) > 0 {
+		for _, fn := range listeners {
+			fn(conn.ConnectionID, changes)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetConnection(_ context.Context, connectionID string) (*Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.connections[connectionID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &conn, nil
+}
+
+func (s *MemoryStore) DeleteConnection(_ context.Context, connectionID string) error {
+	s.mu.Lock()
+	old, ok := s.connections[connectionID]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.connections, connectionID)
+	changes := s.moveWatcher(old.Channel, "")
+	listeners := slices.Clone(s.connListeners)
+	s.mu.Unlock()
+
+	if len(changes) > 0 {
+		for _, fn := range listeners {
+			fn(connectionID, changes)
+		}
+	}
+	return nil
+}
+
+// moveWatcher counts a connection out of channel old and into new, either of
+// which may be empty, and returns the changes. s.mu must be held.
+func (s *MemoryStore) moveWatcher(old, new string) map[string]int {
+	changes := make(map[string]int)
+	if old == new {
+		return changes
+	}
+	if old != "" {
+		s.addWatchers(old, -1)
+		changes[old]--
+	}
+	if new != "" {
+		s.addWatchers(new, 1)
+		changes[new]++
+	}
+	return changes
+}
+
+// addWatchers adjusts the count of channel. s.mu must be held.
+func (s *MemoryStore) addWatchers(channel string, delta int) {
+	if channel == "" {
+		return
+	}
+	if n := s.watchers[channel] + delta; n > 0 {
+		s.watchers[channel] = n
+	} else {
+		delete(s.watchers, channel)
+	}
+}
+
+func (s *MemoryStore) AddWatchers(_ context.Context, _ string, changes map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for channel, delta := range changes {
+		s.addWatchers(channel, delta)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Watchers(_ context.Context, channel string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watchers[channel], nil
+}
+
+func (s *MemoryStore) ConnectionsForChannel(_ context.Context, channel string) ([]Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []Connection
+	for _, conn := range s.connections {
+		if conn.Channel == channel {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectionID < conns[j].ConnectionID })
+	return conns, nil
+}
+
+func (s *MemoryStore) TouchConnection(_ context.Context, connectionID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.connections[connectionID]
+	if !ok {
+		return ErrNotFound
+	}
+	conn.LastSeen = at
+	s.connections[connectionID] = conn
+	return nil
+}
+
+func (s *MemoryStore) IdleConnections(_ context.Context, before time.Time) ([]Connection, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []Connection
+	for _, conn := range s.connections {
+		if conn.LastSeen.Before(before) {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectionID < conns[j].ConnectionID })
+	return conns, nil
+}
+
+func (s *MemoryStore) ScanConnections(_ context.Context, segment, segments int) ([]Connection, error) {
+	if segment < 0 || segment >= segments {
+		return nil, fmt.Errorf("segment %d out of %d", segment, segments)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []Connection
+	for id, conn := range s.connections {
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		if int(h.Sum32()%uint32(segments)) == segment {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ConnectionID < conns[j].ConnectionID })
+	return conns, nil
+}
+
+func (s *MemoryStore) PutMessage(_ context.Context, msg StoredMessage) error {
+	s.mu.Lock()
+	key := msg.ChannelKey()
+	old, existed := s.messages[key]
+	s.messages[key] = msg
+	var oldPtr *StoredMessage
+	eventName := "INSERT"
+	if existed {
+		oldPtr, eventName = &old, "MODIFY"
+	}
+	record, listeners := s.record(eventName, oldPtr, &msg)
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(record)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMessage(_ context.Context, channel string) (*StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg, ok := s.messages[channel]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &msg, nil
+}
+
+func (s *MemoryStore) DeleteMessage(_ context.Context, channel string) error {
+	s.mu.Lock()
+	old, existed := s.messages[channel]
+	if !existed {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.messages, channel)
+	record, listeners := s.record("REMOVE", &old, nil)
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(record)
+	}
+	return nil
+}
+
+func (s *MemoryStore) AppendHistory(_ context.Context, event HistoryEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := event.ChannelKey()
+	list := append(s.history[key], event)
+	sort.SliceStable(list, func(i, j int) bool { return historyKey(list[i]) < historyKey(list[j]) })
+	s.history[key] = list
+	return nil
+}
+
+func (s *MemoryStore) History(_ context.Context, q HistoryQuery) (HistoryPage, error) {
+	if err := q.Normalize(); err != nil {
+		return HistoryPage{}, err
+	}
+	after, _ := q.after()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var page HistoryPage
+	for _, event := range s.history[q.Channel] {
+		if historyKey(event) <= after || !q.Matches(event) {
+			continue
+		}
+		if len(page.Events) == q.Limit {
+			page.Cursor = encodeHistoryCursor(historyKey(page.Events[len(page.Events)-1]))
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page, nil
+}
+
+// record builds the stream record for a change. s.mu must be held.
+func (s *MemoryStore) record(eventName string, old, new *StoredMessage) (events.DynamoDBEventRecord, []func(events.DynamoDBEventRecord)) {
+	s.sequence++
+	ttl := time.Now().Add(s.TTL).Unix()
+	record := events.DynamoDBEventRecord{
+		EventID:     strconv.Itoa(s.sequence),
+		EventName:   eventName,
+		EventSource: "aws:dynamodb",
+		Change: events.DynamoDBStreamRecord{
+			SequenceNumber: strconv.Itoa(s.sequence),
+			StreamViewType: "NEW_AND_OLD_IMAGES",
+		},
+	}
+	if old != nil {
+		record.Change.Keys = map[string]events.DynamoDBAttributeValue{"eventId": events.NewStringAttribute(old.ChannelKey())}
+		record.Change.OldImage = streamImage(messageItem(*old, ttl))
+	}
+	if new != nil {
+		record.Change.Keys = map[string]events.DynamoDBAttributeValue{"eventId": events.NewStringAttribute(new.ChannelKey())}
+		record.Change.NewImage = streamImage(messageItem(*new, ttl))
+	}
+	return record, slices.Clone(s.listeners)
+}
+
+func streamImage(item map[string]types.AttributeValue) map[string]events.DynamoDBAttributeValue {
+	image := make(map[string]events.DynamoDBAttributeValue, len(item))
+	for name, value := range item {
+		switch v := value.(type) {
+		case *types.AttributeValueMemberS:
+			image[name] = events.NewStringAttribute(v.Value)
+		case *types.AttributeValueMemberN:
+			image[name] = events.NewNumberAttribute(v.Value)
+		}
+	}
+	return image
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// SSEContentType is the content type of a Server-Sent Events stream.
+const SSEContentType = "text/event-stream"
+
+// DefaultPollInterval is how often WaitForMessage reads the store.
+const DefaultPollInterval = time.Second
+
+// WriteSSE writes one Server-Sent Event with data encoded as JSON. id and
+// event are omitted when empty. Clients resume a stream by sending the last id
+// back in the Last-Event-ID header.
+func WriteSSE(w io.Writer, id, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	fmt.Fprintf(&buf, "data: %s\n\n", payload)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// WriteSSEComment writes an SSE comment line, used as a keepalive.
+func WriteSSEComment(w io.Writer, comment string) error {
+	_, err := fmt.Fprintf(w, ": %s\n\n", comment)
+	return err
+}
+
+// WaitForMessage returns the latest status of orderID once its message ID
+// differs from afterID, reading the store every interval. It returns nil and
+// no error when ctx ends first.
+//
+// It is the fallback for clients that cannot hold a WebSocket when no process
+// is there to receive the fan-out, e.g. a Lambda serving a long poll.
+func (d *Deps) WaitForMessage(ctx context.Context, orderID, afterID string, interval time.Duration) (*StoredMessage, error) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		msg, err := d.Store.GetMessage(ctx, orderID)
+		switch {
+		case err == nil && msg.ID != afterID:
+			return msg, nil
+		case err != nil && !errors.Is(err, ErrNotFound):
+			if ctx.Err() != nil {
+				return nil, nil
+			}
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-ticker.C:
+		}
+	}
+}
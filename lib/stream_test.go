@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWriteSSE(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteSSE(&buf, "m1", "status", MessageData{ID: "m1", Status: "PAID", OrderID: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "id: m1\nevent: status\ndata: {\"id\":\"m1\",\"status\":\"PAID\",\"date\":\"\",\"order_id\":\"42\"}\n\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWaitForMessage(t *testing.T) {
+	ctx := context.Background()
+	conf := DefaultConfig()
+	store := NewMemoryStore()
+	deps := &Deps{Config: &conf, Store: store}
+	if err := store.PutMessage(ctx, StoredMessage{MessageData: MessageData{ID: "m1", OrderID: "42"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that has not seen m1 gets it right away
+	msg, err := deps.WaitForMessage(ctx, "42", "", time.Millisecond)
+	if err != nil || msg == nil || msg.ID != "m1" {
+		t.Fatalf("got %+v, %v", msg, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.PutMessage(ctx, StoredMessage{MessageData: MessageData{ID: "m2", OrderID: "42"}})
+	}()
+	msg, err = deps.WaitForMessage(ctx, "42", "m1", time.Millisecond)
+	if err != nil || msg == nil || msg.ID != "m2" {
+		t.Fatalf("got %+v, %v", msg, err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	if msg, err := deps.WaitForMessage(timeout, "42", "m2", time.Millisecond); msg != nil || err != nil {
+		t.Fatalf("got %+v, %v, want nothing on timeout", msg, err)
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+// SweepReport summarizes a Sweep.
+type SweepReport struct {
+	Segments int `json:"segments"`
+	Scanned  int `json:"scanned"`
+	Alive    int `json:"alive"`
+	// Removed counts the rows deleted because their connection is gone.
+	Removed int `json:"removed"`
+	// Failed counts the connections that could not be checked or removed.
+	// They are left for the next sweep.
+	Failed int `json:"failed"`
+	// FailedSegments lists the segments that could not be read.
+	FailedSegments []int `json:"failed_segments,omitempty"`
+	DurationMS     int64 `json:"duration_ms"`
+}
+
+// Sweep asks the @connections endpoint about every stored connection and
+// deletes the rows of those that are gone, e.g. because the socket died
+// without $disconnect or the row was written by a $connect that failed
+// later. The store is read as segments parts, in parallel.
+//
+// Unlike Reap it never closes a connection: one that still answers is kept,
+// however long it has been idle.
+func (d *Deps) Sweep(ctx context.Context, segments int) (SweepReport, error) {
+	report := SweepReport{Segments: segments}
+	endpoint := d.Config.ConnectionsEndpoint
+	if endpoint == "" {
+		return report, ErrNoConnectionsEndpoint
+	}
+	if segments < 1 {
+		return report, fmt.Errorf("segments must be at least 1, got %d", segments)
+	}
+	start := time.Now()
+	api := d.ManagementAPI(endpoint)
+	logger := Logger(ctx)
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	for segment := range segments {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns, err := d.Store.ScanConnections(ctx, segment, segments)
+			if err != nil {
+				mu.Lock()
+				report.FailedSegments = append(report.FailedSegments, segment)
+				errs = append(errs, fmt.Errorf("failed to scan segment %d: %w", segment, err))
+				mu.Unlock()
+				return
+			}
+			var part SweepReport
+			var partErrs []error
+			for _, conn := range conns {
+				if ctx.Err() != nil {
+					partErrs = append(partErrs, ctx.Err())
+					break
+				}
+				part.Scanned++
+				_, err := api.GetConnection(ctx, &apigatewaymanagementapi.GetConnectionInput{
+					ConnectionId: aws.String(conn.ConnectionID),
+				})
+				switch {
+				case err == nil:
+					part.Alive++
+				case IsGone(err):
+					if err := d.Store.DeleteConnection(ctx, conn.ConnectionID); err != nil {
+						partErrs = append(partErrs, fmt.Errorf("failed to remove %s: %w", conn.ConnectionID, err))
+						part.Failed++
+						continue
+					}
+					part.Removed++
+				default:
+					logger.Warn("failed to check connection", "target", conn.ConnectionID, "error", err)
+					part.Failed++
+				}
+			}
+			mu.Lock()
+			report.Scanned += part.Scanned
+			report.Alive += part.Alive
+			report.Removed += part.Removed
+			report.Failed += part.Failed
+			errs = append(errs, partErrs...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	slices.Sort(report.FailedSegments)
+	report.DurationMS = time.Since(start).Milliseconds()
+	return report, errors.Join(errs...)
+}
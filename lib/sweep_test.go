@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+// getFunc is a ManagementAPI that only looks connections up.
+type getFunc func(connectionID string) error
+
+func (f getFunc) PostToConnection(context.Context, *apigatewaymanagementapi.PostToConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	return nil, errors.New("unexpected PostToConnection")
+}
+
+func (f getFunc) GetConnection(_ context.Context, in *apigatewaymanagementapi.GetConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	if err := f(aws.ToString(in.ConnectionId)); err != nil {
+		return nil, err
+	}
+	return &apigatewaymanagementapi.GetConnectionOutput{}, nil
+}
+
+func (f getFunc) DeleteConnection(context.Context, *apigatewaymanagementapi.DeleteConnectionInput, ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	return nil, errors.New("unexpected DeleteConnection")
+}
+
+// brokenSegmentStore fails to scan one segment.
+type brokenSegmentStore struct {
+	*MemoryStore
+	broken int
+}
+
+func (s brokenSegmentStore) ScanConnections(ctx context.Context, segment, segments int) ([]Connection, error) {
+	if segment == s.broken {
+		return nil, errors.New("throttled")
+	}
+	return s.MemoryStore.ScanConnections(ctx, segment, segments)
+}
+
+func TestSweep(t *testing.T) {
+	ctx := context.Background()
+	conf := DefaultConfig()
+	conf.ConnectionsEndpoint = "https://example.com/dev"
+	store := NewMemoryStore()
+	var (
+		mu      sync.Mutex
+		checked []string
+	)
+	deps := &Deps{
+		Config: &conf,
+		Store:  store,
+		NewManagementAPI: func(string) ManagementAPI {
+			return getFunc(func(id string) error {
+				mu.Lock()
+				checked = append(checked, id)
+				mu.Unlock()
+				switch {
+				case id == "broken":
+					return errors.New("throttled")
+				case id[0] == 'g':
+					return &apigatewaytypes.GoneException{}
+				}
+				return nil
+			})
+		},
+	}
+	var ids []string
+	for i := range 20 {
+		ids = append(ids, fmt.Sprintf("alive-%d", i), fmt.Sprintf("gone-%d", i))
+	}
+	ids = append(ids, "broken")
+	for _, id := range ids {
+		store.PutConnection(ctx, Connection{ConnectionID: id, Channel: "42"})
+	}
+
+	report, err := deps.Sweep(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Segments != 4 || report.Scanned != 41 || report.Alive != 20 || report.Removed != 20 || report.Failed != 1 {
+		t.Fatalf("got %+v", report)
+	}
+	slices.Sort(checked)
+	slices.Sort(ids)
+	if !slices.Equal(checked, ids) {
+		t.Fatalf("checked %v, want every connection once", checked)
+	}
+	conns, _ := store.ConnectionsForChannel(ctx, "42")
+	if len(conns) != 21 {
+		t.Fatalf("left %d connections, want the alive and broken ones", len(conns))
+	}
+	for _, conn := range conns {
+		if conn.ConnectionID[0] == 'g' {
+			t.Fatalf("%s was kept", conn.ConnectionID)
+		}
+	}
+
+	deps.Store = brokenSegmentStore{MemoryStore: store, broken: 1}
+	report, err = deps.Sweep(ctx, 2)
+	if err == nil || !slices.Equal(report.FailedSegments, []int{1}) || report.Scanned == 0 {
+		t.Fatalf("got %+v, %v, want segment 1 to fail alone", report, err)
+	}
+
+	if _, err := deps.Sweep(ctx, 0); err == nil {
+		t.Fatal("expected an error for zero segments")
+	}
+	conf.ConnectionsEndpoint = ""
+	if _, err := deps.Sweep(ctx, 1); !errors.Is(err, ErrNoConnectionsEndpoint) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestScanConnectionsSegments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for i := range 100 {
+		store.PutConnection(ctx, Connection{ConnectionID: fmt.Sprint(i), Channel: "42"})
+	}
+	seen := make(map[string]int)
+	for segment := range 3 {
+		conns, err := store.ScanConnections(ctx, segment, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) == 0 {
+			t.Errorf("segment %d is empty", segment)
+		}
+		for _, conn := range conns {
+			seen[conn.ConnectionID]++
+		}
+	}
+	if len(seen) != 100 {
+		t.Fatalf("saw %d connections, want 100", len(seen))
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("%s is in %d segments", id, n)
+		}
+	}
+	if _, err := store.ScanConnections(ctx, 3, 3); err == nil {
+		t.Fatal("expected an error for a segment out of range")
+	}
+}
@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace exporters selected with TRACES_EXPORTER.
+const (
+	TracesExporterNone   = "none"
+	TracesExporterStdout = "stdout"
+	TracesExporterOTLP   = "otlp"
+)
+
+const tracerName = "lib"
+
+// propagator reads and writes the W3C traceparent and tracestate keys carried
+// in MessageData.Trace and in the traceparent attribute of stored messages.
+var propagator = propagation.TraceContext{}
+
+// NewTracerProvider returns the provider for the configured exporter, or nil
+// when tracing is disabled. The OTLP exporter honours the standard
+// OTEL_EXPORTER_OTLP_* variables.
+func NewTracerProvider(ctx context.Context, conf *Config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch conf.TracesExporter {
+	case TracesExporterNone:
+		return nil, nil
+	case TracesExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create stdout trace exporter: %w", err)
+		}
+		exporter = exp
+	case TracesExporterOTLP:
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create OTLP trace exporter: %w", err)
+		}
+		exporter = exp
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", conf.TracesExporter)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)), nil
+}
+
+// Tracer returns the tracer used for the spans around store and fan-out
+// operations.
+func (d *Deps) Tracer() trace.Tracer {
+	if d.TracerProvider == nil {
+		return otel.GetTracerProvider().Tracer(tracerName)
+	}
+	return d.TracerProvider.Tracer(tracerName)
+}
+
+// FlushTraces exports the spans buffered so far. Call it before a handler
+// returns, the container may be frozen until the next invocation otherwise.
+func (d *Deps) FlushTraces(ctx context.Context) {
+	if d.TracerProvider == nil {
+		return
+	}
+	if err := d.TracerProvider.ForceFlush(ctx); err != nil {
+		Logger(ctx).Warn("failed to flush traces", "error", err)
+	}
+}
+
+// InjectTrace returns the trace context of ctx as a carrier for the message
+// envelope, or nil when ctx has no span.
+func InjectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// ExtractTrace returns ctx with the remote span found in carrier as parent.
+func ExtractTrace(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
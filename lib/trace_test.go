@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceThroughEnvelope(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	deps := &Deps{TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))}
+
+	// Publisher side
+	ctx, publish := deps.Tracer().Start(context.Background(), "publish")
+	frame, err := json.Marshal(Message{Action: "sendmessage", Message: MessageData{OrderID: "42", Trace: InjectTrace(ctx)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish.End()
+
+	// Subscriber side
+	var msg Message
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		t.Fatal(err)
+	}
+	_, fanout := deps.Tracer().Start(ExtractTrace(context.Background(), msg.Message.Trace), "fanout")
+	fanout.End()
+	deps.FlushTraces(context.Background())
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[1].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Fatalf("fanout parent = %s, want publish span %s", spans[1].Parent.SpanID(), spans[0].SpanContext.SpanID())
+	}
+	if spans[1].SpanContext.TraceID() != spans[0].SpanContext.TraceID() {
+		t.Fatal("fanout is not in the publisher's trace")
+	}
+}
+
+func TestInjectTraceWithoutSpan(t *testing.T) {
+	if carrier := InjectTrace(context.Background()); carrier != nil {
+		t.Fatalf("got %v, want nil", carrier)
+	}
+}
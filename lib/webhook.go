@@ -0,0 +1,483 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers of a webhook delivery. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)), see
+// VerifyWebhook.
+const (
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// ErrWebhookNotFound is returned by WebhookStore.GetWebhook for unknown IDs.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+type (
+	// Webhook is a partner URL subscribed to the statuses of one order or of
+	// every order of one customer.
+	Webhook struct {
+		ID         string `json:"id"`
+		URL        string `json:"url"`
+		Secret     string `json:"secret,omitempty"`
+		OrderID    string `json:"order_id,omitempty"`
+		CustomerID string `json:"customer_id,omitempty"`
+		// Owner is the principal that created the webhook.
+		Owner     string    `json:"owner,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// WebhookStore keeps the webhook subscriptions.
+	WebhookStore interface {
+		PutWebhook(ctx context.Context, hook Webhook) error
+		// GetWebhook returns ErrWebhookNotFound for unknown IDs.
+		GetWebhook(ctx context.Context, id string) (*Webhook, error)
+		DeleteWebhook(ctx context.Context, id string) error
+		// WebhooksFor returns the webhooks subscribed to orderID or, when
+		// set, to customerID.
+		WebhooksFor(ctx context.Context, orderID, customerID string) ([]Webhook, error)
+	}
+
+	// DynamoWebhookStore stores webhooks in a table keyed by id, with a
+	// global secondary index on the subscription attribute.
+	DynamoWebhookStore struct {
+		DynamoDB DynamoDBAPI
+		Table    string
+		Index    string
+	}
+
+	// MemoryWebhookStore is an in-process WebhookStore for tests and local
+	// runs.
+	MemoryWebhookStore struct {
+		mu    sync.Mutex
+		hooks map[string]Webhook
+	}
+
+	// WebhookStatusError is a webhook response outside 2xx.
+	WebhookStatusError struct {
+		StatusCode int
+	}
+)
+
+func (e *WebhookStatusError) Error() string {
+	return fmt.Sprintf("webhook responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// retryable reports whether a later attempt may succeed.
+func (e *WebhookStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// NewWebhook returns a webhook with a fresh ID and secret.
+func NewWebhook(rawURL, orderID, customerID, owner string) (Webhook, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, err
+	}
+	hook := Webhook{
+		ID:         uuid.NewString(),
+		URL:        rawURL,
+		Secret:     hex.EncodeToString(secret),
+		OrderID:    orderID,
+		CustomerID: customerID,
+		Owner:      owner,
+		CreatedAt:  time.Now().UTC(),
+	}
+	return hook, hook.Validate()
+}
+
+// Validate checks that the webhook has a usable URL and exactly one
+// subscription. The URL must be https:// and name its host, IP addresses
+// are refused; see CheckWebhookHost for where the name points.
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("url %q is not an https:// URL", w.URL)
+	}
+	if net.ParseIP(u.Hostname()) != nil {
+		return fmt.Errorf("url %q must name a host, not an IP address", w.URL)
+	}
+	if (w.OrderID == "") == (w.CustomerID == "") {
+		return errors.New("exactly one of order_id and customer_id must be set")
+	}
+	return nil
+}
+
+// CheckWebhookHost checks that the host of the webhook only resolves to
+// public addresses, so that callers cannot make the fan-out reach into the
+// VPC or the instance metadata endpoint. The name may resolve elsewhere by
+// the time of a delivery, which is why the webhook client checks the address
+// it dials again, see NewWebhookClient.
+func (d *Deps) CheckWebhookHost(ctx context.Context, hook Webhook) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return err
+	}
+	lookup := d.LookupIPAddr
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	host := u.Hostname()
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %q: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return fmt.Errorf("host %q resolves to the non-public address %s", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10, which
+// net.IP doesn't count as private.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether webhooks may be delivered to ip.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip))
+}
+
+// dialPublic is the net.Dialer Control of the webhook client, which sees the
+// address actually dialed after name resolution.
+func dialPublic(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhook address %s is not public", host)
+	}
+	return nil
+}
+
+// NewWebhookClient returns the client webhooks are delivered with. It only
+// connects to public addresses, whatever the host resolved to when the
+// webhook was registered, ignores proxy settings and doesn't follow
+// redirects.
+func NewWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialPublic}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// defaultWebhookClient delivers webhooks when Deps.HTTPClient is nil.
+var defaultWebhookClient = NewWebhookClient()
+
+// subscription is the index key the webhook is found under.
+func (w Webhook) subscription() string {
+	if w.OrderID != "" {
+		return orderSubscription(w.OrderID)
+	}
+	return customerSubscription(w.CustomerID)
+}
+
+func orderSubscription(orderID string) string       { return "order#" + orderID }
+func customerSubscription(customerID string) string { return "customer#" + customerID }
+
+// SignWebhook returns the signature header value for a delivery.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether header carries a valid signature of body, as
+// a receiver would check it.
+func VerifyWebhook(secret string, header http.Header, body []byte) bool {
+	want := SignWebhook(secret, header.Get(WebhookTimestampHeader), body)
+	return hmac.Equal([]byte(header.Get(WebhookSignatureHeader)), []byte(want))
+}
+
+// maxWebhookRequests bounds the webhook requests a fan-out makes at once.
+const maxWebhookRequests = 16
+
+// deliverWebhooks posts frame to every hook, in parallel and once each, and
+// returns the error of each hook, nil for those delivered. The whole of it
+// is bounded by WebhookTimeout: a partner that is down holds the stream
+// shard no longer than that, and hooks not called by then fail with the
+// deadline. Retries are left to the replay of the dead letters.
+func (d *Deps) deliverWebhooks(ctx context.Context, hooks []Webhook, frame any) []error {
+	errs := make([]error, len(hooks))
+	body, err := json.Marshal(frame)
+	if err != nil {
+		for i := range errs {
+			errs[i] = fmt.Errorf("failed to marshal message: %w", err)
+		}
+		return errs
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.Config.WebhookTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	requests := make(chan struct{}, maxWebhookRequests)
+	for i, hook := range hooks {
+		select {
+		case requests <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("not called in time: %w", ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-requests
+				wg.Done()
+			}()
+			ctx, span := d.Tracer().Start(ctx, "PostWebhook",
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attribute.String("webhook_id", hook.ID)))
+			errs[i] = d.postWebhookOnce(ctx, hook, body)
+			EndSpan(span, errs[i])
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// PostWebhook delivers frame to hook, retrying network errors, 429 and 5xx
+// responses with exponential backoff. It returns the number of requests made.
+func (d *Deps) PostWebhook(ctx context.Context, hook Webhook, frame any) (attempts int, err error) {
+	ctx, span := d.Tracer().Start(ctx, "PostWebhook",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("webhook_id", hook.ID)))
+	defer func() {
+		span.SetAttributes(attribute.Int("attempts", attempts))
+		EndSpan(span, err)
+	}()
+
+	body, err := json.Marshal(frame)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	backoff := d.Config.WebhookBackoff
+	for {
+		attempts++
+		err = d.postWebhookOnce(ctx, hook, body)
+		var status *WebhookStatusError
+		if err == nil || attempts >= d.Config.WebhookMaxAttempts || (errors.As(err, &status) && !status.retryable()) {
+			return attempts, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempts, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Deps) postWebhookOnce(ctx context.Context, hook Webhook, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, d.Config.WebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, hook.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, timestamp, body))
+
+	client := d.HTTPClient
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain a little so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &WebhookStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func (s *DynamoWebhookStore) PutWebhook(ctx context.Context, hook Webhook) error {
+	item := map[string]types.AttributeValue{
+		"id":           &types.AttributeValueMemberS{Value: hook.ID},
+		"subscription": &types.AttributeValueMemberS{Value: hook.subscription()},
+		"url":          &types.AttributeValueMemberS{Value: hook.URL},
+		"secret":       &types.AttributeValueMemberS{Value: hook.Secret},
+		"createdAt":    &types.AttributeValueMemberS{Value: hook.CreatedAt.Format(time.RFC3339Nano)},
+	}
+	if hook.Owner != "" {
+		item["owner"] = &types.AttributeValueMemberS{Value: hook.Owner}
+	}
+	_, err := s.DynamoDB.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.Table),
+		Item:      item,
+	})
+	return err
+}
+
+func (s *DynamoWebhookStore) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	out, err := s.DynamoDB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrWebhookNotFound
+	}
+	hook := webhookFromItem(out.Item)
+	return &hook, nil
+}
+
+func (s *DynamoWebhookStore) DeleteWebhook(ctx context.Context, id string) error {
+	_, err := s.DynamoDB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	return err
+}
+
+func (s *DynamoWebhookStore) WebhooksFor(ctx context.Context, orderID, customerID string) ([]Webhook, error) {
+	subscriptions := []string{orderSubscription(orderID)}
+	if customerID != "" {
+		subscriptions = append(subscriptions, customerSubscription(customerID))
+	}
+	var hooks []Webhook
+	for _, subscription := range subscriptions {
+		var start map[string]types.AttributeValue
+		for {
+			out, err := s.DynamoDB.Query(ctx, &dynamodb.QueryInput{
+				TableName:              aws.String(s.Table),
+				IndexName:              aws.String(s.Index),
+				KeyConditionExpression: aws.String("subscription = :subscription"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":subscription": &types.AttributeValueMemberS{Value: subscription},
+				},
+				ExclusiveStartKey: start,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Items {
+				hooks = append(hooks, webhookFromItem(item))
+			}
+			if start = out.LastEvaluatedKey; len(start) == 0 {
+				break
+			}
+		}
+	}
+	return hooks, nil
+}
+
+func webhookFromItem(item map[string]types.AttributeValue) Webhook {
+	str := func(name string) string {
+		if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	hook := Webhook{
+		ID:     str("id"),
+		URL:    str("url"),
+		Secret: str("secret"),
+		Owner:  str("owner"),
+	}
+	kind, value, _ := strings.Cut(str("subscription"), "#")
+	switch kind {
+	case "order":
+		hook.OrderID = value
+	case "customer":
+		hook.CustomerID = value
+	}
+	hook.CreatedAt, _ = time.Parse(time.RFC3339Nano, str("createdAt"))
+	return hook
+}
+
+// NewMemoryWebhookStore returns an empty in-process store.
+func NewMemoryWebhookStore() *MemoryWebhookStore {
+	return &MemoryWebhookStore{hooks: make(map[string]Webhook)}
+}
+
+func (s *MemoryWebhookStore) PutWebhook(_ context.Context, hook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[hook.ID] = hook
+	return nil
+}
+
+func (s *MemoryWebhookStore) GetWebhook(_ context.Context, id string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook, ok := s.hooks[id]
+	if !ok {
+		return nil, ErrWebhookNotFound
+	}
+	return &hook, nil
+}
+
+func (s *MemoryWebhookStore) DeleteWebhook(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hooks, id)
+	return nil
+}
+
+func (s *MemoryWebhookStore) WebhooksFor(_ context.Context, orderID, customerID string) ([]Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hooks []Webhook
+	for _, hook := range s.hooks {
+		if (hook.OrderID != "" && hook.OrderID == orderID) || (hook.CustomerID != "" && hook.CustomerID == customerID) {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	return hooks, nil
+}
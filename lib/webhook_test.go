@@ -0,0 +1,272 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a local webhook endpoint answering with the queued status
+// codes, then 200.
+type receiver struct {
+	t      *testing.T
+	secret string
+
+	mu       sync.Mutex
+	statuses []int
+	received []MessageData
+	calls    int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if !VerifyWebhook(r.secret, req.Header, body) {
+		r.t.Errorf("bad signature %q", req.Header.Get(WebhookSignatureHeader))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var msg MessageData
+	if err := json.Unmarshal(body, &msg); err != nil {
+		r.t.Error(err)
+	}
+	r.received = append(r.received, msg)
+}
+
+func webhookDeps(t *testing.T) (*Deps, *MemoryWebhookStore, *MemoryDeadLetterStore) {
+	conf := DefaultConfig()
+	conf.WebhookBackoff = time.Millisecond
+	conf.WebhookMaxAttempts = 3
+	hooks := NewMemoryWebhookStore()
+	deadLetters := NewMemoryDeadLetterStore()
+	return &Deps{
+		Config:      &conf,
+		Store:       NewMemoryStore(),
+		DeadLetters: deadLetters,
+		Webhooks:    hooks,
+		// The receivers listen on loopback, which NewWebhookClient refuses
+		HTTPClient: &http.Client{},
+		NewManagementAPI: func(string) ManagementAPI {
+			t.Fatal("no connections expected")
+			return nil
+		},
+	}, hooks, deadLetters
+}
+
+func TestPostWebhookRetries(t *testing.T) {
+	deps, _, _ := webhookDeps(t)
+	recv := &receiver{t: t, secret: "s3cr3t", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	hook := Webhook{ID: "h1", URL: server.URL, Secret: "s3cr3t", OrderID: "42"}
+	attempts, err := deps.PostWebhook(context.Background(), hook, MessageData{ID: "m1", Status: "PAID", OrderID: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || len(recv.received) != 1 || recv.received[0].Status != "PAID" {
+		t.Fatalf("got %d attempts, received %+v", attempts, recv.received)
+	}
+}
+
+func TestPostWebhookPermanentFailure(t *testing.T) {
+	deps, _, _ := webhookDeps(t)
+	recv := &receiver{t: t, secret: "s3cr3t", statuses: []int{http.StatusGone}}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+
+	_, err := deps.PostWebhook(context.Background(), Webhook{ID: "h1", URL: server.URL, Secret: "s3cr3t"}, MessageData{})
+	if err == nil || recv.calls != 1 {
+		t.Fatalf("got %v after %d calls, want one failed call", err, recv.calls)
+	}
+}
+
+func TestPostWebhookTimeout(t *testing.T) {
+	deps, _, _ := webhookDeps(t)
+	deps.Config.WebhookTimeout = 10 * time.Millisecond
+	deps.Config.WebhookMaxAttempts = 1
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	if _, err := deps.PostWebhook(context.Background(), Webhook{ID: "h1", URL: server.URL}, MessageData{}); err == nil {
+		t.Fatal("want a timeout error")
+	}
+}
+
+func TestFanoutWebhooks(t *testing.T) {
+	ctx := context.Background()
+	deps, hooks, deadLetters := webhookDeps(t)
+	recv := &receiver{t: t, secret: "s3cr3t"}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	broken := &receiver{t: t, secret: "other", statuses: []int{500}}
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+
+	for _, hook := range []Webhook{
+		{ID: "order", URL: server.URL, Secret: "s3cr3t", OrderID: "42"},
+		{ID: "customer", URL: server.URL, Secret: "s3cr3t", CustomerID: "c1"},
+		{ID: "broken", URL: brokenServer.URL, Secret: "other", OrderID: "42"},
+		{ID: "unrelated", URL: server.URL, Secret: "s3cr3t", OrderID: "7"},
+	} {
+		if err := hooks.PutWebhook(ctx, hook); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := deps.Fanout(ctx, StoredMessage{MessageData: MessageData{ID: "m1", Status: "PAID", OrderID: "42", CustomerID: "c1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := FanoutResult{Webhooks: 3, Delivered: 2, Failed: 1, DeadLettered: 1}
+	if result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+	dls, _ := deadLetters.List(ctx, 0)
+	if len(dls) != 1 || dls[0].WebhookID != "broken" || dls[0].Attempts != 1 || broken.calls != 1 {
+		t.Fatalf("got dead letters %+v after %d calls, want one call and no retry", dls, broken.calls)
+	}
+
+	// The receiver recovers, the replay goes through and clears the dead letter
+	if err := deps.Replay(ctx, deadLetters, dls[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(broken.received) != 1 {
+		t.Fatalf("replay not received: %+v", broken.received)
+	}
+	if dls, _ := deadLetters.List(ctx, 0); len(dls) != 0 {
+		t.Fatalf("dead letter left after replay: %+v", dls)
+	}
+}
+
+func TestFanoutWebhooksTimeLimit(t *testing.T) {
+	ctx := context.Background()
+	deps, hooks, deadLetters := webhookDeps(t)
+	deps.Config.WebhookTimeout = 50 * time.Millisecond
+	recv := &receiver{t: t, secret: "s3cr3t"}
+	server := httptest.NewServer(recv)
+	defer server.Close()
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	for i := range 2 * maxWebhookRequests {
+		url := hanging.URL
+		if i == 0 {
+			url = server.URL
+		}
+		if err := hooks.PutWebhook(ctx, Webhook{ID: fmt.Sprintf("h%02d", i), URL: url, Secret: "s3cr3t", OrderID: "42"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	result, err := deps.Fanout(ctx, StoredMessage{MessageData: MessageData{ID: "m1", Status: "PAID", OrderID: "42"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("fan-out took %s, want it bounded by the webhook timeout", elapsed)
+	}
+	want := FanoutResult{Webhooks: 2 * maxWebhookRequests, Delivered: 1, Failed: 2*maxWebhookRequests - 1, DeadLettered: 2*maxWebhookRequests - 1}
+	if result != want {
+		t.Fatalf("got %+v, want %+v", result, want)
+	}
+	if dls, _ := deadLetters.List(ctx, 0); len(dls) != 2*maxWebhookRequests-1 {
+		t.Fatalf("got %d dead letters", len(dls))
+	}
+}
+
+func TestNewWebhook(t *testing.T) {
+	hook, err := NewWebhook("https://partner.example.com/hooks", "42", "", "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.ID == "" || len(hook.Secret) != 64 {
+		t.Fatalf("got %+v", hook)
+	}
+	for _, rawURL := range []string{
+		"ftp://partner.example.com",
+		"http://partner.example.com/hooks",
+		"https://169.254.169.254/latest/meta-data",
+		"https://[::1]:8443/hooks",
+	} {
+		if _, err := NewWebhook(rawURL, "42", "", ""); err == nil {
+			t.Errorf("want an error for %s", rawURL)
+		}
+	}
+	if _, err := NewWebhook("https://partner.example.com", "42", "c1", ""); err == nil {
+		t.Fatal("want an error for two subscriptions")
+	}
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	addrs := map[string]string{
+		"partner.example.com":  "203.0.113.10",
+		"internal.example.com": "10.0.3.7",
+		"metadata.example.com": "169.254.169.254",
+		"cgnat.example.com":    "100.64.1.1",
+		"local.example.com":    "::1",
+	}
+	deps := &Deps{LookupIPAddr: func(_ context.Context, host string) ([]net.IPAddr, error) {
+		addr, ok := addrs[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IPAddr{{IP: net.ParseIP(addr)}}, nil
+	}}
+	for host := range addrs {
+		err := deps.CheckWebhookHost(context.Background(), Webhook{URL: "https://" + host + "/hooks"})
+		if public := host == "partner.example.com"; public != (err == nil) {
+			t.Errorf("%s: got %v", host, err)
+		}
+	}
+	if err := deps.CheckWebhookHost(context.Background(), Webhook{URL: "https://nowhere.example.com/hooks"}); err == nil {
+		t.Error("want an error for a host that doesn't resolve")
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("the webhook client must not reach loopback")
+	}))
+	defer server.Close()
+
+	resp, err := NewWebhookClient().Post(server.URL, "application/json", nil)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("want an error")
+	}
+	if !strings.Contains(err.Error(), "is not public") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package wstest
+
+import (
+	"context"
+	"encoding/json"
+	"lib"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+type (
+	// Post is a frame posted to a connection.
+	Post struct {
+		Endpoint     string
+		ConnectionID string
+		Data         []byte
+	}
+
+	// ManagementAPI records the frames posted through it and the
+	// connections it closed instead of calling AWS. Connections can be marked
+	// gone or failing.
+	ManagementAPI struct {
+		mu      sync.Mutex
+		posts   []Post
+		deleted []string
+		gone    map[string]bool
+		errs    map[string]error
+	}
+
+	// endpointAPI is the ManagementAPI client of one endpoint.
+	endpointAPI struct {
+		*ManagementAPI
+		endpoint string
+	}
+)
+
+// NewManagementAPI returns a recorder with no posts.
+func NewManagementAPI() *ManagementAPI {
+	return &ManagementAPI{gone: make(map[string]bool), errs: make(map[string]error)}
+}
+
+// Client returns the client for endpoint, for lib.Deps.NewManagementAPI.
+func (m *ManagementAPI) Client(endpoint string) lib.ManagementAPI {
+	return endpointAPI{ManagementAPI: m, endpoint: endpoint}
+}
+
+// Gone makes calls for connectionID fail with GoneException, like after the
+// client went away.
+func (m *ManagementAPI) Gone(connectionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gone[connectionID] = true
+}
+
+// Fail makes calls for connectionID return err.
+func (m *ManagementAPI) Fail(connectionID string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs[connectionID] = err
+}
+
+// Posts returns the successful posts in order.
+func (m *ManagementAPI) Posts() []Post {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Post(nil), m.posts...)
+}
+
+// Frames returns the data posted to connectionID in order.
+func (m *ManagementAPI) Frames(connectionID string) [][]byte {
+	var frames [][]byte
+	for _, p := range m.Posts() {
+		if p.ConnectionID == connectionID {
+			frames = append(frames, p.Data)
+		}
+	}
+	return frames
+}
+
+// Deleted returns the connections closed with DeleteConnection, in order.
+// They are gone afterwards.
+func (m *ManagementAPI) Deleted() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.deleted...)
+}
+
+// Decode unmarshals the frame data into v.
+func (p Post) Decode(v any) error {
+	return json.Unmarshal(p.Data, v)
+}
+
+func (a endpointAPI) PostToConnection(_ context.Context, in *apigatewaymanagementapi.PostToConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	id := aws.ToString(in.ConnectionId)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.check(id); err != nil {
+		return nil, err
+	}
+	a.posts = append(a.posts, Post{Endpoint: a.endpoint, ConnectionID: id, Data: append([]byte(nil), in.Data...)})
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, nil
+}
+
+func (a endpointAPI) GetConnection(_ context.Context, in *apigatewaymanagementapi.GetConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.check(aws.ToString(in.ConnectionId)); err != nil {
+		return nil, err
+	}
+	return &apigatewaymanagementapi.GetConnectionOutput{}, nil
+}
+
+func (a endpointAPI) DeleteConnection(_ context.Context, in *apigatewaymanagementapi.DeleteConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	id := aws.ToString(in.ConnectionId)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.check(id); err != nil {
+		return nil, err
+	}
+	a.deleted = append(a.deleted, id)
+	a.gone[id] = true
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, nil
+}
+
+// check returns the error set up for id. The caller holds mu.
+func (m *ManagementAPI) check(id string) error {
+	if m.gone[id] {
+		return &types.GoneException{Message: aws.String("connection " + id + " is gone")}
+	}
+	return m.errs[id]
+}
@@ -0,0 +1,222 @@
+// Package wstest builds API Gateway events and in-memory dependencies for
+// testing the handlers without AWS:
+//
+//	h := wstest.New(t)
+//	deps = h.Deps
+//	resp, err := handler(ctx, wstest.Message("conn-1", "request", lib.Request{Action: "request", OrderID: "42"}).Request())
+//	frames := h.API.Frames("conn-1")
+package wstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The API every built event comes from. Endpoint is what lib.Endpoint
+// returns for them.
+const (
+	DomainName = "test.execute-api.us-east-1.amazonaws.com"
+	Stage      = "test"
+	Endpoint   = "https://" + DomainName + "/" + Stage
+)
+
+type (
+	// Event builds a WebSocket event. Its methods modify and return the
+	// receiver so calls can be chained.
+	Event struct {
+		req events.APIGatewayWebsocketProxyRequest
+	}
+
+	// HTTPEvent builds an HTTP API (payload 2.0) event.
+	HTTPEvent struct {
+		req events.APIGatewayV2HTTPRequest
+	}
+)
+
+var requests atomic.Int64
+
+func newEvent(connectionID, routeKey, eventType string) *Event {
+	return &Event{req: events.APIGatewayWebsocketProxyRequest{
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID:     connectionID,
+			RouteKey:         routeKey,
+			EventType:        eventType,
+			MessageDirection: "IN",
+			DomainName:       DomainName,
+			Stage:            Stage,
+			APIID:            "test",
+			RequestID:        fmt.Sprintf("req-%d", requests.Add(1)),
+			RequestTimeEpoch: time.Now().UnixMilli(),
+			ConnectedAt:      time.Now().UnixMilli(),
+		},
+	}}
+}
+
+// Connect returns a $connect event.
+func Connect(connectionID string) *Event {
+	return newEvent(connectionID, "$connect", "CONNECT")
+}
+
+// Disconnect returns a $disconnect event.
+func Disconnect(connectionID string) *Event {
+	return newEvent(connectionID, "$disconnect", "DISCONNECT")
+}
+
+// Message returns a message event for routeKey carrying body, see Body.
+func Message(connectionID, routeKey string, body any) *Event {
+	return newEvent(connectionID, routeKey, "MESSAGE").Body(body)
+}
+
+// Body sets the body. Strings and byte slices are used as is, anything else
+// is marshaled to JSON, panicking if it can't be.
+func (e *Event) Body(body any) *Event {
+	e.req.Body = encode(body)
+	return e
+}
+
+// Query adds a query string parameter, as sent to $connect.
+func (e *Event) Query(name, value string) *Event {
+	if e.req.QueryStringParameters == nil {
+		e.req.QueryStringParameters = make(map[string]string)
+	}
+	e.req.QueryStringParameters[name] = value
+	if e.req.MultiValueQueryStringParameters == nil {
+		e.req.MultiValueQueryStringParameters = make(map[string][]string)
+	}
+	e.req.MultiValueQueryStringParameters[name] = append(e.req.MultiValueQueryStringParameters[name], value)
+	return e
+}
+
+// Header adds a request header, as sent to $connect.
+func (e *Event) Header(name, value string) *Event {
+	if e.req.Headers == nil {
+		e.req.Headers = make(map[string]string)
+	}
+	e.req.Headers[name] = value
+	if e.req.MultiValueHeaders == nil {
+		e.req.MultiValueHeaders = make(map[string][]string)
+	}
+	e.req.MultiValueHeaders[name] = append(e.req.MultiValueHeaders[name], value)
+	return e
+}
+
+// Authorizer sets the context a request authorizer returned for principal.
+// The keys of context are added next to principalId.
+func (e *Event) Authorizer(principal string, context map[string]any) *Event {
+	authorizer := map[string]any{"principalId": principal}
+	for k, v := range context {
+		authorizer[k] = v
+	}
+	e.req.RequestContext.Authorizer = authorizer
+	return e
+}
+
+// SourceIP sets the caller address.
+func (e *Event) SourceIP(ip string) *Event {
+	e.req.RequestContext.Identity.SourceIP = ip
+	return e
+}
+
+// UserAgent sets the caller user agent, as API Gateway reports it.
+func (e *Event) UserAgent(ua string) *Event {
+	e.req.RequestContext.Identity.UserAgent = ua
+	return e
+}
+
+// Request returns the built event.
+func (e *Event) Request() events.APIGatewayWebsocketProxyRequest {
+	return e.req
+}
+
+// HTTP returns an event for routeKey, e.g. "GET /orders/{id}/status". Fill
+// the path with Path.
+func HTTP(routeKey string) *HTTPEvent {
+	method, path, _ := strings.Cut(routeKey, " ")
+	return &HTTPEvent{req: events.APIGatewayV2HTTPRequest{
+		Version:  "2.0",
+		RouteKey: routeKey,
+		RawPath:  path,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RouteKey:   routeKey,
+			DomainName: DomainName,
+			Stage:      "$default",
+			RequestID:  fmt.Sprintf("req-%d", requests.Add(1)),
+			TimeEpoch:  time.Now().UnixMilli(),
+			HTTP: events.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method: method,
+				Path:   path,
+			},
+		},
+	}}
+}
+
+// Path sets a path parameter and substitutes it in the raw path.
+func (e *HTTPEvent) Path(name, value string) *HTTPEvent {
+	if e.req.PathParameters == nil {
+		e.req.PathParameters = make(map[string]string)
+	}
+	e.req.PathParameters[name] = value
+	e.req.RawPath = strings.ReplaceAll(e.req.RawPath, "{"+name+"}", value)
+	e.req.RequestContext.HTTP.Path = e.req.RawPath
+	return e
+}
+
+// Query adds a query string parameter.
+func (e *HTTPEvent) Query(name, value string) *HTTPEvent {
+	if e.req.QueryStringParameters == nil {
+		e.req.QueryStringParameters = make(map[string]string)
+	}
+	e.req.QueryStringParameters[name] = value
+	return e
+}
+
+// Header sets a request header. Payload 2.0 headers are lower case.
+func (e *HTTPEvent) Header(name, value string) *HTTPEvent {
+	if e.req.Headers == nil {
+		e.req.Headers = make(map[string]string)
+	}
+	e.req.Headers[strings.ToLower(name)] = value
+	return e
+}
+
+// Body sets the body, see Event.Body.
+func (e *HTTPEvent) Body(body any) *HTTPEvent {
+	e.req.Body = encode(body)
+	return e
+}
+
+// Principal authorizes the request with a JWT whose subject is principal.
+func (e *HTTPEvent) Principal(principal string) *HTTPEvent {
+	e.req.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		JWT: &events.APIGatewayV2HTTPRequestContextAuthorizerJWTDescription{
+			Claims: map[string]string{"sub": principal},
+		},
+	}
+	return e
+}
+
+// Request returns the built event.
+func (e *HTTPEvent) Request() events.APIGatewayV2HTTPRequest {
+	return e.req
+}
+
+func encode(body any) string {
+	switch b := body.(type) {
+	case nil:
+		return ""
+	case string:
+		return b
+	case []byte:
+		return string(b)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		panic(fmt.Sprintf("wstest: cannot marshal body: %v", err))
+	}
+	return string(data)
+}
@@ -0,0 +1,100 @@
+package wstest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"lib"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type (
+	// Harness is a lib.Deps wired to in-memory fakes. Set it as the deps of
+	// the handler under test, then inspect the fakes, logs and metrics.
+	Harness struct {
+		Deps        *lib.Deps
+		Store       *Store
+		DeadLetters *lib.MemoryDeadLetterStore
+		Webhooks    *lib.MemoryWebhookStore
+		API         *ManagementAPI
+
+		logs    buffer
+		metrics buffer
+	}
+
+	// buffer is a bytes.Buffer safe for concurrent writes.
+	buffer struct {
+		mu  sync.Mutex
+		buf bytes.Buffer
+	}
+)
+
+// New returns a harness with empty stores and the default configuration,
+// with ConnectionsEndpoint set to Endpoint. Webhook retries don't wait, and
+// webhook hosts resolve to a public documentation address, but localhost.
+func New() *Harness {
+	h := &Harness{
+		Store:       NewStore(),
+		DeadLetters: lib.NewMemoryDeadLetterStore(),
+		Webhooks:    lib.NewMemoryWebhookStore(),
+		API:         NewManagementAPI(),
+	}
+	conf := lib.DefaultConfig()
+	conf.Stage = Stage
+	conf.ConnectionsEndpoint = Endpoint
+	conf.WebhookBackoff = 0
+	h.Deps = lib.NewDepsFromConfig(&conf, aws.Config{Region: conf.Region})
+	h.Deps.Store = h.Store
+	h.Deps.DeadLetters = h.DeadLetters
+	h.Deps.Webhooks = h.Webhooks
+	h.Deps.Logger = lib.NewLogger(&h.logs, slog.LevelDebug)
+	h.Deps.Metrics = lib.NewMetrics(&h.metrics, conf.MetricsNamespace)
+	h.Deps.NewManagementAPI = h.API.Client
+	h.Deps.LookupIPAddr = lookupIPAddr
+	return h
+}
+
+func lookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if host == "localhost" {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+	return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 1)}}, nil
+}
+
+// Logs returns the JSON log lines written so far.
+func (h *Harness) Logs() string {
+	return h.logs.String()
+}
+
+// Metric returns the sum of the named metric over every flushed record.
+func (h *Harness) Metric(name string) float64 {
+	var total float64
+	lines := bufio.NewScanner(bytes.NewReader([]byte(h.metrics.String())))
+	for lines.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			continue
+		}
+		if v, ok := record[name].(float64); ok {
+			total += v
+		}
+	}
+	return total
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *buffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,138 @@
+package wstest
+
+import (
+	"context"
+	"lib"
+	"sync"
+	"time"
+)
+
+// Store is a lib.MemoryStore whose methods can be made to fail, to exercise
+// the error paths of the handlers.
+type Store struct {
+	*lib.MemoryStore
+
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{MemoryStore: lib.NewMemoryStore(), errs: make(map[string]error)}
+}
+
+// Fail makes every later call to the named method, e.g. "GetMessage",
+// return err. A nil err makes it work again.
+func (s *Store) Fail(method string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.errs, method)
+		return
+	}
+	s.errs[method] = err
+}
+
+func (s *Store) err(method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errs[method]
+}
+
+func (s *Store) PutConnection(ctx context.Context, conn lib.Connection) error {
+	if err := s.err("PutConnection"); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutConnection(ctx, conn)
+}
+
+func (s *Store) GetConnection(ctx context.Context, connectionID string) (*lib.Connection, error) {
+	if err := s.err("GetConnection"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetConnection(ctx, connectionID)
+}
+
+func (s *Store) DeleteConnection(ctx context.Context, connectionID string) error {
+	if err := s.err("DeleteConnection"); err != nil {
+		return err
+	}
+	return s.MemoryStore.DeleteConnection(ctx, connectionID)
+}
+
+func (s *Store) ConnectionsForChannel(ctx context.Context, channel string) ([]lib.Connection, error) {
+	if err := s.err("ConnectionsForChannel"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.ConnectionsForChannel(ctx, channel)
+}
+
+func (s *Store) Watchers(ctx context.Context, channel string) (int, error) {
+	if err := s.err("Watchers"); err != nil {
+		return 0, err
+	}
+	return s.MemoryStore.Watchers(ctx, channel)
+}
+
+func (s *Store) AddWatchers(ctx context.Context, token string, changes map[string]int) error {
+	if err := s.err("AddWatchers"); err != nil {
+		return err
+	}
+	return s.MemoryStore.AddWatchers(ctx, token, changes)
+}
+
+func (s *Store) TouchConnection(ctx context.Context, connectionID string, at time.Time) error {
+	if err := s.err("TouchConnection"); err != nil {
+		return err
+	}
+	return s.MemoryStore.TouchConnection(ctx, connectionID, at)
+}
+
+func (s *Store) IdleConnections(ctx context.Context, before time.Time) ([]lib.Connection, error) {
+	if err := s.err("IdleConnections"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.IdleConnections(ctx, before)
+}
+
+func (s *Store) ScanConnections(ctx context.Context, segment, segments int) ([]lib.Connection, error) {
+	if err := s.err("ScanConnections"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.ScanConnections(ctx, segment, segments)
+}
+
+func (s *Store) PutMessage(ctx context.Context, msg lib.StoredMessage) error {
+	if err := s.err("PutMessage"); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutMessage(ctx, msg)
+}
+
+func (s *Store) GetMessage(ctx context.Context, channel string) (*lib.StoredMessage, error) {
+	if err := s.err("GetMessage"); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetMessage(ctx, channel)
+}
+
+func (s *Store) DeleteMessage(ctx context.Context, channel string) error {
+	if err := s.err("DeleteMessage"); err != nil {
+		return err
+	}
+	return s.MemoryStore.DeleteMessage(ctx, channel)
+}
+
+func (s *Store) AppendHistory(ctx context.Context, event lib.HistoryEvent) error {
+	if err := s.err("AppendHistory"); err != nil {
+		return err
+	}
+	return s.MemoryStore.AppendHistory(ctx, event)
+}
+
+func (s *Store) History(ctx context.Context, q lib.HistoryQuery) (lib.HistoryPage, error) {
+	if err := s.err("History"); err != nil {
+		return lib.HistoryPage{}, err
+	}
+	return s.MemoryStore.History(ctx, q)
+}
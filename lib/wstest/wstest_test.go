@@ -0,0 +1,90 @@
+package wstest
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+func TestEvents(t *testing.T) {
+	connect := Connect("c1").Query("order_id", "42").Header("User-Agent", "test").Authorizer("user1", map[string]any{"scope": "read"}).Request()
+	if connect.RequestContext.RouteKey != "$connect" || connect.RequestContext.EventType != "CONNECT" {
+		t.Fatalf("got %+v", connect.RequestContext)
+	}
+	if connect.QueryStringParameters["order_id"] != "42" || connect.Headers["User-Agent"] != "test" {
+		t.Fatalf("got query %v and headers %v", connect.QueryStringParameters, connect.Headers)
+	}
+	if lib.Principal(connect.RequestContext) != "user1" || lib.Endpoint(connect.RequestContext) != Endpoint {
+		t.Fatalf("got principal %q and endpoint %q", lib.Principal(connect.RequestContext), lib.Endpoint(connect.RequestContext))
+	}
+
+	msg := Message("c1", "request", lib.Request{Action: "request", OrderID: "42"}).Request()
+	if msg.Body != `{"action":"request","order_id":"42"}` || msg.RequestContext.RequestID == connect.RequestContext.RequestID {
+		t.Fatalf("got %+v", msg)
+	}
+
+	http := HTTP("GET /orders/{id}/status").Path("id", "42").Principal("svc").Request()
+	if http.RawPath != "/orders/42/status" || http.PathParameters["id"] != "42" || lib.HTTPPrincipal(http.RequestContext) != "svc" {
+		t.Fatalf("got %+v", http)
+	}
+}
+
+func TestStoreFail(t *testing.T) {
+	ctx := context.Background()
+	s := NewStore()
+	boom := errors.New("boom")
+	s.Fail("GetMessage", boom)
+	if _, err := s.GetMessage(ctx, "42"); !errors.Is(err, boom) {
+		t.Fatalf("got %v", err)
+	}
+	s.Fail("GetMessage", nil)
+	if _, err := s.GetMessage(ctx, "42"); !errors.Is(err, lib.ErrNotFound) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestManagementAPI(t *testing.T) {
+	ctx := context.Background()
+	h := New()
+	h.API.Gone("gone")
+	h.API.Fail("broken", errors.New("throttled"))
+	api := h.Deps.ManagementAPI(Endpoint)
+
+	post := func(id string) error {
+		_, err := api.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{ConnectionId: aws.String(id), Data: []byte(`{"n":1}`)})
+		return err
+	}
+	var gone *types.GoneException
+	if err := post("gone"); !errors.As(err, &gone) {
+		t.Fatalf("got %v", err)
+	}
+	if err := post("broken"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := post("c1"); err != nil {
+		t.Fatal(err)
+	}
+	posts := h.API.Posts()
+	if len(posts) != 1 || posts[0].Endpoint != Endpoint || string(h.API.Frames("c1")[0]) != `{"n":1}` {
+		t.Fatalf("got %+v", posts)
+	}
+
+	get := func(id string) error {
+		_, err := api.GetConnection(ctx, &apigatewaymanagementapi.GetConnectionInput{ConnectionId: aws.String(id)})
+		return err
+	}
+	if _, err := api.DeleteConnection(ctx, &apigatewaymanagementapi.DeleteConnectionInput{ConnectionId: aws.String("c1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("c1"); !errors.As(err, &gone) {
+		t.Fatalf("got %v, want closed connections to be gone", err)
+	}
+	if err := get("c2"); err != nil {
+		t.Fatal(err)
+	}
+}
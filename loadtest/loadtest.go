@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lib"
+	"lib/client"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Config describes a load test run.
+	Config struct {
+		Endpoint        string
+		Token           string
+		Connections     int
+		Orders          int
+		Publishers      int
+		Rate            float64
+		Duration        time.Duration
+		Settle          time.Duration
+		DialConcurrency int
+	}
+
+	// Report is the outcome of a run. Expected deliveries count one per
+	// watcher of the order for each publish; what was not delivered by the
+	// end of the settle time is lost.
+	Report struct {
+		Endpoint      string  `json:"endpoint"`
+		Connections   int     `json:"connections"`
+		ConnectErrors int     `json:"connect_errors"`
+		ConnectTime   float64 `json:"connect_seconds"`
+		Orders        int     `json:"orders"`
+		Publishers    int     `json:"publishers"`
+		TargetRate    float64 `json:"target_rate"`
+		ActualRate    float64 `json:"actual_rate"`
+		Duration      float64 `json:"duration_seconds"`
+		Published     int     `json:"published"`
+		PublishErrors int     `json:"publish_errors"`
+		Expected      int     `json:"expected_deliveries"`
+		Delivered     int     `json:"delivered"`
+		Lost          int     `json:"lost"`
+		LossRate      float64 `json:"loss_rate"`
+		Latency       Latency `json:"latency_ms"`
+	}
+
+	// Latency summarizes the publish to delivery latencies in milliseconds.
+	Latency struct {
+		Min  float64 `json:"min"`
+		Mean float64 `json:"mean"`
+		P50  float64 `json:"p50"`
+		P90  float64 `json:"p90"`
+		P95  float64 `json:"p95"`
+		P99  float64 `json:"p99"`
+		Max  float64 `json:"max"`
+	}
+
+	// recorder matches deliveries with the publishes they came from.
+	recorder struct {
+		mu        sync.Mutex
+		sent      map[string]time.Time
+		latencies []time.Duration
+		expected  int
+	}
+)
+
+// Validate reports the first unusable setting.
+func (c Config) Validate() error {
+	switch {
+	case c.Endpoint == "":
+		return errors.New("endpoint is required")
+	case c.Connections < 1 || c.Orders < 1 || c.Publishers < 1:
+		return errors.New("connections, orders and publishers must be at least 1")
+	case c.Rate <= 0:
+		return errors.New("rate must be positive")
+	case c.Duration <= 0:
+		return errors.New("duration must be positive")
+	}
+	return nil
+}
+
+// Run opens the connections, publishes for cfg.Duration and reports.
+func Run(ctx context.Context, cfg Config, logger *slog.Logger) (*Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.DialConcurrency < 1 {
+		cfg.DialConcurrency = 1
+	}
+	report := &Report{
+		Endpoint:    cfg.Endpoint,
+		Orders:      cfg.Orders,
+		Publishers:  cfg.Publishers,
+		TargetRate:  cfg.Rate,
+		Connections: cfg.Connections,
+	}
+	rec := &recorder{sent: make(map[string]time.Time)}
+
+	// Fresh order IDs keep earlier runs' statuses out of this one
+	run := uuid.NewString()[:8]
+	orders := make([]string, cfg.Orders)
+	for i := range orders {
+		orders[i] = fmt.Sprintf("loadtest-%s-%d", run, i)
+	}
+	opts := client.Options{
+		URL:        cfg.Endpoint,
+		Token:      cfg.Token,
+		TokenParam: "Authorization",
+		OnUpdate:   rec.receive,
+		Logger:     logger,
+	}
+
+	start := time.Now()
+	watchers, watching, errs := dialAll(ctx, cfg.Connections, cfg.DialConcurrency, func(i int) string { return orders[i%len(orders)] }, opts)
+	defer closeAll(watchers)
+	report.ConnectErrors = errs
+	report.ConnectTime = time.Since(start).Seconds()
+	logger.Info("watchers connected", "connected", len(watchers), "errors", errs, "seconds", report.ConnectTime)
+
+	opts.OnUpdate = nil
+	publishers, _, errs := dialAll(ctx, cfg.Publishers, cfg.DialConcurrency, func(int) string { return "loadtest-" + run + "-publisher" }, opts)
+	defer closeAll(publishers)
+	if len(watchers) == 0 || len(publishers) == 0 {
+		return nil, fmt.Errorf("no connections could be opened (%d watcher and %d publisher errors)", report.ConnectErrors, errs)
+	}
+	go drain(publishers)
+
+	start = time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+	defer ticker.Stop()
+	deadline := time.After(cfg.Duration)
+publish:
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			break publish
+		case <-deadline:
+			break publish
+		case <-ticker.C:
+		}
+		order := orders[n%len(orders)]
+		msg := lib.MessageData{ID: uuid.NewString(), OrderID: order, Status: fmt.Sprintf("LOAD-%d", n)}
+		// Record first, the delivery can beat Publish returning
+		rec.publish(msg.ID, watching[order])
+		if _, err := publishers[n%len(publishers)].Publish(ctx, msg); err != nil {
+			rec.forget(msg.ID, watching[order])
+			report.PublishErrors++
+			continue
+		}
+		report.Published++
+	}
+	report.Duration = time.Since(start).Seconds()
+	report.ActualRate = float64(report.Published) / report.Duration
+	logger.Info("publishing done, waiting for deliveries", "published", report.Published)
+
+	settle := time.Now().Add(cfg.Settle)
+	for time.Now().Before(settle) && !rec.done() && ctx.Err() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	rec.summarize(report)
+	return report, nil
+}
+
+// dialAll opens n connections, the ith watching orderFor(i), and returns
+// them with the number of connections per order and the failed dials.
+func dialAll(ctx context.Context, n, concurrency int, orderFor func(int) string, opts client.Options) ([]*client.Client, map[string]int, int) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		clients  []*client.Client
+		watching = make(map[string]int)
+		failed   int
+		slots    = make(chan struct{}, concurrency)
+	)
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(orderID string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			dialCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			defer cancel()
+			c, err := client.Dial(dialCtx, orderID, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if failed == 0 {
+					opts.Logger.Warn("failed to connect", "error", err)
+				}
+				failed++
+				return
+			}
+			clients = append(clients, c)
+			watching[orderID]++
+		}(orderFor(i))
+	}
+	wg.Wait()
+	return clients, watching, failed
+}
+
+// drain discards what the publishers receive so they keep reading.
+func drain(publishers []*client.Client) {
+	for _, p := range publishers {
+		go func(p *client.Client) {
+			for range p.Updates() {
+			}
+		}(p)
+	}
+}
+
+func closeAll(clients []*client.Client) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			c.Close()
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (r *recorder) publish(id string, watchers int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent[id] = time.Now()
+	r.expected += watchers
+}
+
+func (r *recorder) forget(id string, watchers int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sent, id)
+	r.expected -= watchers
+}
+
+func (r *recorder) receive(msg lib.MessageData) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sentAt, ok := r.sent[msg.ID]; ok {
+		r.latencies = append(r.latencies, now.Sub(sentAt))
+	}
+}
+
+func (r *recorder) done() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.latencies) >= r.expected
+}
+
+func (r *recorder) summarize(report *Report) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report.Expected = r.expected
+	report.Delivered = len(r.latencies)
+	report.Lost = max(report.Expected-report.Delivered, 0)
+	if report.Expected > 0 {
+		report.LossRate = float64(report.Lost) / float64(report.Expected)
+	}
+	report.Latency = summarize(r.latencies)
+}
+
+func summarize(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return ms(sorted[max(i, 0)])
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	return Latency{
+		Min:  ms(sorted[0]),
+		Mean: ms(total / time.Duration(len(sorted))),
+		P50:  percentile(0.50),
+		P90:  percentile(0.90),
+		P95:  percentile(0.95),
+		P99:  percentile(0.99),
+		Max:  ms(sorted[len(sorted)-1]),
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRunAgainstLocalGateway(t *testing.T) {
+	url, shutdown, err := startLocalGateway()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown()
+
+	report, err := Run(context.Background(), Config{
+		Endpoint:        url,
+		Connections:     20,
+		Orders:          4,
+		Publishers:      2,
+		Rate:            50,
+		Duration:        500 * time.Millisecond,
+		Settle:          5 * time.Second,
+		DialConcurrency: 5,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ConnectErrors != 0 || report.Published == 0 || report.PublishErrors != 0 {
+		t.Fatalf("got %+v", report)
+	}
+	if report.Expected != report.Published*5 || report.Lost != 0 || report.Delivered != report.Expected {
+		t.Fatalf("expected every watcher to get every publish, got %+v", report)
+	}
+	if l := report.Latency; l.Min <= 0 || l.P50 < l.Min || l.P99 < l.P50 || l.Max < l.P99 {
+		t.Fatalf("inconsistent latencies %+v", l)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	got := summarize(latencies)
+	want := Latency{Min: 1, Mean: 50.5, P50: 50, P90: 90, P95: 95, P99: 99, Max: 100}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if summarize(nil) != (Latency{}) {
+		t.Fatal("expected zero latencies without deliveries")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{Endpoint: "ws://localhost/ws", Connections: 1, Orders: 1, Publishers: 1, Rate: 1, Duration: time.Second}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.Endpoint = "" },
+		func(c *Config) { c.Orders = 0 },
+		func(c *Config) { c.Rate = 0 },
+		func(c *Config) { c.Duration = 0 },
+	} {
+		c := valid
+		mutate(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"lib"
+	"lib/gateway"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// loadtest opens watcher connections across orders, publishes to those
+// orders at a steady rate and reports the delivery latency and loss as JSON:
+//
+//	loadtest -connections 1000 -orders 100 -rate 50 -duration 1m
+//	loadtest -endpoint wss://<api>/dev -connections 200 -report report.json
+//
+// Without -endpoint it runs against an in-process local gateway, which
+// measures the client and handler code but not API Gateway or DynamoDB. A
+// deployed API rate limits each publisher, see lib.Config's
+// ConnectionRateLimit: use enough -publishers for the -rate.
+func main() {
+	var (
+		cfg    Config
+		report string
+	)
+	flag.StringVar(&cfg.Endpoint, "endpoint", "", "ws:// or wss:// URL of the API, empty for an in-process local gateway")
+	flag.StringVar(&cfg.Token, "token", os.Getenv("LOADTEST_TOKEN"), "auth token, sent as the Authorization query parameter")
+	flag.IntVar(&cfg.Connections, "connections", 100, "watcher connections")
+	flag.IntVar(&cfg.Orders, "orders", 10, "orders the watchers are spread across")
+	flag.IntVar(&cfg.Publishers, "publishers", 4, "publisher connections")
+	flag.Float64Var(&cfg.Rate, "rate", 10, "publishes per second, across all orders")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "how long to publish")
+	flag.DurationVar(&cfg.Settle, "settle", 5*time.Second, "how long to wait for deliveries after the last publish")
+	flag.IntVar(&cfg.DialConcurrency, "dial-concurrency", 50, "connections opened at once")
+	flag.StringVar(&report, "report", "", "file to write the JSON report to, stdout when empty")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	if cfg.Endpoint == "" {
+		url, shutdown, err := startLocalGateway()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer shutdown()
+		cfg.Endpoint = url
+	}
+
+	result, err := Run(ctx, cfg, logger)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if report != "" {
+		f, err := os.Create(report)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(result); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// startLocalGateway serves a local gateway on a free loopback port and
+// returns its WebSocket URL.
+func startLocalGateway() (string, func(), error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	g := gateway.NewLocal(lib.NewLogger(io.Discard, slog.LevelError))
+	// The publishers are meant to go as fast as -rate says
+	g.Deps.RateLimits = nil
+	server := &http.Server{Handler: g}
+	go server.Serve(l)
+	return "ws://" + l.Addr().String() + "/ws", func() {
+		server.Close()
+		g.Close()
+	}, nil
+}
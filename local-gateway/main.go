@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"lib"
+	"lib/gateway"
+	"log"
+	"net/http"
+	"os"
+)
+
+// local-gateway serves the WebSocket API, SSE streams and long polls on top
+// of in-memory stores, for trying clients without AWS:
+//
+//	ws://localhost:8080/ws?order_id=42
+//	http://localhost:8080/orders/42/stream
+//	http://localhost:8080/orders/42/poll?after=<message id>
+func main() {
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	flag.Parse()
+
+	conf, err := lib.LoadConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	g := gateway.NewLocal(lib.NewLogger(os.Stdout, conf.LogLevel))
+	defer g.Close()
+
+	g.Deps.Logger.Info("local gateway listening", "addr", *addr)
+	log.Fatal(http.ListenAndServe(*addr, g))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"net/http"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
+
+// handler answers {"action":"ping"} with a pong frame and records the
+// connection as seen, which keeps the idle reaper away from it.
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+
+	var ping lib.Ping
+	if err := json.Unmarshal([]byte(request.Body), &ping); err != nil {
+		logger.Warn("failed to parse WebSocket message", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+
+	err := deps.Heartbeat(ctx, lib.Endpoint(request.RequestContext), request.RequestContext.ConnectionID, ping)
+	if errors.Is(err, lib.ErrNotFound) {
+		// Reaped, or $connect failed to store it. The client reconnects when
+		// no pong comes back.
+		logger.Warn("ping from an unknown connection")
+		metrics.Count("PingErrors", 1)
+		return createErrorResponse(http.StatusGone, "Unknown connection"), nil
+	}
+	if err != nil {
+		logger.Error("failed to answer ping", "error", err)
+		metrics.Count("PingErrors", 1)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to send pong"), nil
+	}
+	metrics.Count("Pings", 1)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+}
+
+func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       fmt.Sprintf(`{"error":"%s"}`, message),
+	}
+}
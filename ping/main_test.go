@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection string
+		body       any
+		storeErr   error
+		postErr    error
+		wantStatus int
+		wantPong   bool
+	}{
+		{name: "pong", connection: "c1", body: lib.Ping{Action: "ping", ID: "p1"}, wantStatus: 200, wantPong: true},
+		{name: "unknown connection", connection: "c2", body: lib.Ping{Action: "ping"}, wantStatus: 410},
+		{name: "invalid body", connection: "c1", body: "{", wantStatus: 400},
+		{name: "store failure", connection: "c1", body: lib.Ping{Action: "ping"}, storeErr: errors.New("throttled"), wantStatus: 500},
+		{name: "connection failure", connection: "c1", body: lib.Ping{Action: "ping"}, postErr: errors.New("throttled"), wantStatus: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			connected := time.Now().Add(-time.Hour)
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42", LastSeen: connected})
+			h.Store.Fail("TouchConnection", tt.storeErr)
+			h.API.Fail(tt.connection, tt.postErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message(tt.connection, "ping", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			posts := h.API.Posts()
+			if !tt.wantPong {
+				if len(posts) != 0 {
+					t.Fatalf("expected no pong, got %+v", posts)
+				}
+				return
+			}
+			var pong lib.Pong
+			if len(posts) != 1 || posts[0].Decode(&pong) != nil || pong.Type != "pong" || pong.ID != "p1" || pong.ServerTime.IsZero() {
+				t.Fatalf("got posts %+v", posts)
+			}
+			conns, _ := h.Store.ConnectionsForChannel(ctx, "42")
+			if !conns[0].LastSeen.After(connected) {
+				t.Fatalf("last seen not updated: %+v", conns[0])
+			}
+		})
+	}
+}
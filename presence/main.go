@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"net/http"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
+}
+
+// handler answers {"action":"presence"} with a count frame telling how many
+// connections watch the channel. Without a channel or order_id it counts the
+// channel of the asking connection.
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+	connectionID := request.RequestContext.ConnectionID
+
+	var body lib.Request
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		logger.Warn("failed to parse WebSocket message", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+	channel, err := lib.ResolveChannel(body.Channel, body.OrderID)
+	if errors.Is(err, lib.ErrMissingChannel) {
+		var conn *lib.Connection
+		conn, err = deps.Store.GetConnection(ctx, connectionID)
+		switch {
+		case errors.Is(err, lib.ErrNotFound):
+			logger.Warn("presence from an unknown connection")
+			return createErrorResponse(http.StatusGone, "Unknown connection"), nil
+		case err != nil:
+			logger.Error("failed to load connection", "error", err)
+			metrics.Count("PresenceErrors", 1)
+			return createErrorResponse(http.StatusInternalServerError, "Failed to count watchers"), nil
+		case conn.Channel == "":
+			return createErrorResponse(http.StatusBadRequest, "Missing order_id"), nil
+		}
+		channel = lib.ChannelFromKey(conn.Channel)
+	} else if err != nil {
+		logger.Warn("invalid channel", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid channel"), nil
+	}
+
+	frame, err := deps.Presence(ctx, channel, lib.PresenceCount)
+	if err == nil {
+		err = deps.PostFrame(ctx, lib.Endpoint(request.RequestContext), connectionID, frame)
+	}
+	if err != nil {
+		logger.Error("failed to answer presence", "error", err)
+		metrics.Count("PresenceErrors", 1)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to count watchers"), nil
+	}
+	metrics.Count("PresenceRequests", 1)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+}
+
+func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       fmt.Sprintf(`{"error":"%s"}`, message),
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		connection   string
+		body         any
+		storeErr     error
+		wantStatus   int
+		wantWatchers int
+		wantChannel  string
+	}{
+		{name: "order", connection: "c1", body: lib.Request{Action: "presence", OrderID: "42"}, wantStatus: 200, wantWatchers: 2, wantChannel: "order:42"},
+		{name: "own channel", connection: "c1", body: lib.Request{Action: "presence"}, wantStatus: 200, wantWatchers: 2, wantChannel: "order:42"},
+		{name: "unwatched channel", connection: "c1", body: lib.Request{Action: "presence", Channel: "shipment:S1"}, wantStatus: 200, wantChannel: "shipment:S1"},
+		{name: "unknown connection", connection: "c9", body: lib.Request{Action: "presence"}, wantStatus: 410},
+		{name: "invalid channel", connection: "c1", body: lib.Request{Action: "presence", Channel: "invoice:1"}, wantStatus: 400},
+		{name: "invalid body", connection: "c1", body: "{", wantStatus: 400},
+		{name: "store failure", connection: "c1", body: lib.Request{Action: "presence", OrderID: "42"}, storeErr: errors.New("throttled"), wantStatus: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42"})
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c2", Channel: "42"})
+			h.Store.Fail("Watchers", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message(tt.connection, "presence", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			posts := h.API.Posts()
+			if tt.wantChannel == "" {
+				if len(posts) != 0 {
+					t.Fatalf("expected no frame, got %+v", posts)
+				}
+				return
+			}
+			var frame lib.PresenceFrame
+			if len(posts) != 1 || posts[0].Decode(&frame) != nil {
+				t.Fatalf("got posts %+v", posts)
+			}
+			if frame.Event != lib.PresenceCount || frame.Channel != tt.wantChannel || frame.Watchers != tt.wantWatchers {
+				t.Fatalf("got %+v", frame)
+			}
+		})
+	}
+}
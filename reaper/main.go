@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"time"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
+
+// handler runs on a schedule and closes the connections that have not pinged
+// within IDLE_TIMEOUT, for clients that vanished without $disconnect.
+func handler(ctx context.Context, event events.EventBridgeEvent) (lib.ReapResult, error) {
+	logger := deps.Logger.With("route", "reaper", "eventId", event.ID)
+	ctx = lib.WithLogger(ctx, logger)
+	metrics := deps.Metrics.Recorder("Route", "reaper", "Stage", deps.Config.Stage)
+	defer metrics.Flush()
+
+	start := time.Now()
+	result, err := deps.Reap(ctx, start.Add(-deps.Config.IdleTimeout))
+	metrics.Count("IdleConnections", result.Idle)
+	metrics.Count("Reaped", result.Closed+result.Gone)
+	metrics.Count("ReapErrors", result.Failed)
+	metrics.Duration("ReapLatency", time.Since(start))
+	if err != nil {
+		logger.Error("reaping failed", "error", err)
+		return result, err
+	}
+	logger.Info("reaped idle connections", "idle", result.Idle, "closed", result.Closed, "gone", result.Gone, "failed", result.Failed)
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		gone       string
+		failing    string
+		storeErr   error
+		endpoint   string
+		wantErr    bool
+		want       lib.ReapResult
+		wantClosed []string
+		wantLeft   []string
+	}{
+		{
+			name:       "closes idle connections",
+			want:       lib.ReapResult{Idle: 2, Closed: 2},
+			wantClosed: []string{"idle", "never-pinged"},
+			wantLeft:   []string{"active"},
+		},
+		{
+			name:       "gone connections are removed",
+			gone:       "idle",
+			want:       lib.ReapResult{Idle: 2, Closed: 1, Gone: 1},
+			wantClosed: []string{"never-pinged"},
+			wantLeft:   []string{"active"},
+		},
+		{
+			name:       "failed closes are kept for the next run",
+			failing:    "idle",
+			want:       lib.ReapResult{Idle: 2, Closed: 1, Failed: 1},
+			wantClosed: []string{"never-pinged"},
+			wantLeft:   []string{"active", "idle"},
+		},
+		{
+			name:     "store failure",
+			storeErr: errors.New("throttled"),
+			wantErr:  true,
+			wantLeft: []string{"active", "idle", "never-pinged"},
+		},
+		{
+			name:     "no connections endpoint",
+			endpoint: "none",
+			wantErr:  true,
+			wantLeft: []string{"active", "idle", "never-pinged"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			now := time.Now()
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "active", Channel: "42", LastSeen: now})
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "idle", Channel: "42", LastSeen: now.Add(-time.Hour)})
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "never-pinged", Channel: "42"})
+			if tt.gone != "" {
+				h.API.Gone(tt.gone)
+			}
+			if tt.failing != "" {
+				h.API.Fail(tt.failing, errors.New("throttled"))
+			}
+			h.Store.Fail("IdleConnections", tt.storeErr)
+			if tt.endpoint == "none" {
+				h.Deps.Config.ConnectionsEndpoint = ""
+			}
+			deps = h.Deps
+
+			result, err := handler(ctx, events.EventBridgeEvent{ID: "e1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if result != tt.want {
+				t.Fatalf("got %+v, want %+v", result, tt.want)
+			}
+			if closed := h.API.Deleted(); !slices.Equal(closed, tt.wantClosed) {
+				t.Fatalf("closed %v, want %v", closed, tt.wantClosed)
+			}
+			var left []string
+			conns, _ := h.Store.ConnectionsForChannel(ctx, "42")
+			for _, conn := range conns {
+				left = append(left, conn.ConnectionID)
+			}
+			if !slices.Equal(left, tt.wantLeft) {
+				t.Fatalf("left %v, want %v", left, tt.wantLeft)
+			}
+		})
+	}
+}
@@ -3,107 +3,120 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"lib"
 	"log"
 	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var deps *lib.Deps
+
 func main() {
-	lambda.Start(handler)
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
 }
 
 type (
 	RequestBody struct {
-		OrderID string `json:"order_id"`
-		Action  string `json:"action"`
+		Channel   string `json:"channel"`
+		OrderID   string `json:"order_id"`
+		Action    string `json:"action"`
+		RequestID string `json:"request_id"`
 	}
 	MessageData struct {
-		ID      string `json:"id,omitempty"`
-		Status  string `json:"status"`
-		Date    string `json:"date,omitempty"`
-		OrderID string `json:"order_id"`
+		ID        string            `json:"id,omitempty"`
+		Status    string            `json:"status"`
+		Date      string            `json:"date,omitempty"`
+		Channel   string            `json:"channel,omitempty"`
+		OrderID   string            `json:"order_id,omitempty"`
+		Trace     map[string]string `json:"trace,omitempty"`
+		RequestID string            `json:"request_id,omitempty"`
 	}
 )
 
 func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
-		return createErrorResponse(500, fmt.Sprintf("AWS config error: %v", err)), nil
-	}
-
-	dynamoClient := dynamodb.NewFromConfig(cfg)
-	endpoint := fmt.Sprintf("https://%s/%s", request.RequestContext.DomainName, request.RequestContext.Stage)
-	apigatewayclient := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
-		o.BaseEndpoint = aws.String(endpoint)
-	})
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+	endpoint := lib.Endpoint(request.RequestContext)
 
 	var msg RequestBody
-	err = json.Unmarshal([]byte(request.Body), &msg)
+	err := json.Unmarshal([]byte(request.Body), &msg)
 	if err != nil {
-		log.Printf("Error parsing WebSocket message: %v", err)
+		logger.Warn("failed to parse WebSocket message", "error", err)
 		return createErrorResponse(http.StatusBadRequest, "Invalid request body"), nil
 	}
-	if msg.OrderID == "" {
-		log.Printf("empty order id")
+	channel, err := lib.ResolveChannel(msg.Channel, msg.OrderID)
+	if errors.Is(err, lib.ErrMissingChannel) {
+		logger.Warn("empty order id")
 		return createErrorResponse(http.StatusBadRequest, "Missing order_id"), nil
 	}
-
-	event, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
-		Key: map[string]types.AttributeValue{
-			"eventId": &types.AttributeValueMemberS{Value: msg.OrderID},
-		},
-		TableName: aws.String("WebSocketMessages"),
-	})
 	if err != nil {
-		log.Printf("event not found: %v", err)
-		return createErrorResponse(500, "cannot get item"), nil
+		logger.Warn("invalid channel", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid channel"), nil
 	}
-
-	if len(event.Item) == 0 { // Check if the item is empty
-		log.Printf("Event not found for OrderID: %s", msg.OrderID)
-		if err := sendMessage(ctx, apigatewayclient, request.RequestContext.ConnectionID,
+	// Frames name the channel the way the client did, and carry its request ID
+	address := MessageData{Channel: msg.Channel, OrderID: msg.OrderID, RequestID: msg.RequestID}
+
+	defer deps.FlushTraces(ctx)
+	ctx, span := deps.Tracer().Start(ctx, "request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("channel", channel.String())))
+	defer span.End()
+
+	_, loadSpan := deps.Tracer().Start(ctx, "load message")
+	stored, err := deps.Store.GetMessage(ctx, channel.Key())
+	if errors.Is(err, lib.ErrNotFound) {
+		loadSpan.End()
+		logger.Info("event not found")
+		metrics.Count("RequestsNotFound", 1)
+		if err := deps.PostFrame(ctx, endpoint, request.RequestContext.ConnectionID,
 			MessageData{
-				Status:  "NOT FOUND",
-				OrderID: msg.OrderID,
+				Status:    "NOT FOUND",
+				Channel:   address.Channel,
+				OrderID:   address.OrderID,
+				RequestID: address.RequestID,
 			}); err != nil {
-			log.Printf("Failed to send message: %v", err)
+			logger.Error("failed to send message", "error", err)
+			metrics.Count("DeliveryFailures", 1)
 			return createErrorResponse(500, "Failed to send WebSocket response"), nil
 		}
+		metrics.Count("Deliveries", 1)
 		return createErrorResponse(404, "Event not found"), nil
 	}
-
-	date, ok := event.Item["date"].(*types.AttributeValueMemberS)
-	if !ok {
-		return createErrorResponse(500, "Missing date attribute"), nil
-	}
-	messageId, ok := event.Item["messageId"].(*types.AttributeValueMemberS)
-	if !ok {
-		return createErrorResponse(500, "Missing messageId attribute"), nil
-	}
-	status, ok := event.Item["status"].(*types.AttributeValueMemberS)
-	if !ok {
-		return createErrorResponse(500, "Missing status attribute"), nil
+	lib.EndSpan(loadSpan, err)
+	if err != nil {
+		logger.Error("failed to get event", "error", err)
+		return createErrorResponse(500, "cannot get item"), nil
 	}
 
 	response := MessageData{
-		ID:      messageId.Value,
-		Status:  status.Value,
-		Date:    date.Value,
-		OrderID: msg.OrderID,
+		ID:      stored.ID,
+		Status:  stored.Status,
+		Date:    stored.Date,
+		Channel: address.Channel,
+		OrderID: address.OrderID,
+		// Link the reply to the trace of the publish that stored the status
+		Trace:     stored.Trace,
+		RequestID: address.RequestID,
 	}
 
-	if err := sendMessage(ctx, apigatewayclient, request.RequestContext.ConnectionID, response); err != nil {
-		log.Printf("Failed to send message: %v", err)
+	if err := deps.PostFrame(ctx, endpoint, request.RequestContext.ConnectionID, response); err != nil {
+		logger.Error("failed to send message", "error", err)
+		metrics.Count("DeliveryFailures", 1)
 		return createErrorResponse(500, "Failed to send WebSocket response"), nil
 	}
+	metrics.Count("Deliveries", 1)
 
 	responseBody, _ := json.Marshal(response)
 	return events.APIGatewayProxyResponse{
@@ -112,25 +125,6 @@ func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest
 	}, nil
 }
 
-func sendMessage(ctx context.Context, client *apigatewaymanagementapi.Client, connectionID string, message interface{}) error {
-	messageData, err := json.Marshal(message)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %v", err)
-	}
-
-	_, err = client.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
-		ConnectionId: &connectionID,
-		Data:         messageData,
-	})
-
-	if err != nil {
-		log.Printf("PostToConnection failed: %v", err)
-		return fmt.Errorf("PostToConnection failed: %v", err)
-	}
-
-	return nil
-}
-
 func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
 		StatusCode: statusCode,
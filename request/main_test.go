@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	shipped := lib.MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED", Date: "2024-05-01 10:00:00"}
+	tests := []struct {
+		name       string
+		body       any
+		stored     bool
+		storeErr   error
+		postErr    error
+		wantStatus int
+		wantFrame  *MessageData
+	}{
+		{
+			name:       "current status",
+			body:       lib.Request{Action: "request", OrderID: "42"},
+			stored:     true,
+			wantStatus: 200,
+			wantFrame:  &MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED", Date: "2024-05-01 10:00:00"},
+		},
+		{
+			name:       "echoes the request ID",
+			body:       lib.Request{Action: "request", OrderID: "42", RequestID: "r1"},
+			stored:     true,
+			wantStatus: 200,
+			wantFrame:  &MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED", Date: "2024-05-01 10:00:00", RequestID: "r1"},
+		},
+		{
+			name:       "no status",
+			body:       lib.Request{Action: "request", OrderID: "42"},
+			wantStatus: 404,
+			wantFrame:  &MessageData{OrderID: "42", Status: "NOT FOUND"},
+		},
+		{
+			name:       "no status echoes the request ID",
+			body:       lib.Request{Action: "request", OrderID: "42", RequestID: "r2"},
+			wantStatus: 404,
+			wantFrame:  &MessageData{OrderID: "42", Status: "NOT FOUND", RequestID: "r2"},
+		},
+		{
+			name:       "channel",
+			body:       lib.Request{Action: "request", Channel: "order:42"},
+			stored:     true,
+			wantStatus: 200,
+			wantFrame:  &MessageData{ID: "m1", Channel: "order:42", Status: "SHIPPED", Date: "2024-05-01 10:00:00"},
+		},
+		{
+			name:       "channel without status",
+			body:       lib.Request{Action: "request", Channel: "shipment:S1"},
+			wantStatus: 404,
+			wantFrame:  &MessageData{Channel: "shipment:S1", Status: "NOT FOUND"},
+		},
+		{name: "invalid channel", body: lib.Request{Action: "request", Channel: "shipment:"}, wantStatus: 400},
+		{name: "invalid body", body: "{", wantStatus: 400},
+		{name: "missing order", body: lib.Request{Action: "request"}, wantStatus: 400},
+		{
+			name:       "store failure",
+			body:       lib.Request{Action: "request", OrderID: "42"},
+			storeErr:   errors.New("throttled"),
+			wantStatus: 500,
+		},
+		{
+			name:       "connection failure",
+			body:       lib.Request{Action: "request", OrderID: "42"},
+			stored:     true,
+			postErr:    errors.New("throttled"),
+			wantStatus: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			if tt.stored {
+				h.Store.PutMessage(ctx, lib.StoredMessage{MessageData: shipped})
+			}
+			h.Store.Fail("GetMessage", tt.storeErr)
+			h.API.Fail("c1", tt.postErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message("c1", "request", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			posts := h.API.Posts()
+			if tt.wantFrame == nil {
+				if len(posts) != 0 {
+					t.Fatalf("expected no frame, got %+v", posts)
+				}
+				return
+			}
+			var frame MessageData
+			if len(posts) != 1 || posts[0].Endpoint != wstest.Endpoint || posts[0].Decode(&frame) != nil {
+				t.Fatalf("got posts %+v", posts)
+			}
+			if frame.ID != tt.wantFrame.ID || frame.Status != tt.wantFrame.Status || frame.OrderID != tt.wantFrame.OrderID || frame.Channel != tt.wantFrame.Channel || frame.Date != tt.wantFrame.Date ||
+				frame.RequestID != tt.wantFrame.RequestID {
+				t.Fatalf("got frame %+v, want %+v", frame, *tt.wantFrame)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
+
+// Routes of the HTTP API, as configured in API Gateway.
+const (
+	routeStatus     = "GET /orders/{id}/status"
+	routeEvents     = "GET /orders/{id}/events"
+	routePublish    = "POST /orders/{id}/events"
+	publishMaxBytes = 64 << 10
+	// routeConnections is for operators, see lib.Config.IsAdmin.
+	routeConnections = "GET /orders/{id}/connections"
+
+	// The order routes for any channel type, e.g. /channels/shipment/S1/status.
+	routeChannelStatus  = "GET /channels/{type}/{id}/status"
+	routeChannelEvents  = "GET /channels/{type}/{id}/events"
+	routeChannelPublish = "POST /channels/{type}/{id}/events"
+
+	routeCreateWebhook = "POST /webhooks"
+	routeGetWebhook    = "GET /webhooks/{id}"
+	routeDeleteWebhook = "DELETE /webhooks/{id}"
+)
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// handler serves the channel lookups and publishes of the HTTP API from the
+// same store as the WebSocket routes, and the webhook subscriptions.
+// Published events reach WebSocket watchers and webhooks through the messages
+// table stream like any other.
+func handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ctx, logger := deps.HTTPRequestLogger(ctx, request)
+	metrics := deps.HTTPRequestMetrics(request)
+	defer metrics.Flush()
+
+	// The authorizer of the API vouches for the principal, which owns the
+	// webhooks it creates and decides who sees them
+	if lib.HTTPPrincipal(request.RequestContext) == "" {
+		logger.Warn("request without principal refused")
+		metrics.Count("Unauthorized", 1)
+		return jsonResponse(http.StatusUnauthorized, errorBody{"Missing principal"}), nil
+	}
+
+	id := request.PathParameters["id"]
+	if id == "" && request.RouteKey != routeCreateWebhook {
+		return jsonResponse(http.StatusBadRequest, errorBody{"Missing id"}), nil
+	}
+	channel := lib.OrderChannel(id)
+	if typ, ok := request.PathParameters["type"]; ok {
+		channel = lib.Channel{Type: typ, ID: id}
+		if err := channel.Validate(); err != nil {
+			return jsonResponse(http.StatusBadRequest, errorBody{err.Error()}), nil
+		}
+	}
+
+	defer deps.FlushTraces(ctx)
+	ctx, span := deps.Tracer().Start(lib.ExtractTrace(ctx, request.Headers), request.RouteKey,
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	var response events.APIGatewayV2HTTPResponse
+	switch request.RouteKey {
+	case routeStatus, routeChannelStatus:
+		span.SetAttributes(attribute.String("channel", channel.String()))
+		response = getStatus(ctx, logger, channel)
+	case routeEvents, routeChannelEvents:
+		span.SetAttributes(attribute.String("channel", channel.String()))
+		response = getEvents(ctx, logger, channel, request.QueryStringParameters)
+	case routePublish, routeChannelPublish:
+		span.SetAttributes(attribute.String("channel", channel.String()))
+		response = publish(ctx, logger, channel, request)
+	case routeConnections:
+		span.SetAttributes(attribute.String("order_id", id))
+		response = listConnections(ctx, logger, id, request)
+	case routeCreateWebhook:
+		response = createWebhook(ctx, logger, request)
+	case routeGetWebhook:
+		response = getWebhook(ctx, logger, id, request)
+	case routeDeleteWebhook:
+		response = deleteWebhook(ctx, logger, id, request)
+	default:
+		response = jsonResponse(http.StatusNotFound, errorBody{"Unknown route"})
+	}
+	if response.StatusCode >= http.StatusInternalServerError {
+		metrics.Count("Errors", 1)
+	}
+	return response, nil
+}
+
+func getStatus(ctx context.Context, logger *slog.Logger, channel lib.Channel) events.APIGatewayV2HTTPResponse {
+	stored, err := deps.Store.GetMessage(ctx, channel.Key())
+	if errors.Is(err, lib.ErrNotFound) {
+		return jsonResponse(http.StatusNotFound, errorBody{"Event not found"})
+	}
+	if err != nil {
+		logger.Error("failed to get event", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"cannot get item"})
+	}
+	return jsonResponse(http.StatusOK, stored.MessageData)
+}
+
+func getEvents(ctx context.Context, logger *slog.Logger, channel lib.Channel, params map[string]string) events.APIGatewayV2HTTPResponse {
+	q := lib.HistoryQuery{Channel: channel.Key(), Cursor: params["cursor"]}
+	if v := params["limit"]; v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return jsonResponse(http.StatusBadRequest, errorBody{"limit must be a number"})
+		}
+		q.Limit = limit
+	}
+	if v := params["status"]; v != "" {
+		q.Statuses = strings.Split(v, ",")
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := params[p.name]; v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return jsonResponse(http.StatusBadRequest, errorBody{p.name + " must be an RFC 3339 time"})
+			}
+			*p.dst = t
+		}
+	}
+	if err := q.Normalize(); err != nil {
+		return jsonResponse(http.StatusBadRequest, errorBody{err.Error()})
+	}
+
+	page, err := deps.Store.History(ctx, q)
+	if err != nil {
+		logger.Error("failed to query history", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"cannot query history"})
+	}
+	if page.Events == nil {
+		page.Events = []lib.HistoryEvent{}
+	}
+	return jsonResponse(http.StatusOK, page)
+}
+
+// publish stores the body as the latest status of channel. For orders the
+// body may repeat the order_id of the path, for other channels it may name
+// the order they relate to.
+func publish(ctx context.Context, logger *slog.Logger, channel lib.Channel, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	if len(request.Body) > publishMaxBytes {
+		return jsonResponse(http.StatusRequestEntityTooLarge, errorBody{"Request body too large"})
+	}
+	var msg lib.MessageData
+	if err := json.Unmarshal([]byte(request.Body), &msg); err != nil {
+		logger.Warn("failed to parse request body", "error", err)
+		return jsonResponse(http.StatusBadRequest, errorBody{"Invalid request body"})
+	}
+	if target, err := msg.Target(); msg.Channel != "" && (err != nil || target != channel) {
+		return jsonResponse(http.StatusBadRequest, errorBody{"channel does not match the path"})
+	}
+	if channel.Type == lib.ChannelOrder && msg.OrderID != "" && msg.OrderID != channel.ID {
+		return jsonResponse(http.StatusBadRequest, errorBody{"order_id does not match the path"})
+	}
+	if msg.Status == "" {
+		return jsonResponse(http.StatusBadRequest, errorBody{"Missing status"})
+	}
+	msg = msg.WithChannel(channel)
+	msg.Trace = lib.InjectTrace(ctx)
+
+	// No connection published this, so every watcher gets it, through the
+	// configured @connections endpoint
+	err := deps.Publish(ctx, lib.StoredMessage{MessageData: msg, Endpoint: deps.Config.ConnectionsEndpoint})
+	if err != nil {
+		logger.Error("failed to save message", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"Error saving message"})
+	}
+	return jsonResponse(http.StatusAccepted, msg)
+}
+
+// ConnectionList is the body of the connections route.
+type ConnectionList struct {
+	OrderID     string           `json:"order_id"`
+	Connections []lib.Connection `json:"connections"`
+}
+
+// listConnections returns the connections watching an order with what was
+// recorded about each caller at $connect.
+func listConnections(ctx context.Context, logger *slog.Logger, orderID string, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	if principal := lib.HTTPPrincipal(request.RequestContext); !deps.Config.IsAdmin(principal) {
+		logger.Warn("connections listing refused", "principal", principal)
+		return jsonResponse(http.StatusForbidden, errorBody{"Admin access required"})
+	}
+	conns, err := deps.Store.ConnectionsForChannel(ctx, orderID)
+	if err != nil {
+		logger.Error("failed to list connections", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"cannot list connections"})
+	}
+	if conns == nil {
+		conns = []lib.Connection{}
+	}
+	return jsonResponse(http.StatusOK, ConnectionList{OrderID: orderID, Connections: conns})
+}
+
+func jsonResponse(statusCode int, body any) events.APIGatewayV2HTTPResponse {
+	data, _ := json.Marshal(body)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(data),
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	hook := lib.Webhook{ID: "wh1", URL: "https://example.com/hook", Secret: "s3cr3t", OrderID: "42", Owner: "svc-billing"}
+	tests := []struct {
+		name       string
+		event      events.APIGatewayV2HTTPRequest
+		storeErr   string
+		wantStatus int
+		// wantBody is a substring of the response body
+		wantBody string
+	}{
+		{
+			name:       "status",
+			event:      wstest.HTTP(routeStatus).Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"status":"SHIPPED"`,
+		},
+		{
+			name:       "status of an unknown order",
+			event:      wstest.HTTP(routeStatus).Path("id", "7").Principal("svc-billing").Request(),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "status store failure",
+			event:      wstest.HTTP(routeStatus).Path("id", "42").Principal("svc-billing").Request(),
+			storeErr:   "GetMessage",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "events",
+			event:      wstest.HTTP(routeEvents).Path("id", "42").Query("status", "SHIPPED,PACKED").Query("limit", "5").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"id":"m1"`,
+		},
+		{
+			name:       "events of an unknown order",
+			event:      wstest.HTTP(routeEvents).Path("id", "7").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"events":[]`,
+		},
+		{
+			name:       "events with an invalid limit",
+			event:      wstest.HTTP(routeEvents).Path("id", "42").Query("limit", "many").Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "events with an invalid time",
+			event:      wstest.HTTP(routeEvents).Path("id", "42").Query("from", "yesterday").Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "publish",
+			event:      wstest.HTTP(routePublish).Path("id", "42").Body(lib.MessageData{ID: "m2", Status: "DELIVERED"}).Principal("svc-billing").Request(),
+			wantStatus: http.StatusAccepted,
+			wantBody:   `"order_id":"42"`,
+		},
+		{
+			name:       "publish without status",
+			event:      wstest.HTTP(routePublish).Path("id", "42").Body(lib.MessageData{ID: "m2"}).Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "publish to another order",
+			event:      wstest.HTTP(routePublish).Path("id", "42").Body(lib.MessageData{ID: "m2", Status: "DELIVERED", OrderID: "7"}).Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "publish too large",
+			event:      wstest.HTTP(routePublish).Path("id", "42").Body(strings.Repeat("x", publishMaxBytes+1)).Principal("svc-billing").Request(),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "publish store failure",
+			event:      wstest.HTTP(routePublish).Path("id", "42").Body(lib.MessageData{ID: "m2", Status: "DELIVERED"}).Principal("svc-billing").Request(),
+			storeErr:   "PutMessage",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "status of the order channel",
+			event:      wstest.HTTP(routeChannelStatus).Path("type", "order").Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"status":"SHIPPED"`,
+		},
+		{
+			name:       "status of a shipment",
+			event:      wstest.HTTP(routeChannelStatus).Path("type", "shipment").Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown channel type",
+			event:      wstest.HTTP(routeChannelStatus).Path("type", "invoice").Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "publish to a channel",
+			event:      wstest.HTTP(routeChannelPublish).Path("type", "shipment").Path("id", "S1").Body(lib.MessageData{ID: "s1", Status: "IN TRANSIT", OrderID: "42"}).Principal("svc-billing").Request(),
+			wantStatus: http.StatusAccepted,
+			wantBody:   `"channel":"shipment:S1","order_id":"42"`,
+		},
+		{
+			name:       "publish to another channel",
+			event:      wstest.HTTP(routeChannelPublish).Path("type", "shipment").Path("id", "S1").Body(lib.MessageData{ID: "s1", Status: "IN TRANSIT", Channel: "shipment:S2"}).Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "events of a channel",
+			event:      wstest.HTTP(routeChannelEvents).Path("type", "payment").Path("id", "P1").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"events":[]`,
+		},
+		{
+			name:       "create webhook",
+			event:      wstest.HTTP(routeCreateWebhook).Principal("ops-alice").Body(WebhookRequest{URL: "https://example.com/new", OrderID: "42"}).Request(),
+			wantStatus: http.StatusCreated,
+			wantBody:   `"secret":"`,
+		},
+		{
+			name:       "create webhook as a non-admin",
+			event:      wstest.HTTP(routeCreateWebhook).Principal("svc-billing").Body(WebhookRequest{URL: "https://example.com/new", OrderID: "42"}).Request(),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "create webhook to a private host",
+			event:      wstest.HTTP(routeCreateWebhook).Principal("ops-alice").Body(WebhookRequest{URL: "https://localhost/hook", OrderID: "42"}).Request(),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `non-public address`,
+		},
+		{
+			name:       "create webhook over http",
+			event:      wstest.HTTP(routeCreateWebhook).Principal("ops-alice").Body(WebhookRequest{URL: "http://example.com/new", OrderID: "42"}).Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "create webhook without a target",
+			event:      wstest.HTTP(routeCreateWebhook).Body(WebhookRequest{URL: "https://example.com/new"}).Principal("ops-alice").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "get webhook hides the secret",
+			event:      wstest.HTTP(routeGetWebhook).Path("id", "wh1").Principal("svc-billing").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"id":"wh1"`,
+		},
+		{
+			name:       "get webhook of another principal",
+			event:      wstest.HTTP(routeGetWebhook).Path("id", "wh1").Principal("svc-other").Request(),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "get unknown webhook",
+			event:      wstest.HTTP(routeGetWebhook).Path("id", "nope").Principal("svc-billing").Request(),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "delete webhook",
+			event:      wstest.HTTP(routeDeleteWebhook).Path("id", "wh1").Principal("svc-billing").Request(),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "connections",
+			event:      wstest.HTTP(routeConnections).Path("id", "42").Principal("ops-alice").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"sourceIp":"203.0.113.7"`,
+		},
+		{
+			name:       "connections of an unwatched order",
+			event:      wstest.HTTP(routeConnections).Path("id", "7").Principal("ops-alice").Request(),
+			wantStatus: http.StatusOK,
+			wantBody:   `"connections":[]`,
+		},
+		{
+			name:       "connections for a non-admin",
+			event:      wstest.HTTP(routeConnections).Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "anonymous callers are refused",
+			event:      wstest.HTTP(routeConnections).Path("id", "42").Request(),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "anonymous callers cannot see ownerless webhooks",
+			event:      wstest.HTTP(routeGetWebhook).Path("id", "wh2").Request(),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "connections store failure",
+			event:      wstest.HTTP(routeConnections).Path("id", "42").Principal("ops-alice").Request(),
+			storeErr:   "ConnectionsForChannel",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "missing id",
+			event:      wstest.HTTP(routeStatus).Principal("svc-billing").Request(),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown route",
+			event:      wstest.HTTP("PUT /orders/{id}").Path("id", "42").Principal("svc-billing").Request(),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Deps.Publish(ctx, lib.StoredMessage{MessageData: lib.MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED"}})
+			h.Webhooks.PutWebhook(ctx, hook)
+			h.Webhooks.PutWebhook(ctx, lib.Webhook{ID: "wh2", URL: "https://example.com/legacy", Secret: "s3cr3t", OrderID: "42"})
+			h.Store.PutConnection(ctx, lib.NewConnection(wstest.Connect("c1").SourceIP("203.0.113.7").Request(), lib.OrderChannel("42"), time.Now()))
+			h.Deps.Config.AdminPrincipals = "ops-alice"
+			if tt.storeErr != "" {
+				h.Store.Fail(tt.storeErr, errors.New("throttled"))
+			}
+			deps = h.Deps
+
+			resp, err := handler(ctx, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if !strings.Contains(resp.Body, tt.wantBody) {
+				t.Fatalf("got body %s, want it to contain %s", resp.Body, tt.wantBody)
+			}
+			if resp.Body != "" && !json.Valid([]byte(resp.Body)) {
+				t.Fatalf("invalid JSON body %s", resp.Body)
+			}
+			if strings.Contains(resp.Body, hook.Secret) {
+				t.Fatal("the secret of an existing webhook must not be returned")
+			}
+		})
+	}
+}
+
+func TestPublishReachesTheStore(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	deps = h.Deps
+
+	event := wstest.HTTP(routePublish).Path("id", "42").Body(lib.MessageData{ID: "m1", Status: "SHIPPED"}).Principal("svc-billing").Request()
+	if resp, _ := handler(ctx, event); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("got %d %s", resp.StatusCode, resp.Body)
+	}
+	stored, err := h.Store.GetMessage(ctx, "42")
+	if err != nil || stored.ID != "m1" || stored.Endpoint != wstest.Endpoint {
+		t.Fatalf("got %+v, %v", stored, err)
+	}
+	page, _ := h.Store.History(ctx, lib.HistoryQuery{Channel: "42", Limit: 1, From: time.Now().Add(-time.Minute)})
+	if len(page.Events) != 1 {
+		t.Fatalf("expected the publish in the history, got %+v", page)
+	}
+}
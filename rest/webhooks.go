@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-lambda-go/events"
+	"lib"
+	"log/slog"
+	"net/http"
+)
+
+// WebhookRequest subscribes url to one order or to every order of a customer.
+type WebhookRequest struct {
+	URL        string `json:"url"`
+	OrderID    string `json:"order_id,omitempty"`
+	CustomerID string `json:"customer_id,omitempty"`
+}
+
+// createWebhook registers a webhook. The secret used to sign deliveries is
+// only returned here. Principals aren't tied to the orders and customers they
+// may follow, so only admins subscribe webhooks.
+func createWebhook(ctx context.Context, logger *slog.Logger, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	principal := lib.HTTPPrincipal(request.RequestContext)
+	if !deps.Config.IsAdmin(principal) {
+		logger.Warn("webhook creation refused", "principal", principal)
+		return jsonResponse(http.StatusForbidden, errorBody{"Admin access required"})
+	}
+	var body WebhookRequest
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		logger.Warn("failed to parse request body", "error", err)
+		return jsonResponse(http.StatusBadRequest, errorBody{"Invalid request body"})
+	}
+	hook, err := lib.NewWebhook(body.URL, body.OrderID, body.CustomerID, principal)
+	if err != nil {
+		return jsonResponse(http.StatusBadRequest, errorBody{err.Error()})
+	}
+	if err := deps.CheckWebhookHost(ctx, hook); err != nil {
+		logger.Warn("webhook host refused", "url", hook.URL, "error", err)
+		return jsonResponse(http.StatusBadRequest, errorBody{err.Error()})
+	}
+	if err := deps.Webhooks.PutWebhook(ctx, hook); err != nil {
+		logger.Error("failed to save webhook", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"Error saving webhook"})
+	}
+	logger.Info("webhook created", "webhook", hook.ID)
+	return jsonResponse(http.StatusCreated, hook)
+}
+
+func getWebhook(ctx context.Context, logger *slog.Logger, id string, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	hook, response, ok := ownedWebhook(ctx, logger, id, request)
+	if !ok {
+		return response
+	}
+	hook.Secret = ""
+	return jsonResponse(http.StatusOK, hook)
+}
+
+func deleteWebhook(ctx context.Context, logger *slog.Logger, id string, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	if _, response, ok := ownedWebhook(ctx, logger, id, request); !ok {
+		return response
+	}
+	if err := deps.Webhooks.DeleteWebhook(ctx, id); err != nil {
+		logger.Error("failed to delete webhook", "error", err)
+		return jsonResponse(http.StatusInternalServerError, errorBody{"Error deleting webhook"})
+	}
+	logger.Info("webhook deleted", "webhook", id)
+	return events.APIGatewayV2HTTPResponse{StatusCode: http.StatusNoContent}
+}
+
+// ownedWebhook loads a webhook, refusing principals other than the one that
+// created it.
+func ownedWebhook(ctx context.Context, logger *slog.Logger, id string, request events.APIGatewayV2HTTPRequest) (*lib.Webhook, events.APIGatewayV2HTTPResponse, bool) {
+	hook, err := deps.Webhooks.GetWebhook(ctx, id)
+	if errors.Is(err, lib.ErrWebhookNotFound) {
+		return nil, jsonResponse(http.StatusNotFound, errorBody{"Webhook not found"}), false
+	}
+	if err != nil {
+		logger.Error("failed to get webhook", "error", err)
+		return nil, jsonResponse(http.StatusInternalServerError, errorBody{"cannot get webhook"}), false
+	}
+	if hook.Owner != "" && hook.Owner != lib.HTTPPrincipal(request.RequestContext) {
+		return nil, jsonResponse(http.StatusForbidden, errorBody{"Webhook belongs to another principal"}), false
+	}
+	return hook, events.APIGatewayV2HTTPResponse{}, true
+}
@@ -5,121 +5,65 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"lib"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type (
-	WebSocketMessage struct {
-		Action  string      `json:"action"`
-		Message MessageData `json:"message"`
-		OrderID string      `json:"order_id"`
-	}
-	MessageData struct {
-		ID      string `json:"id"`
-		Status  string `json:"status"`
-		Date    string `json:"date"`
-		OrderID string `json:"order_id"`
-	}
-)
+var deps *lib.Deps
 
+// handler only stores the event. The fanout function picks it up from the
+// messages table stream and delivers it to the watchers of the order.
 func handler(ctx context.Context, event events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Load AWS config
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatalf("Unable to load AWS config: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: 500, Body: fmt.Sprintf(`{"message":"%v"}`, err)}, nil
-	}
-
-	// Initialize DynamoDB client
-	dynamoClient := dynamodb.NewFromConfig(cfg)
-	endpoint := fmt.Sprintf("https://%s/%s", event.RequestContext.DomainName, event.RequestContext.Stage)
-
-	log.Printf("Complete URL: %s", endpoint)
-
-	apigatewayclient := apigatewaymanagementapi.NewFromConfig(cfg, func(o *apigatewaymanagementapi.Options) {
-		o.BaseEndpoint = aws.String(endpoint)
-	})
+	start := time.Now()
+	ctx, logger := deps.RequestLogger(ctx, event)
+	metrics := deps.RequestMetrics(event)
+	defer metrics.Flush()
 
-	var msg WebSocketMessage
-	err = json.Unmarshal([]byte(event.Body), &msg)
+	var msg lib.Message
+	err := json.Unmarshal([]byte(event.Body), &msg)
 	if err != nil {
-		log.Printf("Error parsing WebSocket message: %v", err)
+		logger.Warn("failed to parse WebSocket message", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
 	}
 
-	log.Printf("Received body: %s", msg)
+	logger.Debug("received message", "message", msg)
 
-	if msg.OrderID == "" {
-		log.Printf("empty order id")
+	channel, err := lib.ResolveChannel(msg.Channel, msg.OrderID)
+	if err != nil {
+		logger.Warn("invalid channel", "error", err)
 		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
 	}
-	ttl := time.Now().Add(1 * time.Hour).Unix()
-	// Prepare the item to store in DynamoDB
-	item := map[string]types.AttributeValue{
-		"eventId":   &types.AttributeValueMemberS{Value: msg.OrderID},
-		"status":    &types.AttributeValueMemberS{Value: msg.Message.Status},
-		"messageId": &types.AttributeValueMemberS{Value: msg.Message.ID},
-		"date":      &types.AttributeValueMemberS{Value: msg.Message.Date},
-		"ttl":       &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", ttl)},
-	}
-
-	// Insert into DynamoDB
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String("WebSocketMessages"),
-		Item:      item,
+	msg.Message = msg.Message.WithChannel(channel)
+
+	// Continue the publisher's trace and hand ours on to the subscribers
+	defer deps.FlushTraces(ctx)
+	ctx, span := deps.Tracer().Start(lib.ExtractTrace(ctx, msg.Message.Trace), "sendmessage",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("channel", channel.String())))
+	defer span.End()
+	msg.Message.Trace = lib.InjectTrace(ctx)
+
+	err = deps.Publish(ctx, lib.StoredMessage{
+		MessageData:        msg.Message,
+		Endpoint:           lib.Endpoint(event.RequestContext),
+		SourceConnectionID: event.RequestContext.ConnectionID,
 	})
 	if err != nil {
-		log.Printf("DynamoDB error: %v", err)
+		logger.Error("failed to save message", "error", err)
+		metrics.Count("PublishErrors", 1)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Body:       fmt.Sprintf(`{"message":"Error saving message","error":"%v"}`, err),
 		}, nil
 	}
-
-	// Query DynamoDB for connections with the specified order ID
-	queryInput := &dynamodb.QueryInput{
-		TableName:              aws.String("WebSocketConnections"),
-		IndexName:              aws.String("orderId-index"),
-		KeyConditionExpression: aws.String("orderId = :orderID"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":orderID": &types.AttributeValueMemberS{Value: msg.OrderID},
-		},
-	}
-
-	connections, err := dynamoClient.Query(ctx, queryInput)
-	if err != nil {
-		log.Printf("DynamoDB query error: %v", err)
-		return events.APIGatewayProxyResponse{StatusCode: 500, Body: `fmt.Sprintf({"message":"%v"}, err)`}, nil
-	}
-
-	log.Printf("Connections: %v", connections.Items)
-
-	// Send the message to all other connections
-	var sendMessages []error
-	for _, item := range connections.Items {
-		connectionID := item["connectionId"].(*types.AttributeValueMemberS).Value
-		log.Printf("Connection id: %v", connectionID)
-		// Avoid sending to the same connection that originated the message
-		if connectionID != event.RequestContext.ConnectionID {
-			err := sendMessage(apigatewayclient, connectionID, msg.Message)
-			if err != nil {
-				log.Printf("Failed to send message to connection %s: %v", connectionID, err)
-				sendMessages = append(sendMessages, err)
-			}
-		}
-	}
-	if len(sendMessages) > 0 {
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
-	}
+	metrics.Count("Publishes", 1)
+	metrics.Duration("PublishLatency", time.Since(start))
 
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
@@ -127,27 +71,11 @@ func handler(ctx context.Context, event events.APIGatewayWebsocketProxyRequest)
 	}, nil
 }
 
-func sendMessage(client *apigatewaymanagementapi.Client, connectionID string, message interface{}) error {
-	// Marshal the message into JSON format
-	messageData, err := json.Marshal(message)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %v", err)
-	}
-
-	// Send the message using the PostToConnection API
-	_, err = client.PostToConnection(context.TODO(), &apigatewaymanagementapi.PostToConnectionInput{
-		ConnectionId: &connectionID,
-		Data:         messageData,
-	})
-
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
 	if err != nil {
-		log.Printf("PostToConnection failed: %v", err)
-		return fmt.Errorf("PostToConnection failed: %v", err)
+		log.Fatalf("%v", err)
 	}
-
-	return nil
-}
-
-func main() {
-	lambda.Start(handler)
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
 }
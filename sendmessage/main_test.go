@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       any
+		storeErr   error
+		wantStatus int
+		wantMetric string
+	}{
+		{
+			name:       "stores the message",
+			body:       lib.Message{Action: "sendmessage", OrderID: "42", Message: lib.MessageData{ID: "m1", Status: "SHIPPED"}},
+			wantStatus: 200,
+			wantMetric: "Publishes",
+		},
+		{
+			name:       "order channel",
+			body:       lib.Message{Action: "sendmessage", Channel: "order:42", Message: lib.MessageData{ID: "m1", Status: "SHIPPED"}},
+			wantStatus: 200,
+			wantMetric: "Publishes",
+		},
+		{name: "invalid channel", body: lib.Message{Action: "sendmessage", Channel: "parcel:1"}, wantStatus: 400},
+		{name: "invalid body", body: "{", wantStatus: 400},
+		{name: "missing order", body: lib.Message{Action: "sendmessage"}, wantStatus: 400},
+		{
+			name:       "store failure",
+			body:       lib.Message{Action: "sendmessage", OrderID: "42", Message: lib.MessageData{ID: "m1", Status: "SHIPPED"}},
+			storeErr:   errors.New("throttled"),
+			wantStatus: 500,
+			wantMetric: "PublishErrors",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Store.Fail("PutMessage", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message("c1", "sendmessage", tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			if tt.wantMetric != "" && h.Metric(tt.wantMetric) != 1 {
+				t.Errorf("expected %s to be counted", tt.wantMetric)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			stored, err := h.Store.GetMessage(ctx, "42")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.ID != "m1" || stored.OrderID != "42" || stored.Endpoint != wstest.Endpoint || stored.SourceConnectionID != "c1" {
+				t.Fatalf("got %+v", stored)
+			}
+			if len(h.API.Posts()) != 0 {
+				t.Fatal("delivery is left to the fan-out")
+			}
+		})
+	}
+}
+
+func TestHandlerChannel(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	deps = h.Deps
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "shipment-watcher", Channel: "shipment:S1"})
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "order-watcher", Channel: "42"})
+
+	body := lib.Message{Action: "sendmessage", Channel: "shipment:S1", Message: lib.MessageData{ID: "m1", Status: "IN TRANSIT", OrderID: "42"}}
+	resp, err := handler(ctx, wstest.Message("c1", "sendmessage", body).Request())
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+	if _, err := h.Store.GetMessage(ctx, "42"); !errors.Is(err, lib.ErrNotFound) {
+		t.Fatalf("the order status was overwritten: %v", err)
+	}
+	stored, err := h.Store.GetMessage(ctx, "shipment:S1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Channel != "shipment:S1" || stored.OrderID != "42" {
+		t.Fatalf("got %+v", stored)
+	}
+
+	if _, err := h.Deps.Fanout(ctx, *stored); err != nil {
+		t.Fatal(err)
+	}
+	posts := h.API.Posts()
+	if len(posts) != 1 || posts[0].ConnectionID != "shipment-watcher" {
+		t.Fatalf("got posts %+v, want the shipment watcher alone", posts)
+	}
+}
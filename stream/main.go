@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"io"
+	"lib"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
+
+const (
+	// maxWait stays under the API Gateway and function URL idle limits
+	maxWait = 25 * time.Second
+	// keepAlive is how often an idle SSE stream gets a comment
+	keepAlive = 15 * time.Second
+	// deadlineMargin is left to end the response before Lambda times out
+	deadlineMargin = 2 * time.Second
+)
+
+// handler serves the SSE and long-poll fallbacks from a function URL in
+// RESPONSE_STREAM mode:
+//
+//	GET /orders/{id}/stream   Server-Sent Events until the invocation ends
+//	GET /orders/{id}/poll     the next status after ?after=<message id>
+//
+// A Lambda cannot receive PostToConnection calls, so instead of registering
+// with the fan-out it watches the messages table the fan-out reads. Build
+// with -tags lambda.norpc for the provided.al2 runtime.
+//
+// The function URL uses AWS_IAM authorization, so callers sign their requests
+// with credentials allowed lambda:InvokeFunctionUrl. Requests that reach the
+// handler without an IAM caller are refused in case the URL is left open.
+func handler(ctx context.Context, request events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	principal := caller(request)
+	logger := deps.Logger.With("requestId", request.RequestContext.RequestID, "path", request.RawPath, "principal", principal)
+	ctx = lib.WithLogger(ctx, logger)
+	metrics := deps.Metrics.Recorder("Route", "stream", "Stage", deps.Config.Stage)
+	defer metrics.Flush()
+
+	if principal == "" {
+		logger.Warn("request without an IAM caller refused")
+		metrics.Count("Unauthorized", 1)
+		return textResponse(http.StatusUnauthorized, "unauthorized"), nil
+	}
+
+	parts := strings.Split(strings.Trim(request.RawPath, "/"), "/")
+	if request.RequestContext.HTTP.Method != http.MethodGet || len(parts) != 3 || parts[0] != "orders" || parts[1] == "" {
+		return textResponse(http.StatusNotFound, "not found"), nil
+	}
+	orderID := parts[1]
+
+	switch parts[2] {
+	case "stream":
+		metrics.Count("Streams", 1)
+		return stream(ctx, orderID, request.Headers["last-event-id"]), nil
+	case "poll":
+		metrics.Count("Polls", 1)
+		return poll(ctx, orderID, request.QueryStringParameters), nil
+	default:
+		return textResponse(http.StatusNotFound, "not found"), nil
+	}
+}
+
+// caller returns the IAM identity that signed the request, or "" when it
+// wasn't signed.
+func caller(request events.LambdaFunctionURLRequest) string {
+	if auth := request.RequestContext.Authorizer; auth != nil && auth.IAM != nil {
+		return auth.IAM.UserARN
+	}
+	return ""
+}
+
+// stream writes every new status of the order until the invocation is about
+// to end. EventSource clients then reconnect with Last-Event-ID and carry on.
+func stream(ctx context.Context, orderID, lastEventID string) *events.LambdaFunctionURLStreamingResponse {
+	r, w := io.Pipe()
+	go func() {
+		cancel := func() {}
+		if deadline, ok := ctx.Deadline(); ok {
+			ctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+		}
+		defer cancel()
+
+		after := lastEventID
+		for ctx.Err() == nil {
+			wait, cancel := context.WithTimeout(ctx, keepAlive)
+			msg, err := deps.WaitForMessage(wait, orderID, after, lib.DefaultPollInterval)
+			cancel()
+			switch {
+			case err != nil:
+				lib.Logger(ctx).Error("failed to read message", "error", err)
+				w.CloseWithError(err)
+				return
+			case msg == nil:
+				err = lib.WriteSSEComment(w, "keepalive")
+			default:
+				after = msg.ID
+				err = lib.WriteSSE(w, msg.ID, "status", msg.MessageData)
+			}
+			if err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type":  lib.SSEContentType,
+			"Cache-Control": "no-cache",
+		},
+		Body: r,
+	}
+}
+
+// poll answers with the current status unless it is ?after, otherwise waits
+// for the next one, or answers 204 No Content after ?timeout.
+func poll(ctx context.Context, orderID string, params map[string]string) *events.LambdaFunctionURLStreamingResponse {
+	timeout := maxWait
+	if v := params["timeout"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return textResponse(http.StatusBadRequest, "timeout must be a positive duration")
+		}
+		timeout = min(d, maxWait)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	msg, err := deps.WaitForMessage(ctx, orderID, params["after"], lib.DefaultPollInterval)
+	if err != nil {
+		lib.Logger(ctx).Error("failed to read message", "error", err)
+		return textResponse(http.StatusInternalServerError, "cannot get item")
+	}
+	if msg == nil {
+		return &events.LambdaFunctionURLStreamingResponse{StatusCode: http.StatusNoContent}
+	}
+	body, _ := json.Marshal(msg.MessageData)
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       strings.NewReader(string(body)),
+	}
+}
+
+func textResponse(statusCode int, message string) *events.LambdaFunctionURLStreamingResponse {
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       strings.NewReader(message),
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"lib"
+	"lib/wstest"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func urlRequest(method, path string, query map[string]string) events.LambdaFunctionURLRequest {
+	return events.LambdaFunctionURLRequest{
+		RawPath:               path,
+		QueryStringParameters: query,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			RequestID: "req-1",
+			HTTP:      events.LambdaFunctionURLRequestContextHTTPDescription{Method: method, Path: path},
+			Authorizer: &events.LambdaFunctionURLRequestContextAuthorizerDescription{
+				IAM: &events.LambdaFunctionURLRequestContextAuthorizerIAMDescription{
+					AccountID: "123456789012",
+					UserARN:   "arn:aws:iam::123456789012:user/tracker",
+				},
+			},
+		},
+	}
+}
+
+// unsigned drops the IAM caller of request.
+func unsigned(request events.LambdaFunctionURLRequest) events.LambdaFunctionURLRequest {
+	request.RequestContext.Authorizer = nil
+	return request
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    events.LambdaFunctionURLRequest
+		wantStatus int
+		// wantBody is a substring of the response body
+		wantBody string
+	}{
+		{
+			name:       "poll returns the current status",
+			request:    urlRequest(http.MethodGet, "/orders/42/poll", nil),
+			wantStatus: http.StatusOK,
+			wantBody:   `"id":"m1"`,
+		},
+		{
+			name:       "poll after the current status times out",
+			request:    urlRequest(http.MethodGet, "/orders/42/poll", map[string]string{"after": "m1", "timeout": "50ms"}),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "poll with an invalid timeout",
+			request:    urlRequest(http.MethodGet, "/orders/42/poll", map[string]string{"timeout": "soon"}),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "stream sends the current status",
+			request:    urlRequest(http.MethodGet, "/orders/42/stream", nil),
+			wantStatus: http.StatusOK,
+			wantBody:   "id: m1\nevent: status\n",
+		},
+		{
+			name:       "unsigned poll",
+			request:    unsigned(urlRequest(http.MethodGet, "/orders/42/poll", nil)),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unsigned stream",
+			request:    unsigned(urlRequest(http.MethodGet, "/orders/42/stream", nil)),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown path",
+			request:    urlRequest(http.MethodGet, "/orders/42", nil),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrong method",
+			request:    urlRequest(http.MethodPost, "/orders/42/poll", nil),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The stream ends deadlineMargin before the deadline
+			ctx, cancel := context.WithTimeout(context.Background(), deadlineMargin+200*time.Millisecond)
+			defer cancel()
+			h := wstest.New()
+			h.Deps.Publish(ctx, lib.StoredMessage{MessageData: lib.MessageData{ID: "m1", OrderID: "42", Status: "SHIPPED"}})
+			deps = h.Deps
+
+			resp, err := handler(ctx, tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			var body []byte
+			if resp.Body != nil {
+				if body, err = io.ReadAll(resp.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !strings.Contains(string(body), tt.wantBody) {
+				t.Fatalf("got body %q, want it to contain %q", body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"net/http"
+)
+
+const routeUnsubscribe = "unsubscribe"
+
+var deps *lib.Deps
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(deps.LimitSize(deps.RateLimit(handler)))
+}
+
+// handler serves the subscribe and unsubscribe routes. Subscribing moves the
+// connection to another channel, whose count frame the watchers Lambda sends
+// once it includes the connection; unsubscribing leaves the connection open
+// but watching nothing.
+func handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, logger := deps.RequestLogger(ctx, request)
+	metrics := deps.RequestMetrics(request)
+	defer metrics.Flush()
+	connectionID := request.RequestContext.ConnectionID
+
+	var body lib.Subscription
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		logger.Warn("failed to parse WebSocket message", "error", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid request body"), nil
+	}
+	var (
+		channel lib.Channel
+		filter  lib.Filter
+		err     error
+	)
+	if request.RequestContext.RouteKey != routeUnsubscribe {
+		channel, err = lib.ResolveChannel(body.Channel, body.OrderID)
+		if errors.Is(err, lib.ErrMissingChannel) {
+			logger.Warn("empty order id")
+			return createErrorResponse(http.StatusBadRequest, "Missing order_id"), nil
+		}
+		if err != nil {
+			logger.Warn("invalid channel", "error", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid channel"), nil
+		}
+		if filter, err = lib.ParseFilter(body.Filter); err != nil {
+			logger.Warn("invalid filter", "error", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid filter"), nil
+		}
+	}
+
+	err = deps.Subscribe(ctx, connectionID, channel, filter)
+	if errors.Is(err, lib.ErrNotFound) {
+		logger.Warn("subscription of an unknown connection")
+		metrics.Count("SubscribeErrors", 1)
+		return createErrorResponse(http.StatusGone, "Unknown connection"), nil
+	}
+	if err != nil {
+		logger.Error("failed to subscribe", "error", err)
+		metrics.Count("SubscribeErrors", 1)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to subscribe"), nil
+	}
+	if channel == (lib.Channel{}) {
+		metrics.Count("Unsubscribes", 1)
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	metrics.Count("Subscribes", 1)
+	return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+}
+
+func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       fmt.Sprintf(`{"error":"%s"}`, message),
+	}
+}
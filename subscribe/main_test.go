@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		route       string
+		connection  string
+		body        any
+		storeErr    error
+		wantStatus  int
+		wantChannel string
+	}{
+		{
+			name:        "subscribe",
+			route:       "subscribe",
+			connection:  "c1",
+			body:        lib.Subscription{Action: "subscribe", Channel: "shipment:S1", Filter: "status != CREATED"},
+			wantStatus:  200,
+			wantChannel: "shipment:S1",
+		},
+		{
+			name:        "unsubscribe",
+			route:       routeUnsubscribe,
+			connection:  "c1",
+			body:        lib.Subscription{Action: routeUnsubscribe},
+			wantStatus:  200,
+			wantChannel: "",
+		},
+		{name: "missing channel", route: "subscribe", connection: "c1", body: lib.Subscription{Action: "subscribe"}, wantStatus: 400, wantChannel: "42"},
+		{name: "invalid filter", route: "subscribe", connection: "c1", body: lib.Subscription{Action: "subscribe", OrderID: "7", Filter: "status ="}, wantStatus: 400, wantChannel: "42"},
+		{name: "unknown connection", route: "subscribe", connection: "c9", body: lib.Subscription{Action: "subscribe", OrderID: "7"}, wantStatus: 410, wantChannel: "42"},
+		{name: "store failure", route: "subscribe", connection: "c1", body: lib.Subscription{Action: "subscribe", OrderID: "7"}, storeErr: errors.New("throttled"), wantStatus: 500, wantChannel: "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42"})
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c2", Channel: "42"})
+			h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c3", Channel: "shipment:S1"})
+			h.Store.Fail("PutConnection", tt.storeErr)
+			deps = h.Deps
+
+			resp, err := handler(ctx, wstest.Message(tt.connection, tt.route, tt.body).Request())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("got %d %s, want %d", resp.StatusCode, resp.Body, tt.wantStatus)
+			}
+			conn, err := h.Store.GetConnection(ctx, "c1")
+			if err != nil || conn.Channel != tt.wantChannel {
+				t.Fatalf("got %+v, %v, want channel %q", conn, err, tt.wantChannel)
+			}
+			// Presence goes out from the watchers Lambda
+			if posts := h.API.Posts(); len(posts) != 0 {
+				t.Fatalf("got posts %+v", posts)
+			}
+		})
+	}
+}
+
+func TestSubscribeKeepsFilter(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42", Filter: "SHIPPED"})
+	deps = h.Deps
+
+	body := lib.Subscription{Action: "subscribe", OrderID: "7", Filter: "DELIVERED, CANCELLED"}
+	if resp, err := handler(ctx, wstest.Message("c1", "subscribe", body).Request()); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+	if conn, _ := h.Store.GetConnection(ctx, "c1"); conn.Channel != "7" || conn.Filter != "DELIVERED, CANCELLED" {
+		t.Fatalf("got %+v", conn)
+	}
+	if n, _ := h.Store.Watchers(ctx, "42"); n != 0 {
+		t.Fatalf("got %d watchers left on the old order", n)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lib"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigatewaytypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+)
+
+const localEndpoint = "local"
+
+type (
+	// localConnection is one line of input for the local driver, a stored
+	// connection whose socket is open unless gone is set:
+	//
+	//	{"connection_id":"c1","order_id":"42"}
+	//	{"connection_id":"c2","order_id":"42","gone":true}
+	localConnection struct {
+		ConnectionID string `json:"connection_id"`
+		OrderID      string `json:"order_id"`
+		Gone         bool   `json:"gone"`
+	}
+
+	// standInAPI stands in for the @connections endpoint, knowing which
+	// sockets are open.
+	standInAPI struct {
+		mu   sync.Mutex
+		open map[string]bool
+	}
+)
+
+func (a *standInAPI) check(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.open[id] {
+		return &apigatewaytypes.GoneException{Message: aws.String("connection is gone")}
+	}
+	return nil
+}
+
+func (a *standInAPI) PostToConnection(_ context.Context, in *apigatewaymanagementapi.PostToConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.PostToConnectionOutput, error) {
+	if err := a.check(aws.ToString(in.ConnectionId)); err != nil {
+		return nil, err
+	}
+	return &apigatewaymanagementapi.PostToConnectionOutput{}, nil
+}
+
+func (a *standInAPI) GetConnection(_ context.Context, in *apigatewaymanagementapi.GetConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.GetConnectionOutput, error) {
+	if err := a.check(aws.ToString(in.ConnectionId)); err != nil {
+		return nil, err
+	}
+	return &apigatewaymanagementapi.GetConnectionOutput{}, nil
+}
+
+func (a *standInAPI) DeleteConnection(_ context.Context, in *apigatewaymanagementapi.DeleteConnectionInput, _ ...func(*apigatewaymanagementapi.Options)) (*apigatewaymanagementapi.DeleteConnectionOutput, error) {
+	id := aws.ToString(in.ConnectionId)
+	if err := a.check(id); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.open, id)
+	return &apigatewaymanagementapi.DeleteConnectionOutput{}, nil
+}
+
+// runLocal loads the connections read from in into an in-memory store,
+// sweeps it against the stand-in, then prints the removed connections and
+// the report.
+func runLocal(in io.Reader, out io.Writer) error {
+	ctx := context.Background()
+	conf := lib.DefaultConfig()
+	conf.ConnectionsEndpoint = localEndpoint
+	store := lib.NewMemoryStore()
+	api := &standInAPI{open: make(map[string]bool)}
+
+	deps = lib.NewDepsFromConfig(&conf, aws.Config{Region: conf.Region})
+	deps.Store = store
+	deps.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	deps.Metrics = lib.NewMetrics(io.Discard, conf.MetricsNamespace)
+	deps.NewManagementAPI = func(string) lib.ManagementAPI { return api }
+
+	var loaded []localConnection
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var conn localConnection
+		if err := json.Unmarshal(scanner.Bytes(), &conn); err != nil || conn.ConnectionID == "" {
+			fmt.Fprintf(out, "skipping %q\n", scanner.Text())
+			continue
+		}
+		if err := store.PutConnection(ctx, lib.Connection{ConnectionID: conn.ConnectionID, Channel: conn.OrderID}); err != nil {
+			return err
+		}
+		api.open[conn.ConnectionID] = !conn.Gone
+		loaded = append(loaded, conn)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	report, err := handler(ctx, events.EventBridgeEvent{ID: "local", DetailType: "Scheduled Event"})
+	if err != nil {
+		fmt.Fprintf(out, "sweep failed: %v\n", err)
+	}
+	for _, conn := range loaded {
+		left, err := store.ConnectionsForChannel(ctx, conn.OrderID)
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(left, func(c lib.Connection) bool { return c.ConnectionID == conn.ConnectionID }) {
+			fmt.Fprintf(out, "%s removed\n", conn.ConnectionID)
+		}
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
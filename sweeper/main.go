@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"lib"
+	"log"
+	"os"
+	"time"
+)
+
+var deps *lib.Deps
+
+func main() {
+	local := flag.Bool("local", false, "read connections from stdin into an in-memory store and sweep them against a stand-in @connections endpoint")
+	flag.Parse()
+	if *local {
+		if err := runLocal(os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
+
+// handler runs on a schedule and removes the connection rows whose socket is
+// gone, whether or not the client kept pinging before it vanished. The
+// report is returned and logged.
+func handler(ctx context.Context, event events.EventBridgeEvent) (lib.SweepReport, error) {
+	logger := deps.Logger.With("route", "sweeper", "eventId", event.ID)
+	ctx = lib.WithLogger(ctx, logger)
+	metrics := deps.Metrics.Recorder("Route", "sweeper", "Stage", deps.Config.Stage)
+	defer metrics.Flush()
+
+	report, err := deps.Sweep(ctx, deps.Config.SweepSegments)
+	metrics.Count("SweptConnections", report.Scanned)
+	metrics.Count("OrphanedConnections", report.Removed)
+	metrics.Count("SweepErrors", report.Failed+len(report.FailedSegments))
+	metrics.Duration("SweepLatency", time.Duration(report.DurationMS)*time.Millisecond)
+	logger.Info("sweep report", "segments", report.Segments, "scanned", report.Scanned, "alive", report.Alive,
+		"removed", report.Removed, "failed", report.Failed, "failed_segments", report.FailedSegments,
+		"duration_ms", report.DurationMS)
+	if err != nil {
+		logger.Error("sweep failed", "error", err)
+		return report, err
+	}
+	return report, nil
+}
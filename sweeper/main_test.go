@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		failing     string
+		storeErr    error
+		endpoint    string
+		wantErr     bool
+		wantScanned int
+		wantRemoved int
+		wantFailed  int
+		wantLeft    int
+	}{
+		{name: "removes gone connections", wantScanned: 3, wantRemoved: 1, wantLeft: 2},
+		{name: "check failures are kept", failing: "alive-1", wantScanned: 3, wantRemoved: 1, wantFailed: 1, wantLeft: 2},
+		{name: "store failure", storeErr: errors.New("throttled"), wantErr: true, wantLeft: 3},
+		{name: "no connections endpoint", endpoint: "none", wantErr: true, wantLeft: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			h := wstest.New()
+			for _, id := range []string{"alive-1", "alive-2", "orphan"} {
+				h.Store.PutConnection(ctx, lib.Connection{ConnectionID: id, Channel: "42"})
+			}
+			h.API.Gone("orphan")
+			if tt.failing != "" {
+				h.API.Fail(tt.failing, errors.New("throttled"))
+			}
+			h.Store.Fail("ScanConnections", tt.storeErr)
+			if tt.endpoint == "none" {
+				h.Deps.Config.ConnectionsEndpoint = ""
+			}
+			deps = h.Deps
+
+			report, err := handler(ctx, events.EventBridgeEvent{ID: "e1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if report.Scanned != tt.wantScanned || report.Removed != tt.wantRemoved || report.Failed != tt.wantFailed {
+				t.Fatalf("got %+v", report)
+			}
+			if tt.storeErr != nil && len(report.FailedSegments) != h.Deps.Config.SweepSegments {
+				t.Errorf("got failed segments %v, want all of them", report.FailedSegments)
+			}
+			if !tt.wantErr && h.Metric("OrphanedConnections") != float64(tt.wantRemoved) {
+				t.Errorf("OrphanedConnections = %v", h.Metric("OrphanedConnections"))
+			}
+			conns, _ := h.Store.ConnectionsForChannel(ctx, "42")
+			if len(conns) != tt.wantLeft {
+				t.Fatalf("left %+v", conns)
+			}
+			if len(h.API.Deleted()) != 0 {
+				t.Fatalf("the sweeper must not close connections, closed %v", h.API.Deleted())
+			}
+		})
+	}
+}
+
+func TestRunLocal(t *testing.T) {
+	in := strings.NewReader(`{"connection_id":"c1","order_id":"42"}
+{"connection_id":"c2","order_id":"42","gone":true}
+not json
+{"connection_id":"c3","order_id":"7","gone":true}
+`)
+	var out bytes.Buffer
+	if err := runLocal(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines, reportJSON, _ := strings.Cut(out.String(), "{\n")
+	if lines != "skipping \"not json\"\nc2 removed\nc3 removed\n" {
+		t.Fatalf("got %q", lines)
+	}
+	var report lib.SweepReport
+	if err := json.Unmarshal([]byte("{\n"+reportJSON), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Scanned != 3 || report.Alive != 1 || report.Removed != 2 || report.Failed != 0 {
+		t.Fatalf("got %+v", report)
+	}
+}
@@ -5,6 +5,85 @@ provider "aws" {
   token      = "-"
 }
 
+# Settings handed to every function as environment variables, see lib.Config.
+# The defaults are those of lib.DefaultConfig.
+variable "stage" {
+  type    = string
+  default = "dev"
+}
+
+variable "connections_table" {
+  type    = string
+  default = "WebSocketConnections"
+}
+
+variable "messages_table" {
+  type    = string
+  default = "WebSocketMessages"
+}
+
+variable "order_index" {
+  type    = string
+  default = "orderId-index"
+}
+
+variable "deadletters_table" {
+  type    = string
+  default = "WebSocketDeadLetters"
+}
+
+variable "history_table" {
+  type    = string
+  default = "WebSocketOrderHistory"
+}
+
+variable "webhooks_table" {
+  type    = string
+  default = "WebSocketWebhooks"
+}
+
+variable "webhooks_index" {
+  type    = string
+  default = "subscription-index"
+}
+
+variable "presence_table" {
+  type    = string
+  default = "WebSocketPresence"
+}
+
+variable "rate_limit_table" {
+  type    = string
+  default = "WebSocketRateLimits"
+}
+
+# Actions a minute and burst of each connection and of each principal
+variable "connection_rate_limit" {
+  type    = object({ per_minute = number, burst = number })
+  default = { per_minute = 120, burst = 30 }
+}
+
+variable "principal_rate_limit" {
+  type    = object({ per_minute = number, burst = number })
+  default = { per_minute = 600, burst = 100 }
+}
+
+# Largest action accepted and largest frame posted whole, in bytes
+variable "max_message_size" {
+  type    = number
+  default = 32768
+}
+
+variable "max_frame_size" {
+  type    = number
+  default = 32768
+}
+
+variable "admin_principals" {
+  type    = string
+  default = ""
+}
+
 # Data block to reference the existing Lambda functions
 data "aws_lambda_function" "existing_connect_lambda" {
   function_name = "WebsocketConnectTest"  # Replace with the name of your existing connect Lambda function
@@ -22,6 +101,188 @@ data "aws_lambda_function" "existing_ack_lambda" {
   function_name = "WebsocketAckTest"  # Replace with the name of your existing disconnect Lambda function
 }
 
+data "aws_lambda_function" "existing_history_lambda" {
+  function_name = "WebsocketHistoryTest"  # Replace with the name of your existing history Lambda function
+}
+
+data "aws_lambda_function" "existing_rest_lambda" {
+  function_name = "WebsocketRestTest"  # Replace with the name of your existing REST Lambda function
+}
+
+data "aws_lambda_function" "existing_stream_lambda" {
+  function_name = "WebsocketStreamTest"  # Replace with the name of your existing SSE/long-poll Lambda function
+}
+
+data "aws_lambda_function" "existing_ping_lambda" {
+  function_name = "WebsocketPingTest"  # Replace with the name of your existing ping Lambda function
+}
+
+data "aws_lambda_function" "existing_presence_lambda" {
+  function_name = "WebsocketPresenceTest"  # Replace with the name of your existing presence Lambda function
+}
+
+data "aws_lambda_function" "existing_subscribe_lambda" {
+  function_name = "WebsocketSubscribeTest"  # Replace with the name of your existing subscribe Lambda function
+}
+
+data "aws_lambda_function" "existing_reaper_lambda" {
+  function_name = "WebsocketReaperTest"  # Replace with the name of your existing reaper Lambda function
+}
+
+data "aws_lambda_function" "existing_sweeper_lambda" {
+  function_name = "WebsocketSweeperTest"  # Replace with the name of your existing sweeper Lambda function
+}
+
+data "aws_lambda_function" "existing_fanout_lambda" {
+  function_name = "WebsocketFanoutTest"  # Replace with the name of your existing fanout Lambda function
+}
+
+data "aws_lambda_function" "existing_authorizer_lambda" {
+  function_name = "WebsocketAuthorizerTest"  # Replace with the name of your existing authorizer Lambda function
+}
+
+data "aws_lambda_function" "existing_watchers_lambda" {
+  function_name = "WebsocketWatchersTest"  # Replace with the name of your existing watchers Lambda function
+}
+
+# Messages table, its stream feeds the fanout Lambda
+data "aws_dynamodb_table" "messages" {
+  name = var.messages_table
+}
+
+# Connections table, its stream (NEW_AND_OLD_IMAGES) feeds the watchers Lambda
+data "aws_dynamodb_table" "connections" {
+  name = var.connections_table
+}
+
+data "aws_dynamodb_table" "deadletters" {
+  name = var.deadletters_table
+}
+
+data "aws_dynamodb_table" "history" {
+  name = var.history_table
+}
+
+data "aws_dynamodb_table" "webhooks" {
+  name = var.webhooks_table
+}
+
+data "aws_dynamodb_table" "presence" {
+  name = var.presence_table
+}
+
+data "aws_dynamodb_table" "rate_limits" {
+  name = var.rate_limit_table
+}
+
+locals {
+  functions = {
+    connect    = data.aws_lambda_function.existing_connect_lambda
+    disconnect = data.aws_lambda_function.existing_disconnect_lambda
+    request    = data.aws_lambda_function.existing_request_lambda
+    ack        = data.aws_lambda_function.existing_ack_lambda
+    history    = data.aws_lambda_function.existing_history_lambda
+    rest       = data.aws_lambda_function.existing_rest_lambda
+    stream     = data.aws_lambda_function.existing_stream_lambda
+    ping       = data.aws_lambda_function.existing_ping_lambda
+    presence   = data.aws_lambda_function.existing_presence_lambda
+    subscribe  = data.aws_lambda_function.existing_subscribe_lambda
+    reaper     = data.aws_lambda_function.existing_reaper_lambda
+    sweeper    = data.aws_lambda_function.existing_sweeper_lambda
+    fanout     = data.aws_lambda_function.existing_fanout_lambda
+    watchers   = data.aws_lambda_function.existing_watchers_lambda
+  }
+
+  tables = [
+    data.aws_dynamodb_table.connections,
+    data.aws_dynamodb_table.messages,
+    data.aws_dynamodb_table.deadletters,
+    data.aws_dynamodb_table.history,
+    data.aws_dynamodb_table.webhooks,
+    data.aws_dynamodb_table.presence,
+    data.aws_dynamodb_table.rate_limits,
+  ]
+
+  # Every function loads and validates the whole configuration
+  environment = {
+    STAGE                 = var.stage
+    CONNECTIONS_TABLE     = var.connections_table
+    MESSAGES_TABLE        = var.messages_table
+    ORDER_INDEX           = var.order_index
+    DEADLETTERS_TABLE     = var.deadletters_table
+    HISTORY_TABLE         = var.history_table
+    WEBHOOKS_TABLE        = var.webhooks_table
+    WEBHOOKS_INDEX        = var.webhooks_index
+    PRESENCE_TABLE        = var.presence_table
+    RATE_LIMIT_TABLE      = var.rate_limit_table
+    CONNECTION_RATE_LIMIT = tostring(var.connection_rate_limit.per_minute)
+    CONNECTION_RATE_BURST = tostring(var.connection_rate_limit.burst)
+    PRINCIPAL_RATE_LIMIT  = tostring(var.principal_rate_limit.per_minute)
+    PRINCIPAL_RATE_BURST  = tostring(var.principal_rate_limit.burst)
+    MAX_MESSAGE_SIZE      = tostring(var.max_message_size)
+    MAX_FRAME_SIZE        = tostring(var.max_frame_size)
+    ADMIN_PRINCIPALS      = var.admin_principals
+    WEBSOCKET_URL         = aws_apigatewayv2_stage.websocket_stage.invoke_url
+    CONNECTIONS_ENDPOINT  = "${replace(aws_apigatewayv2_api.websocket_api.api_endpoint, "wss://", "https://")}/${aws_apigatewayv2_stage.websocket_stage.name}"
+  }
+
+  # Functions may share a role, each role gets the policy once
+  roles = toset([for f in local.functions : element(split("/", f.role), length(split("/", f.role)) - 1)])
+}
+
+# The functions are not managed here, so their environment is set through
+# the CLI whenever it changes
+resource "terraform_data" "lambda_environment" {
+  for_each         = local.functions
+  triggers_replace = local.environment
+
+  provisioner "local-exec" {
+    command = "aws lambda update-function-configuration --function-name ${each.value.function_name} --environment '${jsonencode({ Variables = local.environment })}'"
+  }
+}
+
+# Tables, indexes and streams the functions read and write, and the
+# connections they post to
+data "aws_iam_policy_document" "lambda_access" {
+  statement {
+    actions = [
+      "dynamodb:GetItem",
+      "dynamodb:PutItem",
+      "dynamodb:UpdateItem",
+      "dynamodb:DeleteItem",
+      "dynamodb:Query",
+      "dynamodb:Scan",
+      "dynamodb:ConditionCheckItem",
+    ]
+    resources = flatten([for t in local.tables : [t.arn, "${t.arn}/index/*"]])
+  }
+
+  statement {
+    actions = [
+      "dynamodb:DescribeStream",
+      "dynamodb:GetRecords",
+      "dynamodb:GetShardIterator",
+      "dynamodb:ListStreams",
+    ]
+    resources = [
+      data.aws_dynamodb_table.messages.stream_arn,
+      data.aws_dynamodb_table.connections.stream_arn,
+    ]
+  }
+
+  statement {
+    actions   = ["execute-api:ManageConnections"]
+    resources = ["${aws_apigatewayv2_api.websocket_api.execution_arn}/*"]
+  }
+}
+
+resource "aws_iam_role_policy" "lambda_access" {
+  for_each = local.roles
+  name     = "websocket-notifications-access"
+  role     = each.value
+  policy   = data.aws_iam_policy_document.lambda_access.json
+}
+
 # API Gateway WebSocket API
 resource "aws_apigatewayv2_api" "websocket_api" {
   name                       = "websocket-api-test-terra"
@@ -29,11 +290,24 @@ resource "aws_apigatewayv2_api" "websocket_api" {
   route_selection_expression = "$request.body.action"
 }
 
+# Authorizer of the WebSocket API, checked once at $connect. Its principal
+# reaches every route of the connection.
+resource "aws_apigatewayv2_authorizer" "websocket_authorizer" {
+  api_id           = aws_apigatewayv2_api.websocket_api.id
+  name             = "websocket-authorizer"
+  authorizer_type  = "REQUEST"
+  authorizer_uri   = data.aws_lambda_function.existing_authorizer_lambda.invoke_arn
+  identity_sources = ["route.request.querystring.Authorization"]
+}
+
 # Connect Route for WebSocket
 resource "aws_apigatewayv2_route" "connect_route" {
   api_id    = aws_apigatewayv2_api.websocket_api.id
   route_key = "$connect"
 
+  authorization_type = "CUSTOM"
+  authorizer_id      = aws_apigatewayv2_authorizer.websocket_authorizer.id
+
   target = "integrations/${aws_apigatewayv2_integration.connect_integration.id}"
 }
 
@@ -60,6 +334,44 @@ resource "aws_apigatewayv2_route" "ack_route" {
   target = "integrations/${aws_apigatewayv2_integration.request_integration.id}"
 }
 
+# History Route for WebSocket
+resource "aws_apigatewayv2_route" "history_route" {
+  api_id    = aws_apigatewayv2_api.websocket_api.id
+  route_key = "history"
+
+  target = "integrations/${aws_apigatewayv2_integration.history_integration.id}"
+}
+
+# Ping Route for WebSocket, keeps the connection from being reaped
+resource "aws_apigatewayv2_route" "ping_route" {
+  api_id    = aws_apigatewayv2_api.websocket_api.id
+  route_key = "ping"
+
+  target = "integrations/${aws_apigatewayv2_integration.ping_integration.id}"
+}
+
+# Presence Route for WebSocket, answers with the watcher count of a channel
+resource "aws_apigatewayv2_route" "presence_route" {
+  api_id    = aws_apigatewayv2_api.websocket_api.id
+  route_key = "presence"
+
+  target = "integrations/${aws_apigatewayv2_integration.presence_integration.id}"
+}
+
+# Subscribe and Unsubscribe Routes for WebSocket, move a connection between channels
+resource "aws_apigatewayv2_route" "subscribe_route" {
+  api_id    = aws_apigatewayv2_api.websocket_api.id
+  route_key = "subscribe"
+
+  target = "integrations/${aws_apigatewayv2_integration.subscribe_integration.id}"
+}
+
+resource "aws_apigatewayv2_route" "unsubscribe_route" {
+  api_id    = aws_apigatewayv2_api.websocket_api.id
+  route_key = "unsubscribe"
+
+  target = "integrations/${aws_apigatewayv2_integration.subscribe_integration.id}"
+}
 
 # WebSocket API Gateway integration with existing Lambda for connect
 resource "aws_apigatewayv2_integration" "connect_integration" {
@@ -93,6 +405,38 @@ resource "aws_apigatewayv2_integration" "ack_integration" {
   integration_method = "POST"
 }
 
+# WebSocket API Gateway integration with existing Lambda for history
+resource "aws_apigatewayv2_integration" "history_integration" {
+  api_id          = aws_apigatewayv2_api.websocket_api.id
+  integration_uri = data.aws_lambda_function.existing_history_lambda.invoke_arn
+  integration_type = "AWS_PROXY"
+  integration_method = "POST"
+}
+
+# WebSocket API Gateway integration with existing Lambda for ping
+resource "aws_apigatewayv2_integration" "ping_integration" {
+  api_id          = aws_apigatewayv2_api.websocket_api.id
+  integration_uri = data.aws_lambda_function.existing_ping_lambda.invoke_arn
+  integration_type = "AWS_PROXY"
+  integration_method = "POST"
+}
+
+# WebSocket API Gateway integration with existing Lambda for presence
+resource "aws_apigatewayv2_integration" "presence_integration" {
+  api_id          = aws_apigatewayv2_api.websocket_api.id
+  integration_uri = data.aws_lambda_function.existing_presence_lambda.invoke_arn
+  integration_type = "AWS_PROXY"
+  integration_method = "POST"
+}
+
+# WebSocket API Gateway integration with existing Lambda for subscribe and unsubscribe
+resource "aws_apigatewayv2_integration" "subscribe_integration" {
+  api_id          = aws_apigatewayv2_api.websocket_api.id
+  integration_uri = data.aws_lambda_function.existing_subscribe_lambda.invoke_arn
+  integration_type = "AWS_PROXY"
+  integration_method = "POST"
+}
+
 # API Gateway Deployment
 resource "aws_apigatewayv2_deployment" "websocket_deployment" {
   api_id = aws_apigatewayv2_api.websocket_api.id
@@ -100,7 +444,12 @@ resource "aws_apigatewayv2_deployment" "websocket_deployment" {
   depends_on = [
     aws_apigatewayv2_route.connect_route,
     aws_apigatewayv2_route.disconnect_route,
-    aws_apigatewayv2_route.request_route
+    aws_apigatewayv2_route.request_route,
+    aws_apigatewayv2_route.history_route,
+    aws_apigatewayv2_route.ping_route,
+    aws_apigatewayv2_route.presence_route,
+    aws_apigatewayv2_route.subscribe_route,
+    aws_apigatewayv2_route.unsubscribe_route
   ]
 }
 
@@ -147,6 +496,190 @@ resource "aws_lambda_permission" "apigw_ack_lambda_permission" {
   source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
 }
 
+# Lambda Permission to allow API Gateway to invoke the existing history function
+resource "aws_lambda_permission" "apigw_history_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayHistory"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_history_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
+}
+
+# Lambda Permission to allow API Gateway to invoke the existing ping function
+resource "aws_lambda_permission" "apigw_ping_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayPing"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_ping_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
+}
+
+# Lambda Permission to allow API Gateway to invoke the existing presence function
+resource "aws_lambda_permission" "apigw_presence_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayPresence"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_presence_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
+}
+
+# Lambda Permission to allow API Gateway to invoke the existing subscribe function
+resource "aws_lambda_permission" "apigw_subscribe_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewaySubscribe"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_subscribe_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/*/*"
+}
+
+# Close the connections that stopped pinging, every 5 minutes. The reaper
+# uses CONNECTIONS_ENDPOINT, the stage's @connections URL, from local.environment.
+resource "aws_cloudwatch_event_rule" "reaper_schedule" {
+  name                = "websocket-reaper-test"
+  schedule_expression = "rate(5 minutes)"
+}
+
+resource "aws_cloudwatch_event_target" "reaper_target" {
+  rule = aws_cloudwatch_event_rule.reaper_schedule.name
+  arn  = data.aws_lambda_function.existing_reaper_lambda.arn
+}
+
+resource "aws_lambda_permission" "events_reaper_lambda_permission" {
+  statement_id  = "AllowExecutionFromEventBridgeReaper"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_reaper_lambda.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.reaper_schedule.arn
+}
+
+# Remove the rows of connections that are gone, every hour. Like the reaper
+# it needs CONNECTIONS_ENDPOINT, SWEEP_SEGMENTS sets the scan parallelism.
+resource "aws_cloudwatch_event_rule" "sweeper_schedule" {
+  name                = "websocket-sweeper-test"
+  schedule_expression = "rate(1 hour)"
+}
+
+resource "aws_cloudwatch_event_target" "sweeper_target" {
+  rule = aws_cloudwatch_event_rule.sweeper_schedule.name
+  arn  = data.aws_lambda_function.existing_sweeper_lambda.arn
+}
+
+resource "aws_lambda_permission" "events_sweeper_lambda_permission" {
+  statement_id  = "AllowExecutionFromEventBridgeSweeper"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_sweeper_lambda.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.sweeper_schedule.arn
+}
+
+# Fan out every stored status to the watchers of the order
+resource "aws_lambda_event_source_mapping" "fanout_stream" {
+  event_source_arn        = data.aws_dynamodb_table.messages.stream_arn
+  function_name           = data.aws_lambda_function.existing_fanout_lambda.function_name
+  starting_position       = "LATEST"
+  function_response_types = ["ReportBatchItemFailures"]
+}
+
+# Count the watchers of each channel as connections come, move, go or expire,
+# and send the presence frames with the new counts
+resource "aws_lambda_event_source_mapping" "watchers_stream" {
+  event_source_arn        = data.aws_dynamodb_table.connections.stream_arn
+  function_name           = data.aws_lambda_function.existing_watchers_lambda.function_name
+  starting_position       = "TRIM_HORIZON"
+  function_response_types = ["ReportBatchItemFailures"]
+}
+
+# HTTP API for clients without a socket, backed by the same tables
+resource "aws_apigatewayv2_api" "http_api" {
+  name          = "websocket-http-api-test-terra"
+  protocol_type = "HTTP"
+}
+
+# The same authorizer guards the HTTP API, so webhooks have an owner
+resource "aws_apigatewayv2_authorizer" "http_authorizer" {
+  api_id                            = aws_apigatewayv2_api.http_api.id
+  name                              = "http-authorizer"
+  authorizer_type                   = "REQUEST"
+  authorizer_uri                    = data.aws_lambda_function.existing_authorizer_lambda.invoke_arn
+  authorizer_payload_format_version = "1.0"
+  identity_sources                  = ["$request.querystring.Authorization"]
+}
+
+resource "aws_apigatewayv2_integration" "rest_integration" {
+  api_id                 = aws_apigatewayv2_api.http_api.id
+  integration_uri        = data.aws_lambda_function.existing_rest_lambda.invoke_arn
+  integration_type       = "AWS_PROXY"
+  integration_method     = "POST"
+  payload_format_version = "2.0"
+}
+
+resource "aws_apigatewayv2_route" "rest_routes" {
+  for_each = toset([
+    "GET /orders/{id}/status",
+    "GET /orders/{id}/events",
+    "POST /orders/{id}/events",
+    "GET /orders/{id}/connections",
+    "GET /channels/{type}/{id}/status",
+    "GET /channels/{type}/{id}/events",
+    "POST /channels/{type}/{id}/events",
+    "POST /webhooks",
+    "GET /webhooks/{id}",
+    "DELETE /webhooks/{id}",
+  ])
+  api_id    = aws_apigatewayv2_api.http_api.id
+  route_key = each.value
+
+  authorization_type = "CUSTOM"
+  authorizer_id      = aws_apigatewayv2_authorizer.http_authorizer.id
+
+  target = "integrations/${aws_apigatewayv2_integration.rest_integration.id}"
+}
+
+resource "aws_apigatewayv2_stage" "http_stage" {
+  api_id      = aws_apigatewayv2_api.http_api.id
+  name        = "$default"
+  auto_deploy = true
+}
+
+# Lambda Permission to allow the HTTP API to invoke the existing REST function
+resource "aws_lambda_permission" "apigw_rest_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayRest"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_rest_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.http_api.execution_arn}/*/*"
+}
+
+# Lambda Permission to allow both APIs to invoke the existing authorizer function
+resource "aws_lambda_permission" "apigw_authorizer_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayAuthorizer"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_authorizer_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.websocket_api.execution_arn}/authorizers/${aws_apigatewayv2_authorizer.websocket_authorizer.id}"
+}
+
+resource "aws_lambda_permission" "apigw_http_authorizer_lambda_permission" {
+  statement_id  = "AllowExecutionFromAPIGatewayHTTPAuthorizer"
+  action        = "lambda:InvokeFunction"
+  function_name = data.aws_lambda_function.existing_authorizer_lambda.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_apigatewayv2_api.http_api.execution_arn}/authorizers/${aws_apigatewayv2_authorizer.http_authorizer.id}"
+}
+
+# SSE and long-poll fallback for networks that block WebSockets. Callers
+# sign their requests with SigV4 and need lambda:InvokeFunctionUrl on the
+# stream function.
+resource "aws_lambda_function_url" "stream_url" {
+  function_name      = data.aws_lambda_function.existing_stream_lambda.function_name
+  authorization_type = "AWS_IAM"
+  invoke_mode        = "RESPONSE_STREAM"
+}
+
+output "stream_url" {
+  value = aws_lambda_function_url.stream_url.function_url
+}
+
 output "account_id" {
   value = data.aws_caller_identity.current.account_id
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"lib"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+var deps *lib.Deps
+
+// handler consumes the connections table stream and keeps the watcher
+// counts of the presence table. Counting from the stream rather than beside
+// each write keeps the counts in step with the rows, including those removed
+// by their TTL. Once a record is counted, the other watchers of the channels
+// it changes are sent presence frames with the new counts.
+//
+// Processing stops at the first record that could not be counted and only
+// that record is reported, so Lambda retries the shard from there. Each
+// record is applied under its event ID, which makes the retry count once;
+// its presence frames may go out again, they are advisory.
+func handler(ctx context.Context, event events.DynamoDBEvent) (events.DynamoDBEventResponse, error) {
+	metrics := deps.Metrics.Recorder("Route", "watchers", "Stage", deps.Config.Stage)
+	defer metrics.Flush()
+
+	var response events.DynamoDBEventResponse
+	for _, record := range event.Records {
+		if err := process(ctx, record, metrics); err != nil {
+			metrics.Count("WatcherErrors", 1)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.DynamoDBBatchItemFailure{
+				ItemIdentifier: record.Change.SequenceNumber,
+			})
+			break
+		}
+	}
+	return response, nil
+}
+
+func process(ctx context.Context, record events.DynamoDBEventRecord, metrics *lib.Recorder) error {
+	changes := lib.WatcherChanges(record)
+	if len(changes) == 0 {
+		return nil
+	}
+	logger := deps.Logger.With("eventId", record.EventID, "eventName", record.EventName)
+	if err := deps.Store.AddWatchers(ctx, record.EventID, changes); err != nil {
+		logger.Error("failed to count watchers", "error", err)
+		return err
+	}
+	ctx = lib.WithLogger(ctx, logger)
+	deps.AnnounceChanges(ctx, deps.Config.ConnectionsEndpoint, lib.WatcherConnection(record), changes)
+	if record.EventName == "REMOVE" && record.UserIdentity != nil && record.UserIdentity.PrincipalID == "dynamodb.amazonaws.com" {
+		// Deleted by the TTL rather than $disconnect or a cleanup
+		metrics.Count("ExpiredConnections", 1)
+	}
+	return nil
+}
+
+func main() {
+	var err error
+	deps, err = lib.NewDeps(context.Background())
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lambda.Start(handler)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/wstest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func record(seq, name, old, new string) events.DynamoDBEventRecord {
+	image := func(channel string) map[string]events.DynamoDBAttributeValue {
+		if channel == "" {
+			return nil
+		}
+		return map[string]events.DynamoDBAttributeValue{
+			"connectionId": events.NewStringAttribute("c1"),
+			"orderId":      events.NewStringAttribute(channel),
+		}
+	}
+	r := events.DynamoDBEventRecord{EventID: "e" + seq, EventName: name}
+	r.Change.SequenceNumber = seq
+	r.Change.Keys = map[string]events.DynamoDBAttributeValue{"connectionId": events.NewStringAttribute("c1")}
+	r.Change.OldImage, r.Change.NewImage = image(old), image(new)
+	return r
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	deps = h.Deps
+
+	expired := record("4", "REMOVE", "shipment:S1", "")
+	expired.UserIdentity = &events.DynamoDBUserIdentity{Type: "Service", PrincipalID: "dynamodb.amazonaws.com"}
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record("1", "INSERT", "", "42"),
+		record("2", "INSERT", "", "42"),
+		record("3", "MODIFY", "42", "shipment:S1"),
+		expired,
+		record("5", "MODIFY", "42", "42"),
+	}}
+	resp, err := handler(ctx, event)
+	if err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+	for channel, want := range map[string]int{"42": 1, "shipment:S1": 0} {
+		if n, _ := h.Store.Watchers(ctx, channel); n != want {
+			t.Errorf("got %d watchers of %s, want %d", n, channel, want)
+		}
+	}
+	if n := h.Metric("ExpiredConnections"); n != 1 {
+		t.Errorf("got %v expired connections, want 1", n)
+	}
+
+	// A failing record is reported and the ones after it are left for the retry
+	h.Store.Fail("AddWatchers", errors.New("transaction canceled"))
+	event = events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		record("6", "MODIFY", "42", "42"),
+		record("7", "REMOVE", "42", ""),
+		record("8", "INSERT", "", "42"),
+	}}
+	resp, err = handler(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.BatchItemFailures) != 1 || resp.BatchItemFailures[0].ItemIdentifier != "7" {
+		t.Fatalf("got failures %+v, want record 7", resp.BatchItemFailures)
+	}
+	if h.Metric("WatcherErrors") != 1 {
+		t.Errorf("got %v errors, want 1", h.Metric("WatcherErrors"))
+	}
+}
+
+// laggingStore counts watchers from AddWatchers only, like the presence
+// table, so writing a connection leaves the count as it was.
+type laggingStore struct {
+	*wstest.Store
+	counts map[string]int
+}
+
+func (s *laggingStore) AddWatchers(_ context.Context, _ string, changes map[string]int) error {
+	for channel, delta := range changes {
+		s.counts[channel] += delta
+	}
+	return nil
+}
+
+func (s *laggingStore) Watchers(_ context.Context, channel string) (int, error) {
+	return s.counts[channel], nil
+}
+
+func TestHandlerAnnounces(t *testing.T) {
+	ctx := context.Background()
+	h := wstest.New()
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "merchant", Channel: "42"})
+	h.Store.PutConnection(ctx, lib.Connection{ConnectionID: "c1", Channel: "42"})
+	deps = h.Deps
+	deps.Store = &laggingStore{Store: h.Store, counts: map[string]int{"42": 1}}
+
+	event := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{record("1", "INSERT", "", "42")}}
+	if resp, err := handler(ctx, event); err != nil || len(resp.BatchItemFailures) != 0 {
+		t.Fatalf("got %+v, %v", resp, err)
+	}
+	want := map[string]lib.PresenceFrame{
+		"merchant": {Type: "presence", Event: lib.PresenceJoin, Channel: "order:42", OrderID: "42", Watchers: 2},
+		"c1":       {Type: "presence", Event: lib.PresenceCount, Channel: "order:42", OrderID: "42", Watchers: 2},
+	}
+	posts := h.API.Posts()
+	if len(posts) != len(want) {
+		t.Fatalf("got posts %+v, want %v", posts, want)
+	}
+	for _, post := range posts {
+		var frame lib.PresenceFrame
+		if err := post.Decode(&frame); err != nil || frame != want[post.ConnectionID] {
+			t.Errorf("got %+v, %v to %s, want %+v", frame, err, post.ConnectionID, want[post.ConnectionID])
+		}
+	}
+}
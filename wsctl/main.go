@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"lib"
+	"lib/client"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wsctl talks to the order notification API from a terminal:
+//
+//	wsctl tail -order 42
+//	wsctl publish -order 42 -status SHIPPED
+//	wsctl request -order 42
+//	wsctl ack -order 42
+//	wsctl presence -order 42
+//	wsctl connections -order 42
+//
+// The endpoint defaults to WEBSOCKET_URL and the token to WSCTL_TOKEN.
+// connections reads the connections table, so it needs AWS credentials and
+// the same environment as the functions, see lib.Config.
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "wsctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+const (
+	outputHuman = "human"
+	outputJSON  = "json"
+)
+
+type (
+	// cli holds the flags shared by every command.
+	cli struct {
+		endpoint   string
+		token      string
+		tokenParam string
+		output     string
+		orderID    string
+		filter     string
+		out        io.Writer
+	}
+
+	command struct {
+		usage string
+		run   func(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error
+	}
+)
+
+var commands = map[string]command{
+	"tail":        {"print the status updates of an order until interrupted", tail},
+	"publish":     {"publish a status for an order", publish},
+	"request":     {"print the current status of an order", request},
+	"ack":         {"acknowledge the status of an order", ack},
+	"presence":    {"print how many connections watch an order", presence},
+	"connections": {"list the connections watching an order", connections},
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return usage()
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return usage()
+	}
+
+	c := &cli{out: out}
+	endpoint := lib.DefaultConfig().WebSocketURL
+	if conf, err := lib.LoadConfig(); err == nil {
+		endpoint = conf.WebSocketURL
+	}
+	flags := flag.NewFlagSet("wsctl "+args[0], flag.ContinueOnError)
+	flags.StringVar(&c.endpoint, "endpoint", endpoint, "ws:// or wss:// URL of the API")
+	flags.StringVar(&c.token, "token", os.Getenv("WSCTL_TOKEN"), "auth token")
+	flags.StringVar(&c.tokenParam, "token-param", "Authorization", "query parameter carrying the token, empty to send it as a bearer header")
+	flags.StringVar(&c.output, "output", outputHuman, "output format, human or json")
+	flags.StringVar(&c.orderID, "order", "", "order ID")
+	return cmd.run(ctx, c, flags, args[1:])
+}
+
+func usage() error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: wsctl <command> [flags]\n\ncommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].usage)
+	}
+	return flag.ErrHelp
+}
+
+// parse parses the command flags and checks the shared ones.
+func (c *cli) parse(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if c.orderID == "" {
+		return errors.New("-order is required")
+	}
+	if c.output != outputHuman && c.output != outputJSON {
+		return fmt.Errorf("-output must be %s or %s, got %q", outputHuman, outputJSON, c.output)
+	}
+	return nil
+}
+
+// dial connects watching the order of the command.
+func (c *cli) dial(ctx context.Context) (*client.Client, error) {
+	return client.Dial(ctx, c.orderID, client.Options{
+		URL:        c.endpoint,
+		Token:      c.token,
+		TokenParam: c.tokenParam,
+		Filter:     c.filter,
+	})
+}
+
+// print writes v as a JSON line, or human as is.
+func (c *cli) print(v any, human string) error {
+	if c.output == outputJSON {
+		return json.NewEncoder(c.out).Encode(v)
+	}
+	_, err := fmt.Fprintln(c.out, human)
+	return err
+}
+
+func (c *cli) printMessage(msg lib.MessageData) error {
+	line := fmt.Sprintf("%s  %s  %-12s  %s", msg.Date, msg.OrderID, msg.Status, msg.ID)
+	if msg.CustomerID != "" {
+		line += "  customer=" + msg.CustomerID
+	}
+	if msg.MerchantID != "" {
+		line += "  merchant=" + msg.MerchantID
+	}
+	return c.print(msg, line)
+}
+
+func (c *cli) printConnection(conn lib.Connection) error {
+	line := conn.ConnectionID
+	if !conn.ConnectedAt.IsZero() {
+		line += "  connected " + conn.ConnectedAt.Format(time.RFC3339)
+	}
+	if !conn.LastSeen.IsZero() {
+		line += "  seen " + conn.LastSeen.Format(time.RFC3339)
+	}
+	for _, field := range []struct{ name, value string }{
+		{"principal", conn.Principal},
+		{"ip", conn.SourceIP},
+		{"client", conn.ClientVersion},
+		{"protocol", conn.ProtocolVersion},
+	} {
+		if field.value != "" {
+			line += "  " + field.name + "=" + field.value
+		}
+	}
+	if conn.Filter != "" {
+		line += "  filter=" + strconv.Quote(conn.Filter)
+	}
+	if conn.UserAgent != "" {
+		line += "  agent=" + strconv.Quote(conn.UserAgent)
+	}
+	return c.print(conn, line)
+}
+
+func tail(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	current := flags.Bool("current", true, "print the current status first")
+	flags.StringVar(&c.filter, "filter", "", "statuses to print, e.g. DELIVERED,CANCELLED or status != CREATED")
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	filter, err := lib.ParseFilter(c.filter)
+	if err != nil {
+		return err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if *current {
+		msg, err := conn.Request(ctx, c.orderID)
+		switch {
+		case err == nil && !filter.Match(msg):
+		case err == nil:
+			if err := c.printMessage(msg); err != nil {
+				return err
+			}
+		case !errors.Is(err, client.ErrNotFound):
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-conn.Updates():
+			if !ok {
+				return nil
+			}
+			if err := c.printMessage(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func publish(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	status := flags.String("status", "", "status to publish")
+	customerID := flags.String("customer", "", "customer ID, to reach the customer's watchers and webhooks")
+	merchantID := flags.String("merchant", "", "merchant ID, to reach the merchant's watchers")
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	if *status == "" {
+		return errors.New("-status is required")
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := conn.Publish(ctx, lib.MessageData{
+		OrderID:    c.orderID,
+		Status:     strings.ToUpper(*status),
+		CustomerID: *customerID,
+		MerchantID: *merchantID,
+	})
+	if err != nil {
+		return err
+	}
+	return c.printMessage(msg)
+}
+
+func request(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	timeout := flags.Duration("timeout", 10*time.Second, "how long to wait for the reply")
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := conn.Request(ctx, c.orderID)
+	if err != nil {
+		return fmt.Errorf("order %s: %w", c.orderID, err)
+	}
+	return c.printMessage(msg)
+}
+
+func ack(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Ack(ctx, c.orderID); err != nil {
+		return err
+	}
+	return c.print(lib.Request{Action: "ack", OrderID: c.orderID}, "acknowledged "+c.orderID)
+}
+
+func presence(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n, err := conn.Presence(ctx, c.orderID)
+	if err != nil {
+		return err
+	}
+	// Our own connection watches the order too
+	n = max(n-1, 0)
+	frame := lib.PresenceFrame{Type: "presence", Event: lib.PresenceCount, Channel: lib.OrderChannel(c.orderID).String(), OrderID: c.orderID, Watchers: n}
+	return c.print(frame, fmt.Sprintf("%d watching %s", n, c.orderID))
+}
+
+func connections(ctx context.Context, c *cli, flags *flag.FlagSet, args []string) error {
+	if err := c.parse(flags, args); err != nil {
+		return err
+	}
+	deps, err := lib.NewDeps(ctx)
+	if err != nil {
+		return err
+	}
+	conns, err := deps.Store.ConnectionsForChannel(ctx, c.orderID)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if err := c.printConnection(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"lib"
+	"lib/gateway"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer tail can write to while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCommands(t *testing.T) {
+	g := gateway.NewLocal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+	endpoint := "-endpoint=ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tailCtx, stopTail := context.WithCancel(ctx)
+	var tailed lockedBuffer
+	tailDone := make(chan error, 1)
+	go func() {
+		tailDone <- run(tailCtx, []string{"tail", endpoint, "-order=42", "-output=json"}, &tailed)
+	}()
+	for len(g.Connections()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var out bytes.Buffer
+	if err := run(ctx, []string{"publish", endpoint, "-order=42", "-status=shipped", "-customer=c1", "-merchant=m1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if fields := strings.Fields(out.String()); len(fields) != 7 || fields[2] != "42" || fields[3] != "SHIPPED" || fields[5] != "customer=c1" || fields[6] != "merchant=m1" {
+		t.Fatalf("publish printed %q", out.String())
+	}
+
+	out.Reset()
+	if err := run(ctx, []string{"request", endpoint, "-order=42", "-output=json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var current lib.MessageData
+	if err := json.Unmarshal(out.Bytes(), &current); err != nil || current.Status != "SHIPPED" {
+		t.Fatalf("request printed %q: %v", out.String(), err)
+	}
+
+	for !strings.Contains(tailed.String(), current.ID) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("tail printed %q", tailed.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	stopTail()
+	if err := <-tailDone; err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 1; n != 0; n, _ = g.Deps.Store.Watchers(ctx, "42") {
+		// The tail leaves once the gateway ran its $disconnect
+		time.Sleep(10 * time.Millisecond)
+	}
+	out.Reset()
+	if err := run(ctx, []string{"presence", endpoint, "-order=42"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "0 watching 42\n" {
+		t.Fatalf("presence printed %q", out.String())
+	}
+
+	out.Reset()
+	if err := run(ctx, []string{"ack", endpoint, "-order=42"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "acknowledged 42\n" {
+		t.Fatalf("ack printed %q", out.String())
+	}
+}
+
+func TestFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"request"},
+		{"request", "-order=42", "-output=yaml"},
+		{"publish", "-order=42"},
+		{"tail", "-order=42", "-filter=status ="},
+	} {
+		if err := run(context.Background(), args, io.Discard); err == nil {
+			t.Errorf("run(%q) succeeded", args)
+		}
+	}
+}
+
+func TestPrintConnection(t *testing.T) {
+	var out bytes.Buffer
+	c := &cli{out: &out, output: outputHuman}
+	connected := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.printConnection(lib.Connection{ConnectionID: "c1", Channel: "42"})
+	c.printConnection(lib.Connection{
+		ConnectionID:  "c2",
+		Channel:       "42",
+		ConnectedAt:   connected,
+		LastSeen:      connected.Add(time.Minute),
+		SourceIP:      "203.0.113.7",
+		UserAgent:     "Mozilla/5.0 (X11)",
+		ClientVersion: "web/1.4.0",
+		Filter:        "status != CREATED",
+	})
+	want := "c1\n" +
+		`c2  connected 2024-05-01T12:00:00Z  seen 2024-05-01T12:01:00Z  ip=203.0.113.7  client=web/1.4.0  filter="status != CREATED"  agent="Mozilla/5.0 (X11)"` + "\n"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+}